@@ -0,0 +1,120 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// withAdminAuth only lets through requests carrying the configured admin token
+func withAdminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" {
+			respondWithError(w, http.StatusForbidden, codeAdminDisabled, "Admin endpoints are disabled", nil)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			respondWithError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized", nil)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleNotFound answers the admin routes on the main port when they are
+// served on -admin-addr
+func handleNotFound(w http.ResponseWriter, r *http.Request) {
+	respondWithError(w, http.StatusNotFound, codeNotFound, "Not found", nil)
+}
+
+func handleSelfTest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET and POST allowed", nil)
+		return
+	}
+
+	if err := storage.Check(); err != nil {
+		respondWithError(w, http.StatusServiceUnavailable, codeSelfTestFailed, "Self-test failed: "+err.Error(), err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("SELFTEST OK\n"))
+}
+
+// storageSelfTest writes a probe file to dir, reads it back, verifies it and removes it
+func storageSelfTest(dir string) error {
+	probe := []byte(fmt.Sprintf("fapi self-test %d\n", time.Now().UnixNano()))
+	path := filepath.Join(dir, fmt.Sprintf(".selftest-%d.probe", time.Now().UnixNano()))
+
+	if err := writeToFile(context.Background(), probe, path, false); err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read back probe file %s: %w", path, err)
+	}
+	if !bytes.Equal(got, probe) {
+		return fmt.Errorf("probe file %s content mismatch", path)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove probe file %s: %w", path, err)
+	}
+	return nil
+}
+
+// handleAdminCleanup removes the stored files older than ?older_than=, only
+// in ?collection= if given
+func handleAdminCleanup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only POST allowed", nil)
+		return
+	}
+
+	olderThan, err := time.ParseDuration(r.URL.Query().Get("older_than"))
+	if err != nil || olderThan < 0 {
+		respondWithError(w, http.StatusBadRequest, codeInvalidParameter, "Invalid or missing older_than", err)
+		return
+	}
+	collection := r.URL.Query().Get("collection")
+	if collection != "" && !isValidName(collection) {
+		respondWithError(w, http.StatusBadRequest, codeInvalidCollection, "Invalid collection name", nil)
+		return
+	}
+
+	res, err := storage.Cleanup(clk.Now().Add(-olderThan), collection)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, codeInternal, "Cleanup failed", err)
+		return
+	}
+	slog.Info("Cleanup done", "removed", res.Removed, "bytes", res.Bytes)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,192 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAdminToken = "secret"
+
+// adminRequest serves an admin request with the test token to handler
+func adminRequest(t *testing.T, handler http.HandlerFunc, method, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	saved := adminToken
+	adminToken = testAdminToken
+	defer func() { adminToken = saved }()
+
+	r := httptest.NewRequest(method, target, nil)
+	r.Header.Set("Authorization", "Bearer "+testAdminToken)
+	rec := httptest.NewRecorder()
+	withAdminAuth(handler)(rec, r)
+	return rec
+}
+
+// withStorage runs fn with backend as the storage
+func withStorage(t *testing.T, backend StorageBackend, fn func()) {
+	t.Helper()
+	saved := storage
+	storage = backend
+	defer func() { storage = saved }()
+	fn()
+}
+
+func TestAdminAuth(t *testing.T) {
+	saved := adminToken
+	defer func() { adminToken = saved }()
+	handler := withAdminAuth(func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, tc := range []struct {
+		token, header string
+		status        int
+	}{
+		{"", "Bearer ", http.StatusForbidden},
+		{testAdminToken, "", http.StatusUnauthorized},
+		{testAdminToken, "Bearer wrong", http.StatusUnauthorized},
+		{testAdminToken, "Bearer " + testAdminToken, http.StatusOK},
+	} {
+		adminToken = tc.token
+		r := httptest.NewRequest(http.MethodGet, "/v1/selftest", nil)
+		if tc.header != "" {
+			r.Header.Set("Authorization", tc.header)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, r)
+		if rec.Code != tc.status {
+			t.Errorf("token %q, Authorization %q: status %d, want %d", tc.token, tc.header, rec.Code, tc.status)
+		}
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	dir := t.TempDir()
+	backend, err := newFSBackend([]string{dir}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withStorage(t, backend, func() {
+		rec := adminRequest(t, handleSelfTest, http.MethodPost, "/v1/selftest")
+		if rec.Code != http.StatusOK || rec.Body.String() != "SELFTEST OK\n" {
+			t.Errorf("status %d: %s", rec.Code, rec.Body)
+		}
+		// The probe file is removed
+		if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+			t.Errorf("left %d files behind", len(entries))
+		}
+	})
+}
+
+func TestSelfTestWriteFailure(t *testing.T) {
+	// A file where the upload directory should be fails every write, even as root
+	dir := filepath.Join(t.TempDir(), "uploads")
+	backend, err := newFSBackend([]string{dir}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dir, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	withStorage(t, backend, func() {
+		rec := adminRequest(t, handleSelfTest, http.MethodPost, "/v1/selftest")
+		if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), string(codeSelfTestFailed)) {
+			t.Errorf("status %d: %s", rec.Code, rec.Body)
+		}
+		// The underlying error is surfaced
+		if !strings.Contains(rec.Body.String(), "not a directory") {
+			t.Errorf("error not surfaced: %s", rec.Body)
+		}
+	})
+}
+
+func TestAdminCleanup(t *testing.T) {
+	const content = `{"a":1}`
+	now := time.Now()
+	files := []struct {
+		id  string
+		age time.Duration
+	}{
+		{"orders/old.json", 48 * time.Hour},
+		{"orders/new.json", time.Hour},
+		{"events/old.json", 48 * time.Hour},
+		{"events/older.json", 72 * time.Hour},
+	}
+
+	for _, tc := range []struct {
+		query   string
+		status  int
+		removed []string
+	}{
+		{"?older_than=24h&collection=orders", http.StatusOK, []string{"orders/old.json"}},
+		{"?older_than=24h", http.StatusOK, []string{"orders/old.json", "events/old.json", "events/older.json"}},
+		{"?older_than=60h", http.StatusOK, []string{"events/older.json"}},
+		{"?older_than=0s&collection=events", http.StatusOK, []string{"events/old.json", "events/older.json"}},
+		{"?collection=orders", http.StatusBadRequest, nil},
+		{"?older_than=24h&collection=..", http.StatusBadRequest, nil},
+	} {
+		dir := t.TempDir()
+		backend, err := newFSBackend([]string{dir}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range files {
+			if err := backend.Store(context.Background(), f.id, []byte(content)); err != nil {
+				t.Fatal(err)
+			}
+			modTime := now.Add(-f.age)
+			if err := os.Chtimes(filepath.Join(dir, f.id), modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		withStorage(t, backend, func() {
+			rec := adminRequest(t, handleAdminCleanup, http.MethodPost, "/v1/admin/cleanup"+tc.query)
+			if rec.Code != tc.status {
+				t.Fatalf("%s: status %d, want %d: %s", tc.query, rec.Code, tc.status, rec.Body)
+			}
+			if tc.status != http.StatusOK {
+				return
+			}
+			var res cleanupResult
+			if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			if want := (cleanupResult{Removed: len(tc.removed), Bytes: int64(len(tc.removed) * len(content))}); res != want {
+				t.Errorf("%s: %+v, want %+v", tc.query, res, want)
+			}
+			for _, f := range files {
+				_, err := os.Stat(filepath.Join(dir, f.id))
+				if gone, want := os.IsNotExist(err), slices.Contains(tc.removed, f.id); gone != want {
+					t.Errorf("%s: %s removed %v, want %v", tc.query, f.id, gone, want)
+				}
+			}
+		})
+	}
+
+	if rec := adminRequest(t, handleAdminCleanup, http.MethodGet, "/v1/admin/cleanup?older_than=1h"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status %d, want 405", rec.Code)
+	}
+}
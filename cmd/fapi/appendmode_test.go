@@ -0,0 +1,115 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAppendModeDailyFile(t *testing.T) {
+	savedAppend, savedOrdered := appendMode, orderedWrites
+	appendMode, orderedWrites = true, true
+	defer func() { appendMode, orderedWrites = savedAppend, savedOrdered }()
+	c := withFakeClock(t, time.Date(2024, 3, 1, 23, 59, 0, 0, time.UTC))
+
+	backend, err := newFSBackend([]string{t.TempDir()}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withWriteQueues(t, backend, func() {
+		for _, body := range []string{`{"n": 1}`, `{"n": 2}`, `{"n": 3}`} {
+			if rec := doRequest(http.MethodPost, "/v1/collection/logs", "application/json", body); rec.Code != http.StatusAccepted {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+		}
+		// Past midnight UTC
+		c.Advance(2 * time.Minute)
+		doRequest(http.MethodPost, "/v1/collection/logs", "application/json", `{"n": 4}`)
+		drainWrites(context.Background())
+
+		n := 0
+		_ = backend.List("logs", func(string, storedInfo) error { n++; return nil })
+		if n != 2 {
+			t.Errorf("%d files stored, want 2", n)
+		}
+		if got := readStored(t, backend, "logs/2024-03-01.ndjson"); got != "{\"n\":1}\n{\"n\":2}\n{\"n\":3}\n" {
+			t.Errorf("first day holds %q", got)
+		}
+		if got := readStored(t, backend, "logs/2024-03-02.ndjson"); got != "{\"n\":4}\n" {
+			t.Errorf("second day holds %q", got)
+		}
+	})
+}
+
+// jitterBackend is an inmemBackend taking a random while to append, so that
+// writes picked up by several workers at once finish in any order
+type jitterBackend struct{ *inmemBackend }
+
+func (b jitterBackend) Append(ctx context.Context, id string, data []byte) error {
+	time.Sleep(time.Duration(rand.IntN(500)) * time.Microsecond)
+	return b.inmemBackend.Append(ctx, id, data)
+}
+
+func TestOrderedWrites(t *testing.T) {
+	savedAppend, savedOrdered := appendMode, orderedWrites
+	appendMode, orderedWrites = true, true
+	defer func() { appendMode, orderedWrites = savedAppend, savedOrdered }()
+	withFakeClock(t, time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC))
+
+	const collections, lines = 8, 50
+	backend := jitterBackend{newInmemBackend(1000)}
+	withWriteQueues(t, backend, func() {
+		// Each collection is submitted to in order, all of them at once
+		var wg sync.WaitGroup
+		for c := 0; c < collections; c++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for n := 0; n < lines; n++ {
+					target, body := fmt.Sprintf("/v1/collection/logs%d", c), fmt.Sprintf(`{"n":%d}`, n)
+					rec := doRequest(http.MethodPost, target, "application/json", body)
+					// Back off while the queue is full, like a client would
+					for rec.Code == http.StatusServiceUnavailable {
+						time.Sleep(time.Millisecond)
+						rec = doRequest(http.MethodPost, target, "application/json", body)
+					}
+					if rec.Code != http.StatusAccepted {
+						t.Errorf("logs%d line %d: status %d: %s", c, n, rec.Code, rec.Body)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		drainWrites(context.Background())
+
+		for c := 0; c < collections; c++ {
+			var want strings.Builder
+			for n := 0; n < lines; n++ {
+				fmt.Fprintf(&want, "{\"n\":%d}\n", n)
+			}
+			if got := readStored(t, backend, fmt.Sprintf("logs%d/2024-03-01.ndjson", c)); got != want.String() {
+				t.Errorf("logs%d holds the lines out of order: %q", c, got)
+			}
+		}
+	})
+}
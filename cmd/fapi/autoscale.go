@@ -0,0 +1,86 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// How often the queue depth is sampled
+	scaleInterval = 100 * time.Millisecond
+	// Number of consecutive samples over half the queue capacity before an
+	// extra worker is started
+	scaleAfterSamples = 5
+)
+
+var (
+	// extraWorkers is the number of workers started on top of workerCount
+	extraWorkers atomic.Int32
+
+	_ = newGaugeFunc("fapi_writer_workers", "Number of running writer workers.", func() float64 {
+		return float64(workerCount + extraWorkers.Load())
+	})
+)
+
+// autoscaleWorkers starts extra workers on queue, tracked by workers, up to
+// max in total, while it stays more than half full, until shutdown. Extra
+// workers exit once idle for idle.
+func autoscaleWorkers(queue chan writeRequest, workers *sync.WaitGroup, max int, idle time.Duration) {
+	ticker := time.NewTicker(scaleInterval)
+	defer ticker.Stop()
+
+	busy := 0
+	for {
+		select {
+		case <-shuttingDown:
+			return
+		case <-ticker.C:
+		}
+		if len(queue) <= cap(queue)/2 {
+			busy = 0
+			continue
+		}
+		busy++
+		if busy >= scaleAfterSamples && workerCount+int(extraWorkers.Load()) < max {
+			extraWorkers.Add(1)
+			workers.Add(1)
+			go extraWriterWorker(queue, workers, idle)
+			busy = 0
+		}
+	}
+}
+
+func extraWriterWorker(queue <-chan writeRequest, workers *sync.WaitGroup, idle time.Duration) {
+	defer workers.Done()
+	defer extraWorkers.Add(-1)
+
+	timer := time.NewTimer(idle)
+	defer timer.Stop()
+	for {
+		select {
+		case req, ok := <-queue:
+			if !ok {
+				return
+			}
+			handleWrite(req)
+			timer.Reset(idle)
+		case <-timer.C:
+			return
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitUntil polls cond until it holds or the timeout expires
+func waitUntil(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAutoscaleWorkers(t *testing.T) {
+	const extra, queued = 2, 8
+	backend := &gatedBackend{inmemBackend: newInmemBackend(100), collection: "burst", gate: make(chan struct{}), stored: make(chan string, queued)}
+	savedStorage, savedShutdown := storage, shuttingDown
+	storage, shuttingDown = backend, make(chan struct{})
+	defer func() { storage, shuttingDown = savedStorage, savedShutdown }()
+
+	// A burst keeps the queue over half full, as if the regular workers were
+	// all busy
+	queue := make(chan writeRequest, 10)
+	for i := 0; i < queued; i++ {
+		queue <- writeRequest{data: []byte("{}"), id: fmt.Sprintf("burst/%d.json", i), collection: "burst", enqueued: time.Now()}
+	}
+	var workers sync.WaitGroup
+	stopped := make(chan struct{})
+	go func() {
+		autoscaleWorkers(queue, &workers, workerCount+extra, 100*time.Millisecond)
+		close(stopped)
+	}()
+	defer func() {
+		close(shuttingDown)
+		<-stopped
+	}()
+
+	waitUntil(t, 5*time.Second, "the pool to grow", func() bool { return extraWorkers.Load() == extra })
+	// Never past -max-workers, even though the queue is still over half full
+	time.Sleep(2 * scaleAfterSamples * scaleInterval)
+	if n := extraWorkers.Load(); n != extra {
+		t.Errorf("%d extra workers, want %d", n, extra)
+	}
+
+	// The lull: the extra workers empty the queue and exit once idle
+	close(backend.gate)
+	for i := 0; i < queued; i++ {
+		select {
+		case <-backend.stored:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d of %d writes done", i, queued)
+		}
+	}
+	waitUntil(t, 5*time.Second, "the pool to shrink", func() bool { return extraWorkers.Load() == 0 })
+	workers.Wait()
+}
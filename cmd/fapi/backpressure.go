@@ -0,0 +1,100 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Window over which the write throughput is measured
+	throughputWindow = 10 * time.Second
+
+	minRetryAfter = 1 * time.Second
+	maxRetryAfter = 60 * time.Second
+)
+
+// writeThroughput tracks completed writes in one-second buckets, so we can
+// estimate how fast the queue drains
+var writeThroughput = newThroughputMeter(throughputWindow)
+
+type throughputMeter struct {
+	mu      sync.Mutex
+	buckets []uint64
+	// second of the newest bucket
+	head int64
+}
+
+func newThroughputMeter(window time.Duration) *throughputMeter {
+	return &throughputMeter{buckets: make([]uint64, int(window/time.Second))}
+}
+
+// advance moves the head to now, clearing the buckets that fell out of the
+// window. Must be called with mu held.
+func (m *throughputMeter) advance(now int64) {
+	if now <= m.head {
+		return
+	}
+	gap := now - m.head
+	if gap > int64(len(m.buckets)) {
+		gap = int64(len(m.buckets))
+	}
+	for i := int64(1); i <= gap; i++ {
+		m.buckets[(m.head+i)%int64(len(m.buckets))] = 0
+	}
+	m.head = now
+}
+
+func (m *throughputMeter) record() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := clk.Now().Unix()
+	m.advance(now)
+	m.buckets[now%int64(len(m.buckets))]++
+}
+
+// rate returns the writes per second completed over the window
+func (m *throughputMeter) rate() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.advance(clk.Now().Unix())
+	var total uint64
+	for _, n := range m.buckets {
+		total += n
+	}
+	return float64(total) / float64(len(m.buckets))
+}
+
+// retryAfter estimates how long the current write queue takes to drain at
+// the observed throughput, clamped to [minRetryAfter, maxRetryAfter]
+func retryAfter(depth int, rate float64) time.Duration {
+	if depth == 0 {
+		return minRetryAfter
+	}
+	if rate <= 0 {
+		return maxRetryAfter
+	}
+	d := time.Duration(math.Ceil(float64(depth)/rate)) * time.Second
+	return min(max(d, minRetryAfter), maxRetryAfter)
+}
+
+// retryAfterHeader is the Retry-After value (in seconds) for 503 responses
+func retryAfterHeader() string {
+	d := retryAfter(queueDepth(), writeThroughput.rate())
+	return strconv.Itoa(int(d / time.Second))
+}
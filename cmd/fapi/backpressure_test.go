@@ -0,0 +1,85 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	for _, tc := range []struct {
+		depth int
+		rate  float64
+		want  time.Duration
+	}{
+		{0, 0, minRetryAfter},
+		{10, 0, maxRetryAfter},
+		{1, 100, minRetryAfter},
+		{10, 5, 2 * time.Second},
+		{11, 5, 3 * time.Second},
+		{100, 5, 20 * time.Second},
+		{10000, 5, maxRetryAfter},
+	} {
+		if got := retryAfter(tc.depth, tc.rate); got != tc.want {
+			t.Errorf("retryAfter(%d, %g) = %v, want %v", tc.depth, tc.rate, got, tc.want)
+		}
+	}
+}
+
+func TestThroughputMeter(t *testing.T) {
+	c := withFakeClock(t, time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC))
+	m := newThroughputMeter(10 * time.Second)
+	for i := 0; i < 50; i++ {
+		m.record()
+	}
+	if got := m.rate(); got != 5 {
+		t.Errorf("rate = %g, want 5", got)
+	}
+	c.Advance(5 * time.Second)
+	if got := m.rate(); got != 5 {
+		t.Errorf("rate within the window = %g, want 5", got)
+	}
+	c.Advance(5 * time.Second)
+	if got := m.rate(); got != 0 {
+		t.Errorf("rate once the writes left the window = %g, want 0", got)
+	}
+}
+
+func TestRetryAfterHeaderScalesWithDepth(t *testing.T) {
+	withFakeClock(t, time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC))
+	savedMeter, savedQueues := writeThroughput, writeQueues
+	defer func() { writeThroughput, writeQueues = savedMeter, savedQueues }()
+
+	// 5 writes a second
+	writeThroughput = newThroughputMeter(throughputWindow)
+	for i := 0; i < 50; i++ {
+		writeThroughput.record()
+	}
+	queue := make(chan writeRequest, 1000)
+	writeQueues = []chan writeRequest{queue}
+
+	for _, tc := range []struct {
+		depth int
+		want  string
+	}{{0, "1"}, {10, "2"}, {100, "20"}, {1000, "60"}} {
+		for len(queue) < tc.depth {
+			queue <- writeRequest{}
+		}
+		if got := retryAfterHeader(); got != tc.want {
+			t.Errorf("depth %d: Retry-After %s, want %s", tc.depth, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// breakerState is the state of the storage circuit breaker
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerHalfOpen:
+		return "half_open"
+	case breakerOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+var errBreakerOpen = errors.New("storage circuit breaker open")
+
+// errDeadLettered is returned for a write kept in -dead-letter-dir by the
+// open breaker. It isn't in the storage, so it must not be reported as
+// stored.
+var errDeadLettered = errors.New("write dead-lettered, storage circuit breaker open")
+
+var (
+	breakerOpened   = newCounter("fapi_storage_breaker_opened_total", "Times the storage circuit breaker opened.")
+	breakerRejected = newCounter("fapi_storage_breaker_rejected_total", "Writes failed fast, or dead-lettered, while the storage circuit breaker was open.")
+	deadLettered    = newCounter("fapi_dead_lettered_total", "Writes stored in -dead-letter-dir while the storage circuit breaker was open.")
+
+	_ = newGaugeFunc("fapi_storage_breaker_state", "State of the storage circuit breaker: 0 closed, 1 half-open, 2 open.", func() float64 {
+		if storageBreaker == nil {
+			return float64(breakerClosed)
+		}
+		return float64(storageBreaker.State())
+	})
+)
+
+// storageBreaker is only set when -breaker-failures is configured
+var storageBreaker *breakerBackend
+
+// breakerBackend stops sending writes to another backend after threshold of
+// them failed in a row. While open, writes fail straight away, or go to
+// -dead-letter-dir if set. After cooldown one write is let through as a
+// probe (half-open): the breaker closes if it succeeds and opens again
+// otherwise. Reads aren't affected.
+type breakerBackend struct {
+	StorageBackend
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+
+	// deadLetterMu serialises the dead-letter appends
+	deadLetterMu sync.Mutex
+}
+
+func newBreakerBackend(backend StorageBackend, threshold int, cooldown time.Duration) *breakerBackend {
+	return &breakerBackend{
+		StorageBackend: backend,
+		threshold:      threshold,
+		cooldown:       cooldown,
+	}
+}
+
+// State returns the current state, half-open once the cooldown is over
+func (b *breakerBackend) State() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen && time.Since(b.openedAt) >= b.cooldown {
+		return breakerHalfOpen
+	}
+	return b.state
+}
+
+func (b *breakerBackend) Store(ctx context.Context, id string, data []byte) error {
+	ok, probe := b.allow()
+	if !ok {
+		return b.deadLetter(ctx, id, data, false)
+	}
+	err := b.StorageBackend.Store(ctx, id, data)
+	b.record(ctx, probe, err)
+	return err
+}
+
+func (b *breakerBackend) StoreFile(ctx context.Context, id, path string) error {
+	ok, probe := b.allow()
+	if !ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return b.deadLetter(ctx, id, data, false)
+	}
+	err := b.StorageBackend.StoreFile(ctx, id, path)
+	b.record(ctx, probe, err)
+	return err
+}
+
+func (b *breakerBackend) Append(ctx context.Context, id string, data []byte) error {
+	ok, probe := b.allow()
+	if !ok {
+		return b.deadLetter(ctx, id, data, true)
+	}
+	err := b.StorageBackend.Append(ctx, id, data)
+	b.record(ctx, probe, err)
+	return err
+}
+
+// allow reports whether a write may go to the backend, and whether it is the
+// probe of a half-open breaker. Once the cooldown is over, only one write at
+// a time is let through until one succeeds.
+func (b *breakerBackend) allow() (bool, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerClosed:
+		return true, false
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false, false
+		}
+		b.state = breakerHalfOpen
+		slog.Info("Storage circuit breaker half-open, probing")
+	}
+	if b.probing {
+		return false, false
+	}
+	b.probing = true
+	return true, true
+}
+
+// record updates the breaker with the outcome of a write let through.
+// Writes abandoned by their client say nothing about the backend.
+func (b *breakerBackend) record(ctx context.Context, probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probing = false
+	}
+	if err != nil && ctx.Err() != nil {
+		// Still half-open if it was the probe, the next write probes instead
+		return
+	}
+	if err == nil {
+		if probe {
+			b.state = breakerClosed
+			slog.Info("Storage circuit breaker closed")
+		}
+		// Writes started before the breaker opened don't close it
+		if b.state == breakerClosed {
+			b.failures = 0
+		}
+		return
+	}
+	b.failures++
+	if probe || (b.state == breakerClosed && b.failures >= b.threshold) {
+		b.state, b.openedAt = breakerOpen, time.Now()
+		breakerOpened.inc()
+		slog.Error("Storage circuit breaker open", "failures", b.failures, "cooldown", b.cooldown, "error", err)
+	}
+}
+
+// deadLetter handles a write refused by the open breaker: it's stored under
+// -dead-letter-dir if set, and fails otherwise. Either way it returns an
+// error, errDeadLettered once the write is kept.
+func (b *breakerBackend) deadLetter(ctx context.Context, id string, data []byte, appendLine bool) error {
+	breakerRejected.inc()
+	if deadLetterDir == "" {
+		return errBreakerOpen
+	}
+	path := filepath.Join(deadLetterDir, filepath.FromSlash(id))
+	var err error
+	if appendLine {
+		b.deadLetterMu.Lock()
+		err = appendToFile(ctx, data, path, compressStorage)
+		b.deadLetterMu.Unlock()
+	} else {
+		err = writeToFile(ctx, data, path, compressStorage)
+	}
+	if err != nil {
+		return fmt.Errorf("%w, dead-lettering failed: %w", errBreakerOpen, err)
+	}
+	deadLettered.inc()
+	slog.Warn("Write dead-lettered", "id", id, "path", path)
+	return errDeadLettered
+}
+
+// respondDeadLettered answers an upload that waited for its write and was
+// dead-lettered: it is kept, but can't be retrieved until it's moved back
+// into the storage
+func respondDeadLettered(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = w.Write([]byte("Accepted, kept in the dead-letter directory until the storage recovers\n"))
+}
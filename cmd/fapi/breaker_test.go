@@ -0,0 +1,215 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyBackend is an inmemBackend whose writes fail while broken is set,
+// counting the writes that reached it
+type flakyBackend struct {
+	*inmemBackend
+	broken atomic.Bool
+	writes atomic.Int32
+	// gate, if set, holds each write until it is closed
+	gate chan struct{}
+}
+
+func (b *flakyBackend) Store(ctx context.Context, id string, data []byte) error {
+	b.writes.Add(1)
+	if b.gate != nil {
+		<-b.gate
+	}
+	if b.broken.Load() {
+		return errors.New("backend unreachable")
+	}
+	return b.inmemBackend.Store(ctx, id, data)
+}
+
+// endCooldown makes b act as if it had been open for its whole cooldown
+func (b *breakerBackend) endCooldown() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.openedAt = time.Now().Add(-b.cooldown)
+}
+
+func TestBreakerTransitions(t *testing.T) {
+	ctx := context.Background()
+	backend := &flakyBackend{inmemBackend: newInmemBackend(100)}
+	b := newBreakerBackend(backend, 3, time.Hour)
+	opened := breakerOpened.value.Load()
+
+	expect := func(step string, want breakerState) {
+		t.Helper()
+		if got := b.State(); got != want {
+			t.Fatalf("%s: breaker %s, want %s", step, got, want)
+		}
+	}
+
+	// Closed: failures below the threshold, or not in a row, don't open it
+	backend.broken.Store(true)
+	for i := 0; i < 2; i++ {
+		_ = b.Store(ctx, "t/fail.json", []byte("{}"))
+	}
+	backend.broken.Store(false)
+	if err := b.Store(ctx, "t/1.json", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	backend.broken.Store(true)
+	for i := 0; i < 2; i++ {
+		_ = b.Store(ctx, "t/fail.json", []byte("{}"))
+	}
+	expect("failures not in a row", breakerClosed)
+
+	// Open: the third failure in a row opens it, writes then fail fast
+	_ = b.Store(ctx, "t/fail.json", []byte("{}"))
+	expect("threshold reached", breakerOpen)
+	if n := breakerOpened.value.Load() - opened; n != 1 {
+		t.Errorf("opened %d times, want 1", n)
+	}
+	writes := backend.writes.Load()
+	if err := b.Store(ctx, "t/2.json", []byte("{}")); !errors.Is(err, errBreakerOpen) {
+		t.Errorf("write while open: %v, want %v", err, errBreakerOpen)
+	}
+	if backend.writes.Load() != writes {
+		t.Error("write while open reached the backend")
+	}
+
+	// Half-open: a failed probe opens it again for another cooldown
+	b.endCooldown()
+	expect("cooldown over", breakerHalfOpen)
+	_ = b.Store(ctx, "t/fail.json", []byte("{}"))
+	expect("probe failed", breakerOpen)
+	if backend.writes.Load() != writes+1 {
+		t.Errorf("%d writes reached the backend, want the probe only", backend.writes.Load()-writes)
+	}
+
+	// A successful probe closes it
+	backend.broken.Store(false)
+	b.endCooldown()
+	if err := b.Store(ctx, "t/3.json", []byte("{}")); err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	expect("probe succeeded", breakerClosed)
+	if err := b.Store(ctx, "t/4.json", []byte("{}")); err != nil {
+		t.Errorf("write once closed: %v", err)
+	}
+	if n := breakerOpened.value.Load() - opened; n != 2 {
+		t.Errorf("opened %d times, want 2", n)
+	}
+}
+
+func TestBreakerSingleProbe(t *testing.T) {
+	ctx := context.Background()
+	backend := &flakyBackend{inmemBackend: newInmemBackend(100)}
+	b := newBreakerBackend(backend, 1, time.Hour)
+	backend.broken.Store(true)
+	_ = b.Store(ctx, "t/fail.json", []byte("{}"))
+	backend.broken.Store(false)
+	b.endCooldown()
+
+	backend.gate = make(chan struct{})
+	probed := make(chan error)
+	go func() { probed <- b.Store(ctx, "t/probe.json", []byte("{}")) }()
+	for backend.writes.Load() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	// Only the probe goes through while it is in flight
+	if err := b.Store(ctx, "t/other.json", []byte("{}")); !errors.Is(err, errBreakerOpen) {
+		t.Errorf("write during the probe: %v, want %v", err, errBreakerOpen)
+	}
+	close(backend.gate)
+	if err := <-probed; err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	if got := b.State(); got != breakerClosed {
+		t.Errorf("breaker %s after the probe, want closed", got)
+	}
+}
+
+func TestBreakerDeadLetter(t *testing.T) {
+	saved := deadLetterDir
+	deadLetterDir = t.TempDir()
+	defer func() { deadLetterDir = saved }()
+
+	ctx := context.Background()
+	backend := &flakyBackend{inmemBackend: newInmemBackend(100)}
+	b := newBreakerBackend(backend, 1, time.Hour)
+	backend.broken.Store(true)
+	_ = b.Store(ctx, "t/fail.json", []byte("{}"))
+
+	if err := b.Store(ctx, "t/1.json", []byte(`{"a":1}`)); !errors.Is(err, errDeadLettered) {
+		t.Fatalf("dead-lettered write: %v, want %v", err, errDeadLettered)
+	}
+	for _, line := range []string{"one\n", "two\n"} {
+		if err := b.Append(ctx, "t/log.ndjson", []byte(line)); !errors.Is(err, errDeadLettered) {
+			t.Fatalf("dead-lettered append: %v, want %v", err, errDeadLettered)
+		}
+	}
+	for name, want := range map[string]string{"1.json": `{"a":1}`, "log.ndjson": "one\ntwo\n"} {
+		data, err := os.ReadFile(filepath.Join(deadLetterDir, "t", name))
+		if err != nil || string(data) != want {
+			t.Errorf("dead-lettered %s: %q, %v, want %q", name, data, err, want)
+		}
+	}
+	if _, _, err := backend.Open("t/1.json"); err == nil {
+		t.Error("dead-lettered write reached the backend")
+	}
+}
+
+func TestDeadLetteredNotStored(t *testing.T) {
+	savedDir, savedBreaker := deadLetterDir, storageBreaker
+	deadLetterDir = t.TempDir()
+	defer func() { deadLetterDir, storageBreaker = savedDir, savedBreaker }()
+
+	backend := &flakyBackend{inmemBackend: newInmemBackend(100)}
+	storageBreaker = newBreakerBackend(backend, 1, time.Hour)
+	backend.broken.Store(true)
+	_ = storageBreaker.Store(context.Background(), "dl/fail.json", []byte("{}"))
+	written := writesTotal.value("dl")
+
+	withMaxWriteFailures(t, 10, func() {
+		writeFailures.Store(3)
+		withWriteQueues(t, storageBreaker, func() {
+			for _, tc := range []struct{ method, target string }{
+				{http.MethodPost, "/v1/collection/dl?sync=true"},
+				{http.MethodPatch, "/v1/collection/dl/log.ndjson"},
+			} {
+				rec := doRequest(tc.method, tc.target, "application/json", "{}")
+				if rec.Code != http.StatusAccepted || rec.Header().Get("Location") != "" {
+					t.Errorf("%s %s: status %d, Location %q, want 202 without one", tc.method, tc.target, rec.Code, rec.Header().Get("Location"))
+				}
+			}
+			drainWrites(context.Background())
+		})
+		if n := writeFailures.Load(); n != 3 {
+			t.Errorf("%d write failures in a row after dead-lettering, want 3", n)
+		}
+	})
+	if n := writesTotal.value("dl") - written; n != 0 {
+		t.Errorf("%d dead-lettered writes counted as stored", n)
+	}
+	if n := countFiles(t, deadLetterDir); n != 2 {
+		t.Errorf("%d files dead-lettered, want 2", n)
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	callbackQueueCap = 1000
+	callbackWorkers  = 2
+	callbackAttempts = 3
+	callbackTimeout  = 10 * time.Second
+)
+
+// callbackRequest is the outcome of a write, waiting to be POSTed to the
+// X-Callback-URL of its upload
+type callbackRequest struct {
+	url     string
+	payload callbackPayload
+}
+
+type callbackPayload struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+// callbackQueue is only set when -callback-hosts is configured
+var callbackQueue chan callbackRequest
+
+// callbacksRunning tracks the callback workers
+var callbacksRunning sync.WaitGroup
+
+// callbackClient doesn't follow redirects, they could lead to a host that
+// isn't allowed
+var callbackClient = &http.Client{
+	Timeout: callbackTimeout,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+var (
+	callbacksSent    = newCounter("fapi_callbacks_sent_total", "Upload callbacks the client accepted.")
+	callbacksFailed  = newCounter("fapi_callbacks_failed_total", "Upload callbacks that failed after all retries.")
+	callbacksDropped = newCounter("fapi_callbacks_dropped_total", "Upload callbacks not sent because their queue was full.")
+)
+
+func startCallbacks() {
+	callbackQueue = make(chan callbackRequest, callbackQueueCap)
+	for i := 0; i < callbackWorkers; i++ {
+		callbacksRunning.Add(1)
+		go callbackWorker()
+	}
+}
+
+// callbackURL returns the X-Callback-URL of an upload, empty if it has none or
+// -callback-hosts isn't set. On failure the error response has already been
+// sent.
+func callbackURL(w http.ResponseWriter, r *http.Request) (string, bool) {
+	raw := r.Header.Get("X-Callback-URL")
+	if raw == "" || callbackQueue == nil {
+		return "", true
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" || u.User != nil {
+		respondWithError(w, http.StatusBadRequest, codeInvalidCallback, "Invalid X-Callback-URL", err)
+		return "", false
+	}
+	if !isCallbackHostAllowed(u.Hostname()) {
+		respondWithError(w, http.StatusForbidden, codeCallbackNotAllowed, "Callback host not allowed", nil)
+		return "", false
+	}
+	return u.String(), true
+}
+
+// isCallbackHostAllowed reports whether host is one of -callback-hosts or a
+// subdomain of one
+func isCallbackHostAllowed(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, allowed := range callbackHosts {
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyCallback queues the outcome of the write of req for its callback, if
+// it has one. It never blocks, the callback is dropped if the queue is full.
+func notifyCallback(req writeRequest, err error) {
+	if req.callback == "" || callbackQueue == nil {
+		return
+	}
+	status := "stored"
+	switch {
+	case errors.Is(err, errDeadLettered):
+		status = "dead_lettered"
+	case err != nil:
+		status = "failed"
+	}
+	select {
+	case callbackQueue <- callbackRequest{url: req.callback, payload: callbackPayload{ID: req.id, Status: status}}:
+	default:
+		callbacksDropped.inc()
+		slog.Warn("Callback queue full, callback not sent", "id", req.id)
+	}
+}
+
+func callbackWorker() {
+	defer callbacksRunning.Done()
+	for req := range callbackQueue {
+		if err := sendCallback(req); err != nil {
+			callbacksFailed.inc()
+			slog.Error("Failed to send upload callback", "id", req.payload.ID, "url", req.url, "error", err)
+			continue
+		}
+		callbacksSent.inc()
+	}
+}
+
+// sendCallback POSTs the payload of req, retrying network errors and 5xx or
+// 429 responses with a growing delay
+func sendCallback(req callbackRequest) error {
+	body, err := json.Marshal(req.payload)
+	if err != nil {
+		return err
+	}
+
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		retry, err := postCallback(req.url, body)
+		if err == nil || !retry || attempt == callbackAttempts {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// postCallback sends body once and reports whether a failure is worth retrying
+func postCallback(target string, body []byte) (bool, error) {
+	resp, err := callbackClient.Post(target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("callback responded with status %d", resp.StatusCode)
+	}
+	return false, nil
+}
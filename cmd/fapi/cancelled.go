@@ -0,0 +1,78 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// Phases of a request a client can give up in
+const (
+	phaseReadBody  = "read_body"
+	phaseWrite     = "write" // waiting for a synchronous write
+	phaseTransform = "transform"
+)
+
+const (
+	reasonCanceled         = "canceled"
+	reasonDeadlineExceeded = "deadline_exceeded"
+)
+
+var cancelledRequests = newCounterVec("fapi_cancelled_requests_total",
+	"Requests abandoned by the client (canceled) or cut off by a timeout (deadline_exceeded), by phase.",
+	"phase", "reason")
+
+// cancelReason tells whether err, from reading the request body or waiting
+// on its context, means the client went away or a deadline passed. It
+// returns an empty string for any other error.
+func cancelReason(r *http.Request, err error) string {
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, context.DeadlineExceeded),
+		errors.Is(r.Context().Err(), context.DeadlineExceeded):
+		return reasonDeadlineExceeded
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, context.Canceled),
+		r.Context().Err() != nil:
+		return reasonCanceled
+	default:
+		return ""
+	}
+}
+
+// recordCancelled counts the request if err means it was cancelled in phase,
+// and returns the reason
+func recordCancelled(r *http.Request, phase string, err error) string {
+	reason := cancelReason(r, err)
+	if reason != "" {
+		cancelledRequests.inc(phase, reason)
+		slog.Debug("Request cancelled", "phase", phase, "reason", reason,
+			"path", truncate(r.URL.Path, maxLoggedPathLen), "error", err)
+	}
+	return reason
+}
+
+// respondReadFailed answers a request whose body couldn't be read. received
+// holds the error of the connection, err the one of the (decoded) body.
+func respondReadFailed(w http.ResponseWriter, r *http.Request, received *countingReader, err error) {
+	if recordCancelled(r, phaseReadBody, received.err) == reasonDeadlineExceeded {
+		respondWithError(w, http.StatusRequestTimeout, codeRequestTimeout, "Request body not received in time", err)
+		return
+	}
+	respondWithError(w, http.StatusBadRequest, codeReadFailed, "Failed to read request body", err)
+}
@@ -0,0 +1,89 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// brokenBody returns some data, then err
+type brokenBody struct {
+	data string
+	err  error
+}
+
+func (b *brokenBody) Read(p []byte) (int, error) {
+	if b.data == "" {
+		return 0, b.err
+	}
+	n := copy(p, b.data)
+	b.data = b.data[n:]
+	return n, nil
+}
+
+func TestCancelledReadingBody(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		reason string
+		status int
+	}{
+		// What net/http returns when the client goes away mid-body
+		{io.ErrUnexpectedEOF, reasonCanceled, http.StatusBadRequest},
+		{os.ErrDeadlineExceeded, reasonDeadlineExceeded, http.StatusRequestTimeout},
+	} {
+		before := cancelledRequests.value(phaseReadBody, tc.reason)
+		r := httptest.NewRequest(http.MethodPost, "/v1/collection/orders", nil)
+		r.Body = io.NopCloser(&brokenBody{data: `{"id":`, err: tc.err})
+		r.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		handleCollection(rec, r)
+
+		if rec.Code != tc.status {
+			t.Errorf("%v: status %d, want %d: %s", tc.err, rec.Code, tc.status, rec.Body)
+		}
+		if got := cancelledRequests.value(phaseReadBody, tc.reason) - before; got != 1 {
+			t.Errorf("%v: %s/%s counted %d times, want once", tc.err, phaseReadBody, tc.reason, got)
+		}
+	}
+}
+
+func TestCancelledWaitingForWrite(t *testing.T) {
+	backend := &gatedBackend{inmemBackend: newInmemBackend(100), collection: "orders", gate: make(chan struct{}), stored: make(chan string, 1)}
+	withWriteQueues(t, backend, func() {
+		before := cancelledRequests.value(phaseWrite, reasonCanceled)
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		r := httptest.NewRequest(http.MethodPost, "/v1/collection/orders?sync=true", strings.NewReader("{}")).WithContext(ctx)
+		r.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		handleCollection(rec, r)
+
+		if rec.Body.Len() > 0 {
+			t.Errorf("cancelled request answered with %d: %s", rec.Code, rec.Body)
+		}
+		if got := cancelledRequests.value(phaseWrite, reasonCanceled) - before; got != 1 {
+			t.Errorf("%s/%s counted %d times, want once", phaseWrite, reasonCanceled, got)
+		}
+		close(backend.gate)
+		drainWrites(context.Background())
+	})
+}
@@ -0,0 +1,89 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+var errUnsupportedCharset = errors.New("unsupported charset")
+
+// requestCharset returns the lower-cased charset parameter of a Content-Type
+func requestCharset(contentType string) string {
+	if contentType == "" {
+		return ""
+	}
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(params["charset"])
+}
+
+// toUTF8 transcodes data from the given charset to UTF-8. The few charsets
+// supported are decoded here with the standard library rather than with
+// golang.org/x/text/encoding, so the module keeps no dependencies.
+func toUTF8(data []byte, charset string) ([]byte, error) {
+	switch charset {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return data, nil
+	case "iso-8859-1", "iso8859-1", "latin1", "l1":
+		return latin1ToUTF8(data), nil
+	case "utf-16":
+		// RFC 2781: honour the BOM if there is one, otherwise big endian
+		if len(data) >= 2 && data[0] == 0xFF && data[1] == 0xFE {
+			return utf16ToUTF8(data[2:], binary.LittleEndian)
+		}
+		if len(data) >= 2 && data[0] == 0xFE && data[1] == 0xFF {
+			return utf16ToUTF8(data[2:], binary.BigEndian)
+		}
+		return utf16ToUTF8(data, binary.BigEndian)
+	case "utf-16le":
+		return utf16ToUTF8(data, binary.LittleEndian)
+	case "utf-16be":
+		return utf16ToUTF8(data, binary.BigEndian)
+	default:
+		return nil, fmt.Errorf("%w %q", errUnsupportedCharset, charset)
+	}
+}
+
+func latin1ToUTF8(data []byte) []byte {
+	out := make([]byte, 0, len(data)+len(data)/4)
+	for _, b := range data {
+		out = utf8.AppendRune(out, rune(b))
+	}
+	return out
+}
+
+func utf16ToUTF8(data []byte, order binary.ByteOrder) ([]byte, error) {
+	if len(data)%2 != 0 {
+		return nil, errors.New("odd number of bytes in UTF-16 data")
+	}
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		units[i] = order.Uint16(data[2*i:])
+	}
+	out := make([]byte, 0, len(data))
+	for _, r := range utf16.Decode(units) {
+		out = utf8.AppendRune(out, r)
+	}
+	return out, nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestToUTF8(t *testing.T) {
+	want := `{"name":"café"}`
+	for _, tc := range []struct {
+		charset string
+		data    string
+	}{
+		{"utf-16le", "{\x00\"\x00n\x00a\x00m\x00e\x00\"\x00:\x00\"\x00c\x00a\x00f\x00\xe9\x00\"\x00}\x00"},
+		{"utf-16", "\xff\xfe{\x00\"\x00n\x00a\x00m\x00e\x00\"\x00:\x00\"\x00c\x00a\x00f\x00\xe9\x00\"\x00}\x00"},
+		{"utf-16be", "\x00{\x00\"\x00n\x00a\x00m\x00e\x00\"\x00:\x00\"\x00c\x00a\x00f\x00\xe9\x00\"\x00}"},
+		{"iso-8859-1", "{\"name\":\"caf\xe9\"}"},
+		{"utf-8", want},
+	} {
+		got, err := toUTF8([]byte(tc.data), tc.charset)
+		if err != nil || string(got) != want || !json.Valid(got) {
+			t.Errorf("toUTF8(%s) = %q, %v, want %q", tc.charset, got, err, want)
+		}
+	}
+
+	if _, err := toUTF8([]byte("x"), "koi8-r"); !errors.Is(err, errUnsupportedCharset) {
+		t.Errorf("unknown charset: %v, want %v", err, errUnsupportedCharset)
+	}
+	if _, err := toUTF8([]byte("{\x00\""), "utf-16le"); err == nil {
+		t.Error("odd length UTF-16 accepted")
+	}
+}
+
+func TestRequestCharset(t *testing.T) {
+	for contentType, want := range map[string]string{
+		"application/json; charset=UTF-16LE": "utf-16le",
+		"application/json":                   "",
+		"":                                   "",
+		"not a media type;;":                 "",
+	} {
+		if got := requestCharset(contentType); got != want {
+			t.Errorf("requestCharset(%q) = %q, want %q", contentType, got, want)
+		}
+	}
+}
+
+func TestTranscodeOnStore(t *testing.T) {
+	saved := transcodeCharset
+	transcodeCharset = true
+	defer func() { transcodeCharset = saved }()
+
+	backend := newInmemBackend(100)
+	withWriteQueues(t, backend, func() {
+		doRequest(http.MethodPost, "/v1/collection/latin1", "application/json; charset=iso-8859-1", "{\"name\":\"caf\xe9\"}")
+		doRequest(http.MethodPost, "/v1/collection/utf16", "application/json; charset=utf-16le", "{\x00}\x00")
+		drainWrites(context.Background())
+
+		for collection, want := range map[string]string{"latin1": `{"name":"café"}`, "utf16": "{}"} {
+			id := firstStored(backend, collection)
+			if !strings.HasSuffix(id, ".json") {
+				t.Errorf("%s stored as %s, want a .json", collection, id)
+			}
+			if got := readStored(t, backend, id); got != want {
+				t.Errorf("%s stored as %q, want %q", collection, got, want)
+			}
+		}
+	})
+}
@@ -0,0 +1,438 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resumable uploads send a file in numbered chunks, starting at 0, to
+// /v1/collection/{id}/chunks/{n} and then assemble it with
+// /v1/collection/{id}/complete. Chunks are staged in -chunk-dir, in a
+// directory per id, until the upload completes or -chunk-timeout expires.
+
+// maxChunks caps the number of chunks of an upload
+const maxChunks = 10000
+
+// maxMissingReported caps the missing chunk numbers listed in a 409 response
+const maxMissingReported = 100
+
+// assembledPrefix starts the names of the files chunks are assembled into,
+// in -chunk-dir until they are stored
+const assembledPrefix = ".assembled-"
+
+// stagedSizeFile holds the total size of the chunks staged in an upload's
+// directory, kept up to date as chunks arrive
+const stagedSizeFile = ".staged"
+
+// chunkLocks serialises the staging of chunks of the same upload, so its
+// staged size is updated one chunk at a time
+var chunkLocks = newKeyLock()
+
+// chunkDirFor returns the staging directory of id, named after its hash so
+// the name has a fixed length whatever the length of id
+func chunkDirFor(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(chunkDir, hex.EncodeToString(sum[:]))
+}
+
+// parseChunkPath splits an item path of the form {id}/chunks/{n}
+func parseChunkPath(rest string) (string, int, bool) {
+	i := strings.LastIndex(rest, "/chunks/")
+	if i < 0 {
+		return "", 0, false
+	}
+	n, err := strconv.Atoi(rest[i+len("/chunks/"):])
+	if err != nil || n < 0 || n >= maxChunks {
+		return "", 0, false
+	}
+	return rest[:i], n, true
+}
+
+// handleItemPost serves POSTs below /v1/collection/: chunks and completion of
+// resumable uploads, uploads to a collection otherwise
+func handleItemPost(w http.ResponseWriter, r *http.Request) {
+	rest := itemID(r)
+	if id, n, ok := parseChunkPath(rest); ok {
+		handleChunk(w, r, id, n)
+		return
+	}
+	if id, ok := strings.CutSuffix(rest, "/complete"); ok {
+		handleComplete(w, r, id)
+		return
+	}
+	if collection, ok := strings.CutSuffix(rest, "/stream"); ok && isValidName(collection) {
+		handleStream(w, r, collection)
+		return
+	}
+	handlePost(w, r)
+}
+
+// handleChunk stages chunk n of the upload of id, replacing any previous
+// upload of the same chunk
+func handleChunk(w http.ResponseWriter, r *http.Request, id string, n int) {
+	id, collection, ok := checkTargetID(w, id)
+	if !ok {
+		return
+	}
+	if !admitCollection(w, collection) {
+		return
+	}
+	if _, ok := eventTimeOf(w, r); !ok {
+		return
+	}
+	body, ok := openBody(w, r)
+	if !ok {
+		return
+	}
+	defer r.Body.Close()
+
+	dir := chunkDirFor(id)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		respondWithError(w, http.StatusInternalServerError, codeInternal, "Failed to store chunk", err)
+		return
+	}
+	// Write to a temporary file first, a chunk is never seen half written
+	tmp, err := os.CreateTemp(dir, ".chunk-*")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, codeInternal, "Failed to store chunk", err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	size, err := io.Copy(tmp, body)
+	if closeErr := tmp.Close(); err == nil && closeErr != nil {
+		respondWithError(w, http.StatusInternalServerError, codeInternal, "Failed to store chunk", closeErr)
+		return
+	}
+	if err != nil {
+		if isMaxBytesError(err) {
+			respondWithError(w, http.StatusRequestEntityTooLarge, codeBodyTooLarge, "Request body too large", err)
+			return
+		}
+		if errors.Is(err, errDecompressRatio) {
+			respondWithError(w, http.StatusRequestEntityTooLarge, codeBodyTooLarge, "Decompression ratio too high", err)
+			return
+		}
+		if body.isGzip && isGzipError(err, body.received) {
+			respondWithError(w, http.StatusBadRequest, codeInvalidGzip, "Invalid gzip data", err)
+			return
+		}
+		respondReadFailed(w, r, body.received, err)
+		return
+	}
+	if err := body.close(); err != nil {
+		respondWithError(w, http.StatusBadRequest, codeInvalidGzip, "Invalid gzip data", err)
+		return
+	}
+	if !stageChunk(w, dir, tmp.Name(), n, size) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(map[string]any{"id": id, "chunk": n, "size": size})
+}
+
+// stageChunk moves the chunk n of size bytes received in tmp into dir, unless
+// the chunks staged there would then add up to more than the largest upload
+// allowed. On failure the error response has already been sent.
+func stageChunk(w http.ResponseWriter, dir, tmp string, n int, size int64) bool {
+	defer chunkLocks.lock(dir)()
+
+	staged, err := stagedSize(dir)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, codeInternal, "Failed to store chunk", err)
+		return false
+	}
+	target := filepath.Join(dir, strconv.Itoa(n))
+	// A chunk sent again replaces the previous one
+	if info, err := os.Stat(target); err == nil {
+		staged -= info.Size()
+	}
+	if staged+size > maxDecompressedSize {
+		respondWithError(w, http.StatusRequestEntityTooLarge, codeBodyTooLarge, "Staged chunks too large", nil)
+		return false
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		respondWithError(w, http.StatusInternalServerError, codeInternal, "Failed to store chunk", err)
+		return false
+	}
+	if err := writeStagedSize(dir, staged+size); err != nil {
+		respondWithError(w, http.StatusInternalServerError, codeInternal, "Failed to store chunk", err)
+		return false
+	}
+	return true
+}
+
+// stagedSize returns the total size of the chunks staged in dir
+func stagedSize(dir string) (int64, error) {
+	data, err := os.ReadFile(filepath.Join(dir, stagedSizeFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(data), 10, 64)
+}
+
+// writeStagedSize records size as the total size of the chunks staged in dir,
+// replacing the previous record atomically
+func writeStagedSize(dir string, size int64) error {
+	tmp, err := os.CreateTemp(dir, ".staged-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(strconv.FormatInt(size, 10)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, stagedSizeFile))
+}
+
+// handleComplete assembles the staged chunks of id in order and stores the
+// result. ?total= gives the expected number of chunks, otherwise all the
+// chunks up to the highest numbered one must be there.
+func handleComplete(w http.ResponseWriter, r *http.Request, id string) {
+	id, collection, ok := checkTargetID(w, id)
+	if !ok {
+		return
+	}
+	if !admitCollection(w, collection) {
+		return
+	}
+	eventTime, ok := eventTimeOf(w, r)
+	if !ok {
+		return
+	}
+	if !checkReady() {
+		w.Header().Set("Retry-After", retryAfterHeader())
+		respondWithError(w, http.StatusServiceUnavailable, codeNotReady, "Service not ready", nil)
+		return
+	}
+
+	dir := chunkDirFor(id)
+	chunks, err := stagedChunks(dir)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, codeInternal, "Failed to list chunks", err)
+		return
+	}
+	if len(chunks) == 0 {
+		respondWithError(w, http.StatusNotFound, codeNotFound, "No chunks uploaded for this id", nil)
+		return
+	}
+
+	total := chunks[len(chunks)-1] + 1
+	if v := r.URL.Query().Get("total"); v != "" {
+		if total, err = strconv.Atoi(v); err != nil || total <= 0 || total > maxChunks {
+			respondWithError(w, http.StatusBadRequest, codeInvalidParameter, "Invalid total", err)
+			return
+		}
+	}
+	var missing []int
+	for n := 0; n < total && len(missing) < maxMissingReported; n++ {
+		if _, found := slices.BinarySearch(chunks, n); !found {
+			missing = append(missing, n)
+		}
+	}
+	if len(missing) > 0 || chunks[len(chunks)-1] >= total {
+		respondWithMissingChunks(w, id, total, missing)
+		return
+	}
+
+	var size int64
+	for _, n := range chunks {
+		info, err := os.Stat(filepath.Join(dir, strconv.Itoa(n)))
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, codeInternal, "Failed to read chunk", err)
+			return
+		}
+		size += info.Size()
+	}
+	if size > maxDecompressedSize {
+		respondWithError(w, http.StatusRequestEntityTooLarge, codeBodyTooLarge, "Assembled file too large", nil)
+		return
+	}
+
+	// The chunks are assembled on disk, the upload doesn't have to fit in
+	// memory unless it has to be validated
+	assembled, err := assembleChunks(dir, chunks)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, codeInternal, "Failed to assemble chunks", err)
+		return
+	}
+	queued := false
+	defer func() {
+		if !queued {
+			_ = os.Remove(assembled)
+		}
+	}()
+
+	if isJSONID(id) || matchesAny(contentCollections, collection) {
+		body, err := os.ReadFile(assembled)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, codeInternal, "Failed to read chunks", err)
+			return
+		}
+		if isJSONID(id) && !validateJSONID(w, body, collection) {
+			return
+		}
+		if !isJSONID(id) && !validateContent(w, body, collection, path.Ext(strings.TrimSuffix(id, ".gz"))) {
+			return
+		}
+	}
+
+	req := writeRequest{
+		id:         id,
+		collection: collection,
+		enqueued:   time.Now(),
+		file:       assembled,
+		fileSize:   size,
+		eventTime:  eventTime,
+	}
+	client, ok := chargeQuota(w, r, int(size))
+	if !ok {
+		return
+	}
+	mirrorCopy := mirrorLink(assembled)
+	if !enqueueWrite(w, req) {
+		refundQuota(client, int(size))
+		if mirrorCopy != "" {
+			_ = os.Remove(mirrorCopy)
+		}
+		return
+	}
+	queued = true
+	mirrorFile(r, collection, id, mirrorCopy)
+	if err := os.RemoveAll(dir); err != nil {
+		logError("Failed to remove chunks of "+id, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", collectionURL(id))
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(map[string]any{"id": id, "chunks": total, "size": size})
+}
+
+// assembleChunks concatenates the given chunks staged in dir, in order, into
+// a new file in -chunk-dir and returns its path
+func assembleChunks(dir string, chunks []int) (string, error) {
+	out, err := os.CreateTemp(chunkDir, assembledPrefix+"*")
+	if err != nil {
+		return "", err
+	}
+	for _, n := range chunks {
+		if err = appendChunk(out, filepath.Join(dir, strconv.Itoa(n))); err != nil {
+			break
+		}
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
+
+// stagedChunks returns the sorted numbers of the chunks staged in dir
+func stagedChunks(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var chunks []int
+	for _, e := range entries {
+		if n, err := strconv.Atoi(e.Name()); err == nil && e.Type().IsRegular() {
+			chunks = append(chunks, n)
+		}
+	}
+	slices.Sort(chunks)
+	return chunks, nil
+}
+
+func appendChunk(out io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(out, f)
+	return err
+}
+
+// respondWithMissingChunks rejects completing an upload with gaps
+func respondWithMissingChunks(w http.ResponseWriter, id string, total int, missing []int) {
+	logError("Incomplete chunked upload of "+id, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"error":   "Upload incomplete",
+		"code":    codeMissingChunks,
+		"total":   total,
+		"missing": missing,
+	})
+}
+
+// expireChunks periodically removes the staged chunks of uploads that haven't
+// received a chunk for -chunk-timeout, and assembled files left behind by a
+// shutdown that couldn't store them
+func expireChunks() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		entries, err := os.ReadDir(chunkDir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil || clk.Now().Sub(info.ModTime()) < chunkTimeout {
+				continue
+			}
+			if !e.IsDir() && !strings.HasPrefix(e.Name(), assembledPrefix) {
+				continue
+			}
+			if err := os.RemoveAll(filepath.Join(chunkDir, e.Name())); err != nil {
+				logError("Failed to remove expired chunks", err)
+				continue
+			}
+			slog.Info("Removed expired chunks", "dir", e.Name())
+		}
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// withChunkDir runs the test with -chunk-dir in a temporary directory and
+// writes stored into backend
+func withChunkDir(t *testing.T, backend StorageBackend, fn func()) {
+	t.Helper()
+	saved := chunkDir
+	chunkDir = t.TempDir()
+	defer func() { chunkDir = saved }()
+	withWriteQueues(t, backend, func() {
+		fn()
+		drainWrites(context.Background())
+	})
+}
+
+func putChunk(t *testing.T, id string, n int, data string) {
+	t.Helper()
+	rec := doRequest(http.MethodPost, "/v1/collection/"+id+"/chunks/"+strconv.Itoa(n), "application/octet-stream", data)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("chunk %d: status %d: %s", n, rec.Code, rec.Body)
+	}
+}
+
+func readStored(t *testing.T, backend StorageBackend, id string) string {
+	t.Helper()
+	f, _, err := backend.Open(id)
+	if err != nil {
+		t.Fatalf("%s not stored: %v", id, err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestChunksInOrder(t *testing.T) {
+	backend := newInmemBackend(100)
+	var dir string
+	withChunkDir(t, backend, func() {
+		for n, part := range []string{"alpha,", "beta,", "gamma"} {
+			putChunk(t, "chunks/in-order.txt", n, part)
+		}
+		rec := doRequest(http.MethodPost, "/v1/collection/chunks/in-order.txt/complete", "", "")
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("complete: status %d: %s", rec.Code, rec.Body)
+		}
+		var resp struct {
+			Chunks int   `json:"chunks"`
+			Size   int64 `json:"size"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Chunks != 3 || resp.Size != 16 {
+			t.Errorf("got %+v, want 3 chunks of 16 bytes", resp)
+		}
+		dir = chunkDir
+	})
+	if got := readStored(t, backend, "chunks/in-order.txt"); got != "alpha,beta,gamma" {
+		t.Errorf("stored %q", got)
+	}
+	// Neither the chunks nor the assembled file are left behind
+	if entries, _ := os.ReadDir(dir); len(entries) > 0 {
+		t.Errorf("%d entries left in the chunk dir", len(entries))
+	}
+}
+
+func TestChunksStreamedToFiles(t *testing.T) {
+	backend, err := newFSBackend([]string{t.TempDir()}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// More than one write buffer, so the file is copied in several blocks
+	part := strings.Repeat("0123456789", writeBufferSize/5)
+	withChunkDir(t, backend, func() {
+		putChunk(t, "chunks/big.txt", 0, part)
+		putChunk(t, "chunks/big.txt", 1, part)
+		if rec := doRequest(http.MethodPost, "/v1/collection/chunks/big.txt/complete", "", ""); rec.Code != http.StatusAccepted {
+			t.Fatalf("complete: status %d: %s", rec.Code, rec.Body)
+		}
+	})
+	if got := readStored(t, backend, "chunks/big.txt"); got != part+part {
+		t.Errorf("stored %d bytes, want %d", len(got), 2*len(part))
+	}
+}
+
+func TestChunksOutOfOrder(t *testing.T) {
+	backend := newInmemBackend(100)
+	withChunkDir(t, backend, func() {
+		putChunk(t, "chunks/out-of-order.txt", 2, "c")
+		putChunk(t, "chunks/out-of-order.txt", 0, "a")
+		putChunk(t, "chunks/out-of-order.txt", 1, "x")
+		// A chunk sent again replaces the previous one
+		putChunk(t, "chunks/out-of-order.txt", 1, "b")
+		rec := doRequest(http.MethodPost, "/v1/collection/chunks/out-of-order.txt/complete?total=3", "", "")
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("complete: status %d: %s", rec.Code, rec.Body)
+		}
+	})
+	if got := readStored(t, backend, "chunks/out-of-order.txt"); got != "abc" {
+		t.Errorf("stored %q, want abc", got)
+	}
+}
+
+func TestChunksIncomplete(t *testing.T) {
+	backend := newInmemBackend(100)
+	withChunkDir(t, backend, func() {
+		putChunk(t, "chunks/incomplete.txt", 0, "a")
+		putChunk(t, "chunks/incomplete.txt", 2, "c")
+
+		for _, tc := range []struct {
+			query   string
+			total   int
+			missing []int
+		}{
+			{"", 3, []int{1}},
+			{"?total=5", 5, []int{1, 3, 4}},
+		} {
+			rec := doRequest(http.MethodPost, "/v1/collection/chunks/incomplete.txt/complete"+tc.query, "", "")
+			if rec.Code != http.StatusConflict {
+				t.Fatalf("complete%s: status %d, want 409", tc.query, rec.Code)
+			}
+			var resp struct {
+				Code    errorCode `json:"code"`
+				Total   int       `json:"total"`
+				Missing []int     `json:"missing"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Code != codeMissingChunks || resp.Total != tc.total || !slices.Equal(resp.Missing, tc.missing) {
+				t.Errorf("complete%s: got %+v, want total %d missing %v", tc.query, resp, tc.total, tc.missing)
+			}
+		}
+
+		// Nothing was uploaded for this id
+		if rec := doRequest(http.MethodPost, "/v1/collection/chunks/none.txt/complete", "", ""); rec.Code != http.StatusNotFound {
+			t.Errorf("complete without chunks: status %d, want 404", rec.Code)
+		}
+	})
+	if _, _, err := backend.Open("chunks/incomplete.txt"); err == nil {
+		t.Error("incomplete upload stored")
+	}
+}
+
+func TestChunksLongID(t *testing.T) {
+	backend := newInmemBackend(100)
+	id := "chunks/" + strings.Repeat("n", 200) + ".txt"
+	withChunkDir(t, backend, func() {
+		putChunk(t, id, 0, "long")
+		if dir := filepath.Base(chunkDirFor(id)); len(dir) != 64 {
+			t.Errorf("chunk dir name is %d bytes long, want 64", len(dir))
+		}
+		if rec := doRequest(http.MethodPost, "/v1/collection/"+id+"/complete", "", ""); rec.Code != http.StatusAccepted {
+			t.Fatalf("complete: status %d: %s", rec.Code, rec.Body)
+		}
+	})
+	if got := readStored(t, backend, id); got != "long" {
+		t.Errorf("stored %q", got)
+	}
+}
+
+func TestChunksInvalidJSON(t *testing.T) {
+	backend := newInmemBackend(100)
+	withChunkDir(t, backend, func() {
+		putChunk(t, "chunks/doc.json", 0, `{"a":`)
+		putChunk(t, "chunks/doc.json", 1, `]`)
+		if rec := doRequest(http.MethodPost, "/v1/collection/chunks/doc.json/complete", "", ""); rec.Code != http.StatusBadRequest {
+			t.Fatalf("complete: status %d, want 400", rec.Code)
+		}
+		// The assembled file is removed, the chunks stay for a retry
+		entries, _ := os.ReadDir(chunkDir)
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), assembledPrefix) {
+				t.Errorf("%s left behind", e.Name())
+			}
+		}
+		if len(entries) != 1 {
+			t.Errorf("got %d entries in the chunk dir, want the chunks of the upload", len(entries))
+		}
+	})
+}
+
+func TestChunksStagedLimit(t *testing.T) {
+	saved := maxDecompressedSize
+	maxDecompressedSize = 10
+	defer func() { maxDecompressedSize = saved }()
+
+	backend := newInmemBackend(100)
+	withChunkDir(t, backend, func() {
+		putChunk(t, "big/1.bin", 0, "aaaa")
+		putChunk(t, "big/1.bin", 1, "bbbb")
+		// Re-sending a chunk replaces its size
+		putChunk(t, "big/1.bin", 1, "bbbbbb")
+		rec := doRequest(http.MethodPost, "/v1/collection/big/1.bin/chunks/2", "application/octet-stream", "c")
+		if rec.Code != http.StatusRequestEntityTooLarge || !strings.Contains(rec.Body.String(), string(codeBodyTooLarge)) {
+			t.Fatalf("chunk over the staged limit: status %d: %s", rec.Code, rec.Body)
+		}
+		// Other uploads have their own
+		putChunk(t, "big/2.bin", 0, "0123456789")
+
+		if rec := doRequest(http.MethodPost, "/v1/collection/big/1.bin/complete", "", ""); rec.Code != http.StatusAccepted {
+			t.Fatalf("complete: status %d: %s", rec.Code, rec.Body)
+		}
+	})
+	if got := readStored(t, backend, "big/1.bin"); got != "aaaabbbbbb" {
+		t.Errorf("stored %q", got)
+	}
+}
+
+func TestChunksDeniedCollection(t *testing.T) {
+	saved := deniedCollections
+	deniedCollections = []string{"secret"}
+	defer func() { deniedCollections = saved }()
+
+	withChunkDir(t, newInmemBackend(100), func() {
+		rec := doRequest(http.MethodPost, "/v1/collection/secret/1.bin/chunks/0", "application/octet-stream", "data")
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("chunk into a denied collection: status %d, want 403", rec.Code)
+		}
+		if n := countFiles(t, chunkDir); n != 0 {
+			t.Errorf("%d files staged for a denied collection", n)
+		}
+	})
+}
@@ -0,0 +1,67 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// withFakeClock runs the test with clk set to a fake clock at now
+func withFakeClock(t *testing.T, now time.Time) *fakeClock {
+	t.Helper()
+	c := newFakeClock(now)
+	saved := clk
+	clk = c
+	t.Cleanup(func() { clk = saved })
+	return c
+}
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2024, 3, 1, 23, 59, 59, 0, time.UTC)
+	c := newFakeClock(start)
+	if !c.Now().Equal(start) {
+		t.Errorf("Now = %v, want %v", c.Now(), start)
+	}
+	c.Advance(2 * time.Second)
+	if want := start.Add(2 * time.Second); !c.Now().Equal(want) {
+		t.Errorf("Now after Advance = %v, want %v", c.Now(), want)
+	}
+}
+
+func TestFilenameFromClock(t *testing.T) {
+	withFakeClock(t, time.Date(2024, 3, 1, 10, 4, 5, 123456789, time.UTC))
+	if got := (ipTimeIDs{}).NewName("192.0.2.1", nil); !regexp.MustCompile(`^192\.0\.2\.1-2024-03-01-10_04_05\.123456789-\d{1,4}$`).MatchString(got) {
+		t.Errorf("NewName = %q", got)
+	}
+	if got := dailyFilename(); got != "2024-03-01.ndjson" {
+		t.Errorf("dailyFilename = %q, want 2024-03-01.ndjson", got)
+	}
+
+	saved := idGenerator
+	idGenerator = ipTimeIDs{}
+	defer func() { idGenerator = saved }()
+	withWriteQueues(t, newInmemBackend(100), func() {
+		rec := doRequest(http.MethodPost, "/v1/collection/orders", "application/json", "{}")
+		location := rec.Header().Get("Location")
+		if !regexp.MustCompile(`/orders/192\.0\.2\.1-2024-03-01-10_04_05\.123456789-\d{1,4}\.json$`).MatchString(location) {
+			t.Errorf("Location %q", location)
+		}
+		drainWrites(context.Background())
+	})
+}
@@ -0,0 +1,278 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const collectionPathPrefix = "/v1/collection/"
+
+// collectionURL is the path clients retrieve the file stored as id from
+func collectionURL(id string) string {
+	return routePrefix + collectionPathPrefix + id
+}
+
+// collectionFromPath extracts the collection name from a request path.
+// Uploads to /v1/collection (or any catch-all path) belong to
+// -default-collection, by default the unnamed collection "", which is stored
+// flat in the upload directory.
+func collectionFromPath(path string) (string, bool) {
+	rest, ok := strings.CutPrefix(path, collectionPathPrefix)
+	if !ok {
+		return defaultCollection, true
+	}
+	name, _, _ := strings.Cut(rest, "/")
+	if name == "" {
+		return defaultCollection, true
+	}
+	if !isValidName(name) {
+		return "", false
+	}
+	return fitName(name)
+}
+
+// isValidName reports whether name is safe to use as a collection or file name
+func isValidName(name string) bool {
+	if name == "" || name[0] == '.' {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// fitName applies -long-names to a collection or file name longer than
+// -max-name-length. Under the truncate policy the name is cut short and a hash
+// of the whole name added, keeping the extension, so distinct names stay
+// distinct and the same name always maps to the same file. Under the reject
+// policy it fails.
+func fitName(name string) (string, bool) {
+	if len(name) <= maxNameLength {
+		return name, true
+	}
+	if !truncateNames {
+		return "", false
+	}
+	ext := path.Ext(strings.TrimSuffix(name, ".gz"))
+	if strings.HasSuffix(name, ".gz") {
+		ext += ".gz"
+	}
+	if len(ext) > maxNameLength/4 {
+		ext = ""
+	}
+	sum := sha256.Sum256([]byte(name))
+	suffix := "-" + hex.EncodeToString(sum[:8]) + ext
+	return name[:maxNameLength-len(suffix)] + suffix, true
+}
+
+// fitID applies fitName to each segment of id
+func fitID(id string) (string, bool) {
+	parts := strings.Split(id, "/")
+	for i, part := range parts {
+		var ok bool
+		if parts[i], ok = fitName(part); !ok {
+			return "", false
+		}
+	}
+	return strings.Join(parts, "/"), true
+}
+
+// isCollectionAllowed checks a named collection against the
+// -allowed-collections and -denied-collections patterns. The unnamed
+// collection is always allowed.
+func isCollectionAllowed(name string) bool {
+	if name == "" {
+		return true
+	}
+	if matchesAny(deniedCollections, name) {
+		return false
+	}
+	return len(allowedCollections) == 0 || matchesAny(allowedCollections, name)
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// storedID returns the id under which a file of collection is retrievable
+func storedID(collection, filename string) string {
+	if collection == "" {
+		return filename
+	}
+	return collection + "/" + filename
+}
+
+// collectionLimiter caps the number of concurrent writes per collection.
+// Writes over the limit are parked rather than waited for, so a burst to one
+// collection doesn't tie up the workers that other collections need.
+type collectionLimiter struct {
+	defaultLimit int
+	overrides    map[string]int
+
+	mu      sync.Mutex
+	active  map[string]int
+	pending map[string][]writeRequest
+}
+
+// writeLimiter is only set when per-collection write limits are configured
+var writeLimiter *collectionLimiter
+
+func newCollectionLimiter(defaultLimit int, overrides map[string]int) *collectionLimiter {
+	return &collectionLimiter{
+		defaultLimit: defaultLimit,
+		overrides:    overrides,
+		active:       make(map[string]int),
+		pending:      make(map[string][]writeRequest),
+	}
+}
+
+func (l *collectionLimiter) limit(collection string) int {
+	if n, ok := l.overrides[collection]; ok {
+		return n
+	}
+	return l.defaultLimit
+}
+
+// acquire takes a write slot for req's collection. If the collection is at
+// its limit req is parked and false is returned, a later release hands it out.
+func (l *collectionLimiter) acquire(req writeRequest) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limit := l.limit(req.collection)
+	if limit > 0 && l.active[req.collection] >= limit {
+		l.pending[req.collection] = append(l.pending[req.collection], req)
+		return false
+	}
+	l.active[req.collection]++
+	return true
+}
+
+// release gives back a write slot of collection. If writes are parked for it
+// the slot is kept and the oldest parked request is returned to the caller.
+func (l *collectionLimiter) release(collection string) (writeRequest, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if queue := l.pending[collection]; len(queue) > 0 {
+		next := queue[0]
+		queue[0] = writeRequest{}
+		if len(queue) == 1 {
+			delete(l.pending, collection)
+		} else {
+			l.pending[collection] = queue[1:]
+		}
+		return next, true
+	}
+
+	l.active[collection]--
+	if l.active[collection] <= 0 {
+		delete(l.active, collection)
+	}
+	return writeRequest{}, false
+}
+
+// collectionSet tracks the named collections, so no more than max of them
+// get created
+type collectionSet struct {
+	max int
+
+	mu    sync.Mutex
+	names map[string]bool
+}
+
+// knownCollections is only set when -max-collections is configured
+var knownCollections *collectionSet
+
+// newCollectionSet seeds the set with the collections already in storage
+func newCollectionSet(max int, backend StorageBackend) (*collectionSet, error) {
+	names, err := backend.Collections()
+	if err != nil {
+		return nil, err
+	}
+	s := &collectionSet{max: max, names: make(map[string]bool, len(names))}
+	for _, name := range names {
+		s.names[name] = true
+	}
+	return s, nil
+}
+
+// admit reports whether content may be stored in collection, recording it if
+// it's new. The unnamed collection is always admitted.
+func (s *collectionSet) admit(collection string) bool {
+	if s == nil || collection == "" {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.names[collection] {
+		return true
+	}
+	if len(s.names) >= s.max {
+		return false
+	}
+	s.names[collection] = true
+	return true
+}
+
+// admitCollection checks collection against -max-collections. On failure the
+// error response has already been sent.
+func admitCollection(w http.ResponseWriter, collection string) bool {
+	if !knownCollections.admit(collection) {
+		respondWithError(w, http.StatusForbidden, codeTooManyCollections, "Too many collections", nil)
+		return false
+	}
+	return true
+}
+
+// parseLimits parses a "name=limit,name=limit" list
+func parseLimits(s string) (map[string]int, error) {
+	limits := make(map[string]int)
+	if s == "" {
+		return limits, nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok || !isValidName(name) {
+			return nil, fmt.Errorf("invalid limit %q", item)
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid limit %q", item)
+		}
+		limits[name] = n
+	}
+	return limits, nil
+}
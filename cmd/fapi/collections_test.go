@@ -0,0 +1,329 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gatedBackend holds the writes to one collection until the gate is opened,
+// recording how many were in flight at once
+type gatedBackend struct {
+	*inmemBackend
+	collection string
+	gate       chan struct{}
+	stored     chan string
+
+	mu             sync.Mutex
+	inflight, peak int
+}
+
+func (b *gatedBackend) Store(ctx context.Context, id string, data []byte) error {
+	if strings.HasPrefix(id, b.collection+"/") {
+		b.mu.Lock()
+		b.inflight++
+		b.peak = max(b.peak, b.inflight)
+		b.mu.Unlock()
+		<-b.gate
+		b.mu.Lock()
+		b.inflight--
+		b.mu.Unlock()
+	}
+	err := b.inmemBackend.Store(ctx, id, data)
+	b.stored <- id
+	return err
+}
+
+func TestCollectionWriteLimit(t *testing.T) {
+	saved := writeLimiter
+	writeLimiter = newCollectionLimiter(1, map[string]int{"b": 2})
+	defer func() { writeLimiter = saved }()
+
+	backend := &gatedBackend{inmemBackend: newInmemBackend(100), collection: "a", gate: make(chan struct{}), stored: make(chan string, 10)}
+	withWriteQueues(t, backend, func() {
+		for i := 0; i < 3; i++ {
+			doRequest(http.MethodPost, "/v1/collection/a", "application/json", "{}")
+		}
+		doRequest(http.MethodPost, "/v1/collection/b", "application/json", "{}")
+
+		// b is written while a is stuck at its limit
+		select {
+		case id := <-backend.stored:
+			if !strings.HasPrefix(id, "b/") {
+				t.Errorf("%s written while a was held", id)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("b's write is stuck behind a")
+		}
+
+		close(backend.gate)
+		drainWrites(context.Background())
+	})
+	if backend.peak != 1 {
+		t.Errorf("%d writes to a at once, want 1", backend.peak)
+	}
+	if got := len(backend.stored); got != 3 {
+		t.Errorf("%d writes to a, want 3", got)
+	}
+}
+
+func TestCollectionLimiterOverrides(t *testing.T) {
+	l := newCollectionLimiter(1, map[string]int{"logs": 2, "free": 0})
+	for _, tc := range []struct {
+		collection string
+		want       int
+	}{{"orders", 1}, {"logs", 2}, {"free", 0}} {
+		if got := l.limit(tc.collection); got != tc.want {
+			t.Errorf("limit(%s) = %d, want %d", tc.collection, got, tc.want)
+		}
+	}
+
+	first := writeRequest{collection: "logs", id: "logs/1"}
+	if !l.acquire(first) || !l.acquire(writeRequest{collection: "logs", id: "logs/2"}) {
+		t.Fatal("logs refused below its limit")
+	}
+	if l.acquire(writeRequest{collection: "logs", id: "logs/3"}) {
+		t.Fatal("logs admitted over its limit")
+	}
+	// Releasing hands the parked write to the releasing worker
+	if next, ok := l.release("logs"); !ok || next.id != "logs/3" {
+		t.Errorf("release = %+v, %v, want the parked logs/3", next, ok)
+	}
+}
+
+func TestCollectionAllowDenyLists(t *testing.T) {
+	savedAllowed, savedDenied := allowedCollections, deniedCollections
+	defer func() { allowedCollections, deniedCollections = savedAllowed, savedDenied }()
+
+	for _, tc := range []struct {
+		allowed, denied []string
+		collection      string
+		status          int
+	}{
+		{nil, nil, "anything", http.StatusAccepted},
+		{[]string{"orders"}, nil, "orders", http.StatusAccepted},
+		{[]string{"orders"}, nil, "invoices", http.StatusForbidden},
+		{[]string{"logs-*"}, nil, "logs-eu", http.StatusAccepted},
+		{[]string{"logs-*"}, nil, "metrics-eu", http.StatusForbidden},
+		{nil, []string{"tmp*"}, "tmp-1", http.StatusForbidden},
+		{nil, []string{"tmp*"}, "orders", http.StatusAccepted},
+		// The deny list wins over the allow list
+		{[]string{"logs-*"}, []string{"logs-debug"}, "logs-debug", http.StatusForbidden},
+		{[]string{"logs-*"}, []string{"logs-debug"}, "logs-eu", http.StatusAccepted},
+	} {
+		allowedCollections, deniedCollections = tc.allowed, tc.denied
+		backend := newInmemBackend(100)
+		withWriteQueues(t, backend, func() {
+			rec := doRequest(http.MethodPost, "/v1/collection/"+tc.collection, "application/json", "{}")
+			drainWrites(context.Background())
+			if rec.Code != tc.status {
+				t.Errorf("allowed %v, denied %v: %s got status %d, want %d", tc.allowed, tc.denied, tc.collection, rec.Code, tc.status)
+			}
+			if stored := firstStored(backend, tc.collection) != ""; stored != (tc.status == http.StatusAccepted) {
+				t.Errorf("allowed %v, denied %v: %s stored %v", tc.allowed, tc.denied, tc.collection, stored)
+			}
+		})
+	}
+
+	// The unnamed collection isn't subject to the lists
+	allowedCollections, deniedCollections = []string{"orders"}, []string{"*"}
+	if !isCollectionAllowed("") {
+		t.Error("unnamed collection not allowed")
+	}
+}
+
+func TestMaxCollections(t *testing.T) {
+	backend := newInmemBackend(100)
+	// One collection exists already when the service starts
+	if err := backend.Store(context.Background(), "existing/1.json", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	set, err := newCollectionSet(3, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := knownCollections
+	knownCollections = set
+	defer func() { knownCollections = saved }()
+
+	withWriteQueues(t, backend, func() {
+		for _, tc := range []struct {
+			target string
+			status int
+		}{
+			{"/v1/collection/a", http.StatusAccepted},
+			{"/v1/collection/b", http.StatusAccepted},
+			{"/v1/collection/c", http.StatusForbidden},
+			// Known collections keep working
+			{"/v1/collection/existing", http.StatusAccepted},
+			{"/v1/collection/a", http.StatusAccepted},
+			{"/v1/collection/c/1.json", http.StatusForbidden},
+			// The unnamed collection doesn't count
+			{"/v1/collection", http.StatusAccepted},
+		} {
+			rec := doRequest(http.MethodPost, tc.target, "application/json", "{}")
+			if rec.Code != tc.status {
+				t.Errorf("POST %s: status %d, want %d: %s", tc.target, rec.Code, tc.status, rec.Body)
+			}
+		}
+		if rec := doRequest(http.MethodPut, "/v1/collection/d/1.json", "application/json", "{}"); rec.Code != http.StatusForbidden {
+			t.Errorf("PUT into a new collection: status %d, want 403", rec.Code)
+		}
+		drainWrites(context.Background())
+	})
+	if firstStored(backend, "c") != "" || firstStored(backend, "d") != "" {
+		t.Error("content stored in a collection over the limit")
+	}
+}
+
+func TestFitName(t *testing.T) {
+	saved := truncateNames
+	defer func() { truncateNames = saved }()
+
+	for _, name := range []string{strings.Repeat("a", 255), strings.Repeat("a", 250) + ".json"} {
+		for _, truncate := range []bool{false, true} {
+			truncateNames = truncate
+			if got, ok := fitName(name); !ok || got != name {
+				t.Errorf("truncate %v: %d byte name changed to %q, %v", truncate, len(name), got, ok)
+			}
+		}
+	}
+
+	truncateNames = false
+	if _, ok := fitName(strings.Repeat("a", 256)); ok {
+		t.Error("256 byte name accepted under the reject policy")
+	}
+
+	truncateNames = true
+	seen := make(map[string]string)
+	for _, tc := range []struct{ name, ext string }{
+		{strings.Repeat("a", 256), ""},
+		{strings.Repeat("a", 257), ""},
+		{strings.Repeat("a", 300) + ".json", ".json"},
+		{strings.Repeat("a", 301) + ".json", ".json"},
+		{strings.Repeat("a", 300) + ".json.gz", ".json.gz"},
+	} {
+		got, ok := fitName(tc.name)
+		if !ok || len(got) != 255 || !strings.HasSuffix(got, tc.ext) || !isValidName(got) {
+			t.Errorf("%d byte name truncated to %q (%d bytes), %v", len(tc.name), got, len(got), ok)
+		}
+		if again, _ := fitName(tc.name); again != got {
+			t.Errorf("%d byte name truncated differently: %q, %q", len(tc.name), got, again)
+		}
+		if other, dup := seen[got]; dup {
+			t.Errorf("%d and %d byte names both truncated to %q", len(other), len(tc.name), got)
+		}
+		seen[got] = tc.name
+	}
+}
+
+func TestLongNames(t *testing.T) {
+	saved := truncateNames
+	defer func() { truncateNames = saved }()
+	long := strings.Repeat("c", 300)
+	// 128 two byte characters, 256 bytes
+	multibyte := url.PathEscape(strings.Repeat("é", 128))
+
+	for _, tc := range []struct {
+		truncate       bool
+		method, target string
+		status         int
+	}{
+		{false, http.MethodPost, "/v1/collection/" + strings.Repeat("c", 255), http.StatusAccepted},
+		{false, http.MethodPost, "/v1/collection/" + long, http.StatusBadRequest},
+		{true, http.MethodPost, "/v1/collection/" + long, http.StatusAccepted},
+		{false, http.MethodPut, "/v1/collection/orders/" + long + ".json", http.StatusBadRequest},
+		{true, http.MethodPut, "/v1/collection/orders/" + long + ".json", http.StatusAccepted},
+		// Names are ASCII only, whatever their length
+		{true, http.MethodPost, "/v1/collection/" + multibyte, http.StatusBadRequest},
+		{true, http.MethodPut, "/v1/collection/orders/" + multibyte + ".json", http.StatusBadRequest},
+		{false, http.MethodPost, "/v1/collection/" + url.PathEscape(strings.Repeat("é", 10)), http.StatusBadRequest},
+	} {
+		truncateNames = tc.truncate
+		backend := newInmemBackend(100)
+		withWriteQueues(t, backend, func() {
+			rec := doRequest(tc.method, tc.target, "application/json", "{}")
+			drainWrites(context.Background())
+			if rec.Code != tc.status {
+				t.Fatalf("truncate %v, %s %d byte target: status %d, want %d: %s", tc.truncate, tc.method, len(tc.target), rec.Code, tc.status, rec.Body)
+			}
+			if rec.Code >= 300 {
+				return
+			}
+			// Every segment of the stored id fits
+			id := strings.TrimPrefix(rec.Header().Get("Location"), "/v1/collection/")
+			for _, segment := range strings.Split(id, "/") {
+				if len(segment) > 255 {
+					t.Errorf("%s %d byte target: stored as %q", tc.method, len(tc.target), id)
+				}
+			}
+			if f, _, err := backend.Open(id); err != nil {
+				t.Errorf("%s %d byte target: %v", tc.method, len(tc.target), err)
+			} else {
+				f.Close()
+			}
+		})
+	}
+}
+
+func TestDefaultCollection(t *testing.T) {
+	saved, savedDenied := defaultCollection, deniedCollections
+	defer func() { defaultCollection, deniedCollections = saved, savedDenied }()
+
+	defaultCollection = "inbox"
+	backend := newInmemBackend(100)
+	withWriteQueues(t, backend, func() {
+		for _, target := range []string{"/v1/collection", "/v1/collection/"} {
+			rec := doRequest(http.MethodPost, target, "application/json", "{}")
+			if loc := rec.Header().Get("Location"); rec.Code != http.StatusAccepted || !strings.HasPrefix(loc, "/v1/collection/inbox/") {
+				t.Errorf("POST %s: status %d, Location %q, want 202 into inbox", target, rec.Code, loc)
+			}
+		}
+		// Named collections are unaffected
+		if loc := doRequest(http.MethodPost, "/v1/collection/orders", "application/json", "{}").Header().Get("Location"); !strings.HasPrefix(loc, "/v1/collection/orders/") {
+			t.Errorf("POST to orders stored at %q", loc)
+		}
+		// The default collection is subject to the deny list like any other
+		deniedCollections = []string{"inbox"}
+		if rec := doRequest(http.MethodPost, "/v1/collection", "application/json", "{}"); rec.Code != http.StatusForbidden {
+			t.Errorf("POST into a denied default collection: status %d, want 403", rec.Code)
+		}
+		drainWrites(context.Background())
+	})
+	if firstStored(backend, "inbox") == "" || firstStored(backend, "orders") == "" {
+		t.Error("uploads not stored in their collections")
+	}
+
+	for name, ok := range map[string]bool{
+		"":                       true,
+		"inbox":                  true,
+		"logs-2024.eu":           true,
+		".hidden":                false,
+		"a/b":                    false,
+		"..":                     false,
+		strings.Repeat("a", 256): false,
+	} {
+		defaultCollection = name
+		if err := validateFlags(); (err == nil) != ok {
+			t.Errorf("-default-collection %q: validateFlags = %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,517 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultMaxBodySize = 10 << 20 // 10 MB
+
+var (
+	adminToken          string
+	maxBodySize         int64
+	maxGzipBodySize     int64
+	maxInflightBytes    int64
+	maxDecompressedSize int64
+	requireContentType  bool
+	forwardedHops       int
+	maxPathSegmentLen   int
+	maxPathSegments     int
+	maxNameLength       int
+	truncateNames       bool
+	panicWebhookURL     string
+	panicPolicy         string
+	strictContent       bool
+	jsonValidHeader     bool
+	readCacheBytes      int64
+	shutdownTimeout     time.Duration
+	maxRecordSize       int64
+	firstByteTimeout    time.Duration
+	logBufferLines      int
+	mirrorURL           string
+	adminAddr           string
+	extraExtensions     []string
+	breakerFailures     int
+	breakerCooldown     time.Duration
+	deadLetterDir       string
+	maxResponseBytes    int64
+	defaultCollection   string
+	maxRequests         int64
+	clientIPHeaders     []string
+	trustedProxies      []netip.Prefix
+	callbackHosts       []string
+	maxCollections      int
+	shardByIP           bool
+	cleanPaths          bool
+	maxWriteFailures    int
+	decompressDownloads bool
+	maxMetricLabels     int
+	metricsCollections  []string
+	contentCollections  []string
+	acceptStatus        int
+	syncWrites          bool
+	transformTimeout    time.Duration
+	writeBufferSize     int
+	debugCaptureSize    int
+	debugCaptureMaxBody int
+	captureSampleRate   float64
+	maxDecompressRatio  float64
+	batchManifests      bool
+	canonicalJSON       bool
+	healthFormat        string
+	healthBody          string
+	healthStatus        int
+	transcodeCharset    bool
+	rejectDuplicates    bool
+	duplicateCacheSize  int
+	collectionWrites    int
+	collectionOverrides map[string]int
+	schemaPath          string
+	schemaDir           string
+	compressStorage     bool
+	gzipLevel           int
+	retrievalTimeout    time.Duration
+	storageKind         string
+	inmemMaxEntries     int
+	sniffGzip           bool
+	maxJSONDepth        int
+	appendMode          bool
+	reusePort           bool
+	orderedWrites       bool
+	rejectEmpty         bool
+	eventTimeHeader     string
+	maxClockSkew        time.Duration
+	routePrefix         string
+	fileMode            os.FileMode
+	useSequence         bool
+	sequenceFile        string
+	exposeHeaders       []string
+	allowHeaders        []string
+	dailyQuotaBytes     int64
+	dailyQuotaCount     int64
+	quotaFile           string
+	allowedCollections  []string
+	deniedCollections   []string
+	splitNDJSON         bool
+	maxWorkers          int
+	workerIdleTimeout   time.Duration
+	startReadOnly       bool
+	chunkDir            string
+	chunkTimeout        time.Duration
+	warmupTimeout       time.Duration
+	logLevel            string
+	readTimeout         time.Duration
+	writeTimeout        time.Duration
+	idleTimeout         time.Duration
+	logFormat           string
+)
+
+// parseFlags registers and parses the server command line flags
+func parseFlags() error {
+	flag.StringVar(&logLevel, "log-level", "info", "Minimum level of logged messages: debug, info, warn or error")
+	flag.StringVar(&logFormat, "log-format", "text", "Log format: text or json")
+	flag.IntVar(&logBufferLines, "log-buffer-lines", 1000, "Number of recent log lines kept in memory for /v1/admin/logs (0 disables it)")
+	flag.StringVar(&adminToken, "admin-token", os.Getenv("FAPI_ADMIN_TOKEN"), "Bearer token required by admin endpoints (empty disables them)")
+	flag.Int64Var(&maxBodySize, "max-body-size", defaultMaxBodySize, "Maximum size in bytes of an uncompressed request body")
+	flag.Int64Var(&maxGzipBodySize, "max-gzip-body-size", defaultMaxBodySize, "Maximum size in bytes of a gzip encoded request body (as sent on the wire)")
+	flag.Int64Var(&maxInflightBytes, "max-inflight-bytes", 0, "Maximum total size in bytes of the request bodies handled at once, further requests are rejected with 503 (0 means no limit)")
+	flag.Int64Var(&maxDecompressedSize, "max-decompressed-size", 10*defaultMaxBodySize, "Maximum size in bytes of a request body after decompression")
+	flag.Float64Var(&maxDecompressRatio, "max-decompress-ratio", 0, "Maximum ratio of decompressed to compressed bytes of gzip bodies, checked as they are decompressed once past 1MB (0 disables the check)")
+	flag.BoolVar(&sniffGzip, "sniff-gzip", false, "Decompress gzip bodies sent without a Content-Encoding: gzip header")
+	flag.IntVar(&maxJSONDepth, "max-json-depth", 1000, "Maximum nesting depth of JSON bodies (0 disables the check)")
+	flag.BoolVar(&splitNDJSON, "split-ndjson", false, "Store each line of application/x-ndjson uploads as its own JSON document")
+	flag.BoolVar(&batchManifests, "batch-manifest", false, "Once the documents of an NDJSON batch are written, also store <batch id>.manifest.json listing them")
+	flag.Int64Var(&maxRecordSize, "max-record-size", 0, "Maximum size in bytes of a line of an NDJSON batch or stream, longer lines are rejected on their own (0 means -max-body-size)")
+	flag.BoolVar(&appendMode, "append-mode", false, "Append JSON submissions as NDJSON lines to one file per collection and day (UTC)")
+	flag.BoolVar(&reusePort, "reuseport", false, "Set SO_REUSEPORT on the listening socket so several processes can share the port")
+	flag.BoolVar(&orderedWrites, "ordered-writes", false, "Write each collection from a single worker, preserving the order submissions arrived in")
+	flag.BoolVar(&requireContentType, "require-content-type", false, "Reject POST requests without a Content-Type header")
+	flag.BoolVar(&rejectEmpty, "reject-empty", false, "Reject requests with an empty body")
+	flag.StringVar(&eventTimeHeader, "event-time-header", "Date", "Header holding the time a submission was made, checked against -max-clock-skew")
+	flag.DurationVar(&maxClockSkew, "max-clock-skew", 0, "Reject submissions whose -event-time-header is further than this from our clock (0 disables the check)")
+	ipHeaders := flag.String("client-ip-headers", "X-Forwarded-For", "Comma separated list of the headers the client IP is taken from, the first one present wins, e.g. CF-Connecting-IP,X-Real-IP,X-Forwarded-For (empty always uses the connection address)")
+	proxies := flag.String("trusted-proxies", "", "Comma separated list of the addresses or CIDR ranges of the proxies whose -client-ip-headers are believed, all if empty")
+	flag.IntVar(&forwardedHops, "forwarded-hops", 0, "Number of reverse proxies in front of fapi, the client IP is taken that many entries from the right of X-Forwarded-For (0 uses the leftmost entry)")
+	flag.IntVar(&maxPathSegmentLen, "max-path-segment-length", 255, "Maximum length in bytes of a single URL path segment (collection name or id)")
+	flag.IntVar(&maxPathSegments, "max-path-segments", 8, "Maximum number of URL path segments")
+	flag.StringVar(&defaultCollection, "default-collection", "", "Collection uploads to /v1/collection and the catch-all endpoint are stored in (empty stores them flat in the upload directory)")
+	flag.IntVar(&maxNameLength, "max-name-length", 255, "Maximum length in bytes of a stored collection or file name, most filesystems allow 255")
+	longNames := flag.String("long-names", "reject", "What to do with collection names and ids longer than -max-name-length: reject (400) or truncate (cut short and add a hash of the whole name)")
+	flag.StringVar(&panicWebhookURL, "panic-webhook-url", "", "URL to POST a JSON report to whenever a request handler panics")
+	flag.StringVar(&panicPolicy, "panic-policy", "recover", "What to do when a request handler panics: recover (answer 500 and carry on) or log-and-exit (answer 500, log the stack and exit with status 2)")
+	extensions := flag.String("file-extensions", "", "Comma separated list of extensions uploads may also ask for with X-File-Extension, besides the ones of the recognised media types, e.g. geojson,log")
+	callbacks := flag.String("callback-hosts", "", "Comma separated list of the domains (and their subdomains) uploads may name in X-Callback-URL to be notified once written, callbacks are ignored if empty")
+	flag.StringVar(&mirrorURL, "mirror-url", "", "Base URL of another fapi instance every accepted upload is also forwarded to")
+	transformCmd := flag.String("transform-cmd", "", "Command every upload body is piped through (stdin to stdout) before it is validated and stored, a non-zero exit rejects it with 422")
+	flag.DurationVar(&transformTimeout, "transform-timeout", 5*time.Second, "Time after which the transform command is killed and the upload rejected")
+	flag.Int64Var(&maxRequests, "max-requests", 0, "Number of requests after which the server drains and exits, for the orchestrator to restart it (0 means no limit)")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "Time the requests being handled have to complete after SIGINT or SIGTERM before the process exits anyway")
+	flag.DurationVar(&warmupTimeout, "warmup-timeout", 30*time.Second, "Time the storage has to pass its self-check at startup before the process exits")
+	flag.IntVar(&maxWriteFailures, "max-write-failures", 10, "Number of failed writes in a row after which the service stops being ready until the storage works again (0 disables)")
+	flag.BoolVar(&startReadOnly, "read-only", false, "Start in read-only mode, rejecting writes while retrieval keeps working")
+	flag.IntVar(&maxWorkers, "max-workers", workerCount, "Maximum number of writer workers, extra ones are started while the write queue stays over half full")
+	flag.DurationVar(&workerIdleTimeout, "worker-idle-timeout", 30*time.Second, "Time after which an idle extra writer worker exits")
+	flag.IntVar(&writeBufferSize, "write-buffer-size", 4096, "Size in bytes of the buffered writers used to store files")
+	flag.IntVar(&debugCaptureSize, "debug-capture-size", 0, "Number of recent request bodies kept in memory for GET /v1/debug/recent (0 disables capturing)")
+	flag.IntVar(&debugCaptureMaxBody, "debug-capture-max-body", 4096, "Captured request bodies are truncated to this many bytes")
+	flag.Float64Var(&captureSampleRate, "capture-sample-rate", 1, "Fraction of the requests captured for GET /v1/debug/recent, from 0.0 to 1.0")
+	flag.BoolVar(&canonicalJSON, "canonicalize-json", false, "Store valid JSON bodies with sorted keys and indentation")
+	flag.StringVar(&healthFormat, "health-format", "text", "Format of the /v1/health response: text or json")
+	flag.StringVar(&healthBody, "health-body", "OK", "Body of the /v1/health response in text format")
+	flag.IntVar(&acceptStatus, "accept-status", http.StatusAccepted, "HTTP status returned for accepted uploads: 200, 201 or 202")
+	flag.BoolVar(&syncWrites, "sync-writes", false, "Answer uploads only once they are written to storage, with 201 unless -accept-status is 200 (per request with ?sync=true)")
+	flag.IntVar(&healthStatus, "health-status", http.StatusOK, "HTTP status returned by /v1/health (must be 2xx)")
+	flag.BoolVar(&transcodeCharset, "transcode-charset", false, "Convert bodies to UTF-8 according to the Content-Type charset (UTF-16 and ISO-8859-1 are supported)")
+	flag.BoolVar(&rejectDuplicates, "reject-duplicates", false, "Reject re-submissions of recently stored content with 409 Conflict")
+	flag.IntVar(&duplicateCacheSize, "duplicate-cache-size", 10000, "Number of recent content hashes remembered by -reject-duplicates")
+	flag.IntVar(&collectionWrites, "collection-write-limit", 0, "Maximum number of concurrent writes per collection (0 means no limit)")
+	flag.StringVar(&schemaPath, "schema", "", "JSON Schema file that JSON uploads must match (rejected with 422 otherwise)")
+	flag.StringVar(&schemaDir, "schema-dir", "", "Directory of <collection>.schema.json files, each applied to uploads to that collection instead of -schema")
+	flag.BoolVar(&compressStorage, "compress-storage", false, "Store uploads gzip compressed (with a .gz suffix)")
+	gzipLevelName := flag.String("gzip-level", "DefaultCompression", "gzip compression level: 1-9, BestSpeed, BestCompression or DefaultCompression")
+	flag.DurationVar(&readTimeout, "read-timeout", 10*time.Second, "Maximum time to read a request, including its body (0 means no limit)")
+	flag.DurationVar(&firstByteTimeout, "first-byte-timeout", 0, "Time a client has to start sending the request body before it's rejected with 408, the rest of the body still has -read-timeout (0 disables)")
+	flag.DurationVar(&writeTimeout, "write-timeout", 10*time.Second, "Maximum time to write a response (0 means no limit)")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 120*time.Second, "Time a keep-alive connection may stay idle before it is closed (0 uses -read-timeout)")
+	flag.Int64Var(&maxResponseBytes, "max-response-bytes", 0, "Maximum size in bytes of a download, larger ones are cut off with an error logged (0 means no limit)")
+	flag.DurationVar(&retrievalTimeout, "retrieval-write-timeout", 0, "Write deadline for downloads of stored files, overriding the server write timeout (0 keeps the server one)")
+	flag.BoolVar(&decompressDownloads, "decompress-downloads", true, "Serve gzip compressed files with Content-Encoding: gzip, decompressed for clients that don't accept gzip")
+	flag.IntVar(&breakerFailures, "breaker-failures", 0, "Number of storage writes failing in a row after which writes fail fast until the storage recovers (0 disables the circuit breaker)")
+	flag.DurationVar(&breakerCooldown, "breaker-cooldown", 30*time.Second, "Time the storage circuit breaker stays open before a write is let through to probe the storage")
+	flag.StringVar(&deadLetterDir, "dead-letter-dir", "", "Directory writes refused by the open storage circuit breaker are stored in instead of failing")
+	flag.Int64Var(&readCacheBytes, "read-cache-bytes", 0, "Size in bytes of the in-memory cache of recently retrieved files (0 disables it)")
+	flag.StringVar(&storageKind, "storage", "fs", "Storage backend: fs (files in -upload-dirs) or inmem (bounded, in memory)")
+	flag.IntVar(&inmemMaxEntries, "inmem-max-entries", 10000, "Maximum number of files kept by the inmem storage, the oldest are evicted first")
+	flag.StringVar(&adminAddr, "admin-addr", "", "Address to serve the admin, debug and metrics routes on instead of the main port, e.g. 127.0.0.1:8990 (empty keeps them on the main port)")
+	flag.StringVar(&routePrefix, "route-prefix", "", "Path prefix all the routes are served under, e.g. /ingest")
+	flag.BoolVar(&cleanPaths, "clean-paths", true, "Collapse repeated slashes and drop trailing slashes in request paths before routing")
+	shardBy := flag.String("shard-by", "", "Store files in a subdirectory of their collection per client: ip (empty keeps them flat)")
+	idScheme := flag.String("id-scheme", "ip-time", "How stored file names are generated: ip-time, ulid, uuidv7 or hash (of the content)")
+	hashAlgo := flag.String("hash-algo", "sha256", "Hash algorithm of duplicate detection, -id-scheme hash and the X-Content-Hash checksums: sha256, sha512 or fnv128a (fast but not collision resistant)")
+	flag.BoolVar(&useSequence, "sequence", false, "Start stored file names with a per-server sequence number, so they sort in arrival order")
+	flag.StringVar(&sequenceFile, "sequence-file", "", "File the -sequence counter is persisted to across restarts")
+	fileModeValue := flag.String("file-mode", "0644", "Permissions of stored files (octal), applied regardless of the umask")
+	flag.Int64Var(&dailyQuotaBytes, "daily-quota-bytes", 0, "Maximum total size in bytes of the uploads of each client IP per day (0 means no limit)")
+	flag.Int64Var(&dailyQuotaCount, "daily-quota-count", 0, "Maximum number of uploads of each client IP per day (0 means no limit)")
+	flag.StringVar(&quotaFile, "quota-file", "", "File the daily quota usage is persisted to across restarts")
+	allowed := flag.String("allowed-collections", "", "Comma separated list of the collection names (or glob patterns) uploads are accepted for, all if empty")
+	denied := flag.String("denied-collections", "", "Comma separated list of the collection names (or glob patterns) uploads are refused for")
+	labelled := flag.String("metrics-collections", "", "Comma separated list of the collection names (or glob patterns) with their own metrics label, the others are counted as _other")
+	flag.BoolVar(&jsonValidHeader, "json-valid-header", false, "Send X-JSON-Valid: true or false on uploads, telling whether the body was valid JSON even when it's stored anyway")
+	validated := flag.String("validate-content", "", "Comma separated list of the collection names (or glob patterns) whose CSV and XML uploads are checked to be well-formed")
+	flag.BoolVar(&strictContent, "strict-content", false, "Reject CSV and XML uploads that fail -validate-content with 422 instead of only logging them")
+	flag.IntVar(&maxMetricLabels, "max-metric-collections", 100, "Maximum number of collections with their own metrics label when -metrics-collections isn't set, the others are counted as _other")
+	flag.IntVar(&maxCollections, "max-collections", 0, "Maximum number of named collections, uploads creating more are rejected with 403 (0 means no limit)")
+	requestHeaders := flag.String("allow-headers", "Content-Type,Content-Encoding,Authorization,X-Callback-URL,X-File-Extension,X-Request-ID,If-None-Match", "Comma separated list of request headers browsers may send cross-origin (Access-Control-Allow-Headers), -event-time-header is added when -max-clock-skew is set")
+	exposed := flag.String("expose-headers", "Location,ETag,Retry-After,X-Content-Hash,X-JSON-Valid", "Comma separated list of response headers browsers may read cross-origin (Access-Control-Expose-Headers)")
+	flag.StringVar(&chunkDir, "chunk-dir", filepath.Join(os.TempDir(), "fapi-chunks"), "Directory the chunks of resumable uploads are staged in")
+	flag.DurationVar(&chunkTimeout, "chunk-timeout", time.Hour, "Time after the last chunk after which an incomplete resumable upload is discarded")
+	dirs := flag.String("upload-dirs", "./uploads", "Comma separated list of directories to spread stored files across")
+	collectionWriteLimits := flag.String("collection-write-limits", "", "Per-collection overrides of -collection-write-limit, e.g. logs=1,results=2")
+	flag.Parse()
+
+	routePrefix = strings.TrimRight(routePrefix, "/")
+
+	exposeHeaders = splitList(*exposed)
+	allowHeaders = splitList(*requestHeaders)
+	if maxClockSkew > 0 && !slices.ContainsFunc(allowHeaders, func(h string) bool { return strings.EqualFold(h, eventTimeHeader) }) {
+		allowHeaders = append(allowHeaders, eventTimeHeader)
+	}
+	allowedCollections = splitList(*allowed)
+	deniedCollections = splitList(*denied)
+	metricsCollections = splitList(*labelled)
+	contentCollections = splitList(*validated)
+	for _, value := range splitList(*extensions) {
+		ext := normalizeExtension(value)
+		if !extensionPattern.MatchString(ext) || ext == ".gz" {
+			return fmt.Errorf("file-extensions must list up to 16 letters or digits each, not %q", value)
+		}
+		extraExtensions = append(extraExtensions, ext)
+	}
+	callbackHosts = splitList(strings.ToLower(*callbacks))
+	clientIPHeaders = splitList(*ipHeaders)
+	for _, value := range splitList(*proxies) {
+		prefix, err := parsePrefix(value)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q: %w", value, err)
+		}
+		trustedProxies = append(trustedProxies, prefix)
+	}
+	for _, host := range callbackHosts {
+		if strings.Contains(host, "/") {
+			return fmt.Errorf("callback-hosts must list host names, not URLs: %q", host)
+		}
+	}
+	for _, pattern := range slices.Concat(allowedCollections, deniedCollections, metricsCollections, contentCollections) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid collection pattern %q: %w", pattern, err)
+		}
+	}
+	transformArgs = strings.Fields(*transformCmd)
+	uploadDirs = splitList(*dirs)
+	if len(uploadDirs) == 0 {
+		return errors.New("upload-dirs must list at least one directory")
+	}
+
+	switch *longNames {
+	case "reject":
+	case "truncate":
+		truncateNames = true
+	default:
+		return fmt.Errorf("unknown long-names policy %q", *longNames)
+	}
+
+	switch *shardBy {
+	case "":
+	case "ip":
+		shardByIP = true
+	default:
+		return fmt.Errorf("unknown shard-by layout %q", *shardBy)
+	}
+
+	var err error
+	if idGenerator, err = newIDGenerator(*idScheme); err != nil {
+		return err
+	}
+	if contentHasher, err = newHasher(*hashAlgo); err != nil {
+		return err
+	}
+	if gzipLevel, err = parseGzipLevel(*gzipLevelName); err != nil {
+		return err
+	}
+	if fileMode, err = parseFileMode(*fileModeValue); err != nil {
+		return err
+	}
+	if collectionOverrides, err = parseLimits(*collectionWriteLimits); err != nil {
+		return fmt.Errorf("collection-write-limits: %w", err)
+	}
+
+	return validateFlags()
+}
+
+func validateFlags() error {
+	if breakerFailures < 0 {
+		return errors.New("breaker-failures must not be negative")
+	}
+	if breakerFailures > 0 && breakerCooldown <= 0 {
+		return errors.New("breaker-cooldown must be greater than zero")
+	}
+	if maxBodySize <= 0 || maxGzipBodySize <= 0 || maxDecompressedSize <= 0 {
+		return errors.New("body size limits must be greater than zero")
+	}
+	if maxPathSegmentLen <= 0 || maxPathSegments <= 0 {
+		return errors.New("path limits must be greater than zero")
+	}
+	if logBufferLines < 0 {
+		return errors.New("log-buffer-lines must not be negative")
+	}
+	if firstByteTimeout < 0 {
+		return errors.New("first-byte-timeout must not be negative")
+	}
+	if maxRecordSize < 0 {
+		return errors.New("max-record-size must not be negative")
+	}
+	if shutdownTimeout < 0 {
+		return errors.New("shutdown-timeout must not be negative")
+	}
+	if maxRequests < 0 {
+		return errors.New("max-requests must not be negative")
+	}
+	if readCacheBytes < 0 {
+		return errors.New("read-cache-bytes must not be negative")
+	}
+	if maxNameLength < 64 {
+		return errors.New("max-name-length must be at least 64")
+	}
+	if defaultCollection != "" && (!isValidName(defaultCollection) || len(defaultCollection) > maxNameLength) {
+		return errors.New("default-collection must be a valid collection name, of letters, digits, '-', '_' and '.', not starting with '.' and at most max-name-length bytes")
+	}
+	if writeBufferSize <= 0 {
+		return errors.New("write-buffer-size must be greater than zero")
+	}
+	if maxDecompressRatio < 0 {
+		return errors.New("max-decompress-ratio must not be negative")
+	}
+	if captureSampleRate < 0 || captureSampleRate > 1 {
+		return errors.New("capture-sample-rate must be between 0 and 1")
+	}
+	if debugCaptureSize < 0 || debugCaptureMaxBody < 0 {
+		return errors.New("debug capture limits must not be negative")
+	}
+	if routePrefix != "" && !strings.HasPrefix(routePrefix, "/") {
+		return errors.New("route-prefix must start with /")
+	}
+	if _, ok := idGenerator.(ipTimeIDs); useSequence && !ok {
+		return errors.New("sequence can only be used with -id-scheme ip-time")
+	}
+	if sequenceFile != "" && !useSequence {
+		return errors.New("sequence-file requires -sequence")
+	}
+	if dailyQuotaBytes < 0 || dailyQuotaCount < 0 {
+		return errors.New("daily quotas must not be negative")
+	}
+	if quotaFile != "" && dailyQuotaBytes == 0 && dailyQuotaCount == 0 {
+		return errors.New("quota-file requires -daily-quota-bytes or -daily-quota-count")
+	}
+	if maxWorkers < workerCount {
+		return fmt.Errorf("max-workers must be at least %d", workerCount)
+	}
+	if maxWorkers > workerCount && orderedWrites {
+		return errors.New("max-workers can't be raised with -ordered-writes")
+	}
+	if workerIdleTimeout <= 0 {
+		return errors.New("worker-idle-timeout must be greater than zero")
+	}
+	if warmupTimeout <= 0 {
+		return errors.New("warmup-timeout must be greater than zero")
+	}
+	if chunkTimeout <= 0 {
+		return errors.New("chunk-timeout must be greater than zero")
+	}
+	if maxClockSkew < 0 {
+		return errors.New("max-clock-skew must not be negative")
+	}
+	if maxClockSkew > 0 && strings.TrimSpace(eventTimeHeader) == "" {
+		return errors.New("event-time-header must be set when max-clock-skew is")
+	}
+	if maxJSONDepth < 0 {
+		return errors.New("max-json-depth must not be negative")
+	}
+	if healthFormat != "text" && healthFormat != "json" {
+		return errors.New("health-format must be text or json")
+	}
+	if healthStatus < 200 || healthStatus > 299 {
+		return errors.New("health-status must be a 2xx status code")
+	}
+	if rejectDuplicates && duplicateCacheSize <= 0 {
+		return errors.New("duplicate-cache-size must be greater than zero")
+	}
+	if collectionWrites < 0 {
+		return errors.New("collection-write-limit must not be negative")
+	}
+	if storageKind == "inmem" && inmemMaxEntries <= 0 {
+		return errors.New("inmem-max-entries must be greater than zero")
+	}
+	if storageKind != "fs" && compressStorage {
+		return errors.New("compress-storage is only supported with -storage=fs")
+	}
+	if readTimeout < 0 || writeTimeout < 0 || idleTimeout < 0 {
+		return errors.New("server timeouts must not be negative")
+	}
+	if mirrorURL != "" {
+		if u, err := url.Parse(mirrorURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("mirror-url must be an http or https URL")
+		}
+	}
+	switch acceptStatus {
+	case http.StatusOK, http.StatusCreated, http.StatusAccepted:
+	default:
+		return errors.New("accept-status must be 200, 201 or 202")
+	}
+	if maxMetricLabels < 0 {
+		return errors.New("max-metric-collections must not be negative")
+	}
+	if panicPolicy != "recover" && panicPolicy != "log-and-exit" {
+		return errors.New("panic-policy must be recover or log-and-exit")
+	}
+	if maxWriteFailures < 0 {
+		return errors.New("max-write-failures must not be negative")
+	}
+	if maxCollections < 0 {
+		return errors.New("max-collections must not be negative")
+	}
+	if transformTimeout <= 0 {
+		return errors.New("transform-timeout must be greater than zero")
+	}
+	if maxInflightBytes < 0 {
+		return errors.New("max-inflight-bytes must not be negative")
+	}
+	if maxInflightBytes > 0 && maxInflightBytes < max(maxBodySize, maxGzipBodySize) {
+		return errors.New("max-inflight-bytes must be at least max-body-size and max-gzip-body-size")
+	}
+	if retrievalTimeout < 0 {
+		return errors.New("retrieval-write-timeout must not be negative")
+	}
+	if forwardedHops < 0 {
+		return errors.New("forwarded-hops must not be negative")
+	}
+	return nil
+}
+
+// parseGzipLevel accepts a numeric level (1-9) or one of the compress/gzip
+// constant names
+func parseGzipLevel(s string) (int, error) {
+	switch s {
+	case "BestSpeed":
+		return gzip.BestSpeed, nil
+	case "BestCompression":
+		return gzip.BestCompression, nil
+	case "DefaultCompression":
+		return gzip.DefaultCompression, nil
+	}
+	level, err := strconv.Atoi(s)
+	if err != nil || level < gzip.BestSpeed || level > gzip.BestCompression {
+		return 0, fmt.Errorf("invalid gzip-level %q", s)
+	}
+	return level, nil
+}
+
+// parseFileMode parses an octal permission mode such as 0640
+func parseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid file-mode %q", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// splitList splits a comma separated flag value, dropping empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parsePrefix parses a CIDR range, or a single address as a range of one
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
@@ -0,0 +1,107 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseGzipLevel(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		level int
+		ok    bool
+	}{
+		{"BestSpeed", gzip.BestSpeed, true},
+		{"BestCompression", gzip.BestCompression, true},
+		{"DefaultCompression", gzip.DefaultCompression, true},
+		{"1", 1, true},
+		{"9", 9, true},
+		{"0", 0, false},
+		{"10", 0, false},
+		{"fast", 0, false},
+	} {
+		level, err := parseGzipLevel(tc.value)
+		if (err == nil) != tc.ok || level != tc.level {
+			t.Errorf("parseGzipLevel(%q) = %d, %v", tc.value, level, err)
+		}
+	}
+}
+
+// BenchmarkGzipLevel compares the throughput and the output size of a few
+// -gzip-level values on a JSON payload
+func BenchmarkGzipLevel(b *testing.B) {
+	var payload bytes.Buffer
+	for i := 0; payload.Len() < 256<<10; i++ {
+		fmt.Fprintf(&payload, `{"id":%d,"name":"item %d","price":%d.%02d,"tags":["a","b"]}`+"\n", i, i*7, i%1000, i%100)
+	}
+	for _, name := range []string{"BestSpeed", "DefaultCompression", "BestCompression"} {
+		level, err := parseGzipLevel(name)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(name, func(b *testing.B) {
+			var out bytes.Buffer
+			gz, _ := gzip.NewWriterLevel(&out, level)
+			b.SetBytes(int64(payload.Len()))
+			for i := 0; i < b.N; i++ {
+				out.Reset()
+				gz.Reset(&out)
+				_, _ = gz.Write(payload.Bytes())
+				_ = gz.Close()
+			}
+			b.ReportMetric(float64(out.Len())/float64(payload.Len()), "ratio")
+		})
+	}
+}
+
+func TestParseFileMode(t *testing.T) {
+	if mode, err := parseFileMode("0640"); err != nil || mode != 0640 {
+		t.Errorf("parseFileMode(0640) = %o, %v", mode, err)
+	}
+	for _, s := range []string{"", "0999", "1777", "rw-r--r--"} {
+		if _, err := parseFileMode(s); err == nil {
+			t.Errorf("parseFileMode(%q) accepted", s)
+		}
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	savedRead, savedWrite, savedIdle := readTimeout, writeTimeout, idleTimeout
+	defer func() { readTimeout, writeTimeout, idleTimeout = savedRead, savedWrite, savedIdle }()
+
+	readTimeout, writeTimeout, idleTimeout = 3*time.Second, 7*time.Second, 45*time.Second
+	server := newServer(":0", http.NotFoundHandler())
+	if server.ReadTimeout != readTimeout || server.WriteTimeout != writeTimeout || server.IdleTimeout != idleTimeout {
+		t.Errorf("server timeouts read %v, write %v, idle %v", server.ReadTimeout, server.WriteTimeout, server.IdleTimeout)
+	}
+	if err := validateFlags(); err != nil {
+		t.Errorf("valid timeouts rejected: %v", err)
+	}
+
+	for _, timeout := range []*time.Duration{&readTimeout, &writeTimeout, &idleTimeout} {
+		saved := *timeout
+		*timeout = -time.Second
+		if err := validateFlags(); err == nil {
+			t.Error("negative timeout accepted")
+		}
+		*timeout = saved
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+)
+
+// contentValidator checks the structure of a body that isn't JSON
+type contentValidator func(body []byte) error
+
+// contentValidators are the validators of non-JSON uploads, by media type
+var contentValidators = map[string]contentValidator{
+	"text/csv":        validateCSV,
+	"application/xml": validateXML,
+	"text/xml":        validateXML,
+}
+
+// validateContent checks a non-JSON body stored with extension ext, if
+// collection is one of -validate-content and there is a validator for its
+// content type. Invalid content is rejected with 422 under -strict-content and
+// only logged otherwise. On rejection the error response has already been
+// sent.
+func validateContent(w http.ResponseWriter, body []byte, collection, ext string) bool {
+	if !matchesAny(contentCollections, collection) {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(mime.TypeByExtension(ext))
+	validate, ok := contentValidators[mediaType]
+	if !ok {
+		return true
+	}
+	err := validate(body)
+	if err == nil {
+		return true
+	}
+	if !strictContent {
+		slog.Warn("Invalid content accepted", "collection", collection, "type", mediaType, "error", err)
+		return true
+	}
+	respondWithError(w, http.StatusUnprocessableEntity, codeInvalidContent, "Invalid "+mediaType+": "+err.Error(), nil)
+	return false
+}
+
+// validateCSV checks body is CSV with the same number of columns on every row
+func validateCSV(body []byte) error {
+	r := csv.NewReader(bytes.NewReader(body))
+	r.ReuseRecord = true
+	rows := 0
+	for {
+		_, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		rows++
+	}
+	if rows == 0 {
+		return errors.New("no rows")
+	}
+	return nil
+}
+
+// validateXML checks body is a well-formed XML document with a single root
+// element
+func validateXML(body []byte) error {
+	d := xml.NewDecoder(bytes.NewReader(body))
+	// Only the structure is checked, so the declared encoding doesn't matter
+	d.CharsetReader = func(_ string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	depth, roots := 0, 0
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				roots++
+				if roots > 1 {
+					return errors.New("more than one root element")
+				}
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+		case xml.CharData:
+			if depth == 0 && len(bytes.TrimSpace(t)) > 0 {
+				return errors.New("text outside the root element")
+			}
+		}
+	}
+	if roots == 0 {
+		return errors.New("no root element")
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestValidateCSV(t *testing.T) {
+	for _, tc := range []struct {
+		body  string
+		valid bool
+	}{
+		{"a,b,c\n1,2,3\n", true},
+		{"a,b\n\"1,5\",2\n", true},
+		{"a,b,c", true},
+		{"a,b,c\n1,2\n", false},
+		{"a,b\n1,2,3\n", false},
+		{"a,\"b\n1,2\n", false},
+		{"", false},
+	} {
+		if err := validateCSV([]byte(tc.body)); (err == nil) != tc.valid {
+			t.Errorf("validateCSV(%q) = %v, want valid %v", tc.body, err, tc.valid)
+		}
+	}
+}
+
+func TestValidateXML(t *testing.T) {
+	for _, tc := range []struct {
+		body  string
+		valid bool
+	}{
+		{"<order><id>1</id></order>", true},
+		{"<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?>\n<order id=\"1\"/>\n", true},
+		{"<!-- note --><order/>", true},
+		{"<order><id>1</order>", false},
+		{"<order>", false},
+		{"<a/><b/>", false},
+		{"text<order/>", false},
+		{"just text", false},
+		{"", false},
+	} {
+		if err := validateXML([]byte(tc.body)); (err == nil) != tc.valid {
+			t.Errorf("validateXML(%q) = %v, want valid %v", tc.body, err, tc.valid)
+		}
+	}
+}
+
+func TestValidateContentUploads(t *testing.T) {
+	savedCollections, savedStrict := contentCollections, strictContent
+	defer func() { contentCollections, strictContent = savedCollections, savedStrict }()
+	contentCollections = []string{"reports-*"}
+
+	for _, tc := range []struct {
+		strict              bool
+		target, contentType string
+		body                string
+		rejected            bool
+	}{
+		{true, "/v1/collection/reports-eu", "text/csv", "a,b\n1,2\n", false},
+		{true, "/v1/collection/reports-eu", "text/csv", "a,b\n1,2,3\n", true},
+		{true, "/v1/collection/reports-eu", "application/xml", "<report/>", false},
+		{true, "/v1/collection/reports-eu", "text/xml", "<report>", true},
+		{true, "/v1/collection/reports-eu/1.csv", "text/csv", "a,b\n1\n", true},
+		// Other collections and content types aren't checked
+		{true, "/v1/collection/orders", "text/csv", "a,b\n1,2,3\n", false},
+		{true, "/v1/collection/reports-eu", "text/plain", "a,b\n1,2,3\n", false},
+		// Without -strict-content invalid content is only logged
+		{false, "/v1/collection/reports-eu", "text/csv", "a,b\n1,2,3\n", false},
+	} {
+		strictContent = tc.strict
+		withWriteQueues(t, newInmemBackend(100), func() {
+			method := http.MethodPost
+			if strings.HasSuffix(tc.target, ".csv") {
+				method = http.MethodPut
+			}
+			rec := doRequest(method, tc.target, tc.contentType, tc.body)
+			drainWrites(context.Background())
+			if rejected := rec.Code == http.StatusUnprocessableEntity; rejected != tc.rejected || !rejected && rec.Code >= 300 {
+				t.Errorf("strict %v, %s %s %q: status %d, want rejected %v: %s", tc.strict, tc.target, tc.contentType, tc.body, rec.Code, tc.rejected, rec.Body)
+			}
+			if tc.rejected && !strings.Contains(rec.Body.String(), string(codeInvalidContent)) {
+				t.Errorf("%s %q: no error code in %s", tc.target, tc.body, rec.Body)
+			}
+		})
+	}
+}
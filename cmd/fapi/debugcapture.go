@@ -0,0 +1,133 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// capturedRequest is a request body kept in memory for debugging
+type capturedRequest struct {
+	Time            time.Time `json:"time"`
+	Method          string    `json:"method"`
+	Path            string    `json:"path"`
+	ClientIP        string    `json:"client_ip"`
+	ContentType     string    `json:"content_type,omitempty"`
+	ContentEncoding string    `json:"content_encoding,omitempty"`
+	EventTime       time.Time `json:"event_time,omitzero"`
+	Size            int       `json:"size"`
+	Truncated       bool      `json:"truncated"`
+	Body            string    `json:"body"`
+}
+
+// captureRing holds the most recent captured requests, oldest get evicted
+// first. A nil *captureRing means capturing is disabled.
+type captureRing struct {
+	mu      sync.Mutex
+	entries []capturedRequest
+	next    int
+	full    bool
+
+	// sampleRate is the fraction of requests captured, picked by rng
+	sampleRate float64
+	rng        *rand.Rand
+}
+
+// debugCapture is only set when -debug-capture-size is greater than zero
+var debugCapture *captureRing
+
+// newCaptureRing returns a ring of size entries capturing sampleRate of the
+// requests. The sample is drawn from a generator seeded once per process.
+func newCaptureRing(size int, sampleRate float64) *captureRing {
+	return &captureRing{
+		entries:    make([]capturedRequest, size),
+		sampleRate: sampleRate,
+		rng:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// sampled reports whether the next request is to be captured
+func (c *captureRing) sampled() bool {
+	if c.sampleRate >= 1 {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rng.Float64() < c.sampleRate
+}
+
+func (c *captureRing) capture(r *http.Request, clientIP string, body []byte, eventTime time.Time) {
+	if c == nil || !c.sampled() {
+		return
+	}
+
+	e := capturedRequest{
+		Time:            clk.Now().UTC(),
+		Method:          r.Method,
+		Path:            truncate(r.URL.Path, maxLoggedPathLen),
+		ClientIP:        clientIP,
+		ContentType:     r.Header.Get("Content-Type"),
+		ContentEncoding: r.Header.Get("Content-Encoding"),
+		EventTime:       eventTime,
+		Size:            len(body),
+	}
+	if len(body) > debugCaptureMaxBody {
+		body = body[:debugCaptureMaxBody]
+		e.Truncated = true
+	}
+	e.Body = string(body)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[c.next] = e
+	c.next = (c.next + 1) % len(c.entries)
+	if c.next == 0 {
+		c.full = true
+	}
+}
+
+// recent returns the captured requests, newest first
+func (c *captureRing) recent() []capturedRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := c.next
+	if c.full {
+		n = len(c.entries)
+	}
+	out := make([]capturedRequest, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, c.entries[(c.next-i+len(c.entries))%len(c.entries)])
+	}
+	return out
+}
+
+func handleDebugRecent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET allowed", nil)
+		return
+	}
+	if debugCapture == nil {
+		respondWithError(w, http.StatusNotFound, codeDisabled, "Debug capture is disabled", nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(debugCapture.recent())
+}
@@ -0,0 +1,103 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCaptureRingEviction(t *testing.T) {
+	ring := newCaptureRing(3, 1)
+	for _, body := range []string{"a", "b", "c", "d", "e"} {
+		ring.capture(httptest.NewRequest(http.MethodPost, "/v1/collection", nil), "192.0.2.1", []byte(body), time.Time{})
+	}
+	var bodies []string
+	for _, e := range ring.recent() {
+		bodies = append(bodies, e.Body)
+	}
+	// The two oldest are gone, newest first
+	if got := strings.Join(bodies, ","); got != "e,d,c" {
+		t.Errorf("recent bodies %s, want e,d,c", got)
+	}
+}
+
+func TestCaptureRingTruncates(t *testing.T) {
+	saved := debugCaptureMaxBody
+	debugCaptureMaxBody = 4
+	defer func() { debugCaptureMaxBody = saved }()
+
+	ring := newCaptureRing(2, 1)
+	ring.capture(httptest.NewRequest(http.MethodPost, "/v1/collection", nil), "192.0.2.1", []byte("0123456789"), time.Time{})
+	if e := ring.recent()[0]; e.Body != "0123" || !e.Truncated || e.Size != 10 {
+		t.Errorf("captured %+v, want the first 4 of 10 bytes", e)
+	}
+}
+
+func TestCaptureSampleRate(t *testing.T) {
+	const requests = 10000
+	for _, rate := range []float64{0, 0.1, 0.5, 1} {
+		ring := newCaptureRing(requests, rate)
+		for i := 0; i < requests; i++ {
+			ring.capture(httptest.NewRequest(http.MethodPost, "/v1/collection", nil), "192.0.2.1", []byte("{}"), time.Time{})
+		}
+		// The tolerance is at least 10 standard deviations of the sample size
+		got, want := len(ring.recent()), rate*requests
+		if math.Abs(float64(got)-want) > 0.05*requests {
+			t.Errorf("rate %g: captured %d of %d requests, want about %g", rate, got, requests, want)
+		}
+		if (rate == 0 || rate == 1) && float64(got) != want {
+			t.Errorf("rate %g: captured %d of %d requests", rate, got, requests)
+		}
+	}
+}
+
+func TestDebugRecentEndpoint(t *testing.T) {
+	saved := debugCapture
+	defer func() { debugCapture = saved }()
+
+	debugCapture = nil
+	if rec := adminRequest(t, handleDebugRecent, http.MethodGet, "/v1/debug/recent"); rec.Code != http.StatusNotFound {
+		t.Errorf("disabled: status %d, want 404", rec.Code)
+	}
+
+	debugCapture = newCaptureRing(10, 1)
+	withWriteQueues(t, newInmemBackend(100), func() {
+		doRequestWithHeader(http.MethodPost, "/v1/collection/orders", "application/json", `{"id":1}`, "X-Request-ID", "1")
+		doRequest(http.MethodPost, "/v1/collection/orders", "text/plain", "not json")
+		drainWrites(context.Background())
+	})
+
+	rec := adminRequest(t, handleDebugRecent, http.MethodGet, "/v1/debug/recent")
+	var entries []capturedRequest
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); rec.Code != http.StatusOK || err != nil {
+		t.Fatalf("status %d, %v: %s", rec.Code, err, rec.Body)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("%d entries, want 2: %s", len(entries), rec.Body)
+	}
+	if e := entries[0]; e.Body != "not json" || e.ContentType != "text/plain" || e.Method != http.MethodPost || e.Path != "/v1/collection/orders" {
+		t.Errorf("newest entry %+v", e)
+	}
+	if e := entries[1]; e.Body != `{"id":1}` || e.Size != 8 || e.Time.IsZero() {
+		t.Errorf("oldest entry %+v", e)
+	}
+}
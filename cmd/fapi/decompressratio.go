@@ -0,0 +1,53 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// decompressRatioSlack is the amount of decompressed data allowed regardless
+// of -max-decompress-ratio, small bodies can legitimately compress very well
+const decompressRatioSlack = 1 << 20 // 1 MB
+
+var errDecompressRatio = errors.New("decompression ratio over the limit")
+
+// ratioReader reads decompressed data, failing with errDecompressRatio once
+// more than -max-decompress-ratio times the compressed bytes consumed so far
+// have been produced
+type ratioReader struct {
+	r          io.Reader
+	compressed *countingReader
+	n          int64
+}
+
+// limitRatio wraps the decompressed stream r of the compressed stream
+// counted by compressed, if -max-decompress-ratio is set
+func limitRatio(r io.Reader, compressed *countingReader) io.Reader {
+	if maxDecompressRatio <= 0 {
+		return r
+	}
+	return &ratioReader{r: r, compressed: compressed}
+}
+
+func (rr *ratioReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.n += int64(n)
+	if rr.n > decompressRatioSlack && float64(rr.n) > maxDecompressRatio*float64(rr.compressed.n) {
+		return n, errDecompressRatio
+	}
+	return n, err
+}
@@ -0,0 +1,88 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRatioReaderStopsEarly(t *testing.T) {
+	saved := maxDecompressRatio
+	maxDecompressRatio = 100
+	defer func() { maxDecompressRatio = saved }()
+
+	// 8MB of zeros compress about a thousand times
+	const size = 8 << 20
+	compressed := &countingReader{r: strings.NewReader(gzipped(strings.Repeat("0", size)))}
+	gz, err := gzip.NewReader(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(io.Discard, limitRatio(gz, compressed))
+	if !errors.Is(err, errDecompressRatio) {
+		t.Fatalf("read %d bytes, %v, want the ratio error", n, err)
+	}
+	// Stopped right after the slack, not at the end
+	if n < decompressRatioSlack || n > 2*decompressRatioSlack {
+		t.Errorf("stopped after %d decompressed bytes", n)
+	}
+
+	maxDecompressRatio = 0
+	if r := limitRatio(gz, compressed); r != io.Reader(gz) {
+		t.Error("reader wrapped with the check disabled")
+	}
+}
+
+func TestDecompressRatioUploads(t *testing.T) {
+	savedRatio, savedBody, savedDecompressed := maxDecompressRatio, maxBodySize, maxDecompressedSize
+	defer func() {
+		maxDecompressRatio, maxBodySize, maxDecompressedSize = savedRatio, savedBody, savedDecompressed
+	}()
+	// Well over the bomb, so only the ratio can stop it
+	maxBodySize, maxDecompressedSize = 8<<20, 8<<20
+
+	bomb := gzipped(`{"v":"` + strings.Repeat("0", 4<<20) + `"}`)
+	small := gzipped(`{"v":"` + strings.Repeat("0", 512<<10) + `"}`)
+	withWriteQueues(t, newInmemBackend(100), func() {
+		for _, tc := range []struct {
+			name   string
+			ratio  float64
+			body   string
+			status int
+		}{
+			{"bomb", 100, bomb, http.StatusRequestEntityTooLarge},
+			{"bomb without the check", 0, bomb, http.StatusAccepted},
+			{"bomb under the ratio", 2000, bomb, http.StatusAccepted},
+			// Small bodies may compress as well as they like
+			{"small", 100, small, http.StatusAccepted},
+		} {
+			maxDecompressRatio = tc.ratio
+			rec := doRequestWithHeader(http.MethodPost, "/v1/collection/ratio", "application/json", tc.body, "Content-Encoding", "gzip")
+			if rec.Code != tc.status {
+				t.Errorf("%s: status %d, want %d: %s", tc.name, rec.Code, tc.status, rec.Body)
+			}
+			if tc.status == http.StatusRequestEntityTooLarge && !strings.Contains(rec.Body.String(), "ratio") {
+				t.Errorf("%s: %s", tc.name, rec.Body)
+			}
+		}
+		drainWrites(context.Background())
+	})
+}
@@ -0,0 +1,162 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// hashLRU remembers the ids of the most recently stored contents, keyed by
+// collection and content hash, so the same content may be stored once in
+// each collection. The least recently seen entries are evicted first.
+type hashLRU struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // of *hashEntry, most recent at the front
+	entries map[hashKey]*list.Element
+}
+
+type hashKey struct {
+	collection string
+	hash       string
+}
+
+type hashEntry struct {
+	hashKey
+	id    string
+	added time.Time
+}
+
+// recentHashes is only set when -reject-duplicates is enabled
+var recentHashes *hashLRU
+
+var (
+	dedupHits   = newCounter("fapi_dedup_hits_total", "Submissions rejected as duplicates of recently stored content.")
+	dedupMisses = newCounter("fapi_dedup_misses_total", "Submissions checked for duplicates and found to be new.")
+	_           = newGaugeFunc("fapi_dedup_tracked_keys", "Number of content hashes currently tracked for duplicate detection.", func() float64 {
+		return float64(recentHashes.len())
+	})
+)
+
+func newHashLRU(size int) *hashLRU {
+	return &hashLRU{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[hashKey]*list.Element),
+	}
+}
+
+// addIfAbsent records hash as stored in collection under id. If the hash is
+// already known for the collection it returns the id it was first stored
+// under and false.
+func (l *hashLRU) addIfAbsent(collection, hash, id string) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := hashKey{collection, hash}
+	if el, ok := l.entries[key]; ok {
+		dedupHits.inc()
+		l.order.MoveToFront(el)
+		return el.Value.(*hashEntry).id, false
+	}
+
+	dedupMisses.inc()
+	l.entries[key] = l.order.PushFront(&hashEntry{hashKey: key, id: id, added: clk.Now()})
+	if l.order.Len() > l.size {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.entries, oldest.Value.(*hashEntry).hashKey)
+	}
+	return id, true
+}
+
+// remove forgets hash in collection, used when a submission could not be
+// enqueued after all
+func (l *hashLRU) remove(collection, hash string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := hashKey{collection, hash}
+	if el, ok := l.entries[key]; ok {
+		l.order.Remove(el)
+		delete(l.entries, key)
+	}
+}
+
+// len returns the number of tracked hashes, 0 for a nil *hashLRU
+func (l *hashLRU) len() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.order.Len()
+}
+
+// trackedKey is a tracked hash as reported by /v1/admin/dedup
+type trackedKey struct {
+	Collection string  `json:"collection"`
+	Hash       string  `json:"hash"`
+	ID         string  `json:"id"`
+	AgeS       float64 `json:"age_s"`
+}
+
+// sample returns up to n tracked hashes, most recently seen first
+func (l *hashLRU) sample(n int) []trackedKey {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := clk.Now()
+	keys := make([]trackedKey, 0, min(n, l.order.Len()))
+	for el := l.order.Front(); el != nil && len(keys) < n; el = el.Next() {
+		e := el.Value.(*hashEntry)
+		keys = append(keys, trackedKey{Collection: e.collection, Hash: e.hash, ID: e.id, AgeS: now.Sub(e.added).Seconds()})
+	}
+	return keys
+}
+
+func handleAdminDedup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET allowed", nil)
+		return
+	}
+	if recentHashes == nil {
+		respondWithError(w, http.StatusNotFound, codeDisabled, "Duplicate detection is disabled", nil)
+		return
+	}
+
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			respondWithError(w, http.StatusBadRequest, codeInvalidParameter, "Invalid limit", err)
+			return
+		}
+		limit = n
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"tracked": recentHashes.len(),
+		"hits":    dedupHits.value.Load(),
+		"misses":  dedupMisses.value.Load(),
+		"keys":    recentHashes.sample(limit),
+	})
+}
@@ -0,0 +1,146 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHashLRUPerCollection(t *testing.T) {
+	l := newHashLRU(2)
+	if _, added := l.addIfAbsent("orders", "h1", "orders/1"); !added {
+		t.Fatal("first hash not added")
+	}
+	if existing, added := l.addIfAbsent("orders", "h1", "orders/2"); added || existing != "orders/1" {
+		t.Errorf("duplicate in the same collection = %q, %v", existing, added)
+	}
+	if _, added := l.addIfAbsent("invoices", "h1", "invoices/1"); !added {
+		t.Error("same content in another collection reported as a duplicate")
+	}
+
+	// The least recently seen key is evicted
+	l.addIfAbsent("orders", "h1", "orders/3")
+	l.addIfAbsent("orders", "h2", "orders/4")
+	if l.len() != 2 {
+		t.Errorf("len = %d, want 2", l.len())
+	}
+	if _, added := l.addIfAbsent("invoices", "h1", "invoices/2"); !added {
+		t.Error("evicted key still tracked")
+	}
+
+	l.remove("orders", "h2")
+	if _, added := l.addIfAbsent("orders", "h2", "orders/5"); !added {
+		t.Error("removed key still tracked")
+	}
+}
+
+func TestDuplicateAcrossCollections(t *testing.T) {
+	saved := recentHashes
+	recentHashes = newHashLRU(10)
+	defer func() { recentHashes = saved }()
+
+	withWriteQueues(t, newInmemBackend(100), func() {
+		for _, tc := range []struct {
+			target string
+			status int
+		}{
+			{"/v1/collection/orders", http.StatusAccepted},
+			{"/v1/collection/invoices", http.StatusAccepted},
+			{"/v1/collection/orders", http.StatusConflict},
+		} {
+			if rec := doRequest(http.MethodPost, tc.target, "application/json", `{"id":1}`); rec.Code != tc.status {
+				t.Errorf("POST %s: status %d, want %d: %s", tc.target, rec.Code, tc.status, rec.Body)
+			}
+		}
+		drainWrites(context.Background())
+	})
+}
+
+func TestDuplicateEvicted(t *testing.T) {
+	saved := recentHashes
+	recentHashes = newHashLRU(1)
+	defer func() { recentHashes = saved }()
+
+	withWriteQueues(t, newInmemBackend(100), func() {
+		for i, tc := range []struct {
+			body   string
+			status int
+		}{
+			{`{"id":1}`, http.StatusAccepted},
+			{`{"id":1}`, http.StatusConflict},
+			{`{"id":2}`, http.StatusAccepted},
+			// Pushed out by the second document, so new again
+			{`{"id":1}`, http.StatusAccepted},
+		} {
+			rec := doRequest(http.MethodPost, "/v1/collection/orders", "application/json", tc.body)
+			if rec.Code != tc.status {
+				t.Errorf("submission %d: status %d, want %d: %s", i+1, rec.Code, tc.status, rec.Body)
+			}
+		}
+		drainWrites(context.Background())
+	})
+}
+
+func TestDedupCounters(t *testing.T) {
+	saved := recentHashes
+	recentHashes = newHashLRU(10)
+	defer func() { recentHashes = saved }()
+	withFakeClock(t, time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC))
+	hits, misses := dedupHits.value.Load(), dedupMisses.value.Load()
+
+	withWriteQueues(t, newInmemBackend(100), func() {
+		for _, body := range []string{`{"id":1}`, `{"id":2}`, `{"id":1}`, `{"id":1}`} {
+			doRequest(http.MethodPost, "/v1/collection/orders", "application/json", body)
+		}
+		drainWrites(context.Background())
+	})
+	if got := dedupHits.value.Load() - hits; got != 2 {
+		t.Errorf("%d hits, want 2", got)
+	}
+	if got := dedupMisses.value.Load() - misses; got != 2 {
+		t.Errorf("%d misses, want 2", got)
+	}
+	if got := metricValue(t, "fapi_dedup_tracked_keys"); got != "2" {
+		t.Errorf("fapi_dedup_tracked_keys = %s, want 2", got)
+	}
+
+	clk.(*fakeClock).Advance(90 * time.Second)
+	rec := adminRequest(t, handleAdminDedup, http.MethodGet, "/v1/admin/dedup?limit=1")
+	var resp struct {
+		Tracked int          `json:"tracked"`
+		Hits    uint64       `json:"hits"`
+		Keys    []trackedKey `json:"keys"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); rec.Code != http.StatusOK || err != nil {
+		t.Fatalf("status %d, %v: %s", rec.Code, err, rec.Body)
+	}
+	// The most recently seen key is {"id":1}
+	if resp.Tracked != 2 || len(resp.Keys) != 1 || resp.Keys[0].Collection != "orders" || resp.Keys[0].Hash != contentHash([]byte(`{"id":1}`)) || resp.Keys[0].AgeS != 90 {
+		t.Errorf("dedup response %+v", resp)
+	}
+}
+
+func TestAdminDedupDisabled(t *testing.T) {
+	saved := recentHashes
+	recentHashes = nil
+	defer func() { recentHashes = saved }()
+	if rec := adminRequest(t, handleAdminDedup, http.MethodGet, "/v1/admin/dedup"); rec.Code != http.StatusNotFound {
+		t.Errorf("status %d, want 404", rec.Code)
+	}
+}
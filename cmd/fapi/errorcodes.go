@@ -0,0 +1,64 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// errorCode is the machine readable cause of an error response, sent as the
+// "code" field next to the human readable "error" message
+type errorCode string
+
+const (
+	codeAdminDisabled        errorCode = "admin_disabled"
+	codeUnauthorized         errorCode = "unauthorized"
+	codeMethodNotAllowed     errorCode = "method_not_allowed"
+	codeSelfTestFailed       errorCode = "selftest_failed"
+	codeDisabled             errorCode = "disabled"
+	codeInvalidParameter     errorCode = "invalid_parameter"
+	codeURITooLong           errorCode = "uri_too_long"
+	codeInvalidCollection    errorCode = "invalid_collection"
+	codeCollectionNotAllowed errorCode = "collection_not_allowed"
+	codeInvalidCallback      errorCode = "invalid_callback"
+	codeCallbackNotAllowed   errorCode = "callback_not_allowed"
+	codeTooManyCollections   errorCode = "too_many_collections"
+	codeMissingEventTime     errorCode = "missing_event_time"
+	codeInvalidEventTime     errorCode = "invalid_event_time"
+	codeClockSkew            errorCode = "clock_skew"
+	codeNotReady             errorCode = "not_ready"
+	codeReadOnly             errorCode = "read_only"
+	codeMissingContentType   errorCode = "missing_content_type"
+	codeBodyTooLarge         errorCode = "body_too_large"
+	codeInvalidGzip          errorCode = "invalid_gzip"
+	codeReadFailed           errorCode = "read_failed"
+	codeRequestTimeout       errorCode = "request_timeout"
+	codeUnsupportedCharset   errorCode = "unsupported_charset"
+	codeInvalidCharset       errorCode = "invalid_charset"
+	codeTransformFailed      errorCode = "transform_failed"
+	codeTransformTimeout     errorCode = "transform_timeout"
+	codeEmptyBody            errorCode = "empty_body"
+	codeInvalidJSON          errorCode = "invalid_json"
+	codeJSONTooDeep          errorCode = "json_too_deep"
+	codeSchemaViolation      errorCode = "schema_violation"
+	codeNoSchema             errorCode = "no_schema"
+	codeInvalidContent       errorCode = "invalid_content"
+	codeInvalidExtension     errorCode = "invalid_extension"
+	codeDuplicate            errorCode = "duplicate"
+	codeQueueFull            errorCode = "queue_full"
+	codeWriteFailed          errorCode = "write_failed"
+	codeInflightLimit        errorCode = "inflight_limit"
+	codeMissingChunks        errorCode = "missing_chunks"
+	codeQuotaExceeded        errorCode = "quota_exceeded"
+	codeInvalidID            errorCode = "invalid_id"
+	codeNotFound             errorCode = "not_found"
+	codeInternal             errorCode = "internal_error"
+)
@@ -0,0 +1,72 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestErrorCodes(t *testing.T) {
+	savedBody, savedDepth, savedEmpty := maxBodySize, maxJSONDepth, rejectEmpty
+	maxBodySize, maxJSONDepth, rejectEmpty = 64, 2, true
+	defer func() { maxBodySize, maxJSONDepth, rejectEmpty = savedBody, savedDepth, savedEmpty }()
+
+	withWriteQueues(t, newInmemBackend(100), func() {
+		for _, tc := range []struct {
+			name                              string
+			method, target, contentType, body string
+			header, value                     string
+			status                            int
+			code                              errorCode
+		}{
+			{"body too large", http.MethodPost, "/v1/collection/codes", "application/json", strings.Repeat("a", 65), "", "", http.StatusRequestEntityTooLarge, codeBodyTooLarge},
+			{"invalid gzip", http.MethodPost, "/v1/collection/codes", "application/json", "not gzip", "Content-Encoding", "gzip", http.StatusBadRequest, codeInvalidGzip},
+			{"empty body", http.MethodPost, "/v1/collection/codes", "application/json", "", "", "", http.StatusBadRequest, codeEmptyBody},
+			{"JSON too deep", http.MethodPost, "/v1/collection/codes", "application/json", "[[[1]]]", "", "", http.StatusUnprocessableEntity, codeJSONTooDeep},
+			{"method not allowed", "TRACE", "/v1/collection/codes/1.json", "", "", "", "", http.StatusMethodNotAllowed, codeMethodNotAllowed},
+			{"not found", http.MethodGet, "/v1/collection/codes/missing.json", "", "", "", "", http.StatusNotFound, codeNotFound},
+		} {
+			rec := doRequestWithHeader(tc.method, tc.target, tc.contentType, tc.body, tc.header, tc.value)
+			var resp struct {
+				Error string    `json:"error"`
+				Code  errorCode `json:"code"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Errorf("%s: status %d, not an error response: %s", tc.name, rec.Code, rec.Body)
+				continue
+			}
+			if rec.Code != tc.status || resp.Code != tc.code || resp.Error == "" {
+				t.Errorf("%s: status %d, %+v, want %d with code %s", tc.name, rec.Code, resp, tc.status, tc.code)
+			}
+		}
+		drainWrites(context.Background())
+	})
+}
+
+func TestQueueFullCode(t *testing.T) {
+	saved := writeQueues
+	defer func() { writeQueues = saved }()
+	// No worker takes the write off the queue
+	writeQueues = []chan writeRequest{make(chan writeRequest)}
+
+	rec := doRequest(http.MethodPost, "/v1/collection/codes", "application/json", "{}")
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), `"code":"queue_full"`) {
+		t.Errorf("status %d: %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// eventTimeOf returns the event time of r when -max-clock-skew is set, and
+// the zero time otherwise. On failure the error response has already been
+// sent.
+func eventTimeOf(w http.ResponseWriter, r *http.Request) (time.Time, bool) {
+	if maxClockSkew == 0 {
+		return time.Time{}, true
+	}
+	t, code, msg := checkEventTime(r)
+	if msg != "" {
+		respondWithError(w, http.StatusBadRequest, code, msg, nil)
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// checkEventTime parses the -event-time-header of r and checks it's within
+// -max-clock-skew of our clock. On failure it returns the error code and
+// message to send back to the client.
+func checkEventTime(r *http.Request) (time.Time, errorCode, string) {
+	value := r.Header.Get(eventTimeHeader)
+	if value == "" {
+		return time.Time{}, codeMissingEventTime, "Missing " + eventTimeHeader + " header"
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		if t, err = http.ParseTime(value); err != nil {
+			return time.Time{}, codeInvalidEventTime, "Invalid " + eventTimeHeader + " header"
+		}
+	}
+
+	skew := clk.Now().Sub(t)
+	switch {
+	case skew > maxClockSkew:
+		return time.Time{}, codeClockSkew, fmt.Sprintf("Event time is more than %s in the past", maxClockSkew)
+	case skew < -maxClockSkew:
+		return time.Time{}, codeClockSkew, fmt.Sprintf("Event time is more than %s in the future", maxClockSkew)
+	}
+	return t.UTC(), "", ""
+}
@@ -0,0 +1,147 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// withClockSkew runs the test with -max-clock-skew set to skew
+func withClockSkew(t *testing.T, skew time.Duration) {
+	t.Helper()
+	saved := maxClockSkew
+	maxClockSkew = skew
+	t.Cleanup(func() { maxClockSkew = saved })
+}
+
+func eventRequest(value string) *http.Request {
+	r, _ := http.NewRequest(http.MethodPost, "/v1/collection/events", nil)
+	if value != "" {
+		r.Header.Set(eventTimeHeader, value)
+	}
+	return r
+}
+
+func TestCheckEventTime(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	withFakeClock(t, now)
+	withClockSkew(t, 5*time.Minute)
+
+	for _, tc := range []struct {
+		name  string
+		value string
+		code  errorCode
+	}{
+		{"in window", now.Add(-4 * time.Minute).Format(time.RFC3339), ""},
+		{"in window, HTTP date", now.Add(time.Minute).Format(http.TimeFormat), ""},
+		{"too old", now.Add(-6 * time.Minute).Format(time.RFC3339), codeClockSkew},
+		{"future dated", now.Add(6 * time.Minute).Format(time.RFC3339Nano), codeClockSkew},
+		{"missing", "", codeMissingEventTime},
+		{"invalid", "yesterday", codeInvalidEventTime},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, code, _ := checkEventTime(eventRequest(tc.value))
+			if code != tc.code {
+				t.Fatalf("code = %q, want %q", code, tc.code)
+			}
+			if code == "" && got.Location() != time.UTC {
+				t.Errorf("event time %v not in UTC", got)
+			}
+		})
+	}
+}
+
+func TestEventTimeStored(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	withClockSkew(t, time.Minute)
+	backend := newInmemBackend(100)
+	withWriteQueues(t, backend, func() {
+		for _, tc := range []struct {
+			method, target string
+		}{
+			{http.MethodPut, "/v1/collection/events/put.json"},
+			{http.MethodPatch, "/v1/collection/events/patch.json"},
+		} {
+			rec := doRequestWithHeader(tc.method, tc.target, "application/json", `{"a":1}`, eventTimeHeader, now.Format(time.RFC3339))
+			if rec.Code >= 300 {
+				t.Fatalf("%s %s: status %d: %s", tc.method, tc.target, rec.Code, rec.Body)
+			}
+		}
+		// Rejected on every path when too old
+		old := now.Add(-time.Hour).Format(time.RFC3339)
+		for _, tc := range []struct {
+			method, target string
+		}{
+			{http.MethodPost, "/v1/collection/events"},
+			{http.MethodPut, "/v1/collection/events/old.json"},
+			{http.MethodPatch, "/v1/collection/events/old.json"},
+			{http.MethodPost, "/v1/collection/events/stream"},
+			{http.MethodPost, "/v1/collection/events/old.json/chunks/0"},
+			{http.MethodPost, "/v1/collection/events/old.json/complete"},
+		} {
+			rec := doRequestWithHeader(tc.method, tc.target, "application/json", `{"a":1}`, eventTimeHeader, old)
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("%s %s with a stale event time: status %d, want 400", tc.method, tc.target, rec.Code)
+			}
+		}
+		drainWrites(context.Background())
+
+		for _, id := range []string{"events/put.json", "events/patch.json"} {
+			rec := doRequest(http.MethodGet, "/v1/collection/"+id+"/meta", "", "")
+			var meta storedMeta
+			if err := json.Unmarshal(rec.Body.Bytes(), &meta); err != nil {
+				t.Fatalf("%s: %v: %s", id, err, rec.Body)
+			}
+			if meta.EventTime == nil || !meta.EventTime.Equal(now) {
+				t.Errorf("%s: event time %v, want %v", id, meta.EventTime, now)
+			}
+		}
+	})
+}
+
+func TestEventTimeXattr(t *testing.T) {
+	backend, err := newFSBackend([]string{t.TempDir()}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Store(context.Background(), "events/x.json", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	if err := backend.SetEventTime("events/x.json", now); err != nil {
+		t.Skipf("extended attributes not supported: %v", err)
+	}
+	f, info, err := backend.Open("events/x.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if !info.EventTime.Equal(now) {
+		t.Errorf("event time %v, want %v", info.EventTime, now)
+	}
+
+	if err := backend.SetEventTime("events/x.json", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	f, info, _ = backend.Open("events/x.json")
+	f.Close()
+	if !info.EventTime.IsZero() {
+		t.Errorf("event time %v not removed", info.EventTime)
+	}
+}
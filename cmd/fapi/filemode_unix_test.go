@@ -0,0 +1,60 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestFileModeIgnoresUmask(t *testing.T) {
+	savedMode := fileMode
+	defer func() { fileMode = savedMode }()
+	// A umask that would clear all the group and other bits
+	defer syscall.Umask(syscall.Umask(0077))
+
+	dir := t.TempDir()
+	for _, mode := range []os.FileMode{0666, 0640, 0600} {
+		fileMode = mode
+		path := filepath.Join(dir, "new.json")
+		_ = os.Remove(path)
+		if err := writeToFile(context.Background(), []byte("{}"), path, false); err != nil {
+			t.Fatal(err)
+		}
+		// Appending to an existing file sets its mode too
+		appended := filepath.Join(dir, "existing.ndjson")
+		if err := os.WriteFile(appended, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := appendToFile(context.Background(), []byte("{}\n"), appended, false); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, p := range []string{path, appended} {
+			info, err := os.Stat(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != mode {
+				t.Errorf("%s has mode %o, want %o", filepath.Base(p), info.Mode().Perm(), mode)
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"net/http"
+)
+
+// Hasher computes the content digests used for duplicate detection, the
+// hash id scheme and the checksums returned to clients
+type Hasher interface {
+	// Name is the algorithm, as given to -hash-algo
+	Name() string
+	// New returns a new hash.Hash computing the digest
+	New() hash.Hash
+}
+
+type stdHasher struct {
+	name string
+	new  func() hash.Hash
+}
+
+func (h stdHasher) Name() string   { return h.name }
+func (h stdHasher) New() hash.Hash { return h.new() }
+
+// hashers are the algorithms -hash-algo accepts. fnv128a is much cheaper but
+// not collision resistant, only use it when clients can't be adversarial.
+var hashers = map[string]Hasher{
+	"sha256":  stdHasher{"sha256", sha256.New},
+	"sha512":  stdHasher{"sha512", sha512.New},
+	"fnv128a": stdHasher{"fnv128a", fnv.New128a},
+}
+
+// contentHasher is the algorithm selected with -hash-algo
+var contentHasher = hashers["sha256"]
+
+func newHasher(name string) (Hasher, error) {
+	h, ok := hashers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash algorithm %q", name)
+	}
+	return h, nil
+}
+
+// contentHash returns the hex encoded digest of data
+func contentHash(data []byte) string {
+	h := contentHasher.New()
+	_, _ = h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// setContentHash sets the X-Content-Hash header to the digest of the stored
+// content, prefixed with the algorithm
+func setContentHash(w http.ResponseWriter, hash string) {
+	w.Header().Set("X-Content-Hash", contentHasher.Name()+":"+hash)
+}
@@ -0,0 +1,87 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestHashers(t *testing.T) {
+	saved := contentHasher
+	defer func() { contentHasher = saved }()
+
+	for _, tc := range []struct {
+		algo, data, digest string
+	}{
+		{"sha256", "", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{"sha256", "abc", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{"sha512", "abc", "ddaf35a193617abacc417349ae20413112e6fa4e89a97ea20a9eeee64b55d39a2192992a274fc1a836ba3c23a3feebbd454d4423643ce80e2a9ac94fa54ca49f"},
+		// The FNV-128 offset basis
+		{"fnv128a", "", "6c62272e07bb014262b821756295c58d"},
+	} {
+		h, err := newHasher(tc.algo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contentHasher = h
+		if h.Name() != tc.algo {
+			t.Errorf("%s: Name() = %q", tc.algo, h.Name())
+		}
+		// Every call starts from scratch
+		for i := 0; i < 2; i++ {
+			if got := contentHash([]byte(tc.data)); got != tc.digest {
+				t.Errorf("%s(%q) = %s, want %s", tc.algo, tc.data, got, tc.digest)
+			}
+		}
+	}
+
+	// Every algorithm gives distinct digests for distinct content
+	for name, h := range hashers {
+		contentHasher = h
+		if contentHash([]byte("a")) == contentHash([]byte("b")) {
+			t.Errorf("%s: same digest for a and b", name)
+		}
+	}
+
+	for _, name := range []string{"md5", "SHA256", ""} {
+		if _, err := newHasher(name); err == nil {
+			t.Errorf("newHasher(%q) succeeded", name)
+		}
+	}
+}
+
+func TestContentHashHeader(t *testing.T) {
+	saved := contentHasher
+	defer func() { contentHasher = saved }()
+
+	for name, h := range hashers {
+		contentHasher = h
+		withWriteQueues(t, newInmemBackend(100), func() {
+			want := name + ":" + contentHash([]byte(`{"id":1}`))
+			for _, tc := range []struct{ method, target string }{
+				{http.MethodPost, "/v1/collection/orders"},
+				{http.MethodPut, "/v1/collection/orders/1.json"},
+			} {
+				rec := doRequest(tc.method, tc.target, "application/json", `{"id":1}`)
+				if got := rec.Header().Get("X-Content-Hash"); got != want {
+					t.Errorf("%s %s: X-Content-Hash %q, want %q", tc.method, tc.target, got, want)
+				}
+			}
+			drainWrites(context.Background())
+		})
+	}
+}
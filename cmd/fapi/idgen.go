@@ -0,0 +1,137 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	mrand "math/rand"
+	"sync"
+)
+
+// IDGenerator picks the file names new uploads are stored under
+type IDGenerator interface {
+	// NewName returns a file name, without extension, for an upload of data
+	// sent from ip
+	NewName(ip string, data []byte) string
+}
+
+// idGenerator is the generator selected with -id-scheme
+var idGenerator IDGenerator = ipTimeIDs{}
+
+func newIDGenerator(scheme string) (IDGenerator, error) {
+	switch scheme {
+	case "ip-time":
+		return ipTimeIDs{}, nil
+	case "ulid":
+		return &ulidIDs{}, nil
+	case "uuidv7":
+		return uuidV7IDs{}, nil
+	case "hash":
+		return hashIDs{}, nil
+	default:
+		return nil, fmt.Errorf("unknown id-scheme %q", scheme)
+	}
+}
+
+// ipTimeIDs names files after the client IP and the current time. With
+// -sequence the name starts with the sequence number instead, so sorting
+// names gives the arrival order.
+type ipTimeIDs struct{}
+
+func (ipTimeIDs) NewName(ip string, _ []byte) string {
+	timestamp := clk.Now().UTC().Format("2006-01-02-15_04_05.000000000")
+	if useSequence {
+		return fmt.Sprintf("%020d-%s-%s", fileSequence.next(), ip, timestamp)
+	}
+	return fmt.Sprintf("%s-%s-%d", ip, timestamp, mrand.Intn(10000))
+}
+
+// crockford is the base32 alphabet of ULIDs
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulidIDs generates ULIDs: a millisecond timestamp followed by 80 random
+// bits. Within the same millisecond the random part is incremented, so names
+// sort in generation order.
+type ulidIDs struct {
+	mu      sync.Mutex
+	lastMs  uint64
+	entropy [10]byte
+}
+
+func (g *ulidIDs) NewName(string, []byte) string {
+	g.mu.Lock()
+	ms := uint64(clk.Now().UnixMilli())
+	if ms <= g.lastMs {
+		ms = g.lastMs
+		incrementBytes(g.entropy[:])
+	} else {
+		g.lastMs = ms
+		_, _ = rand.Read(g.entropy[:])
+	}
+	var id [16]byte
+	binary.BigEndian.PutUint64(id[:8], ms<<16)
+	copy(id[6:], g.entropy[:])
+	g.mu.Unlock()
+
+	return encodeCrockford(id)
+}
+
+// incrementBytes adds one to b read as a big-endian number
+func incrementBytes(b []byte) {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return
+		}
+	}
+}
+
+// encodeCrockford encodes the 128 bits of id as 26 base32 characters, the
+// first one only holding the 3 top bits
+func encodeCrockford(id [16]byte) string {
+	hi := binary.BigEndian.Uint64(id[:8])
+	lo := binary.BigEndian.Uint64(id[8:])
+	var out [26]byte
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+// uuidV7IDs generates version 7 UUIDs, which start with a millisecond
+// timestamp and so sort roughly by time
+type uuidV7IDs struct{}
+
+func (uuidV7IDs) NewName(string, []byte) string {
+	var u [16]byte
+	_, _ = rand.Read(u[6:])
+	ms := uint64(clk.Now().UnixMilli())
+	binary.BigEndian.PutUint64(u[:8], ms<<16|uint64(binary.BigEndian.Uint16(u[6:8])))
+	u[6] = u[6]&0x0f | 0x70 // version 7
+	u[8] = u[8]&0x3f | 0x80 // RFC 9562 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+// hashIDs names files after the -hash-algo digest of their content, so the same
+// content is always stored under the same name
+type hashIDs struct{}
+
+func (hashIDs) NewName(_ string, data []byte) string {
+	return contentHash(data)
+}
@@ -0,0 +1,115 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewIDGenerator(t *testing.T) {
+	for scheme, want := range map[string]IDGenerator{
+		"ip-time": ipTimeIDs{},
+		"ulid":    &ulidIDs{},
+		"uuidv7":  uuidV7IDs{},
+		"hash":    hashIDs{},
+	} {
+		gen, err := newIDGenerator(scheme)
+		if err != nil || fmt.Sprintf("%T", gen) != fmt.Sprintf("%T", want) {
+			t.Errorf("newIDGenerator(%q) = %T, %v, want a %T", scheme, gen, err, want)
+		}
+	}
+	if _, err := newIDGenerator("random"); err == nil {
+		t.Error("unknown scheme accepted")
+	}
+}
+
+func TestIDFormats(t *testing.T) {
+	for _, tc := range []struct {
+		gen    IDGenerator
+		format string
+	}{
+		{ipTimeIDs{}, `^192\.0\.2\.1-\d{4}-\d{2}-\d{2}-\d{2}_\d{2}_\d{2}\.\d{9}-\d{1,4}$`},
+		// The first character only holds 3 bits
+		{&ulidIDs{}, `^[0-7][0-9A-HJKMNP-TV-Z]{25}$`},
+		{uuidV7IDs{}, `^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`},
+		{hashIDs{}, `^[0-9a-f]{64}$`},
+	} {
+		re := regexp.MustCompile(tc.format)
+		const names = 1000
+		seen := make(map[string]bool, names)
+		for i := 0; i < names; i++ {
+			name := tc.gen.NewName("192.0.2.1", []byte(fmt.Sprint(i)))
+			if !re.MatchString(name) {
+				t.Fatalf("%T: %q doesn't match %s", tc.gen, name, tc.format)
+			}
+			if seen[name] {
+				t.Fatalf("%T: %q generated twice", tc.gen, name)
+			}
+			seen[name] = true
+		}
+	}
+}
+
+func TestULIDOrder(t *testing.T) {
+	c := withFakeClock(t, time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC))
+	gen := &ulidIDs{}
+	last := ""
+	for i := 0; i < 100; i++ {
+		// Several names within the same millisecond still sort in order
+		if i%10 == 0 {
+			c.Advance(time.Millisecond)
+		}
+		name := gen.NewName("", nil)
+		if name <= last {
+			t.Fatalf("%s generated after %s", name, last)
+		}
+		last = name
+	}
+	// The first 10 characters are the 48 bits of the timestamp
+	var ms int64
+	for _, c := range last[:10] {
+		ms = ms<<5 | int64(strings.IndexRune(crockford, c))
+	}
+	if want := clk.Now().UnixMilli(); ms != want {
+		t.Errorf("timestamp %d, want %d", ms, want)
+	}
+}
+
+func TestEncodeCrockford(t *testing.T) {
+	var zero, ones [16]byte
+	for i := range ones {
+		ones[i] = 0xff
+	}
+	if got := encodeCrockford(zero); got != strings.Repeat("0", 26) {
+		t.Errorf("encodeCrockford(0) = %s", got)
+	}
+	if got := encodeCrockford(ones); got != "7"+strings.Repeat("Z", 25) {
+		t.Errorf("encodeCrockford(max) = %s", got)
+	}
+}
+
+func TestHashIDsStable(t *testing.T) {
+	gen := hashIDs{}
+	if a, b := gen.NewName("192.0.2.1", []byte("{}")), gen.NewName("192.0.2.2", []byte("{}")); a != b {
+		t.Errorf("same content named %s and %s", a, b)
+	}
+	if a, b := gen.NewName("", []byte("{}")), gen.NewName("", []byte("[]")); a == b {
+		t.Errorf("different content both named %s", a)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// inflightBytes is the total size of the request bodies currently admitted
+var inflightBytes atomic.Int64
+
+var _ = newGaugeFunc("fapi_inflight_bytes", "Total size of the request bodies currently being handled.", func() float64 {
+	return float64(inflightBytes.Load())
+})
+
+// withInflightBytes rejects requests whose body would push the total size of
+// the bodies being handled over -max-inflight-bytes. The size is taken from
+// Content-Length, or assumed to be the largest allowed when it's unknown.
+func withInflightBytes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if maxInflightBytes <= 0 || r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		n := r.ContentLength
+		if n < 0 {
+			n = bodySizeLimit(r.Header.Get("Content-Encoding") == "gzip")
+		}
+		// Bodies over the size limits are rejected before they are read
+		n = min(n, max(maxBodySize, maxGzipBodySize))
+
+		if inflightBytes.Add(n) > maxInflightBytes {
+			inflightBytes.Add(-n)
+			w.Header().Set("Retry-After", retryAfterHeader())
+			respondWithError(w, http.StatusServiceUnavailable, codeInflightLimit, "Too much data in flight", nil)
+			return
+		}
+		defer inflightBytes.Add(-n)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,75 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInflightBytes(t *testing.T) {
+	savedMax, savedBody, savedGzip := maxInflightBytes, maxBodySize, maxGzipBodySize
+	maxInflightBytes, maxBodySize, maxGzipBodySize = 1000, 600, 600
+	defer func() { maxInflightBytes, maxBodySize, maxGzipBodySize = savedMax, savedBody, savedGzip }()
+
+	entered, release := make(chan struct{}), make(chan struct{})
+	handler := withInflightBytes(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/held" {
+			entered <- struct{}{}
+			<-release
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	serve := func(path string, size int, known bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(strings.Repeat("a", size)))
+		if !known {
+			r.Body = io.NopCloser(r.Body)
+			r.ContentLength = -1
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec
+	}
+
+	held := make(chan *httptest.ResponseRecorder)
+	go func() { held <- serve("/held", 600, true) }()
+	<-entered
+
+	// 600 bytes of the budget are taken
+	if rec := serve("/", 500, true); rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" || !strings.Contains(rec.Body.String(), string(codeInflightLimit)) {
+		t.Errorf("over the budget: status %d, Retry-After %q: %s", rec.Code, rec.Header().Get("Retry-After"), rec.Body)
+	}
+	if rec := serve("/", 400, true); rec.Code != http.StatusAccepted {
+		t.Errorf("within the budget: status %d", rec.Code)
+	}
+	// Without a Content-Length the body counts as the largest allowed
+	if rec := serve("/", 10, false); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("unknown size over the budget: status %d", rec.Code)
+	}
+
+	close(release)
+	if rec := <-held; rec.Code != http.StatusAccepted {
+		t.Errorf("held request: status %d", rec.Code)
+	}
+	if n := inflightBytes.Load(); n != 0 {
+		t.Errorf("%d bytes still in flight", n)
+	}
+	if rec := serve("/", 10, false); rec.Code != http.StatusAccepted {
+		t.Errorf("unknown size once released: status %d", rec.Code)
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// inmemBackend keeps stored files in memory, for tests and ephemeral
+// deployments. Once maxEntries is reached the oldest entries are evicted.
+type inmemBackend struct {
+	maxEntries int
+
+	mu      sync.RWMutex
+	order   *list.List // of *inmemEntry, oldest at the front
+	entries map[string]*list.Element
+}
+
+type inmemEntry struct {
+	id   string
+	data []byte
+	info storedInfo
+}
+
+func newInmemBackend(maxEntries int) *inmemBackend {
+	return &inmemBackend{
+		maxEntries: maxEntries,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+func (b *inmemBackend) Store(ctx context.Context, id string, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.put(id, data)
+	return nil
+}
+
+func (b *inmemBackend) StoreFile(ctx context.Context, id, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return b.Store(ctx, id, data)
+}
+
+func (b *inmemBackend) SetEventTime(id string, t time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	el, ok := b.entries[id]
+	if !ok {
+		return fmt.Errorf("%s: %w", id, os.ErrNotExist)
+	}
+	el.Value.(*inmemEntry).info.EventTime = t
+	return nil
+}
+
+func (b *inmemBackend) Append(ctx context.Context, id string, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if el, ok := b.entries[id]; ok {
+		prev := el.Value.(*inmemEntry).data
+		// Copy, readers may still hold the previous slice
+		data = append(append(make([]byte, 0, len(prev)+len(data)), prev...), data...)
+	}
+	b.put(id, data)
+	return nil
+}
+
+// put stores data under id as the newest entry, evicting the oldest ones if
+// needed. Must be called with mu held.
+func (b *inmemBackend) put(id string, data []byte) {
+	e := &inmemEntry{
+		id:   id,
+		data: data,
+		info: storedInfo{Size: int64(len(data)), ModTime: clk.Now()},
+	}
+	if el, ok := b.entries[id]; ok {
+		b.order.Remove(el)
+	}
+	b.entries[id] = b.order.PushBack(e)
+	for b.order.Len() > b.maxEntries {
+		oldest := b.order.Front()
+		b.order.Remove(oldest)
+		delete(b.entries, oldest.Value.(*inmemEntry).id)
+	}
+}
+
+func (b *inmemBackend) Open(id string) (io.ReadSeekCloser, storedInfo, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	el, ok := b.entries[id]
+	if !ok {
+		return nil, storedInfo{}, fmt.Errorf("%s: %w", id, os.ErrNotExist)
+	}
+	e := el.Value.(*inmemEntry)
+	return nopCloser{bytes.NewReader(e.data)}, e.info, nil
+}
+
+func (b *inmemBackend) Delete(id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	el, ok := b.entries[id]
+	if !ok {
+		return fmt.Errorf("%s: %w", id, os.ErrNotExist)
+	}
+	b.order.Remove(el)
+	delete(b.entries, id)
+	return nil
+}
+
+func (b *inmemBackend) Cleanup(before time.Time, collection string) (cleanupResult, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var res cleanupResult
+	for id, el := range b.entries {
+		e := el.Value.(*inmemEntry)
+		if collection != "" && !strings.HasPrefix(id, collection+"/") {
+			continue
+		}
+		if !e.info.ModTime.Before(before) {
+			continue
+		}
+		b.order.Remove(el)
+		delete(b.entries, id)
+		res.Removed++
+		res.Bytes += e.info.Size
+	}
+	return res, nil
+}
+
+func (b *inmemBackend) List(collection string, fn func(id string, info storedInfo) error) error {
+	// fn may take its time, so it's called on a snapshot
+	b.mu.RLock()
+	var entries []*inmemEntry
+	for id, el := range b.entries {
+		if collection == "" || strings.HasPrefix(id, collection+"/") {
+			entries = append(entries, el.Value.(*inmemEntry))
+		}
+	}
+	b.mu.RUnlock()
+
+	for _, e := range entries {
+		if err := fn(e.id, e.info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *inmemBackend) Collections() ([]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	var names []string
+	for id := range b.entries {
+		if name, _, ok := strings.Cut(id, "/"); ok && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (b *inmemBackend) Check() error {
+	return nil
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
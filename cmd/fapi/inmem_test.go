@@ -0,0 +1,95 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestInmemStoreRetrieve(t *testing.T) {
+	b := newInmemBackend(10)
+	ctx := context.Background()
+	if err := b.Store(ctx, "orders/1.json", []byte(`{"id":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if got := readStored(t, b, "orders/1.json"); got != `{"id":1}` {
+		t.Errorf("stored %q", got)
+	}
+	// Overwrite and append
+	if err := b.Store(ctx, "orders/1.json", []byte("a\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Append(ctx, "orders/1.json", []byte("b\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readStored(t, b, "orders/1.json"); got != "a\nb\n" {
+		t.Errorf("after append %q", got)
+	}
+
+	if _, _, err := b.Open("orders/2.json"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Open of a missing id: %v, want not exist", err)
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := b.Store(cancelled, "orders/3.json", nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("Store with a cancelled context: %v", err)
+	}
+}
+
+func TestInmemEviction(t *testing.T) {
+	b := newInmemBackend(2)
+	ctx := context.Background()
+	for _, id := range []string{"a", "b", "c"} {
+		if err := b.Store(ctx, id, []byte(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := b.Open("a"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("oldest entry not evicted: %v", err)
+	}
+	for _, id := range []string{"b", "c"} {
+		if got := readStored(t, b, id); got != id {
+			t.Errorf("%s = %q", id, got)
+		}
+	}
+
+	// Rewriting an entry makes it the newest
+	_ = b.Store(ctx, "b", []byte("b2"))
+	_ = b.Store(ctx, "d", []byte("d"))
+	if _, _, err := b.Open("c"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("c not evicted after b was rewritten: %v", err)
+	}
+	if got := readStored(t, b, "b"); got != "b2" {
+		t.Errorf("b = %q", got)
+	}
+}
+
+func TestInmemServesDownloads(t *testing.T) {
+	backend := newInmemBackend(100)
+	withWriteQueues(t, backend, func() {
+		rec := doRequest(http.MethodPost, "/v1/collection/orders", "application/json", `{"id":1}`)
+		drainWrites(context.Background())
+
+		location := rec.Header().Get("Location")
+		rec = doRequest(http.MethodGet, location, "", "")
+		if rec.Code != http.StatusOK || rec.Body.String() != `{"id":1}` {
+			t.Errorf("GET %s: status %d: %q", location, rec.Code, rec.Body)
+		}
+	})
+}
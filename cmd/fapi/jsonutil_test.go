@@ -0,0 +1,101 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCanonicalizeJSON(t *testing.T) {
+	got, err := canonicalizeJSON([]byte(`{"b":1,"a":{"d":12345678901234567890.5,"c":"<x>"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Sorted keys, indented, numbers and characters kept as sent
+	want := "{\n  \"a\": {\n    \"c\": \"<x>\",\n    \"d\": 12345678901234567890.5\n  },\n  \"b\": 1\n}\n"
+	if string(got) != want {
+		t.Errorf("canonicalizeJSON = %q, want %q", got, want)
+	}
+	if _, err := canonicalizeJSON([]byte(`{"a":`)); err == nil {
+		t.Error("invalid JSON canonicalized")
+	}
+}
+
+func TestCanonicalizeOnStore(t *testing.T) {
+	saved := canonicalJSON
+	canonicalJSON = true
+	defer func() { canonicalJSON = saved }()
+
+	backend := newInmemBackend(100)
+	withWriteQueues(t, backend, func() {
+		doRequest(http.MethodPost, "/v1/collection/valid", "application/json", `{"z":1,"a":2}`)
+		doRequest(http.MethodPost, "/v1/collection/invalid", "application/json", `{"z":1,"a":`)
+		drainWrites(context.Background())
+
+		if got := readStored(t, backend, firstStored(backend, "valid")); got != "{\n  \"a\": 2,\n  \"z\": 1\n}\n" {
+			t.Errorf("valid JSON stored as %q", got)
+		}
+		id := firstStored(backend, "invalid")
+		if !strings.HasSuffix(id, ".txt") {
+			t.Errorf("invalid JSON stored as %s, want a .txt", id)
+		}
+		if got := readStored(t, backend, id); got != `{"z":1,"a":` {
+			t.Errorf("invalid JSON stored as %q, want it untouched", got)
+		}
+	})
+}
+
+func nested(depth int) string {
+	return strings.Repeat(`{"a":[`, depth/2) + strings.Repeat(`{}`, depth%2) + strings.Repeat(`]}`, depth/2)
+}
+
+func TestExceedsDepth(t *testing.T) {
+	for _, tc := range []struct {
+		doc   string
+		limit int
+		want  bool
+	}{
+		{`1`, 1, false},
+		{`{}`, 1, false},
+		{`[[]]`, 1, true},
+		{nested(10), 10, false},
+		{nested(11), 10, true},
+		{`[{},{},[]]`, 2, false},
+	} {
+		if got := exceedsDepth([]byte(tc.doc), tc.limit); got != tc.want {
+			t.Errorf("exceedsDepth(%s, %d) = %v, want %v", tc.doc, tc.limit, got, tc.want)
+		}
+	}
+}
+
+func TestMaxJSONDepth(t *testing.T) {
+	saved := maxJSONDepth
+	maxJSONDepth = 10
+	defer func() { maxJSONDepth = saved }()
+
+	withWriteQueues(t, newInmemBackend(100), func() {
+		if rec := doRequest(http.MethodPost, "/v1/collection/depth", "application/json", nested(10)); rec.Code != http.StatusAccepted {
+			t.Errorf("at the limit: status %d, want 202: %s", rec.Code, rec.Body)
+		}
+		rec := doRequest(http.MethodPost, "/v1/collection/depth", "application/json", nested(11))
+		if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), string(codeJSONTooDeep)) {
+			t.Errorf("over the limit: status %d, want 422: %s", rec.Code, rec.Body)
+		}
+		drainWrites(context.Background())
+	})
+}
@@ -0,0 +1,42 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"hash/maphash"
+	"sync"
+)
+
+// keyLockStripes is the number of mutexes of a keyLock
+const keyLockStripes = 256
+
+// keyLock serialises the work on the same key. Keys are spread over a fixed
+// set of mutexes so it doesn't grow with the number of keys, at the cost of
+// keys sharing a mutex now and then.
+type keyLock struct {
+	seed    maphash.Seed
+	stripes [keyLockStripes]sync.Mutex
+}
+
+func newKeyLock() *keyLock {
+	return &keyLock{seed: maphash.MakeSeed()}
+}
+
+// lock locks key and returns the function unlocking it
+func (l *keyLock) lock(key string) func() {
+	mu := &l.stripes[maphash.String(l.seed, key)%keyLockStripes]
+	mu.Lock()
+	return mu.Unlock
+}
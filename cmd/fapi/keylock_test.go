@@ -0,0 +1,41 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestKeyLockSerialisesKey(t *testing.T) {
+	l := newKeyLock()
+	var wg sync.WaitGroup
+	var a, b int
+	for i := 0; i < 100; i++ {
+		for key, count := range map[string]*int{"a": &a, "b": &b} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer l.lock(key)()
+				// Racy unless the key is locked, -race reports it
+				*count++
+			}()
+		}
+	}
+	wg.Wait()
+	if a != 100 || b != 100 {
+		t.Errorf("got %d and %d, want 100 each", a, b)
+	}
+}
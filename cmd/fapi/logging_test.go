@@ -0,0 +1,75 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"testing"
+)
+
+// loggedMessages returns the messages of the JSON lines held by logBuffer
+func loggedMessages(t *testing.T) []string {
+	t.Helper()
+	recent, _, cancel := logBuffer.subscribe()
+	defer cancel()
+	var msgs []string
+	for _, line := range recent {
+		var entry struct{ Msg string }
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("%v: %s", err, line)
+		}
+		msgs = append(msgs, entry.Msg)
+	}
+	return msgs
+}
+
+func TestLogLevel(t *testing.T) {
+	savedLogger, savedBuffer, savedLines := slog.Default(), logBuffer, logBufferLines
+	defer func() {
+		slog.SetDefault(savedLogger)
+		logBuffer, logBufferLines = savedBuffer, savedLines
+	}()
+	logBufferLines = 10
+
+	for _, tc := range []struct {
+		level string
+		want  []string
+	}{
+		{"debug", []string{"debug", "info", "warn", "error"}},
+		{"info", []string{"info", "warn", "error"}},
+		{"warn", []string{"warn", "error"}},
+		{"error", []string{"error"}},
+	} {
+		if err := setupLogging(tc.level, "json"); err != nil {
+			t.Fatal(err)
+		}
+		slog.Debug("debug")
+		slog.Info("info")
+		slog.Warn("warn")
+		slog.Error("error")
+		if got := loggedMessages(t); !slices.Equal(got, tc.want) {
+			t.Errorf("-log-level %s logged %v, want %v", tc.level, got, tc.want)
+		}
+	}
+
+	if err := setupLogging("verbose", "json"); err == nil {
+		t.Error("invalid log level accepted")
+	}
+	if err := setupLogging("info", "xml"); err == nil {
+		t.Error("invalid log format accepted")
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// logSubscriberBuffer is the number of lines a slow /v1/admin/logs
+	// client may fall behind by before lines are dropped for it
+	logSubscriberBuffer = 256
+	logKeepAlive        = 30 * time.Second
+)
+
+// logRing keeps the most recent log lines, up to a fixed number, and hands
+// new ones to the clients tailing /v1/admin/logs
+type logRing struct {
+	mu    sync.Mutex
+	lines []string // ring buffer, the oldest at start once full
+	start int
+	full  bool
+	subs  map[chan string]struct{}
+}
+
+// logBuffer is only set when -log-buffer-lines is not zero
+var logBuffer *logRing
+
+func newLogRing(size int) *logRing {
+	return &logRing{
+		lines: make([]string, 0, size),
+		subs:  make(map[chan string]struct{}),
+	}
+}
+
+// Write records the log lines in p. The logger writes whole records at once.
+func (l *logRing) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, line := range bytes.Split(bytes.TrimRight(p, "\n"), []byte{'\n'}) {
+		s := string(line)
+		if len(l.lines) < cap(l.lines) {
+			l.lines = append(l.lines, s)
+		} else {
+			l.lines[l.start] = s
+			l.start = (l.start + 1) % len(l.lines)
+		}
+		for ch := range l.subs {
+			select {
+			case ch <- s:
+			default:
+				// Never hold up logging for a slow client
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// subscribe returns the recorded lines, oldest first, and a channel receiving
+// the ones logged from then on. cancel must be called once done.
+func (l *logRing) subscribe() (recent []string, lines <-chan string, cancel func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	recent = append(recent, l.lines[l.start:]...)
+	recent = append(recent, l.lines[:l.start]...)
+	ch := make(chan string, logSubscriberBuffer)
+	l.subs[ch] = struct{}{}
+	return recent, ch, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.subs, ch)
+	}
+}
+
+// handleAdminLogs sends the recent log lines as server-sent events, then
+// keeps sending new ones as they are logged until the client goes away
+func handleAdminLogs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET allowed", nil)
+		return
+	}
+	if logBuffer == nil {
+		respondWithError(w, http.StatusNotFound, codeDisabled, "Log buffer is disabled", nil)
+		return
+	}
+
+	// The stream lasts as long as the client wants
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	recent, lines, cancel := logBuffer.subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for _, line := range recent {
+		fmt.Fprintf(w, "data: %s\n\n", line)
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(logKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case line := <-lines:
+			fmt.Fprintf(w, "data: %s\n\n", line)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		case <-shuttingDown:
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogRing(t *testing.T) {
+	ring := newLogRing(3)
+	for i := 1; i <= 5; i++ {
+		fmt.Fprintf(ring, "line %d\n", i)
+	}
+	recent, lines, cancel := ring.subscribe()
+	defer cancel()
+	// Only the most recent lines are kept, oldest first
+	if want := []string{"line 3", "line 4", "line 5"}; !slices.Equal(recent, want) {
+		t.Errorf("recent %q, want %q", recent, want)
+	}
+
+	fmt.Fprint(ring, "line 6\nline 7\n")
+	for _, want := range []string{"line 6", "line 7"} {
+		select {
+		case got := <-lines:
+			if got != want {
+				t.Errorf("tailed %q, want %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s not tailed", want)
+		}
+	}
+}
+
+func TestAdminLogsStream(t *testing.T) {
+	savedLogger, savedBuffer, savedLines, savedToken := slog.Default(), logBuffer, logBufferLines, adminToken
+	defer func() {
+		slog.SetDefault(savedLogger)
+		logBuffer, logBufferLines, adminToken = savedBuffer, savedLines, savedToken
+	}()
+	logBufferLines, adminToken = 10, testAdminToken
+	if err := setupLogging("info", "text"); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(withAdminAuth(handleAdminLogs))
+	defer server.Close()
+
+	slog.Info("logged before")
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status %d, Content-Type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	events := make(chan string, 100)
+	go func() {
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			if data, ok := strings.CutPrefix(sc.Text(), "data: "); ok {
+				events <- data
+			}
+		}
+		close(events)
+	}()
+	// waitEvent waits for an event holding msg
+	waitEvent := func(msg string) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case data, ok := <-events:
+				if !ok {
+					t.Fatalf("stream ended before %q", msg)
+				}
+				if strings.Contains(data, "msg=\""+msg+"\"") {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("%q not streamed", msg)
+			}
+		}
+	}
+
+	// The recent lines first, then the new ones as they are logged
+	waitEvent("logged before")
+	slog.Info("logged after", "n", 1)
+	waitEvent("logged after")
+}
+
+func TestAdminLogsRejected(t *testing.T) {
+	saved := logBuffer
+	defer func() { logBuffer = saved }()
+
+	logBuffer = nil
+	if rec := adminRequest(t, handleAdminLogs, http.MethodGet, "/v1/admin/logs"); rec.Code != http.StatusNotFound {
+		t.Errorf("without a log buffer: status %d, want 404", rec.Code)
+	}
+	logBuffer = newLogRing(10)
+	if rec := adminRequest(t, handleAdminLogs, http.MethodPost, "/v1/admin/logs"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: status %d, want 405", rec.Code)
+	}
+}
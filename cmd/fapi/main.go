@@ -17,47 +17,126 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/flate"
 	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
-	"log"
+	"log/slog"
 	"math/rand"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
 const (
-	uploadDir     = "./uploads"
-	maxBodySize   = 10 << 20 // 10 MB
 	workerCount   = 4
 	writeQueueCap = 100
+
+	maxLoggedPathLen = 256
+
+	// Delay between storage self-checks while warming up
+	warmupRetryInterval = 500 * time.Millisecond
 )
 
 var (
 	isReady   bool
 	readyLock sync.RWMutex
+	startTime time.Time
 )
 
 type writeRequest struct {
-	data []byte
-	path string
+	data       []byte
+	id         string
+	collection string
+	enqueued   time.Time
+	// appendLine adds data to the end of id instead of replacing it
+	appendLine bool
+	// done, if set, receives the outcome of the write
+	done chan error
+	// ctx, if set, abandons the write once done
+	ctx context.Context
+	// batch, if set, tracks the write as part of an NDJSON batch
+	batch *batchWrites
+	// callback, if set, is notified of the outcome of the write
+	callback string
+	// file, if set, is a local file of fileSize bytes to store instead of
+	// data, removed once written
+	file     string
+	fileSize int64
+	// eventTime is recorded with the content when -max-clock-skew is set
+	eventTime time.Time
 }
 
 var (
-	writeQueue = make(chan writeRequest, writeQueueCap)
+	// writeQueues feed the writer workers, see startWorkers
+	writeQueues []chan writeRequest
+	// writerWorkers tracks the writer workers, so shutdown can wait for
+	// them to write what's queued. Each startWorkers gets its own, as a
+	// drain that timed out leaves its wait behind on the last one.
+	writerWorkers *sync.WaitGroup
+
 	bufferPool = sync.Pool{
 		New: func() any {
-			return bufio.NewWriterSize(nil, 4096)
+			return bufio.NewWriterSize(nil, writeBufferSize)
+		},
+	}
+	gzipPool = sync.Pool{
+		New: func() any {
+			// The level is validated at startup, so this can't fail
+			gz, _ := gzip.NewWriterLevel(nil, gzipLevel)
+			return gz
 		},
 	}
 )
 
+// getBufferedWriter returns a pooled writer of -write-buffer-size bytes
+// writing to w
+func getBufferedWriter(w io.Writer) *bufio.Writer {
+	buf := bufferPool.Get().(*bufio.Writer)
+	if buf.Size() != writeBufferSize {
+		// Reset keeps the old buffer, so replace writers of the wrong size
+		return bufio.NewWriterSize(w, writeBufferSize)
+	}
+	buf.Reset(w)
+	return buf
+}
+
+// putBufferedWriter returns buf to the pool. Whatever is still buffered is
+// dropped and buf lets go of its file, so a write that failed or panicked half
+// way through can't leak into the next one.
+func putBufferedWriter(buf *bufio.Writer) {
+	buf.Reset(io.Discard)
+	bufferPool.Put(buf)
+}
+
+// getGzipWriter returns a pooled gzip writer compressing to w
+func getGzipWriter(w io.Writer) *gzip.Writer {
+	gz := gzipPool.Get().(*gzip.Writer)
+	gz.Reset(w)
+	return gz
+}
+
+// putGzipWriter returns gz to the pool, detached from the writer it
+// compressed to, see putBufferedWriter
+func putGzipWriter(gz *gzip.Writer) {
+	gz.Reset(io.Discard)
+	gzipPool.Put(gz)
+}
+
 func setReady(ready bool) {
 	readyLock.Lock()
 	defer readyLock.Unlock()
@@ -71,48 +150,204 @@ func checkReady() bool {
 }
 
 func main() {
+	startTime = time.Now()
 	rand.Seed(time.Now().UnixNano())
+	if err := parseFlags(); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if err := setupLogging(logLevel, logFormat); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+
+	if schemaPath != "" || schemaDir != "" {
+		set, err := loadSchemas(schemaPath, schemaDir)
+		if err != nil {
+			fatal("Failed to load schemas", "error", err)
+		}
+		schemas.Store(set)
+		go reloadSchemasOnHangup()
+	}
+	if collectionWrites > 0 || len(collectionOverrides) > 0 {
+		writeLimiter = newCollectionLimiter(collectionWrites, collectionOverrides)
+	}
+	if rejectDuplicates {
+		recentHashes = newHashLRU(duplicateCacheSize)
+	}
+	if dailyQuotaBytes > 0 || dailyQuotaCount > 0 {
+		uploadQuota = newDailyQuota(dailyQuotaBytes, dailyQuotaCount)
+		if quotaFile != "" {
+			if err := uploadQuota.load(quotaFile); err != nil {
+				fatal("Failed to load quota usage", "error", err)
+			}
+			go uploadQuota.saveEvery(quotaFile, quotaSaveInterval)
+		}
+	}
+	if debugCaptureSize > 0 {
+		debugCapture = newCaptureRing(debugCaptureSize, captureSampleRate)
+	}
+
+	if sequenceFile != "" {
+		if err := fileSequence.load(sequenceFile); err != nil {
+			fatal("Failed to load sequence", "error", err)
+		}
+	}
+
+	backend, err := newStorageBackend(storageKind)
+	if err != nil {
+		fatal("Failed to initialise storage", "error", err)
+	}
+	if breakerFailures > 0 {
+		storageBreaker = newBreakerBackend(backend, breakerFailures, breakerCooldown)
+		backend = storageBreaker
+	}
+	storage = backend
+	if readCacheBytes > 0 {
+		storage = newCachedBackend(backend, readCacheBytes)
+	}
+	if maxCollections > 0 {
+		if knownCollections, err = newCollectionSet(maxCollections, storage); err != nil {
+			fatal("Failed to list collections", "error", err)
+		}
+	}
+
+	readOnly.Store(startReadOnly)
+	startWorkers(orderedWrites)
+	go expireChunks()
+	if mirrorURL != "" {
+		startMirror()
+	}
+	if len(callbackHosts) > 0 {
+		startCallbacks()
+	}
+	go logStatsOnSignal()
+
+	handler, admin := newHandlers()
 
-	if err := os.MkdirAll(uploadDir, 0755); err != nil {
-		log.Fatalf("Failed to create upload directory: %v", err)
+	server := newServer(":8989", handler)
+
+	ln, err := listen(server.Addr)
+	if err != nil {
+		fatal("Failed to listen", "addr", server.Addr, "error", err)
 	}
 
-	for i := 0; i < workerCount; i++ {
-		go fileWriterWorker()
+	endpoints := []endpoint{{server: server, ln: ln}}
+	if adminAddr != "" {
+		adminServer := newServer(adminAddr, withActiveRequests(withRecover(withLogging(withCleanPath(admin)))))
+		adminLn, err := listen(adminServer.Addr)
+		if err != nil {
+			fatal("Failed to listen", "addr", adminServer.Addr, "error", err)
+		}
+		endpoints = append(endpoints, endpoint{server: adminServer, ln: adminLn})
+		slog.Info("Admin listening", "addr", adminServer.Addr)
 	}
 
+	slog.Info("Listening", "addr", server.Addr)
+	// Ready once the storage passes its self-check
+	go func() {
+		if err := warmUp(storage, warmupTimeout); err != nil {
+			fatal("Storage not ready", "timeout", warmupTimeout, "error", err)
+		}
+	}()
+	serve(endpoints...)
+
+	if quotaFile != "" {
+		if err := uploadQuota.save(quotaFile); err != nil {
+			logError("Failed to save quota usage", err)
+		}
+	}
+}
+
+// newServer returns a server for handler on addr with the -read-timeout,
+// -write-timeout and -idle-timeout
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:         addr,
+		Handler:      handler,
+		ReadTimeout:  readTimeout,
+		WriteTimeout: writeTimeout,
+		IdleTimeout:  idleTimeout,
+	}
+}
+
+// newHandlers registers the routes, under -route-prefix if set, and returns
+// the handler of the main server and the mux of the admin routes. Unless
+// -admin-addr is set the admin routes are served by the main handler too.
+func newHandlers() (http.Handler, *http.ServeMux) {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/v1/collection", handleSubmit)
-	mux.HandleFunc("/v1/collection/", handleSubmit)
+	mux.Handle("/v1/collection", collectionRoot)
+	mux.HandleFunc("/v1/collection/", handleCollection)
 	mux.HandleFunc("/v1/health", handleHealth)
 	mux.HandleFunc("/v1/ready", handleReady)
+	mux.HandleFunc("/v1/info", handleInfo)
+	mux.HandleFunc("/v1/schema", handleSchema)
+	mux.HandleFunc("/v1/schema/validate", handleSchemaValidate)
+	mux.HandleFunc("/v1/schema/infer", handleSchemaInfer)
+
+	// With -admin-addr the admin and metrics routes get their own server
+	admin := mux
+	if adminAddr != "" {
+		admin = http.NewServeMux()
+		// Keep them from falling through to the catch-all on the main port
+		for _, pattern := range []string{"/v1/selftest", "/v1/admin/", "/v1/debug/", "/metrics"} {
+			mux.HandleFunc(pattern, handleNotFound)
+		}
+	}
+	admin.HandleFunc("/v1/selftest", withAdminAuth(handleSelfTest))
+	admin.HandleFunc("/v1/admin/dedup", withAdminAuth(handleAdminDedup))
+	admin.HandleFunc("/v1/admin/cleanup", withAdminAuth(handleAdminCleanup))
+	admin.HandleFunc("/v1/admin/replay", withAdminAuth(handleAdminReplay))
+	admin.HandleFunc("/v1/admin/logs", withAdminAuth(handleAdminLogs))
+	admin.HandleFunc("/v1/admin/read-only", withAdminAuth(handleAdminReadOnly))
+	admin.HandleFunc("/v1/debug/recent", withAdminAuth(handleDebugRecent))
+	admin.HandleFunc("/metrics", handleMetrics)
 
 	// This is a special end-point to help debugging other apps will catch any other apps endpoints
-	mux.HandleFunc("/", handleSubmit)
+	mux.Handle("/", collectionRoot)
 
-	handler := withRecover(withLogging(withCORS(mux)))
+	var routes http.Handler = mux
+	if routePrefix != "" {
+		prefixed := http.NewServeMux()
+		prefixed.Handle(routePrefix+"/", http.StripPrefix(routePrefix, mux))
+		routes = prefixed
+	}
 
-	server := &http.Server{
-		Addr:         ":8989",
-		Handler:      handler,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  120 * time.Second,
+	handler := withActiveRequests(withRecover(withLogging(withCORS(withCleanPath(withPathLimits(withInflightBytes(routes)))))))
+	if maxRequests > 0 {
+		handler = withRequestLimit(handler)
 	}
+	return handler, admin
+}
 
-	log.Println("Listening on :8989")
-	// after initialization
-	setReady(true)
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("Server error: %v", err)
+// warmUp marks the service ready as soon as backend passes its self-check,
+// retrying until timeout expires. It returns the last error if it never does.
+func warmUp(backend StorageBackend, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := backend.Check()
+		if err == nil {
+			warmedUp.Store(true)
+			setReady(true)
+			slog.Info("Storage ready")
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		slog.Warn("Storage not ready yet", "error", err)
+		time.Sleep(warmupRetryInterval)
 	}
 }
 
 func withCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+		if len(allowHeaders) > 0 {
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(allowHeaders, ", "))
+		}
+		if len(exposeHeaders) > 0 {
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(exposeHeaders, ", "))
+		}
 
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusNoContent)
@@ -127,8 +362,26 @@ func withRecover(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if rec := recover(); rec != nil {
-				log.Printf("PANIC: %v", rec)
+				if rec == http.ErrAbortHandler {
+					// A deliberate abort, net/http closes the connection
+					panic(rec)
+				}
+				stack := debug.Stack()
+				reported := reportPanic(rec, stack, r)
+				if panicPolicy != "log-and-exit" {
+					slog.Error("Panic", "panic", rec, "path", truncate(r.URL.Path, maxLoggedPathLen))
+					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+					return
+				}
+
+				// Let the orchestrator restart a process that may be left
+				// in a broken state, once the client and webhook are told
+				slog.Error("Panic, exiting", "panic", rec, "path", truncate(r.URL.Path, maxLoggedPathLen), "stack", string(stack))
+				w.Header().Set("Connection", "close")
 				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				_ = http.NewResponseController(w).Flush()
+				<-reported
+				os.Exit(2)
 			}
 		}()
 		next.ServeHTTP(w, r)
@@ -138,73 +391,153 @@ func withRecover(next http.Handler) http.Handler {
 func withLogging(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		slog.Info("Request",
+			"method", r.Method,
+			"path", truncate(r.URL.Path, maxLoggedPathLen),
+			"ip", sanitizeIP(getClientIP(r)),
+			"status", rec.status,
+			"duration", time.Since(start))
+	})
+}
+
+// withCleanPath collapses repeated slashes, resolves . and .. elements and
+// drops trailing slashes, so that e.g. /v1/collection//logs/ and
+// /v1/collection/logs are handled the same. It's disabled with
+// -clean-paths=false, leaving ServeMux to redirect unclean paths.
+func withCleanPath(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cleanPaths {
+			if p := cleanPath(r.URL.Path); p != r.URL.Path {
+				r.URL.Path = p
+				r.URL.RawPath = ""
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func cleanPath(p string) string {
+	p = path.Clean("/" + p)
+	// The prefix itself is only routed with its trailing slash
+	if routePrefix != "" && p == routePrefix {
+		return p + "/"
+	}
+	return p
+}
+
+func withPathLimits(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isPathWithinLimits(r.URL.Path) {
+			respondWithError(w, http.StatusRequestURITooLong, codeURITooLong, "URI Too Long", nil)
+			return
+		}
 		next.ServeHTTP(w, r)
-		log.Printf("%s %s %s", r.Method, r.URL.Path, time.Since(start))
 	})
 }
 
+// isPathWithinLimits checks the number and length of the path segments
+func isPathWithinLimits(path string) bool {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) > maxPathSegments {
+		return false
+	}
+	for _, seg := range segments {
+		if len(seg) > maxPathSegmentLen {
+			return false
+		}
+	}
+	return true
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
 func handleHealth(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write([]byte("OK\n"))
+	if healthFormat == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(healthStatus)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"status":   "ok",
+			"uptime_s": int64(time.Since(startTime).Seconds()),
+		})
+		return
+	}
+	w.WriteHeader(healthStatus)
+	_, _ = w.Write([]byte(healthBody + "\n"))
 }
 
-func handleReady(w http.ResponseWriter, r *http.Request) {
-	if checkReady() {
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("READY\n"))
-	} else {
-		w.WriteHeader(http.StatusServiceUnavailable)
-		_, _ = w.Write([]byte("NOT READY\n"))
+func handleInfo(w http.ResponseWriter, r *http.Request) {
+	info := map[string]any{
+		"start_time": startTime.UTC(),
+		"uptime_s":   time.Since(startTime).Seconds(),
+		"go_version": runtime.Version(),
+		"goroutines": runtime.NumGoroutine(),
+		"build":      buildInfo(),
 	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(info)
 }
 
-func handleSubmit(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodPost:
-		handlePost(w, r)
-	case http.MethodGet:
-		// capture headers and query params for debugging
-		data := map[string]any{
-			"method":  r.Method,
-			"path":    r.URL.Path,
-			"query":   r.URL.Query(),
-			"headers": r.Header,
-		}
-		err := json.NewEncoder(w).Encode(data)
-		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, "Failed to encode response", err)
-			return
+// buildInfo returns the module version and VCS details embedded by go build
+func buildInfo() map[string]string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return nil
+	}
+	build := map[string]string{"version": bi.Main.Version}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision", "vcs.time", "vcs.modified":
+			build[strings.TrimPrefix(s.Key, "vcs.")] = s.Value
 		}
-	default:
-		respondWithError(w, http.StatusMethodNotAllowed, "Only GET and POST allowed", nil)
 	}
+	return build
 }
 
 func handlePost(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		respondWithError(w, http.StatusMethodNotAllowed, "Only POST allowed", nil)
+	collection, ok := collectionFromPath(r.URL.Path)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, codeInvalidCollection, "Invalid collection name", nil)
+		return
+	}
+	if !isCollectionAllowed(collection) {
+		respondWithError(w, http.StatusForbidden, codeCollectionNotAllowed, "Collection not allowed", nil)
+		return
+	}
+	if !admitCollection(w, collection) {
 		return
 	}
 
-	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
-	defer r.Body.Close()
+	eventTime, ok := eventTimeOf(w, r)
+	if !ok {
+		return
+	}
 
-	var reader io.Reader = r.Body
+	if isNDJSONBatch(r) {
+		handleNDJSONBatch(w, r, collection, eventTime)
+		return
+	}
 
-	// Check for gzip
-	if r.Header.Get("Content-Encoding") == "gzip" {
-		gzr, err := gzip.NewReader(r.Body)
-		if err != nil {
-			respondWithError(w, http.StatusBadRequest, "Invalid gzip data", err)
-			return
-		}
-		defer gzr.Close()
-		reader = gzr
+	callback, ok := callbackURL(w, r)
+	if !ok {
+		return
+	}
+	requested, ok := requestedExtension(w, r)
+	if !ok {
+		return
 	}
 
-	body, err := io.ReadAll(reader)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Failed to read request body", err)
+	raw, body, ok := readBodyAndRaw(w, r)
+	if !ok {
 		return
 	}
 
@@ -213,79 +546,819 @@ func handlePost(w http.ResponseWriter, r *http.Request) {
 		ip = "unknown"
 	}
 
-	now := time.Now().UTC()
-	timestamp := now.Format("2006-01-02-15_04_05.000000000")
-	suffix := fmt.Sprintf("-%d", rand.Intn(10000))
+	debugCapture.capture(r, ip, body, eventTime)
 
 	isJSON := json.Valid(body)
+	if jsonValidHeader {
+		w.Header().Set("X-JSON-Valid", strconv.FormatBool(isJSON))
+	}
 	ext := ".json"
 	if !isJSON {
-		ext = ".txt"
+		ext = extensionFor(body, r.Header.Get("Content-Type"))
+	}
+	if requested != "" {
+		if requested == ".json" && !isJSON {
+			respondWithError(w, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON", nil)
+			return
+		}
+		ext = requested
+	}
+	storedAs := ext
+
+	if isJSON && !validateJSON(w, body, collection) {
+		return
+	}
+	if !isJSON && !validateContent(w, body, collection, ext) {
+		return
 	}
 
-	filename := fmt.Sprintf("%s-%s%s%s", ip, timestamp, suffix, ext)
-	fullPath := filepath.Join(uploadDir, filename)
+	appendLine := appendMode && isJSON
+	if isJSON {
+		var err error
+		if body, err = prepareJSON(body, appendLine); err != nil {
+			respondWithError(w, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON", err)
+			return
+		}
+	}
+
+	client, ok := chargeQuota(w, r, len(body))
+	if !ok {
+		return
+	}
+
+	id := newStoredID(collection, ip, ext, body, appendLine)
 
 	req := writeRequest{
-		data: body,
-		path: fullPath,
+		data:       body,
+		id:         id,
+		collection: collection,
+		enqueued:   time.Now(),
+		appendLine: appendLine,
+		callback:   callback,
+		eventTime:  eventTime,
 	}
 
-	select {
-	case writeQueue <- req:
-		// OK
-	case <-r.Context().Done():
-		respondWithError(w, http.StatusRequestTimeout, "Request cancelled", r.Context().Err())
+	hash := contentHash(body)
+	if recentHashes != nil {
+		if existing, added := recentHashes.addIfAbsent(collection, hash, id); !added {
+			refundQuota(client, len(body))
+			respondWithDuplicate(w, existing)
+			return
+		}
+	}
+
+	waitWrite := isSyncWrite(r)
+	if waitWrite {
+		req.done = make(chan error, 1)
+		req.ctx = r.Context()
+	}
+	if !enqueueWrite(w, req) {
+		if recentHashes != nil {
+			recentHashes.remove(collection, hash)
+		}
+		refundQuota(client, len(body))
 		return
 	}
+	status := acceptStatus
+	if waitWrite {
+		select {
+		case err := <-req.done:
+			if errors.Is(err, errDeadLettered) {
+				respondDeadLettered(w)
+				return
+			}
+			if err != nil {
+				if recentHashes != nil {
+					recentHashes.remove(collection, hash)
+				}
+				refundQuota(client, len(body))
+				respondWithError(w, http.StatusInternalServerError, codeWriteFailed, "Failed to store the upload", err)
+				return
+			}
+		case <-r.Context().Done():
+			// The client is gone, the write is abandoned
+			recordCancelled(r, phaseWrite, r.Context().Err())
+			return
+		}
+		// The write is done, so it isn't just accepted any more
+		if status == http.StatusAccepted {
+			status = http.StatusCreated
+		}
+	}
 
-	w.WriteHeader(http.StatusAccepted)
+	mirrorUpload(r, collection, raw)
+
+	w.Header().Set("Location", collectionURL(id))
+	setContentHash(w, hash)
+	w.WriteHeader(status)
 	if isJSON {
 		_, _ = w.Write([]byte("JSON stored\n"))
 	} else {
-		_, _ = w.Write([]byte("Invalid JSON — stored as .txt\n"))
+		_, _ = w.Write([]byte("Invalid JSON — stored as " + storedAs + "\n"))
+	}
+}
+
+// isSyncWrite reports whether the upload must be written before it's answered,
+// see -sync-writes
+func isSyncWrite(r *http.Request) bool {
+	if syncWrites {
+		return true
+	}
+	sync, _ := strconv.ParseBool(r.URL.Query().Get("sync"))
+	return sync
+}
+
+// decodedBody is a request body being read, decompressed if needed
+type decodedBody struct {
+	io.Reader
+	// received counts the bytes read off the wire
+	received *countingReader
+	isGzip   bool
+	gzr      *gzip.Reader
+}
+
+// close finishes the gzip stream, failing if it is truncated or corrupt
+func (d *decodedBody) close() error {
+	if d.gzr == nil {
+		return nil
+	}
+	return d.gzr.Close()
+}
+
+// isGzipError reports whether err, returned while decompressing a body, comes
+// from a truncated or corrupt gzip stream rather than from receiving the body
+func isGzipError(err error, received *countingReader) bool {
+	if received.err != nil {
+		return false
+	}
+	var corrupt flate.CorruptInputError
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, gzip.ErrChecksum) ||
+		errors.Is(err, gzip.ErrHeader) || errors.As(err, &corrupt)
+}
+
+// openBody checks everything that can be checked before reading the request
+// body and returns the reader of the decoded body. On failure the error
+// response has already been sent.
+func openBody(w http.ResponseWriter, r *http.Request) (*decodedBody, bool) {
+	return openBodyLimited(w, r, true)
+}
+
+// openStreamBody is openBody for streams, whose body as a whole has no size
+// limit
+func openStreamBody(w http.ResponseWriter, r *http.Request) (*decodedBody, bool) {
+	return openBodyLimited(w, r, false)
+}
+
+func openBodyLimited(w http.ResponseWriter, r *http.Request, limited bool) (*decodedBody, bool) {
+	// Everything that can be rejected without the body is checked before the
+	// first read. That way net/http never sends "100 Continue" to clients
+	// using "Expect: 100-continue" and they get the final status right away.
+	if !checkReady() {
+		w.Header().Set("Retry-After", retryAfterHeader())
+		respondWithError(w, http.StatusServiceUnavailable, codeNotReady, "Service not ready", nil)
+		return nil, false
+	}
+
+	if requireContentType && strings.TrimSpace(r.Header.Get("Content-Type")) == "" {
+		respondWithError(w, http.StatusBadRequest, codeMissingContentType, "Missing Content-Type header", nil)
+		return nil, false
+	}
+
+	isGzip := r.Header.Get("Content-Encoding") == "gzip"
+
+	if limited {
+		if r.ContentLength > bodySizeLimit(isGzip) {
+			respondWithError(w, http.StatusRequestEntityTooLarge, codeBodyTooLarge, "Request body too large", nil)
+			return nil, false
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, bodySizeLimit(isGzip))
+	}
+
+	var body io.Reader = r.Body
+	if firstByteTimeout > 0 && r.Body != http.NoBody {
+		body = newFirstByteReader(w, r.Body)
+	}
+	received := &countingReader{r: body}
+	var reader io.Reader = received
+
+	// Some clients gzip the body but forget the Content-Encoding header
+	if !isGzip && sniffGzip {
+		br := bufio.NewReader(received)
+		magic, _ := br.Peek(len(gzipMagic))
+		isGzip = bytes.Equal(magic, gzipMagic)
+		reader = br
+	}
+
+	// Check for gzip
+	if isGzip {
+		gzr, err := gzip.NewReader(reader)
+		if err != nil {
+			if isMaxBytesError(err) {
+				respondWithError(w, http.StatusRequestEntityTooLarge, codeBodyTooLarge, "Request body too large", err)
+				return nil, false
+			}
+			if received.err != nil {
+				respondReadFailed(w, r, received, err)
+				return nil, false
+			}
+			respondWithError(w, http.StatusBadRequest, codeInvalidGzip, "Invalid gzip data", err)
+			return nil, false
+		}
+		reader = limitRatio(gzr, received)
+		if limited {
+			// Read one byte past the cap so we can tell an oversized body apart
+			reader = io.LimitReader(reader, maxDecompressedSize+1)
+		}
+		return &decodedBody{Reader: reader, received: received, isGzip: true, gzr: gzr}, true
+	}
+
+	return &decodedBody{Reader: reader, received: received}, true
+}
+
+// prepareJSON turns a valid JSON body into what gets stored: canonicalized
+// with -canonicalize-json and compacted into a single line when appended
+func prepareJSON(body []byte, appendLine bool) ([]byte, error) {
+	if canonicalJSON {
+		if canonical, err := canonicalizeJSON(body); err != nil {
+			logError("Failed to canonicalize JSON, storing it as received", err)
+		} else {
+			body = canonical
+		}
+	}
+	if !appendLine {
+		return body, nil
+	}
+	var line bytes.Buffer
+	if err := json.Compact(&line, body); err != nil {
+		return nil, err
 	}
+	line.WriteByte('\n')
+	return line.Bytes(), nil
 }
 
-func fileWriterWorker() {
-	for req := range writeQueue {
-		writeToFile(req.data, req.path)
+// newStoredID returns the id a new upload of data to collection is stored as
+func newStoredID(collection, ip, ext string, data []byte, appendLine bool) string {
+	filename := idGenerator.NewName(ip, data) + ext
+	if appendLine {
+		filename = dailyFilename()
 	}
+	if compressStorage {
+		filename += ".gz"
+	}
+	if shardByIP {
+		filename = ipShard(ip) + "/" + filename
+	}
+	return storedID(collection, filename)
+}
+
+// readBody reads and decodes the request body, enforcing the size limits. On
+// failure the error response has already been sent.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	_, body, ok := readBodyAndRaw(w, r)
+	return body, ok
 }
 
-func writeToFile(data []byte, path string) {
-	f, err := os.Create(path)
+// readBodyAndRaw is readBody also returning the body as received, only
+// decompressed, before -transcode-charset and -transform
+func readBodyAndRaw(w http.ResponseWriter, r *http.Request) ([]byte, []byte, bool) {
+	decoded, ok := openBody(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+	defer r.Body.Close()
+
+	body, err := io.ReadAll(decoded)
 	if err != nil {
-		log.Printf("ERROR: Failed to create file %s: %v\n", path, err)
+		if isMaxBytesError(err) {
+			respondWithError(w, http.StatusRequestEntityTooLarge, codeBodyTooLarge, "Request body too large", err)
+			return nil, nil, false
+		}
+		if errors.Is(err, errDecompressRatio) {
+			respondWithError(w, http.StatusRequestEntityTooLarge, codeBodyTooLarge, "Decompression ratio too high", err)
+			return nil, nil, false
+		}
+		if decoded.isGzip && isGzipError(err, decoded.received) {
+			respondWithError(w, http.StatusBadRequest, codeInvalidGzip, "Invalid gzip data", err)
+			return nil, nil, false
+		}
+		respondReadFailed(w, r, decoded.received, err)
+		return nil, nil, false
+	}
+	if err := decoded.close(); err != nil {
+		respondWithError(w, http.StatusBadRequest, codeInvalidGzip, "Invalid gzip data", err)
+		return nil, nil, false
+	}
+	if decoded.isGzip && int64(len(body)) > maxDecompressedSize {
+		respondWithError(w, http.StatusRequestEntityTooLarge, codeBodyTooLarge, "Decompressed body too large", nil)
+		return nil, nil, false
+	}
+
+	receivedBodySize.observe(float64(decoded.received.n))
+	decodedBodySize.observe(float64(len(body)))
+
+	raw := body
+	if transcodeCharset {
+		body, err = toUTF8(body, requestCharset(r.Header.Get("Content-Type")))
+		if errors.Is(err, errUnsupportedCharset) {
+			respondWithError(w, http.StatusUnsupportedMediaType, codeUnsupportedCharset, "Unsupported charset", err)
+			return nil, nil, false
+		}
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, codeInvalidCharset, "Invalid charset encoding", err)
+			return nil, nil, false
+		}
+	}
+
+	if len(transformArgs) > 0 {
+		if body, err = transformBody(r.Context(), body); err != nil {
+			var rejected *errTransformRejected
+			switch {
+			case r.Context().Err() != nil:
+				// The client is gone or the request timed out while the command ran
+				if recordCancelled(r, phaseTransform, err) == reasonDeadlineExceeded {
+					respondWithError(w, http.StatusRequestTimeout, codeRequestTimeout, "Request timed out during the transform", err)
+				}
+			case errors.As(err, &rejected):
+				respondWithError(w, http.StatusUnprocessableEntity, codeTransformFailed, "Rejected by the transform command", err)
+			case errors.Is(err, errTransformTimeout):
+				respondWithError(w, http.StatusServiceUnavailable, codeTransformTimeout, "Transform command timed out", err)
+			case errors.Is(err, errTransformOutputTooLarge):
+				respondWithError(w, http.StatusRequestEntityTooLarge, codeBodyTooLarge, "Transformed body too large", err)
+			default:
+				respondWithError(w, http.StatusInternalServerError, codeInternal, "Failed to run the transform command", err)
+			}
+			return nil, nil, false
+		}
+	}
+
+	if rejectEmpty && len(body) == 0 {
+		respondWithError(w, http.StatusBadRequest, codeEmptyBody, "Empty request body", nil)
+		return nil, nil, false
+	}
+
+	return raw, body, true
+}
+
+// firstByteReader gives the client -first-byte-timeout to start sending the
+// body, then puts back the deadline of -read-timeout
+type firstByteReader struct {
+	r       io.Reader
+	rc      *http.ResponseController
+	restore time.Time
+	started bool
+}
+
+func newFirstByteReader(w http.ResponseWriter, r io.Reader) *firstByteReader {
+	f := &firstByteReader{r: r, rc: http.NewResponseController(w)}
+	if readTimeout > 0 {
+		f.restore = time.Now().Add(readTimeout)
+	}
+	deadline := time.Now().Add(firstByteTimeout)
+	if !f.restore.IsZero() && f.restore.Before(deadline) {
+		deadline = f.restore
+	}
+	if err := f.rc.SetReadDeadline(deadline); err != nil {
+		// Without a deadline there's nothing to put back
+		f.started = true
+	}
+	return f
+}
+
+func (f *firstByteReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if n > 0 && !f.started {
+		f.started = true
+		if err := f.rc.SetReadDeadline(f.restore); err != nil {
+			logError("Failed to reset read deadline", err)
+		}
+	}
+	return n, err
+}
+
+// countingReader counts the bytes read through it and remembers the error
+// that ended reading, if any
+type countingReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if err != nil && err != io.EOF {
+		c.err = err
+	}
+	return n, err
+}
+
+// validateJSON checks a valid JSON body against -max-json-depth and the schema
+// of collection, if any. On failure the error response has already been sent.
+func validateJSON(w http.ResponseWriter, body []byte, collection string) bool {
+	code, msg, violations := checkJSON(body, collection)
+	switch code {
+	case "":
+		return true
+	case codeSchemaViolation:
+		respondWithViolations(w, violations)
+	case codeJSONTooDeep:
+		respondWithError(w, http.StatusUnprocessableEntity, code, msg, nil)
+	default:
+		respondWithError(w, http.StatusBadRequest, code, msg, nil)
+	}
+	return false
+}
+
+// checkJSON checks a valid JSON body against -max-json-depth and the schema of
+// collection, if any. On failure it returns the error code and message, and
+// the schema violations if that's the cause.
+func checkJSON(body []byte, collection string) (errorCode, string, []schemaViolation) {
+	if maxJSONDepth > 0 && exceedsDepth(body, maxJSONDepth) {
+		return codeJSONTooDeep, fmt.Sprintf("JSON nested deeper than %d levels", maxJSONDepth), nil
+	}
+	schema := schemaFor(collection)
+	if schema == nil {
+		return "", "", nil
+	}
+	doc, err := decodeJSON(body)
+	if err != nil {
+		return codeInvalidJSON, "Invalid JSON", nil
+	}
+	if violations := schema.validate(doc); len(violations) > 0 {
+		return codeSchemaViolation, "Schema validation failed", violations
+	}
+	return "", "", nil
+}
+
+// enqueueWrite hands req to the writer workers. It fails if the queue is full,
+// in which case the error response has already been sent.
+func enqueueWrite(w http.ResponseWriter, req writeRequest) bool {
+	select {
+	case queueFor(req.collection) <- req:
+		return true
+	default:
+		w.Header().Set("Retry-After", retryAfterHeader())
+		respondWithError(w, http.StatusServiceUnavailable, codeQueueFull, "Write queue full", nil)
+		return false
+	}
+}
+
+// dailyFilename is the file -append-mode adds JSON submissions to. Files
+// rotate at midnight UTC.
+func dailyFilename() string {
+	return clk.Now().UTC().Format("2006-01-02") + ".ndjson"
+}
+
+// gzipMagic are the first two bytes of any gzip stream
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// bodySizeLimit returns the maximum accepted wire size of a request body
+func bodySizeLimit(isGzip bool) int64 {
+	if isGzip {
+		return maxGzipBodySize
+	}
+	return maxBodySize
+}
+
+func isMaxBytesError(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
+
+// startWorkers starts the writer workers. Normally they all share one queue.
+// With ordered set each worker gets its own queue and a collection always
+// goes to the same one, so its writes happen in the order they arrived.
+// Otherwise more workers are started during bursts if -max-workers allows.
+func startWorkers(ordered bool) {
+	workers := &sync.WaitGroup{}
+	writerWorkers = workers
+	if !ordered {
+		queue := make(chan writeRequest, writeQueueCap)
+		writeQueues = []chan writeRequest{queue}
+		for i := 0; i < workerCount; i++ {
+			workers.Add(1)
+			go fileWriterWorker(queue, workers)
+		}
+		if maxWorkers > workerCount {
+			go autoscaleWorkers(queue, workers, maxWorkers, workerIdleTimeout)
+		}
 		return
 	}
-	defer f.Close()
+	writeQueues = make([]chan writeRequest, workerCount)
+	for i := range writeQueues {
+		writeQueues[i] = make(chan writeRequest, writeQueueCap/workerCount)
+		workers.Add(1)
+		go fileWriterWorker(writeQueues[i], workers)
+	}
+}
 
-	buf := bufferPool.Get().(*bufio.Writer)
-	buf.Reset(f)
-	defer bufferPool.Put(buf)
+// queueFor returns the queue the writes to collection go to
+func queueFor(collection string) chan writeRequest {
+	if len(writeQueues) == 1 {
+		return writeQueues[0]
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(collection))
+	return writeQueues[h.Sum32()%uint32(len(writeQueues))]
+}
+
+// queueDepth is the number of writes waiting in the queues
+func queueDepth() int {
+	depth := 0
+	for _, q := range writeQueues {
+		depth += len(q)
+	}
+	return depth
+}
 
-	if _, err := buf.Write(data); err != nil {
-		log.Printf("ERROR: Failed to write to file %s: %v\n", path, err)
+// queueCapacity is the total capacity of the queues
+func queueCapacity() int {
+	total := 0
+	for _, q := range writeQueues {
+		total += cap(q)
+	}
+	return total
+}
+
+func fileWriterWorker(queue <-chan writeRequest, workers *sync.WaitGroup) {
+	defer workers.Done()
+	for req := range queue {
+		handleWrite(req)
+	}
+}
+
+// handleWrite writes req, or parks it if its collection is at its limit
+func handleWrite(req writeRequest) {
+	if writeLimiter == nil {
+		processWrite(req)
+		return
+	}
+	if !writeLimiter.acquire(req) {
+		// Parked, the worker holding the collection's slot will write it
 		return
 	}
+	for {
+		processWrite(req)
+		next, ok := writeLimiter.release(req.collection)
+		if !ok {
+			return
+		}
+		req = next
+	}
+}
+
+func processWrite(req writeRequest) {
+	store := storage.Store
+	if req.appendLine {
+		store = storage.Append
+	}
+	ctx := req.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var err error
+	size := int64(len(req.data))
+	if req.file != "" {
+		err = storage.StoreFile(ctx, req.id, req.file)
+		if removeErr := os.Remove(req.file); removeErr != nil {
+			logError("Failed to remove "+req.file, removeErr)
+		}
+		size = req.fileSize
+	} else {
+		err = store(ctx, req.id, req.data)
+	}
+	if err == nil && maxClockSkew > 0 {
+		// Also when it's zero, so a replaced file doesn't keep the old one
+		if err := storage.SetEventTime(req.id, req.eventTime); err != nil {
+			slog.Warn("Failed to record event time", "id", req.id, "error", err)
+		}
+	}
+	if req.done != nil {
+		req.done <- err
+	}
+	if req.batch != nil {
+		req.batch.done(req.id, err)
+	}
+	notifyCallback(req, err)
+	if errors.Is(err, errDeadLettered) {
+		// Kept aside by the open breaker, neither stored nor a new failure
+		return
+	}
+	if err != nil && ctx.Err() != nil {
+		// Abandoned by the client, that says nothing about the storage
+		slog.Debug("Write abandoned", "id", req.id, "error", err)
+		return
+	}
+	recordWriteResult(err)
+	if err != nil {
+		writeErrors.inc(collectionLabel(req.collection))
+		slog.Error("Failed to store file", "id", req.id, "error", err)
+		return
+	}
+	label := collectionLabel(req.collection)
+	writesTotal.inc(label)
+	writtenBytes.add(uint64(size), label)
+	writeLatency.observe(time.Since(req.enqueued).Seconds())
+	writeThroughput.record()
+}
+
+// writeToFile stores data at path, gzip compressed if compress is set
+func writeToFile(ctx context.Context, data []byte, path string, compress bool) error {
+	return writeFile(ctx, data, path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, compress)
+}
+
+// appendToFile adds data at the end of path. Compressed data is appended as a
+// new gzip member, which gzip readers concatenate transparently.
+func appendToFile(ctx context.Context, data []byte, path string, compress bool) error {
+	return writeFile(ctx, data, path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, compress)
+}
+
+// writeFile writes data to path opened with flag, one buffer at a time so it
+// can give up once ctx is done. What was written until then is undone: the
+// file is removed, or cut back to its previous size when appending.
+func writeFile(ctx context.Context, data []byte, path string, flag int, compress bool) error {
+	n := 0
+	return writeBlocks(ctx, path, flag, compress, int64(len(data)), func() ([]byte, error) {
+		if n == len(data) {
+			return nil, io.EOF
+		}
+		block := data[n:min(n+writeBufferSize, len(data))]
+		n += len(block)
+		return block, nil
+	})
+}
+
+// writeFileFrom is writeFile for the size bytes read from src, which don't
+// have to be in memory all at once
+func writeFileFrom(ctx context.Context, src io.Reader, size int64, path string, flag int, compress bool) error {
+	block := make([]byte, writeBufferSize)
+	return writeBlocks(ctx, path, flag, compress, size, func() ([]byte, error) {
+		n, err := io.ReadFull(src, block)
+		if err == io.ErrUnexpectedEOF || (err == io.EOF && n > 0) {
+			err = nil
+		}
+		return block[:n], err
+	})
+}
+
+// writeBlocks does the work of writeFile, for the size bytes returned by next
+// until it returns io.EOF
+func writeBlocks(ctx context.Context, path string, flag int, compress bool, size int64, next func() ([]byte, error)) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for file %s: %w", path, err)
+	}
+	f, err := os.OpenFile(path, flag, fileMode)
+	if err != nil {
+		return fmt.Errorf("failed to create file %s: %w", path, err)
+	}
+	defer f.Close()
+	// OpenFile applies the umask (and leaves existing files alone), set the
+	// mode explicitly so it's always the configured one
+	if err := f.Chmod(fileMode); err != nil {
+		return fmt.Errorf("failed to set mode of file %s: %w", path, err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file %s: %w", path, err)
+	}
+	start := info.Size()
+	undo := func() {
+		if flag&os.O_APPEND == 0 {
+			_ = os.Remove(path)
+		} else {
+			_ = f.Truncate(start)
+		}
+	}
+
+	buf := getBufferedWriter(f)
+	defer putBufferedWriter(buf)
+
+	var out io.Writer = buf
+	var gz *gzip.Writer
+	if compress {
+		gz = getGzipWriter(buf)
+		defer putGzipWriter(gz)
+		out = gz
+	}
+
+	for n := int64(0); ; {
+		if err := ctx.Err(); err != nil {
+			undo()
+			return fmt.Errorf("write to file %s abandoned (%d of %d bytes written): %w", path, n, size, err)
+		}
+		block, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			undo()
+			return fmt.Errorf("failed to read the content of file %s (%d of %d bytes written): %w", path, n, size, err)
+		}
+		written, err := writeBlock(out, block)
+		n += int64(written)
+		if err != nil {
+			return fmt.Errorf("failed to write to file %s (%d of %d bytes written): %w", path, n, size, err)
+		}
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return fmt.Errorf("failed to compress file %s: %w", path, err)
+		}
+	}
 	if err := buf.Flush(); err != nil {
-		log.Printf("ERROR: Failed to flush buffer for file %s: %v\n", path, err)
+		return fmt.Errorf("failed to flush buffer for file %s: %w", path, err)
 	}
+	return nil
 }
 
-func getClientIP(r *http.Request) string {
-	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
-		parts := strings.Split(forwarded, ",")
-		return strings.TrimSpace(parts[0])
+// writeBlock writes block to w. A short write is an error even when w doesn't
+// report one, so it can't truncate a file silently.
+func writeBlock(w io.Writer, block []byte) (int, error) {
+	n, err := w.Write(block)
+	if err == nil && n < len(block) {
+		err = io.ErrShortWrite
 	}
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	return n, err
+}
+
+// getClientIP returns the address of the client, from the first of
+// -client-ip-headers present when the request comes from a trusted proxy,
+// and from the connection otherwise
+func getClientIP(r *http.Request) string {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
+		peer = ""
+	}
+	if isTrustedProxy(peer) {
+		for _, name := range clientIPHeaders {
+			if ip := headerClientIP(r.Header, name); ip != "" {
+				return ip
+			}
+		}
+	}
+	return peer
+}
+
+// headerClientIP returns the client address given by the header name, empty
+// if it's missing. X-Forwarded-For is a chain, see forwardedClientIP, the
+// other headers hold a single address set by the proxy.
+func headerClientIP(header http.Header, name string) string {
+	value := header.Get(name)
+	if value == "" {
+		return ""
+	}
+	if http.CanonicalHeaderKey(name) == "X-Forwarded-For" {
+		return forwardedClientIP(strings.Split(value, ","), forwardedHops)
+	}
+	ip := strings.TrimSpace(value)
+	if net.ParseIP(ip) == nil {
 		return ""
 	}
 	return ip
 }
 
+// isTrustedProxy reports whether the client IP headers of a request coming
+// from peer can be believed. Any peer is trusted without -trusted-proxies.
+func isTrustedProxy(peer string) bool {
+	if len(trustedProxies) == 0 {
+		return true
+	}
+	addr, err := netip.ParseAddr(peer)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedClientIP picks the client address out of an X-Forwarded-For chain.
+// Each of our hops proxies appends the address it received the request from,
+// so the client is hops entries from the right and anything before it may
+// have been forged by the client itself.
+func forwardedClientIP(parts []string, hops int) string {
+	if hops <= 0 || len(parts) < hops {
+		// With a chain shorter than expected every entry was added by one of
+		// our proxies, so the leftmost one is the closest we have to the client
+		return strings.TrimSpace(parts[0])
+	}
+	return strings.TrimSpace(parts[len(parts)-hops])
+}
+
+// ipShard is the directory the files sent from ip are stored in with
+// -shard-by ip, ip having been through sanitizeIP
+func ipShard(ip string) string {
+	if !isValidName(ip) {
+		return "unknown"
+	}
+	return ip
+}
+
 func sanitizeIP(ip string) string {
 	// Remove characters that are unsafe for filenames
 	ip = strings.ReplaceAll(ip, ":", "_")
@@ -294,15 +1367,30 @@ func sanitizeIP(ip string) string {
 	return ip
 }
 
-func respondWithError(w http.ResponseWriter, statusCode int, message string, err error) {
-	logMsg := message
-	if err != nil {
-		logMsg += " - " + err.Error()
-	}
-	log.Println("ERROR:", logMsg)
+func respondWithError(w http.ResponseWriter, statusCode int, code errorCode, message string, err error) {
+	logError(message, err)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
-	resp := map[string]string{"error": message}
+	resp := map[string]string{"error": message, "code": string(code)}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// respondWithDuplicate tells the client its content is already stored as id
+func respondWithDuplicate(w http.ResponseWriter, id string) {
+	logError("Duplicate content of "+id, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", collectionURL(id))
+	w.WriteHeader(http.StatusConflict)
+	resp := map[string]string{"error": "Duplicate content", "code": string(codeDuplicate), "id": id}
 	_ = json.NewEncoder(w).Encode(resp)
 }
+
+func logError(message string, err error) {
+	if err != nil {
+		slog.Error(message, "error", err)
+		return
+	}
+	slog.Error(message)
+}
@@ -0,0 +1,790 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMain gives the configuration its defaults and marks the service ready,
+// as the tests don't go through main. With FAPI_TEST_ARGS set the test binary runs fapi itself
+// with those arguments instead, for the tests that need a real process.
+func TestMain(m *testing.M) {
+	if args := os.Getenv("FAPI_TEST_ARGS"); args != "" {
+		os.Args = append(os.Args[:1], strings.Fields(args)...)
+		main()
+		os.Exit(0)
+	}
+	if err := parseFlags(); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
+		os.Exit(2)
+	}
+	// There is no storage self-check to wait for
+	warmedUp.Store(true)
+	setReady(true)
+	os.Exit(m.Run())
+}
+
+// doRequest serves a request to the collection routes and returns the
+// recorded response
+func doRequest(method, target, contentType, body string) *httptest.ResponseRecorder {
+	return doRequestWithHeader(method, target, contentType, body, "", "")
+}
+
+// doRequestWithHeader is doRequest with the header name set to value
+func doRequestWithHeader(method, target, contentType, body, name, value string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	if name != "" {
+		r.Header.Set(name, value)
+	}
+	rec := httptest.NewRecorder()
+	handleCollection(rec, r)
+	return rec
+}
+
+func TestCORSAllowHeaders(t *testing.T) {
+	handler := withCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("preflight reached the handler")
+	}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodOptions, "/v1/collection/orders", nil))
+
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("status %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	allowed := rec.Header().Get("Access-Control-Allow-Headers")
+	for _, header := range []string{"Content-Type", "Content-Encoding", "Authorization", "X-Callback-URL", "X-File-Extension"} {
+		if !strings.Contains(allowed, header) {
+			t.Errorf("Access-Control-Allow-Headers %q is missing %s", allowed, header)
+		}
+	}
+
+	saved := allowHeaders
+	allowHeaders = nil
+	defer func() { allowHeaders = saved }()
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodOptions, "/v1/collection/orders", nil))
+	if _, ok := rec.Header()["Access-Control-Allow-Headers"]; ok {
+		t.Error("Access-Control-Allow-Headers sent with an empty -allow-headers")
+	}
+}
+
+func TestCORSExposeHeaders(t *testing.T) {
+	handler := withCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/collection/orders", nil))
+	exposed := rec.Header().Get("Access-Control-Expose-Headers")
+	for _, header := range []string{"Location", "X-Content-Hash"} {
+		if !strings.Contains(exposed, header) {
+			t.Errorf("Access-Control-Expose-Headers %q is missing %s", exposed, header)
+		}
+	}
+	// Only the headers fapi sets are worth exposing
+	if strings.Contains(exposed, "X-Request-ID") {
+		t.Errorf("Access-Control-Expose-Headers %q has X-Request-ID, which is never sent", exposed)
+	}
+
+	saved := exposeHeaders
+	defer func() { exposeHeaders = saved }()
+	exposeHeaders = []string{"X-One", "X-Two"}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/collection/orders", nil))
+	if got := rec.Header().Get("Access-Control-Expose-Headers"); got != "X-One, X-Two" {
+		t.Errorf("Access-Control-Expose-Headers %q, want the configured headers", got)
+	}
+
+	exposeHeaders = nil
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/collection/orders", nil))
+	if _, ok := rec.Header()["Access-Control-Expose-Headers"]; ok {
+		t.Error("Access-Control-Expose-Headers sent with an empty -expose-headers")
+	}
+}
+
+// gzipped returns s gzip compressed
+func gzipped(s string) string {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, _ = gz.Write([]byte(s))
+	_ = gz.Close()
+	return buf.String()
+}
+
+func TestBodySizeLimits(t *testing.T) {
+	savedBody, savedGzip, savedDecompressed := maxBodySize, maxGzipBodySize, maxDecompressedSize
+	maxBodySize, maxGzipBodySize, maxDecompressedSize = 64, 1024, 4096
+	defer func() { maxBodySize, maxGzipBodySize, maxDecompressedSize = savedBody, savedGzip, savedDecompressed }()
+
+	// Random content compresses badly, so these stay over the limits once gzipped
+	rnd := rand.New(rand.NewPCG(1, 2))
+	noise := func(n int) string {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = "0123456789abcdef"[rnd.IntN(16)]
+		}
+		return string(b)
+	}
+
+	withWriteQueues(t, newInmemBackend(100), func() {
+		for _, tc := range []struct {
+			name, body string
+			gzip       bool
+			status     int
+		}{
+			{"uncompressed at the limit", `{"v":"` + strings.Repeat("a", 56) + `"}`, false, http.StatusAccepted},
+			{"uncompressed over the limit", `{"v":"` + strings.Repeat("a", 57) + `"}`, false, http.StatusRequestEntityTooLarge},
+			{"gzip over the uncompressed limit", `{"v":"` + noise(200) + `"}`, true, http.StatusAccepted},
+			{"gzip over the compressed limit", `{"v":"` + noise(3000) + `"}`, true, http.StatusRequestEntityTooLarge},
+			{"gzip over the decompressed limit", `{"v":"` + strings.Repeat("a", 5000) + `"}`, true, http.StatusRequestEntityTooLarge},
+		} {
+			body := tc.body
+			r := httptest.NewRequest(http.MethodPost, "/v1/collection/limits", nil)
+			if tc.gzip {
+				body = gzipped(body)
+				r.Header.Set("Content-Encoding", "gzip")
+			}
+			r.Body = io.NopCloser(strings.NewReader(body))
+			r.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			handleCollection(rec, r)
+			if rec.Code != tc.status {
+				t.Errorf("%s: status %d, want %d: %s", tc.name, rec.Code, tc.status, rec.Body)
+			}
+		}
+		drainWrites(context.Background())
+	})
+}
+
+func TestSniffGzip(t *testing.T) {
+	savedSniff, savedDecompressed := sniffGzip, maxDecompressedSize
+	defer func() { sniffGzip, maxDecompressedSize = savedSniff, savedDecompressed }()
+
+	for _, tc := range []struct {
+		name   string
+		sniff  bool
+		body   string
+		status int
+		stored string // "" when the body is stored as sent
+	}{
+		{"sniffed", true, `{"v":1}`, http.StatusAccepted, `{"v":1}`},
+		{"not sniffed", false, `{"v":1}`, http.StatusAccepted, ""},
+		{"sniffed over the decompressed limit", true, `{"v":"` + strings.Repeat("a", 5000) + `"}`, http.StatusRequestEntityTooLarge, ""},
+	} {
+		sniffGzip, maxDecompressedSize = tc.sniff, 4096
+		backend := newInmemBackend(100)
+		withWriteQueues(t, backend, func() {
+			// No Content-Encoding header
+			body := gzipped(tc.body)
+			rec := doRequest(http.MethodPost, "/v1/collection/sniff", "application/json", body)
+			drainWrites(context.Background())
+			if rec.Code != tc.status {
+				t.Fatalf("%s: status %d, want %d: %s", tc.name, rec.Code, tc.status, rec.Body)
+			}
+			var ids []string
+			_ = backend.List("sniff", func(id string, _ storedInfo) error { ids = append(ids, id); return nil })
+			if tc.status != http.StatusAccepted {
+				if len(ids) != 0 {
+					t.Errorf("%s: stored %v", tc.name, ids)
+				}
+				return
+			}
+			if len(ids) != 1 {
+				t.Fatalf("%s: stored %v, want one file", tc.name, ids)
+			}
+			want := tc.stored
+			if want == "" {
+				want = body
+			}
+			if got := readStored(t, backend, ids[0]); got != want {
+				t.Errorf("%s: stored %q, want %q", tc.name, got, want)
+			}
+		})
+	}
+}
+
+func TestCorruptGzip(t *testing.T) {
+	valid := gzipped(`{"v":"` + strings.Repeat("abc", 100) + `"}`)
+	// The trailer ends with the CRC-32 and size of the content
+	badCRC := []byte(valid)
+	badCRC[len(badCRC)-8] ^= 0xff
+
+	for _, tc := range []struct{ name, body string }{
+		{"without the trailer", valid[:len(valid)-8]},
+		{"cut in the middle", valid[:len(valid)/2]},
+		{"only the header", valid[:10]},
+		{"bad checksum", string(badCRC)},
+		{"bad header", "\x1f\x8b\x09" + valid[3:]},
+	} {
+		backend := newInmemBackend(100)
+		withWriteQueues(t, backend, func() {
+			for _, target := range []string{"/v1/collection/gz", "/v1/collection/gz/1.json"} {
+				method := http.MethodPost
+				if strings.HasSuffix(target, ".json") {
+					method = http.MethodPut
+				}
+				rec := doRequestWithHeader(method, target, "application/json", tc.body, "Content-Encoding", "gzip")
+				if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), string(codeInvalidGzip)) {
+					t.Errorf("%s: %s %s: status %d, want 400: %s", tc.name, method, target, rec.Code, rec.Body)
+				}
+			}
+			drainWrites(context.Background())
+			if id := firstStored(backend, "gz"); id != "" {
+				t.Errorf("%s: stored as %s", tc.name, id)
+			}
+		})
+	}
+
+	// The intact stream is fine
+	withWriteQueues(t, newInmemBackend(100), func() {
+		if rec := doRequestWithHeader(http.MethodPost, "/v1/collection/gz", "application/json", valid, "Content-Encoding", "gzip"); rec.Code != http.StatusAccepted {
+			t.Errorf("valid gzip: status %d: %s", rec.Code, rec.Body)
+		}
+		drainWrites(context.Background())
+	})
+}
+
+func TestRejectEmpty(t *testing.T) {
+	saved := rejectEmpty
+	defer func() { rejectEmpty = saved }()
+
+	for _, tc := range []struct {
+		name   string
+		reject bool
+		body   string
+		gzip   bool
+		status int
+	}{
+		{"empty", true, "", false, http.StatusBadRequest},
+		{"empty once decompressed", true, "", true, http.StatusBadRequest},
+		{"whitespace only", true, " \n", false, http.StatusAccepted},
+		{"normal", true, `{"a":1}`, false, http.StatusAccepted},
+		{"empty without the flag", false, "", false, http.StatusAccepted},
+	} {
+		rejectEmpty = tc.reject
+		backend := newInmemBackend(100)
+		withWriteQueues(t, backend, func() {
+			body, header := tc.body, ""
+			if tc.gzip {
+				body, header = gzipped(body), "Content-Encoding"
+			}
+			rec := doRequestWithHeader(http.MethodPost, "/v1/collection/empty", "text/plain", body, header, "gzip")
+			drainWrites(context.Background())
+			if rec.Code != tc.status {
+				t.Errorf("%s: status %d, want %d: %s", tc.name, rec.Code, tc.status, rec.Body)
+			}
+			stored := firstStored(backend, "empty") != ""
+			if want := tc.status == http.StatusAccepted; stored != want {
+				t.Errorf("%s: stored %v, want %v", tc.name, stored, want)
+			}
+		})
+	}
+}
+
+func TestAcceptStatus(t *testing.T) {
+	savedStatus, savedSync := acceptStatus, syncWrites
+	defer func() { acceptStatus, syncWrites = savedStatus, savedSync }()
+
+	for _, tc := range []struct {
+		accept int
+		sync   bool
+		query  string
+		status int
+	}{
+		{http.StatusAccepted, false, "", http.StatusAccepted},
+		{http.StatusOK, false, "", http.StatusOK},
+		{http.StatusCreated, false, "", http.StatusCreated},
+		// Once written, an upload isn't just accepted
+		{http.StatusAccepted, true, "", http.StatusCreated},
+		{http.StatusAccepted, false, "?sync=true", http.StatusCreated},
+		{http.StatusOK, true, "", http.StatusOK},
+		{http.StatusCreated, false, "?sync=1", http.StatusCreated},
+	} {
+		acceptStatus, syncWrites = tc.accept, tc.sync
+		if err := validateFlags(); err != nil {
+			t.Fatalf("-accept-status %d rejected: %v", tc.accept, err)
+		}
+		backend := newInmemBackend(100)
+		withWriteQueues(t, backend, func() {
+			rec := doRequest(http.MethodPost, "/v1/collection/status"+tc.query, "application/json", "{}")
+			if rec.Code != tc.status {
+				t.Errorf("-accept-status %d, sync %v%s: status %d, want %d", tc.accept, tc.sync, tc.query, rec.Code, tc.status)
+			}
+			// A synchronous upload is stored by the time it's answered
+			if stored := firstStored(backend, "status") != ""; (tc.sync || tc.query != "") && !stored {
+				t.Errorf("-accept-status %d, sync %v%s: answered before it was stored", tc.accept, tc.sync, tc.query)
+			}
+			drainWrites(context.Background())
+		})
+	}
+
+	acceptStatus = http.StatusNoContent
+	if err := validateFlags(); err == nil {
+		t.Error("-accept-status 204 accepted")
+	}
+}
+
+func TestJSONValidHeader(t *testing.T) {
+	saved := jsonValidHeader
+	defer func() { jsonValidHeader = saved }()
+
+	for _, tc := range []struct {
+		enabled bool
+		body    string
+		header  string
+		ext     string
+	}{
+		{true, `{"a":1}`, "true", ".json"},
+		{true, `[1,2]`, "true", ".json"},
+		{true, `{"a":`, "false", ".txt"},
+		{true, "plain text", "false", ".txt"},
+		{false, `{"a":1}`, "", ".json"},
+		{false, `{"a":`, "", ".txt"},
+	} {
+		jsonValidHeader = tc.enabled
+		backend := newInmemBackend(100)
+		withWriteQueues(t, backend, func() {
+			rec := doRequest(http.MethodPost, "/v1/collection/valid", "text/plain", tc.body)
+			drainWrites(context.Background())
+			if rec.Code != http.StatusAccepted || rec.Header().Get("X-JSON-Valid") != tc.header {
+				t.Errorf("enabled %v, %q: status %d, X-JSON-Valid %q, want %q", tc.enabled, tc.body, rec.Code, rec.Header().Get("X-JSON-Valid"), tc.header)
+			}
+			// Invalid JSON is still stored, under another extension
+			if id := firstStored(backend, "valid"); !strings.HasSuffix(id, tc.ext) {
+				t.Errorf("enabled %v, %q: stored as %q, want a %s file", tc.enabled, tc.body, id, tc.ext)
+			}
+		})
+	}
+}
+
+// failingBackend is an inmemBackend whose writes fail
+type failingBackend struct{ *inmemBackend }
+
+func (failingBackend) Store(context.Context, string, []byte) error {
+	return errors.New("disk full")
+}
+
+func TestSyncWrite(t *testing.T) {
+	backend := &gatedBackend{inmemBackend: newInmemBackend(100), collection: "sync", gate: make(chan struct{}), stored: make(chan string, 1)}
+	withWriteQueues(t, backend, func() {
+		answered := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			answered <- doRequest(http.MethodPost, "/v1/collection/sync?sync=true", "application/json", "{}")
+		}()
+
+		select {
+		case rec := <-answered:
+			t.Fatalf("answered with %d before the write was done", rec.Code)
+		case <-time.After(100 * time.Millisecond):
+		}
+		close(backend.gate)
+		rec := <-answered
+		if rec.Code != http.StatusCreated {
+			t.Errorf("status %d, want 201: %s", rec.Code, rec.Body)
+		}
+		if id := strings.TrimPrefix(rec.Header().Get("Location"), "/v1/collection/"); readStored(t, backend, id) != "{}" {
+			t.Errorf("%s not stored by the time it was answered", id)
+		}
+		drainWrites(context.Background())
+	})
+}
+
+func TestSyncWriteFailure(t *testing.T) {
+	withWriteQueues(t, failingBackend{newInmemBackend(100)}, func() {
+		rec := doRequest(http.MethodPost, "/v1/collection/sync?sync=true", "application/json", "{}")
+		if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), string(codeWriteFailed)) {
+			t.Errorf("status %d, want 500: %s", rec.Code, rec.Body)
+		}
+		// Asynchronous uploads are accepted before the write fails
+		if rec := doRequest(http.MethodPost, "/v1/collection/sync", "application/json", "{}"); rec.Code != http.StatusAccepted {
+			t.Errorf("async status %d, want 202", rec.Code)
+		}
+		drainWrites(context.Background())
+	})
+}
+
+func TestRequireContentType(t *testing.T) {
+	saved := requireContentType
+	defer func() { requireContentType = saved }()
+
+	withWriteQueues(t, newInmemBackend(100), func() {
+		for _, tc := range []struct {
+			name        string
+			require     bool
+			contentType string // sent as is when set
+			missing     bool
+			status      int
+		}{
+			{"present", true, "application/json", false, http.StatusAccepted},
+			{"empty", true, " ", false, http.StatusBadRequest},
+			{"missing", true, "", true, http.StatusBadRequest},
+			{"missing without the flag", false, "", true, http.StatusAccepted},
+		} {
+			requireContentType = tc.require
+			var rec *httptest.ResponseRecorder
+			if tc.missing {
+				rec = doRequest(http.MethodPost, "/v1/collection/typed", "", `{"id":1}`)
+			} else {
+				rec = doRequestWithHeader(http.MethodPost, "/v1/collection/typed", "", `{"id":1}`, "Content-Type", tc.contentType)
+			}
+			if rec.Code != tc.status {
+				t.Errorf("%s: status %d, want %d: %s", tc.name, rec.Code, tc.status, rec.Body)
+			}
+			if tc.status == http.StatusBadRequest && !strings.Contains(rec.Body.String(), string(codeMissingContentType)) {
+				t.Errorf("%s: body %s, want code %s", tc.name, rec.Body, codeMissingContentType)
+			}
+		}
+		drainWrites(context.Background())
+	})
+}
+
+func TestForwardedClientIP(t *testing.T) {
+	for _, tc := range []struct {
+		chain string
+		hops  int
+		want  string
+	}{
+		{"203.0.113.7", 0, "203.0.113.7"},
+		{"198.51.100.1, 203.0.113.7, 10.0.0.1", 0, "198.51.100.1"},
+		// Longer than the hops, the spoofed prefix is skipped
+		{"198.51.100.1, 203.0.113.7, 10.0.0.1", 2, "203.0.113.7"},
+		{"6.6.6.6, 198.51.100.1, 203.0.113.7, 10.0.0.1", 2, "203.0.113.7"},
+		// Exactly as long as the hops
+		{"203.0.113.7, 10.0.0.1", 2, "203.0.113.7"},
+		// Shorter than the hops, the leftmost entry is the best guess
+		{"10.0.0.1", 2, "10.0.0.1"},
+	} {
+		if got := forwardedClientIP(strings.Split(tc.chain, ","), tc.hops); got != tc.want {
+			t.Errorf("forwardedClientIP(%q, %d) = %q, want %q", tc.chain, tc.hops, got, tc.want)
+		}
+	}
+}
+
+func TestGetClientIPForwardedHops(t *testing.T) {
+	savedHops, savedHeaders := forwardedHops, clientIPHeaders
+	forwardedHops, clientIPHeaders = 2, []string{"X-Forwarded-For"}
+	defer func() { forwardedHops, clientIPHeaders = savedHops, savedHeaders }()
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/collection", nil)
+	r.RemoteAddr = "10.0.0.2:4242"
+	r.Header.Set("X-Forwarded-For", "6.6.6.6, 203.0.113.7, 10.0.0.1")
+	if got := getClientIP(r); got != "203.0.113.7" {
+		t.Errorf("getClientIP = %q, want 203.0.113.7", got)
+	}
+	r.Header.Del("X-Forwarded-For")
+	if got := getClientIP(r); got != "10.0.0.2" {
+		t.Errorf("getClientIP without the header = %q, want the peer 10.0.0.2", got)
+	}
+}
+
+func TestClientIPHeaders(t *testing.T) {
+	savedHops, savedHeaders, savedProxies := forwardedHops, clientIPHeaders, trustedProxies
+	defer func() { forwardedHops, clientIPHeaders, trustedProxies = savedHops, savedHeaders, savedProxies }()
+	forwardedHops = 0
+
+	cloudflare := []string{"CF-Connecting-IP", "X-Real-IP", "X-Forwarded-For"}
+	all := map[string]string{"CF-Connecting-IP": "198.51.100.1", "X-Real-IP": "198.51.100.2", "X-Forwarded-For": "198.51.100.3, 10.0.0.1"}
+	for _, tc := range []struct {
+		name    string
+		order   []string
+		headers map[string]string
+		want    string
+	}{
+		{"all present", cloudflare, all, "198.51.100.1"},
+		{"other order", []string{"X-Real-IP", "CF-Connecting-IP"}, all, "198.51.100.2"},
+		{"forwarded first", []string{"X-Forwarded-For", "X-Real-IP"}, all, "198.51.100.3"},
+		{"first missing", cloudflare, map[string]string{"X-Real-IP": "198.51.100.2", "X-Forwarded-For": "198.51.100.3"}, "198.51.100.2"},
+		{"only the last", cloudflare, map[string]string{"X-Forwarded-For": "198.51.100.3"}, "198.51.100.3"},
+		{"none present", cloudflare, nil, "10.0.0.2"},
+		// Headers not listed are ignored
+		{"not listed", []string{"X-Real-IP"}, map[string]string{"CF-Connecting-IP": "198.51.100.1"}, "10.0.0.2"},
+		{"no headers", nil, all, "10.0.0.2"},
+		// Invalid values are skipped for the next header
+		{"invalid", cloudflare, map[string]string{"CF-Connecting-IP": "not an ip", "X-Real-IP": " 2001:db8::1 "}, "2001:db8::1"},
+		{"all invalid", cloudflare, map[string]string{"CF-Connecting-IP": "", "X-Real-IP": "198.51.100.2:80"}, "10.0.0.2"},
+	} {
+		clientIPHeaders, trustedProxies = tc.order, nil
+		r := httptest.NewRequest(http.MethodPost, "/v1/collection", nil)
+		r.RemoteAddr = "10.0.0.2:4242"
+		for name, value := range tc.headers {
+			r.Header.Set(name, value)
+		}
+		if got := getClientIP(r); got != tc.want {
+			t.Errorf("%s: getClientIP = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	// Only trusted proxies are believed
+	clientIPHeaders = cloudflare
+	for _, tc := range []struct {
+		proxies, peer, want string
+	}{
+		{"10.0.0.0/8", "10.0.0.2", "198.51.100.1"},
+		{"10.0.0.2", "10.0.0.2", "198.51.100.1"},
+		{"10.0.0.2", "[::ffff:10.0.0.2]", "198.51.100.1"},
+		{"10.0.0.0/8, 2001:db8::/32", "[2001:db8::5]", "198.51.100.1"},
+		{"10.0.0.0/8", "192.0.2.1", "192.0.2.1"},
+		{"10.0.0.1", "10.0.0.2", "10.0.0.2"},
+	} {
+		trustedProxies = nil
+		for _, value := range strings.Split(tc.proxies, ",") {
+			prefix, err := parsePrefix(strings.TrimSpace(value))
+			if err != nil {
+				t.Fatal(err)
+			}
+			trustedProxies = append(trustedProxies, prefix)
+		}
+		r := httptest.NewRequest(http.MethodPost, "/v1/collection", nil)
+		r.RemoteAddr = tc.peer + ":4242"
+		r.Header.Set("CF-Connecting-IP", "198.51.100.1")
+		if got := getClientIP(r); got != tc.want {
+			t.Errorf("trusted %s, peer %s: getClientIP = %q, want %q", tc.proxies, tc.peer, got, tc.want)
+		}
+	}
+}
+
+func TestPathLimits(t *testing.T) {
+	handler := withPathLimits(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	for _, tc := range []struct {
+		name, path string
+		status     int
+	}{
+		{"normal", "/v1/collection/orders/1.json", http.StatusNoContent},
+		{"long segment", "/v1/collection/" + strings.Repeat("a", maxPathSegmentLen+1), http.StatusRequestURITooLong},
+		{"segment at the limit", "/v1/collection/" + strings.Repeat("a", maxPathSegmentLen), http.StatusNoContent},
+		{"too many segments", "/v1/collection" + strings.Repeat("/a", maxPathSegments), http.StatusRequestURITooLong},
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if rec.Code != tc.status {
+			t.Errorf("%s: status %d, want %d", tc.name, rec.Code, tc.status)
+		}
+	}
+}
+
+func TestBufferedWriterSize(t *testing.T) {
+	saved := writeBufferSize
+	defer func() { writeBufferSize = saved }()
+
+	for _, size := range []int{4 << 10, 64 << 10} {
+		writeBufferSize = size
+		buf := getBufferedWriter(io.Discard)
+		if buf.Size() != size {
+			t.Errorf("buffer of %d bytes, want %d", buf.Size(), size)
+		}
+		putBufferedWriter(buf)
+	}
+}
+
+// shortWriter accepts at most max bytes of each write without reporting an error
+type shortWriter struct{ max int }
+
+func (w shortWriter) Write(p []byte) (int, error) {
+	return min(len(p), w.max), nil
+}
+
+func TestShortWriteFails(t *testing.T) {
+	if _, err := writeBlock(shortWriter{max: 3}, []byte("truncated")); !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("short write returned %v, want io.ErrShortWrite", err)
+	}
+	if n, err := writeBlock(shortWriter{max: 9}, []byte("truncated")); n != 9 || err != nil {
+		t.Errorf("full write returned %d, %v", n, err)
+	}
+
+	// Through the buffer a file is written with, the short write shows up on
+	// the flush
+	buf := getBufferedWriter(shortWriter{max: 3})
+	defer putBufferedWriter(buf)
+	if _, err := writeBlock(buf, []byte("truncated")); err != nil {
+		t.Fatal(err)
+	}
+	if err := buf.Flush(); !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("flush returned %v, want io.ErrShortWrite", err)
+	}
+}
+
+func BenchmarkWriteToFile(b *testing.B) {
+	saved := writeBufferSize
+	defer func() { writeBufferSize = saved }()
+
+	payload := bytes.Repeat([]byte(`{"k":"v"},`), 64<<10/10)
+	path := b.TempDir() + "/payload.json"
+	for _, size := range []int{4 << 10, 64 << 10} {
+		b.Run(fmt.Sprintf("buffer=%dKB", size>>10), func(b *testing.B) {
+			writeBufferSize = size
+			b.SetBytes(int64(len(payload)))
+			for i := 0; i < b.N; i++ {
+				if err := writeToFile(context.Background(), payload, path, false); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestHealthBody(t *testing.T) {
+	savedFormat, savedBody, savedStatus, savedStart := healthFormat, healthBody, healthStatus, startTime
+	defer func() {
+		healthFormat, healthBody, healthStatus, startTime = savedFormat, savedBody, savedStatus, savedStart
+	}()
+	startTime = time.Now().Add(-90 * time.Second)
+
+	rec := httptest.NewRecorder()
+	handleHealth(rec, httptest.NewRequest(http.MethodGet, "/v1/health", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "OK\n" {
+		t.Errorf("default: status %d: %q", rec.Code, rec.Body)
+	}
+
+	healthFormat, healthStatus = "json", http.StatusNoContent
+	rec = httptest.NewRecorder()
+	handleHealth(rec, httptest.NewRequest(http.MethodGet, "/v1/health", nil))
+	var health struct {
+		Status  string `json:"status"`
+		UptimeS int64  `json:"uptime_s"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &health); err != nil {
+		t.Fatalf("%v: %q", err, rec.Body)
+	}
+	if rec.Code != http.StatusNoContent || health.Status != "ok" || health.UptimeS < 90 || health.UptimeS > 100 {
+		t.Errorf("json: status %d, %+v", rec.Code, health)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	saved := startTime
+	startTime = time.Now()
+	defer func() { startTime = saved }()
+
+	get := func() map[string]any {
+		rec := httptest.NewRecorder()
+		handleInfo(rec, httptest.NewRequest(http.MethodGet, "/v1/info", nil))
+		var info map[string]any
+		if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+			t.Fatalf("%v: %q", err, rec.Body)
+		}
+		for _, field := range []string{"start_time", "uptime_s", "go_version", "goroutines", "build"} {
+			if _, ok := info[field]; !ok {
+				t.Errorf("missing %s in %v", field, info)
+			}
+		}
+		return info
+	}
+
+	first := get()
+	time.Sleep(10 * time.Millisecond)
+	second := get()
+	if first["uptime_s"].(float64) >= second["uptime_s"].(float64) {
+		t.Errorf("uptime went from %v to %v", first["uptime_s"], second["uptime_s"])
+	}
+	if second["go_version"] != runtime.Version() || second["goroutines"].(float64) < 1 {
+		t.Errorf("info %v", second)
+	}
+}
+
+func TestExpectContinueRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(handleCollection))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		name, target, header string
+		status               int
+	}{
+		{"oversized", "/v1/collection/orders", fmt.Sprintf("Content-Type: application/json\r\nContent-Length: %d\r\n", maxBodySize+1), http.StatusRequestEntityTooLarge},
+		{"invalid collection", "/v1/collection/a%20b", "Content-Type: application/json\r\nContent-Length: 10\r\n", http.StatusBadRequest},
+	} {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Only the headers, the client waits for the go-ahead before the body
+		fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: fapi\r\nExpect: 100-continue\r\n%s\r\n", tc.target, tc.header)
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		// The final status comes straight away, not 100 Continue
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: status %d, want %d", tc.name, resp.StatusCode, tc.status)
+		}
+		_ = resp.Body.Close()
+		_ = conn.Close()
+	}
+}
+
+func TestFirstByteTimeout(t *testing.T) {
+	saved := firstByteTimeout
+	firstByteTimeout = 300 * time.Millisecond
+	defer func() { firstByteTimeout = saved }()
+	server := httptest.NewServer(http.HandlerFunc(handleCollection))
+	defer server.Close()
+
+	withWriteQueues(t, newInmemBackend(100), func() {
+		for _, tc := range []struct {
+			name   string
+			parts  []string
+			status int
+		}{
+			// Connects, sends the headers and then nothing
+			{"stalled", nil, http.StatusRequestTimeout},
+			// Starts in time, then takes longer than the first byte timeout
+			{"slow", []string{`{"a"`, `:1}`}, http.StatusAccepted},
+		} {
+			conn, err := net.Dial("tcp", server.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			fmt.Fprintf(conn, "POST /v1/collection/orders HTTP/1.1\r\nHost: fapi\r\nContent-Type: application/json\r\nContent-Length: 7\r\n\r\n")
+			for i, part := range tc.parts {
+				// The first part well within the timeout, the next well after
+				time.Sleep(time.Duration(100+400*i) * time.Millisecond)
+				fmt.Fprint(conn, part)
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+			if resp.StatusCode != tc.status {
+				t.Errorf("%s: status %d, want %d", tc.name, resp.StatusCode, tc.status)
+			}
+			_ = resp.Body.Close()
+			_ = conn.Close()
+		}
+		drainWrites(context.Background())
+	})
+}
@@ -0,0 +1,93 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const manifestSuffix = ".manifest.json"
+
+// pendingManifests tracks the manifests waiting for their batch, they must
+// be queued before the write queues are closed
+var pendingManifests sync.WaitGroup
+
+// batchManifest is written next to the documents of an NDJSON batch with
+// -batch-manifest, once they are all written
+type batchManifest struct {
+	BatchID    string    `json:"batch_id"`
+	Collection string    `json:"collection"`
+	ClientIP   string    `json:"client_ip"`
+	Received   time.Time `json:"received"`
+	Accepted   int       `json:"accepted"`
+	Rejected   int       `json:"rejected"`
+	Written    int       `json:"written"`
+	IDs        []string  `json:"ids"`
+	// Failed lists the accepted documents whose write failed
+	Failed []string `json:"failed,omitempty"`
+}
+
+// batchWrites tracks the queued writes of an NDJSON batch
+type batchWrites struct {
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	failed []string
+}
+
+// done records the outcome of the write of id
+func (b *batchWrites) done(id string, err error) {
+	if err != nil {
+		b.mu.Lock()
+		b.failed = append(b.failed, id)
+		b.mu.Unlock()
+	}
+	b.wg.Done()
+}
+
+// newManifestID returns the id of the manifest of a batch of ids, and the
+// batch id it is named after
+func newManifestID(collection, ip string, ids []string) (string, string) {
+	id := newStoredID(collection, ip, manifestSuffix, []byte(strings.Join(ids, "\n")), false)
+	batchID := strings.TrimSuffix(path.Base(strings.TrimSuffix(id, ".gz")), manifestSuffix)
+	return id, batchID
+}
+
+// writeManifest waits for the writes of a batch to finish, then queues its
+// manifest under id
+func writeManifest(id string, m batchManifest, writes *batchWrites) {
+	defer pendingManifests.Done()
+	writes.wg.Wait()
+	m.Failed = writes.failed
+	m.Written = len(m.IDs) - len(m.Failed)
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		logError("Failed to encode batch manifest", err)
+		return
+	}
+	// The batch has already been answered, so wait for room in the queue
+	queueFor(m.Collection) <- writeRequest{
+		data:       data,
+		id:         id,
+		collection: m.Collection,
+		enqueued:   time.Now(),
+	}
+	slog.Debug("Batch manifest queued", "id", id, "written", m.Written, "failed", len(m.Failed))
+}
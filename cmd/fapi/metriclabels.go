@@ -0,0 +1,56 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "sync"
+
+// Label values for collections without a label of their own
+const (
+	labelDefaultCollection = "_default"
+	labelOtherCollections  = "_other"
+)
+
+// labelledCollections hands out collection labels. With -metrics-collections
+// only the listed collections get one, otherwise the first
+// -max-metric-collections collections seen do. The others share "_other", so
+// clients making up collection names can't blow up the number of series.
+var labelledCollections = struct {
+	mu   sync.Mutex
+	seen map[string]bool
+}{seen: make(map[string]bool)}
+
+// collectionLabel returns the value of the collection label for collection
+func collectionLabel(collection string) string {
+	if collection == "" {
+		return labelDefaultCollection
+	}
+	if len(metricsCollections) > 0 {
+		if matchesAny(metricsCollections, collection) {
+			return collection
+		}
+		return labelOtherCollections
+	}
+
+	labelledCollections.mu.Lock()
+	defer labelledCollections.mu.Unlock()
+	if labelledCollections.seen[collection] {
+		return collection
+	}
+	if len(labelledCollections.seen) >= maxMetricLabels {
+		return labelOtherCollections
+	}
+	labelledCollections.seen[collection] = true
+	return collection
+}
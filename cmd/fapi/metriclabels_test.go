@@ -0,0 +1,81 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+// withMetricLabels runs fn with the given label settings and no collection
+// seen yet
+func withMetricLabels(t *testing.T, allowed []string, max int, fn func()) {
+	t.Helper()
+	savedAllowed, savedMax := metricsCollections, maxMetricLabels
+	labelledCollections.mu.Lock()
+	savedSeen := labelledCollections.seen
+	labelledCollections.seen = make(map[string]bool)
+	labelledCollections.mu.Unlock()
+	defer func() {
+		metricsCollections, maxMetricLabels = savedAllowed, savedMax
+		labelledCollections.mu.Lock()
+		labelledCollections.seen = savedSeen
+		labelledCollections.mu.Unlock()
+	}()
+	metricsCollections, maxMetricLabels = allowed, max
+	fn()
+}
+
+func TestMetricLabelCap(t *testing.T) {
+	withMetricLabels(t, nil, 2, func() {
+		before := map[string]uint64{}
+		for _, label := range []string{"cap-a", "cap-b", "cap-c", "cap-d", labelOtherCollections, labelDefaultCollection} {
+			before[label] = writesTotal.value(label)
+		}
+
+		withWriteQueues(t, newInmemBackend(100), func() {
+			for _, target := range []string{"/v1/collection/cap-a", "/v1/collection/cap-b", "/v1/collection/cap-c", "/v1/collection/cap-d", "/v1/collection/cap-a", "/v1/collection"} {
+				if rec := doRequest(http.MethodPost, target, "application/json", "{}"); rec.Code != http.StatusAccepted {
+					t.Fatalf("POST %s: status %d: %s", target, rec.Code, rec.Body)
+				}
+			}
+			drainWrites(context.Background())
+		})
+
+		// The first two collections keep their label, the others collapse
+		// into _other
+		for label, want := range map[string]uint64{"cap-a": 2, "cap-b": 1, "cap-c": 0, "cap-d": 0, labelOtherCollections: 2, labelDefaultCollection: 1} {
+			if got := writesTotal.value(label) - before[label]; got != want {
+				t.Errorf("writes labelled %s: %d, want %d", label, got, want)
+			}
+		}
+	})
+}
+
+func TestMetricLabelAllowList(t *testing.T) {
+	withMetricLabels(t, []string{"orders", "logs-*"}, 0, func() {
+		for collection, want := range map[string]string{
+			"orders":  "orders",
+			"logs-eu": "logs-eu",
+			"other":   labelOtherCollections,
+			"":        labelDefaultCollection,
+		} {
+			if got := collectionLabel(collection); got != want {
+				t.Errorf("collectionLabel(%q) = %q, want %q", collection, got, want)
+			}
+		}
+	})
+}
@@ -0,0 +1,230 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// collector is anything that can render itself in the Prometheus text format
+type collector interface {
+	writeProm(w io.Writer)
+}
+
+var registry []collector
+
+func register(c collector) {
+	registry = append(registry, c)
+}
+
+// Default latency buckets (in seconds), same spread as the Prometheus client
+var latencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var writeLatency = newHistogram(
+	"fapi_write_latency_seconds",
+	"Time from enqueueing a write request to the file being successfully written.",
+	latencyBuckets,
+)
+
+var (
+	writesTotal  = newCounterVec("fapi_writes_total", "Files successfully written to storage, by collection.", "collection")
+	writtenBytes = newCounterVec("fapi_written_bytes_total", "Bytes successfully written to storage before compression, by collection.", "collection")
+	writeErrors  = newCounterVec("fapi_write_errors_total", "Writes that failed and were dropped, by collection.", "collection")
+)
+
+// Body size buckets (in bytes), from 256 B to 64 MB
+var sizeBuckets = []float64{256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20}
+
+var receivedBodySize = newHistogram(
+	"fapi_request_body_bytes",
+	"Size of request bodies as received, before decompression.",
+	sizeBuckets,
+)
+
+var decodedBodySize = newHistogram(
+	"fapi_request_body_decompressed_bytes",
+	"Size of request bodies after decompression (same as received for uncompressed bodies).",
+	sizeBuckets,
+)
+
+// histogram is a minimal cumulative histogram compatible with Prometheus
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	h := &histogram{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+	register(h)
+	return h
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) writeProm(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n", h.name, h.help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", h.name)
+	for i, b := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatFloat(b), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+// counter is a monotonically increasing Prometheus counter
+type counter struct {
+	name  string
+	help  string
+	value atomic.Uint64
+}
+
+func newCounter(name, help string) *counter {
+	c := &counter{name: name, help: help}
+	register(c)
+	return c
+}
+
+func (c *counter) inc() {
+	c.value.Add(1)
+}
+
+func (c *counter) add(n uint64) {
+	c.value.Add(n)
+}
+
+func (c *counter) writeProm(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", c.name, c.help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", c.name)
+	fmt.Fprintf(w, "%s %d\n", c.name, c.value.Load())
+}
+
+// counterVec is a set of counters told apart by the values of their labels
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]uint64 // by label values joined with "\xff"
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: make(map[string]uint64)}
+	register(c)
+	return c
+}
+
+// inc increments the counter with the given label values, in the order the
+// labels were declared
+func (c *counterVec) inc(values ...string) {
+	c.add(1, values...)
+}
+
+func (c *counterVec) add(n uint64, values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[strings.Join(values, "\xff")] += n
+}
+
+// total returns the sum of the counters for all label values
+func (c *counterVec) total() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var sum uint64
+	for _, v := range c.values {
+		sum += v
+	}
+	return sum
+}
+
+func (c *counterVec) writeProm(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n", c.name, c.help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", c.name)
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		pairs := make([]string, len(c.labels))
+		for i, v := range strings.Split(k, "\xff") {
+			pairs[i] = fmt.Sprintf("%s=%q", c.labels[i], v)
+		}
+		fmt.Fprintf(w, "%s{%s} %d\n", c.name, strings.Join(pairs, ","), c.values[k])
+	}
+}
+
+// gaugeFunc is a gauge whose value is read when metrics are scraped
+type gaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+func newGaugeFunc(name, help string, fn func() float64) *gaugeFunc {
+	g := &gaugeFunc{name: name, help: help, fn: fn}
+	register(g)
+	return g
+}
+
+func (g *gaugeFunc) writeProm(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", g.name, g.help)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", g.name)
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.fn()))
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, c := range registry {
+		c.writeProm(w)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// snapshot returns the observation count and sum of h
+func (h *histogram) snapshot() (uint64, float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count, h.sum
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	h := &histogram{name: "test_seconds", help: "Test.", buckets: []float64{.1, 1}, counts: make([]uint64, 2)}
+	for _, v := range []float64{.05, .5, 2} {
+		h.observe(v)
+	}
+	var out bytes.Buffer
+	h.writeProm(&out)
+	for _, line := range []string{
+		`test_seconds_bucket{le="0.1"} 1`,
+		`test_seconds_bucket{le="1"} 2`,
+		`test_seconds_bucket{le="+Inf"} 3`,
+		"test_seconds_sum 2.55",
+		"test_seconds_count 3",
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("missing %q in\n%s", line, out.String())
+		}
+	}
+}
+
+func TestWriteLatencyObserved(t *testing.T) {
+	const writes, delay = 5, 20 * time.Millisecond
+	countBefore, sumBefore := writeLatency.snapshot()
+
+	withWriteQueues(t, slowBackend{newInmemBackend(100), delay}, func() {
+		for i := 0; i < writes; i++ {
+			if rec := doRequest(http.MethodPost, "/v1/collection/latency", "application/json", "{}"); rec.Code != http.StatusAccepted {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+		}
+		drainWrites(context.Background())
+	})
+
+	count, sum := writeLatency.snapshot()
+	if count-countBefore != writes {
+		t.Errorf("%d writes observed, want %d", count-countBefore, writes)
+	}
+	// Each write took at least the delay of the backend, waiting in the queue included
+	if got := sum - sumBefore; got < writes*delay.Seconds() {
+		t.Errorf("observed %fs in total, want at least %fs", got, writes*delay.Seconds())
+	}
+}
+
+func TestBodySizesObserved(t *testing.T) {
+	plain, compressed := `{"v":"`+strings.Repeat("a", 1000)+`"}`, gzipped(`{"v":"`+strings.Repeat("b", 3000)+`"}`)
+	receivedCount, receivedSum := receivedBodySize.snapshot()
+	decodedCount, decodedSum := decodedBodySize.snapshot()
+
+	withWriteQueues(t, newInmemBackend(100), func() {
+		doRequest(http.MethodPost, "/v1/collection/sizes", "application/json", plain)
+		doRequestWithHeader(http.MethodPost, "/v1/collection/sizes", "application/json", compressed, "Content-Encoding", "gzip")
+		drainWrites(context.Background())
+	})
+
+	count, sum := receivedBodySize.snapshot()
+	if count-receivedCount != 2 || sum-receivedSum != float64(len(plain)+len(compressed)) {
+		t.Errorf("received sizes: %d observations of %g bytes, want 2 of %d", count-receivedCount, sum-receivedSum, len(plain)+len(compressed))
+	}
+	count, sum = decodedBodySize.snapshot()
+	if count-decodedCount != 2 || sum-decodedSum != float64(len(plain)+3008) {
+		t.Errorf("decompressed sizes: %d observations of %g bytes, want 2 of %d", count-decodedCount, sum-decodedSum, len(plain)+3008)
+	}
+}
+
+// value returns the counter with the given label values
+func (c *counterVec) value(values ...string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[strings.Join(values, "\xff")]
+}
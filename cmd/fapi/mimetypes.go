@@ -0,0 +1,111 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"mime"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// extensionPattern is what the extensions X-File-Extension may name look like
+var extensionPattern = regexp.MustCompile(`^\.[a-z0-9]{1,16}$`)
+
+// extensionsByType maps the media types we recognise to file extensions
+var extensionsByType = map[string]string{
+	"application/json":     ".json",
+	"application/x-ndjson": ".ndjson",
+	"application/xml":      ".xml",
+	"text/xml":             ".xml",
+	"text/csv":             ".csv",
+	"text/html":            ".html",
+	"text/plain":           ".txt",
+	"application/pdf":      ".pdf",
+	"application/zip":      ".zip",
+	"application/gzip":     ".gz",
+	"application/x-gzip":   ".gz",
+	"image/png":            ".png",
+	"image/jpeg":           ".jpg",
+	"image/gif":            ".gif",
+	"image/webp":           ".webp",
+}
+
+func init() {
+	// Make sure retrieval serves these back with the right Content-Type, even
+	// on systems without a mime.types file
+	for ctype, ext := range extensionsByType {
+		if mime.TypeByExtension(ext) == "" {
+			_ = mime.AddExtensionType(ext, ctype)
+		}
+	}
+}
+
+// extensionFor picks the file extension of a body that isn't valid JSON. The
+// declared Content-Type wins if we know it, otherwise the content is sniffed.
+func extensionFor(body []byte, declared string) string {
+	if mediaType, _, err := mime.ParseMediaType(declared); err == nil {
+		if ext, ok := extensionsByType[mediaType]; ok && ext != ".json" {
+			return ext
+		}
+	}
+
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(body))
+	if ext, ok := extensionsByType[sniffed]; ok && ext != ".json" {
+		return ext
+	}
+	return ".bin"
+}
+
+// normalizeExtension lowercases ext and adds its leading dot if missing
+func normalizeExtension(ext string) string {
+	ext = strings.ToLower(strings.TrimSpace(ext))
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	return ext
+}
+
+// isAllowedExtension reports whether uploads may ask to be stored with ext,
+// one of the extensions of the media types we recognise or of
+// -file-extensions. .gz is left to -compress-storage.
+func isAllowedExtension(ext string) bool {
+	if !extensionPattern.MatchString(ext) || ext == ".gz" {
+		return false
+	}
+	for _, known := range extensionsByType {
+		if ext == known {
+			return true
+		}
+	}
+	return slices.Contains(extraExtensions, ext)
+}
+
+// requestedExtension returns the extension named by the X-File-Extension
+// header of r, empty if it has none. On failure the error response has
+// already been sent.
+func requestedExtension(w http.ResponseWriter, r *http.Request) (string, bool) {
+	value := r.Header.Get("X-File-Extension")
+	if value == "" {
+		return "", true
+	}
+	ext := normalizeExtension(value)
+	if !isAllowedExtension(ext) {
+		respondWithError(w, http.StatusBadRequest, codeInvalidExtension, "File extension not allowed", nil)
+		return "", false
+	}
+	return ext, true
+}
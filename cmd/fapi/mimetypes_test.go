@@ -0,0 +1,112 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestExtensionFor(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+	for _, tc := range []struct {
+		name, body, declared, want string
+	}{
+		{"declared xml", "<order/>", "application/xml", ".xml"},
+		{"declared csv", "id,name\n1,a\n", "text/csv; charset=utf-8", ".csv"},
+		{"sniffed xml", "<?xml version=\"1.0\"?><order/>", "", ".xml"},
+		{"sniffed png", png, "application/octet-stream", ".png"},
+		{"sniffed gzip", "\x1f\x8b\x08\x00\x00\x00\x00\x00", "", ".gz"},
+		{"sniffed text", "just some words", "", ".txt"},
+		{"binary", "\x00\x01\x02\x03", "", ".bin"},
+		// Declared JSON that isn't is typed by its content
+		{"invalid json", "{oops", "application/json", ".txt"},
+	} {
+		if got := extensionFor([]byte(tc.body), tc.declared); got != tc.want {
+			t.Errorf("%s: extensionFor = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestUploadExtensions(t *testing.T) {
+	withWriteQueues(t, newInmemBackend(100), func() {
+		for _, tc := range []struct {
+			body, contentType, want string
+		}{
+			{`{"id":1}`, "text/plain", ".json"},
+			{"id,name\n1,a\n", "text/csv", ".csv"},
+			{"\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", "", ".png"},
+		} {
+			rec := doRequest(http.MethodPost, "/v1/collection/typed", tc.contentType, tc.body)
+			if location := rec.Header().Get("Location"); !strings.HasSuffix(location, tc.want) {
+				t.Errorf("%q stored at %q, want a %s", tc.body, location, tc.want)
+			}
+		}
+		drainWrites(context.Background())
+	})
+}
+
+func TestExtensionHeader(t *testing.T) {
+	saved := extraExtensions
+	extraExtensions = []string{".geojson"}
+	defer func() { extraExtensions = saved }()
+
+	backend := newInmemBackend(100)
+	withWriteQueues(t, backend, func() {
+		for _, tc := range []struct {
+			header, body string
+			status       int
+			want         string
+		}{
+			// Without the header the extension is detected
+			{"", `{"id":1}`, http.StatusAccepted, ".json"},
+			{"", "just some words", http.StatusAccepted, ".txt"},
+			{"geojson", `{"type":"Point"}`, http.StatusAccepted, ".geojson"},
+			{".GeoJSON", `{"type":"Point"}`, http.StatusAccepted, ".geojson"},
+			{"csv", "just some words", http.StatusAccepted, ".csv"},
+			{"json", "{oops", http.StatusBadRequest, string(codeInvalidJSON)},
+			{"exe", "MZ", http.StatusBadRequest, string(codeInvalidExtension)},
+			{"gz", "\x1f\x8b\x08", http.StatusBadRequest, string(codeInvalidExtension)},
+			{"../json", `{}`, http.StatusBadRequest, string(codeInvalidExtension)},
+			{"json/x", `{}`, http.StatusBadRequest, string(codeInvalidExtension)},
+			{"js on", `{}`, http.StatusBadRequest, string(codeInvalidExtension)},
+			{strings.Repeat("a", 17), `{}`, http.StatusBadRequest, string(codeInvalidExtension)},
+		} {
+			rec := doRequestWithHeader(http.MethodPost, "/v1/collection/typed", "", tc.body, "X-File-Extension", tc.header)
+			if rec.Code != tc.status {
+				t.Errorf("X-File-Extension %q: status %d, want %d: %s", tc.header, rec.Code, tc.status, rec.Body)
+				continue
+			}
+			if tc.status == http.StatusAccepted {
+				if location := rec.Header().Get("Location"); !strings.HasSuffix(location, tc.want) {
+					t.Errorf("X-File-Extension %q: stored at %q, want a %s", tc.header, location, tc.want)
+				}
+			} else if !strings.Contains(rec.Body.String(), tc.want) {
+				t.Errorf("X-File-Extension %q: %s, want %s", tc.header, rec.Body, tc.want)
+			}
+		}
+		drainWrites(context.Background())
+	})
+	stored := 0
+	_ = backend.List("typed", func(string, storedInfo) error {
+		stored++
+		return nil
+	})
+	if stored != 5 {
+		t.Errorf("%d files stored, want 5", stored)
+	}
+}
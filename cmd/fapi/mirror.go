@@ -0,0 +1,236 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	mirrorQueueCap = 1000
+	mirrorWorkers  = 2
+	mirrorAttempts = 3
+	mirrorTimeout  = 10 * time.Second
+)
+
+// mirrorRequest is an accepted upload waiting to be forwarded to -mirror-url
+type mirrorRequest struct {
+	collection string
+	// method and id are set for uploads to a given id, which are sent to
+	// the same id. Others are POSTed to the collection.
+	method string
+	id     string
+	header http.Header
+	data   []byte
+	// file, if set, holds the body instead of data. It belongs to the
+	// mirror and is removed once sent.
+	file string
+}
+
+// mirrorQueue is only set when -mirror-url is configured
+var mirrorQueue chan mirrorRequest
+
+// mirrorRunning tracks the mirror workers
+var mirrorRunning sync.WaitGroup
+
+var mirrorClient = &http.Client{Timeout: mirrorTimeout}
+
+var (
+	mirrorSent    = newCounter("fapi_mirror_sent_total", "Uploads forwarded to the mirror.")
+	mirrorFailed  = newCounter("fapi_mirror_failed_total", "Uploads the mirror did not accept after all retries.")
+	mirrorDropped = newCounter("fapi_mirror_dropped_total", "Uploads not forwarded to the mirror because its queue was full.")
+)
+
+// mirrorHeadersSkipped are not forwarded, the mirrored body is already
+// decompressed and the rest only applies to the original connection. The
+// body is the one received, before -transcode-charset and -transform, so the
+// mirror applies them itself and the other headers still describe it.
+var mirrorHeadersSkipped = []string{
+	"Connection", "Content-Encoding", "Content-Length", "Keep-Alive",
+	"Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+	// The mirror would call back too, the credentials are ours, and a
+	// retried request could be refused by the -max-clock-skew of the mirror
+	"X-Callback-URL", "Authorization",
+}
+
+func startMirror() {
+	mirrorQueue = make(chan mirrorRequest, mirrorQueueCap)
+	for i := 0; i < mirrorWorkers; i++ {
+		mirrorRunning.Add(1)
+		go mirrorWorker()
+	}
+}
+
+// mirrorUpload queues body, as received in r, for forwarding to the
+// collection on the mirror. It never blocks, the upload is dropped if the
+// mirror can't keep up.
+func mirrorUpload(r *http.Request, collection string, body []byte) {
+	mirror(r, mirrorRequest{collection: collection, data: body}, "")
+}
+
+// mirrorItem is mirrorUpload for the PUT or PATCH of body to id
+func mirrorItem(r *http.Request, collection, id string, body []byte) {
+	mirror(r, mirrorRequest{collection: collection, method: r.Method, id: id, data: body}, "")
+}
+
+// mirrorLink gives the mirror its own link to the upload assembled in path,
+// so it outlives the write. It returns an empty path without a mirror.
+func mirrorLink(path string) string {
+	if mirrorQueue == nil {
+		return ""
+	}
+	link := path + ".mirror"
+	if err := os.Link(path, link); err != nil {
+		mirrorFailed.inc()
+		slog.Error("Failed to mirror upload", "file", path, "error", err)
+		return ""
+	}
+	return link
+}
+
+// mirrorFile is mirrorItem for an upload assembled from chunks, PUT to id on
+// the mirror from link, see mirrorLink
+func mirrorFile(r *http.Request, collection, id, link string) {
+	if link == "" {
+		return
+	}
+	if !mirror(r, mirrorRequest{collection: collection, method: http.MethodPut, id: id, file: link}, "") {
+		_ = os.Remove(link)
+	}
+}
+
+// mirrorLine is mirrorUpload for a line of an NDJSON batch or stream, sent
+// on its own as a JSON document
+func mirrorLine(r *http.Request, collection string, line []byte) {
+	if mirrorQueue == nil {
+		return
+	}
+	// The line is in a buffer the scanner reuses
+	mirror(r, mirrorRequest{collection: collection, data: bytes.Clone(line)}, "application/json")
+}
+
+// mirror queues req with the headers of r, and contentType instead of its
+// Content-Type if set. It reports whether req was queued.
+func mirror(r *http.Request, req mirrorRequest, contentType string) bool {
+	if mirrorQueue == nil {
+		return false
+	}
+	req.header = r.Header.Clone()
+	for _, h := range mirrorHeadersSkipped {
+		req.header.Del(h)
+	}
+	if eventTimeHeader != "" {
+		req.header.Del(eventTimeHeader)
+	}
+	if contentType != "" {
+		req.header.Set("Content-Type", contentType)
+	}
+	select {
+	case mirrorQueue <- req:
+		return true
+	default:
+		mirrorDropped.inc()
+		slog.Warn("Mirror queue full, upload not mirrored", "collection", req.collection)
+		return false
+	}
+}
+
+func mirrorWorker() {
+	defer mirrorRunning.Done()
+	for req := range mirrorQueue {
+		err := sendToMirror(req)
+		if req.file != "" {
+			if removeErr := os.Remove(req.file); removeErr != nil {
+				logError("Failed to remove "+req.file, removeErr)
+			}
+		}
+		if err != nil {
+			mirrorFailed.inc()
+			slog.Error("Failed to mirror upload", "collection", req.collection, "error", err)
+			continue
+		}
+		mirrorSent.inc()
+	}
+}
+
+// sendToMirror sends req to the same collection or id on the mirror,
+// retrying network errors and 5xx or 429 responses with a growing delay
+func sendToMirror(req mirrorRequest) error {
+	path := req.collection
+	if req.id != "" {
+		path = req.id
+	}
+	target, err := url.JoinPath(mirrorURL, "v1/collection", path)
+	if err != nil {
+		return err
+	}
+
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		retry, err := postToMirror(target, req)
+		if err == nil || !retry || attempt == mirrorAttempts {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// postToMirror sends req once and reports whether a failure is worth retrying
+func postToMirror(target string, req mirrorRequest) (bool, error) {
+	method := req.method
+	if method == "" {
+		method = http.MethodPost
+	}
+	var body io.Reader = bytes.NewReader(req.data)
+	size := int64(len(req.data))
+	if req.file != "" {
+		f, err := os.Open(req.file)
+		if err != nil {
+			return false, err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return false, err
+		}
+		body, size = f, info.Size()
+	}
+	out, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return false, err
+	}
+	out.ContentLength = size
+	out.Header = req.header.Clone()
+
+	resp, err := mirrorClient.Do(out)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("mirror responded with status %d", resp.StatusCode)
+	}
+	return false, nil
+}
@@ -0,0 +1,184 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// mirrored is a request received by the test mirror
+type mirrored struct {
+	method, path, contentType, encoding, custom string
+	body                                        string
+}
+
+// withMirror runs fn with -mirror-url pointing at a test server, and returns
+// the requests it received. fn must call drainWrites
+func withMirror(t *testing.T, fn func()) []mirrored {
+	t.Helper()
+	got := make(chan mirrored, 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- mirrored{r.Method, r.URL.Path, r.Header.Get("Content-Type"), r.Header.Get("Content-Encoding"), r.Header.Get("X-Custom"), string(body)}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	saved := mirrorURL
+	mirrorURL = server.URL
+	startMirror()
+	defer func() {
+		mirrorURL = saved
+		mirrorQueue = nil
+	}()
+	// fn drains the writes, which also sends the queued mirror requests
+	fn()
+	close(got)
+
+	var requests []mirrored
+	for m := range got {
+		requests = append(requests, m)
+	}
+	return requests
+}
+
+func TestMirrorPost(t *testing.T) {
+	requests := withMirror(t, func() {
+		withWriteQueues(t, newInmemBackend(100), func() {
+			rec := doRequestWithHeader(http.MethodPost, "/v1/collection/orders", "application/json", `{"id":1}`, "X-Custom", "kept")
+			if rec.Code != http.StatusAccepted {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+			drainWrites(context.Background())
+		})
+	})
+	want := mirrored{http.MethodPost, "/v1/collection/orders", "application/json", "", "kept", `{"id":1}`}
+	if len(requests) != 1 || requests[0] != want {
+		t.Errorf("mirrored %+v, want %+v", requests, want)
+	}
+}
+
+func TestMirrorRawBody(t *testing.T) {
+	saved := transcodeCharset
+	transcodeCharset = true
+	defer func() { transcodeCharset = saved }()
+
+	// {"a":1} in UTF-16LE, with a byte order mark
+	utf16 := "\xff\xfe{\x00\"\x00a\x00\"\x00:\x001\x00}\x00"
+	requests := withMirror(t, func() {
+		withWriteQueues(t, newInmemBackend(100), func() {
+			rec := doRequest(http.MethodPost, "/v1/collection/orders", "application/json; charset=utf-16", utf16)
+			if rec.Code != http.StatusAccepted {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+			drainWrites(context.Background())
+		})
+	})
+	// Sent as received, so the charset still matches the body
+	if len(requests) != 1 || requests[0].body != utf16 || requests[0].contentType != "application/json; charset=utf-16" {
+		t.Errorf("mirrored %+v", requests)
+	}
+}
+
+func TestMirrorItemsAndLines(t *testing.T) {
+	saved := splitNDJSON
+	splitNDJSON = true
+	defer func() { splitNDJSON = saved }()
+
+	requests := withMirror(t, func() {
+		withWriteQueues(t, newInmemBackend(100), func() {
+			for _, tc := range []struct{ method, target, contentType, body string }{
+				{http.MethodPut, "/v1/collection/orders/1.json", "application/json", `{"id":1}`},
+				{http.MethodPatch, "/v1/collection/orders/log.json", "application/json", `{"id":2}`},
+				{http.MethodPost, "/v1/collection/orders", "application/x-ndjson", "{\"id\":3}\n{\"id\":4}\n"},
+			} {
+				if rec := doRequest(tc.method, tc.target, tc.contentType, tc.body); rec.Code >= 300 {
+					t.Fatalf("%s %s: status %d: %s", tc.method, tc.target, rec.Code, rec.Body)
+				}
+			}
+			drainWrites(context.Background())
+		})
+	})
+
+	want := map[mirrored]bool{
+		{http.MethodPut, "/v1/collection/orders/1.json", "application/json", "", "", `{"id":1}`}:     true,
+		{http.MethodPatch, "/v1/collection/orders/log.json", "application/json", "", "", `{"id":2}`}: true,
+		{http.MethodPost, "/v1/collection/orders", "application/json", "", "", `{"id":3}`}:           true,
+		{http.MethodPost, "/v1/collection/orders", "application/json", "", "", `{"id":4}`}:           true,
+	}
+	if len(requests) != len(want) {
+		t.Fatalf("got %d mirrored requests, want %d: %+v", len(requests), len(want), requests)
+	}
+	for _, m := range requests {
+		if !want[m] {
+			t.Errorf("unexpected mirrored request %+v", m)
+		}
+	}
+}
+
+func TestMirrorChunked(t *testing.T) {
+	var dir string
+	requests := withMirror(t, func() {
+		withChunkDir(t, newInmemBackend(100), func() {
+			putChunk(t, "chunks/mirrored.txt", 0, "alpha,")
+			putChunk(t, "chunks/mirrored.txt", 1, "beta")
+			if rec := doRequest(http.MethodPost, "/v1/collection/chunks/mirrored.txt/complete", "", ""); rec.Code != http.StatusAccepted {
+				t.Fatalf("complete: status %d: %s", rec.Code, rec.Body)
+			}
+			dir = chunkDir
+		})
+	})
+	want := mirrored{http.MethodPut, "/v1/collection/chunks/mirrored.txt", "", "", "", "alpha,beta"}
+	if len(requests) != 1 || requests[0] != want {
+		t.Errorf("mirrored %+v, want %+v", requests, want)
+	}
+	// The link of the mirror is removed once sent
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("%d files left in the chunk directory", len(entries))
+	}
+}
+
+func TestMirrorHeadersStripped(t *testing.T) {
+	savedQueue, savedHeader := mirrorQueue, eventTimeHeader
+	mirrorQueue, eventTimeHeader = make(chan mirrorRequest, 1), "X-Event-Time"
+	defer func() { mirrorQueue, eventTimeHeader = savedQueue, savedHeader }()
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/collection/orders", nil)
+	for h, v := range map[string]string{
+		"Authorization":  "Bearer secret",
+		"X-Callback-URL": "https://example.com/hook",
+		"X-Event-Time":   "Mon, 02 Jan 2006 15:04:05 GMT",
+		"X-Custom":       "kept",
+	} {
+		r.Header.Set(h, v)
+	}
+	if !mirror(r, mirrorRequest{collection: "orders", method: http.MethodPost}, "") {
+		t.Fatal("not queued")
+	}
+	req := <-mirrorQueue
+	for _, h := range []string{"Authorization", "X-Callback-URL", "X-Event-Time"} {
+		if v := req.header.Get(h); v != "" {
+			t.Errorf("%s forwarded: %q", h, v)
+		}
+	}
+	if req.header.Get("X-Custom") != "kept" {
+		t.Error("X-Custom not forwarded")
+	}
+}
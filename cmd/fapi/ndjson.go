@@ -0,0 +1,300 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+)
+
+// maxBatchErrors caps the per-line errors reported for an NDJSON batch
+const maxBatchErrors = 100
+
+var oversizedRecords = newCounter("fapi_oversized_records_total",
+	"Lines of NDJSON batches and streams rejected for being over -max-record-size.")
+
+// batchSummary is the response to an NDJSON batch upload
+type batchSummary struct {
+	Accepted int         `json:"accepted"`
+	Rejected int         `json:"rejected"`
+	IDs      []string    `json:"ids"`
+	Errors   []lineError `json:"errors,omitempty"`
+	// BatchID and Manifest, the id of its manifest, are set with
+	// -batch-manifest
+	BatchID  string `json:"batch_id,omitempty"`
+	Manifest string `json:"manifest,omitempty"`
+	// Error is set when reading the batch failed part way through
+	Error string `json:"error,omitempty"`
+}
+
+// lineError describes a rejected line, Offset is the position of its first
+// byte in the (decompressed) batch
+type lineError struct {
+	Line   int    `json:"line"`
+	Offset int64  `json:"offset"`
+	Code   string `json:"code"`
+	Error  string `json:"error"`
+}
+
+// isNDJSONBatch reports whether r should be split into one upload per line
+func isNDJSONBatch(r *http.Request) bool {
+	if !splitNDJSON {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/x-ndjson"
+}
+
+// handleNDJSONBatch stores each line of an NDJSON body as its own upload. The
+// body is read line by line, so a batch is never held in memory as a whole.
+// Every line gets the eventTime of the request.
+func handleNDJSONBatch(w http.ResponseWriter, r *http.Request, collection string, eventTime time.Time) {
+	body, ok := openBody(w, r)
+	if !ok {
+		return
+	}
+	defer r.Body.Close()
+
+	ip, client := sanitizeIP(getClientIP(r)), quotaClient(r)
+	if ip == "" {
+		ip = "unknown"
+	}
+
+	summary := batchSummary{IDs: []string{}}
+	sc := newLineScanner(body)
+	received := clk.Now().UTC()
+	var writes *batchWrites
+	if batchManifests {
+		writes = &batchWrites{}
+	}
+
+	for line := 1; sc.Scan(); line++ {
+		doc := bytes.TrimSpace(sc.Bytes())
+		if len(doc) == 0 && !sc.tooLong {
+			continue
+		}
+		var id, msg string
+		var code errorCode
+		if sc.tooLong {
+			oversizedRecords.inc()
+			code, msg = codeBodyTooLarge, recordTooLarge()
+		} else {
+			id, code, msg = storeBatchLine(r.Context(), collection, ip, client, doc, eventTime, writes)
+		}
+		if code != "" {
+			summary.Rejected++
+			if len(summary.Errors) < maxBatchErrors {
+				summary.Errors = append(summary.Errors, lineError{Line: line, Offset: sc.lineStart, Code: string(code), Error: msg})
+			}
+			continue
+		}
+		summary.Accepted++
+		summary.IDs = append(summary.IDs, id)
+		mirrorLine(r, collection, doc)
+	}
+
+	receivedBodySize.observe(float64(body.received.n))
+	decodedBodySize.observe(float64(sc.offset))
+
+	status := http.StatusAccepted
+	err := sc.Err()
+	if err == nil {
+		err = body.close()
+	}
+	if err != nil {
+		switch {
+		case isMaxBytesError(err):
+			status, summary.Error = http.StatusRequestEntityTooLarge, "Request body too large"
+		case errors.Is(err, errDecompressRatio):
+			status, summary.Error = http.StatusRequestEntityTooLarge, "Decompression ratio too high"
+		case body.isGzip && isGzipError(err, body.received):
+			status, summary.Error = http.StatusBadRequest, "Invalid gzip data"
+		case recordCancelled(r, phaseReadBody, body.received.err) == reasonDeadlineExceeded:
+			status, summary.Error = http.StatusRequestTimeout, "Request body not received in time"
+		default:
+			status, summary.Error = http.StatusBadRequest, "Failed to read request body"
+		}
+		logError(summary.Error, err)
+	} else if body.isGzip && sc.offset > maxDecompressedSize {
+		status, summary.Error = http.StatusRequestEntityTooLarge, "Decompressed body too large"
+		logError(summary.Error, nil)
+	}
+
+	if writes != nil {
+		summary.Manifest, summary.BatchID = newManifestID(collection, ip, summary.IDs)
+		pendingManifests.Add(1)
+		go writeManifest(summary.Manifest, batchManifest{
+			BatchID:    summary.BatchID,
+			Collection: collection,
+			ClientIP:   ip,
+			Received:   received,
+			Accepted:   summary.Accepted,
+			Rejected:   summary.Rejected,
+			IDs:        summary.IDs,
+		}, writes)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(summary)
+}
+
+// lineScanner splits a body into lines, keeping track of where each line
+// starts. Lines over -max-record-size are skipped rather than failing the
+// whole body: they come back empty with tooLong set.
+type lineScanner struct {
+	*bufio.Scanner
+	// offset is the number of bytes consumed, lineStart the offset of the
+	// last line returned
+	offset, lineStart int64
+	// tooLong is set when the last line returned was over the limit
+	tooLong bool
+	// skipping is set while consuming a line over the limit
+	skipping bool
+}
+
+func newLineScanner(r io.Reader) *lineScanner {
+	limit := recordSizeLimit()
+	ls := &lineScanner{Scanner: bufio.NewScanner(r)}
+	// Leave room for the line ending, so the limit is always hit before the
+	// buffer is full
+	ls.Buffer(make([]byte, 0, min(64<<10, limit+2)), int(limit+2))
+	ls.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		start := ls.offset
+		advance, token, err := ls.split(data, atEOF, limit)
+		if token != nil && !ls.tooLong {
+			ls.lineStart = start
+		}
+		ls.offset += int64(advance)
+		return advance, token, err
+	})
+	return ls
+}
+
+// split is bufio.ScanLines, except that lines over limit are consumed as they
+// come in and returned as an empty token
+func (ls *lineScanner) split(data []byte, atEOF bool, limit int64) (int, []byte, error) {
+	i := bytes.IndexByte(data, '\n')
+	if !ls.skipping {
+		ls.tooLong = false
+		line := data
+		if i >= 0 {
+			line = bytes.TrimSuffix(data[:i], []byte{'\r'})
+		}
+		if int64(len(line)) <= limit {
+			return bufio.ScanLines(data, atEOF)
+		}
+		ls.lineStart = ls.offset
+		ls.skipping = true
+	}
+
+	switch {
+	case i >= 0:
+	case atEOF:
+		i = len(data) - 1
+	default:
+		return len(data), nil, nil
+	}
+	ls.skipping = false
+	ls.tooLong = true
+	return i + 1, []byte{}, nil
+}
+
+// recordSizeLimit returns the maximum size of a line of a batch or stream
+func recordSizeLimit() int64 {
+	if maxRecordSize > 0 {
+		return maxRecordSize
+	}
+	return maxBodySize
+}
+
+// recordTooLarge is the error message of a line over recordSizeLimit
+func recordTooLarge() string {
+	return fmt.Sprintf("Line longer than %d bytes", recordSizeLimit())
+}
+
+// storeBatchLine validates one JSON document of a batch and queues it for
+// writing, charging it to the quota of client. It waits for room in a full
+// queue until ctx is done, so a large batch is slowed down rather than partly
+// refused. If batch is set the write is tracked there. On failure it returns
+// the error code and message of the line.
+func storeBatchLine(ctx context.Context, collection, ip, client string, doc []byte, eventTime time.Time, batch *batchWrites) (string, errorCode, string) {
+	if !json.Valid(doc) {
+		return "", codeInvalidJSON, "Invalid JSON"
+	}
+	if code, msg, violations := checkJSON(doc, collection); code != "" {
+		if len(violations) > 0 {
+			msg = fmt.Sprintf("%s: %s %s", msg, violations[0].Path, violations[0].Message)
+		}
+		return "", code, msg
+	}
+
+	// The scanner reuses its buffer, the queued write needs its own copy
+	data, err := prepareJSON(bytes.Clone(doc), appendMode)
+	if err != nil {
+		return "", codeInvalidJSON, "Invalid JSON"
+	}
+
+	if uploadQuota != nil {
+		if ok, reset := uploadQuota.allow(client, len(data)); !ok {
+			return "", codeQuotaExceeded, "Daily upload quota exceeded, it resets at " + reset.Format(time.RFC3339)
+		}
+	}
+
+	id := newStoredID(collection, ip, ".json", data, appendMode)
+
+	var hash string
+	if recentHashes != nil {
+		hash = contentHash(data)
+		if existing, added := recentHashes.addIfAbsent(collection, hash, id); !added {
+			refundQuota(client, len(data))
+			return "", codeDuplicate, "Duplicate content of " + existing
+		}
+	}
+
+	req := writeRequest{
+		data:       data,
+		id:         id,
+		collection: collection,
+		enqueued:   time.Now(),
+		appendLine: appendMode,
+		batch:      batch,
+		eventTime:  eventTime,
+	}
+	if batch != nil {
+		batch.wg.Add(1)
+	}
+	select {
+	case queueFor(collection) <- req:
+		return id, "", ""
+	case <-ctx.Done():
+	}
+	if batch != nil {
+		batch.wg.Done()
+	}
+	if recentHashes != nil {
+		recentHashes.remove(collection, hash)
+	}
+	refundQuota(client, len(data))
+	return "", codeQueueFull, "Write queue full"
+}
@@ -0,0 +1,197 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postBatch sends body as an NDJSON batch and returns its summary
+func postBatch(t *testing.T, collection, body string) batchSummary {
+	t.Helper()
+	rec := doRequest(http.MethodPost, "/v1/collection/"+collection, "application/x-ndjson", body)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var summary batchSummary
+	if err := json.Unmarshal(rec.Body.Bytes(), &summary); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body)
+	}
+	return summary
+}
+
+func TestNDJSONBatchSummary(t *testing.T) {
+	saved := splitNDJSON
+	splitNDJSON = true
+	defer func() { splitNDJSON = saved }()
+
+	backend := newInmemBackend(100)
+	withWriteQueues(t, backend, func() {
+		body := "{\"n\":1}\nnot json\n\n{\"n\":2}\n{\"n\":\n{\"n\":3}"
+		summary := postBatch(t, "batch", body)
+		drainWrites(context.Background())
+
+		if summary.Accepted != 3 || summary.Rejected != 2 || len(summary.IDs) != 3 {
+			t.Fatalf("got %+v, want 3 accepted and 2 rejected", summary)
+		}
+		for i, id := range summary.IDs {
+			if got, want := readStored(t, backend, id), fmt.Sprintf(`{"n":%d}`, i+1); got != want {
+				t.Errorf("%s holds %s, want %s", id, got, want)
+			}
+		}
+		// Lines are counted from 1, offsets from 0, empty lines included
+		want := []lineError{
+			{Line: 2, Offset: int64(strings.Index(body, "not json")), Code: string(codeInvalidJSON)},
+			{Line: 5, Offset: int64(strings.Index(body, "{\"n\":\n")), Code: string(codeInvalidJSON)},
+		}
+		if len(summary.Errors) != len(want) {
+			t.Fatalf("errors %+v, want %+v", summary.Errors, want)
+		}
+		for i, e := range summary.Errors {
+			if e.Line != want[i].Line || e.Offset != want[i].Offset || e.Code != want[i].Code || e.Error == "" {
+				t.Errorf("error %+v, want %+v", e, want[i])
+			}
+		}
+	})
+}
+
+func TestNDJSONBatchBackpressure(t *testing.T) {
+	saved := splitNDJSON
+	splitNDJSON = true
+	defer func() { splitNDJSON = saved }()
+
+	// Twice as many lines as the queue holds, written slower than they arrive
+	const lines = 2 * writeQueueCap
+	backend := slowBackend{newInmemBackend(lines), 2 * time.Millisecond}
+	withWriteQueues(t, backend, func() {
+		summary := postBatch(t, "backpressure", strings.Repeat("{}\n", lines))
+		drainWrites(context.Background())
+		if summary.Accepted != lines || summary.Rejected != 0 {
+			t.Errorf("got %d accepted and %d rejected, want all %d accepted: %+v", summary.Accepted, summary.Rejected, lines, summary.Errors)
+		}
+	})
+}
+
+func TestNDJSONBatchErrorsCapped(t *testing.T) {
+	saved := splitNDJSON
+	splitNDJSON = true
+	defer func() { splitNDJSON = saved }()
+
+	withWriteQueues(t, newInmemBackend(100), func() {
+		summary := postBatch(t, "batch", strings.Repeat("not json\n", maxBatchErrors+5)+"{}\n")
+		drainWrites(context.Background())
+		if summary.Accepted != 1 || summary.Rejected != maxBatchErrors+5 || len(summary.Errors) != maxBatchErrors {
+			t.Errorf("%d accepted, %d rejected with %d errors reported", summary.Accepted, summary.Rejected, len(summary.Errors))
+		}
+	})
+}
+
+func TestNDJSONBatchRecordLimits(t *testing.T) {
+	savedSplit, savedSize, savedDepth := splitNDJSON, maxRecordSize, maxJSONDepth
+	splitNDJSON, maxRecordSize, maxJSONDepth = true, 50, 5
+	defer func() { splitNDJSON, maxRecordSize, maxJSONDepth = savedSplit, savedSize, savedDepth }()
+
+	big := `{"big":"` + strings.Repeat("x", 100) + `"}`
+	deep := strings.Repeat("[", 6) + strings.Repeat("]", 6)
+	// A line of exactly the limit is fine, its line ending isn't counted
+	exact := `{"s":"` + strings.Repeat("y", 42) + `"}`
+	body := "{\"n\":1}\n" + big + "\n{\"n\":2}\r\n" + deep + "\n" + exact + "\r\n" + big
+	oversized := oversizedRecords.value.Load()
+
+	backend := newInmemBackend(100)
+	withWriteQueues(t, backend, func() {
+		summary := postBatch(t, "records", body)
+		drainWrites(context.Background())
+
+		if summary.Accepted != 3 || summary.Rejected != 3 || summary.Error != "" {
+			t.Fatalf("got %+v, want 3 accepted and 3 rejected", summary)
+		}
+		if got := readStored(t, backend, summary.IDs[2]); got != exact {
+			t.Errorf("line at the limit stored as %q", got)
+		}
+		want := []lineError{
+			{Line: 2, Offset: int64(strings.Index(body, big)), Code: string(codeBodyTooLarge)},
+			{Line: 4, Offset: int64(strings.Index(body, deep)), Code: string(codeJSONTooDeep)},
+			{Line: 6, Offset: int64(strings.LastIndex(body, big)), Code: string(codeBodyTooLarge)},
+		}
+		if len(summary.Errors) != len(want) {
+			t.Fatalf("errors %+v, want %+v", summary.Errors, want)
+		}
+		for i, e := range summary.Errors {
+			if e.Line != want[i].Line || e.Offset != want[i].Offset || e.Code != want[i].Code {
+				t.Errorf("error %+v, want %+v", e, want[i])
+			}
+		}
+	})
+	if n := oversizedRecords.value.Load() - oversized; n != 2 {
+		t.Errorf("%d oversized records counted, want 2", n)
+	}
+}
+
+func TestNDJSONBatchManifest(t *testing.T) {
+	savedSplit, savedManifests := splitNDJSON, batchManifests
+	splitNDJSON = true
+	defer func() { splitNDJSON, batchManifests = savedSplit, savedManifests }()
+
+	for _, enabled := range []bool{true, false} {
+		batchManifests = enabled
+		backend := newInmemBackend(100)
+		withWriteQueues(t, backend, func() {
+			summary := postBatch(t, "manifest", "{\"n\":1}\n{\"n\":\n{\"n\":2}\n{\"n\":3}\n")
+			drainWrites(context.Background())
+
+			var stored []string
+			_ = backend.List("manifest", func(id string, _ storedInfo) error {
+				stored = append(stored, id)
+				return nil
+			})
+			if !enabled {
+				if summary.BatchID != "" || summary.Manifest != "" || len(stored) != 3 {
+					t.Errorf("without -batch-manifest: %+v, stored %v", summary, stored)
+				}
+				return
+			}
+
+			if summary.Accepted != 3 || summary.BatchID == "" || !strings.HasPrefix(summary.Manifest, "manifest/"+summary.BatchID) {
+				t.Fatalf("summary %+v", summary)
+			}
+			var m batchManifest
+			if err := json.Unmarshal([]byte(readStored(t, backend, summary.Manifest)), &m); err != nil {
+				t.Fatal(err)
+			}
+			if m.BatchID != summary.BatchID || m.Collection != "manifest" || m.ClientIP != "192.0.2.1" || m.Received.IsZero() ||
+				m.Accepted != 3 || m.Rejected != 1 || m.Written != 3 || len(m.Failed) != 0 {
+				t.Errorf("manifest %+v", m)
+			}
+			// Exactly the ids produced, which are all the documents stored
+			// besides the manifest
+			if !slices.Equal(m.IDs, summary.IDs) {
+				t.Errorf("manifest lists %v, batch produced %v", m.IDs, summary.IDs)
+			}
+			stored = slices.DeleteFunc(stored, func(id string) bool { return id == summary.Manifest })
+			slices.Sort(stored)
+			if ids := slices.Sorted(slices.Values(m.IDs)); !slices.Equal(stored, ids) {
+				t.Errorf("stored %v, manifest lists %v", stored, ids)
+			}
+		})
+	}
+}
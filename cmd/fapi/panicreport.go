@@ -0,0 +1,76 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const panicReportTimeout = 5 * time.Second
+
+type panicReport struct {
+	Message   string    `json:"message"`
+	Stack     string    `json:"stack"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	RequestID string    `json:"request_id,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+var panicReportClient = &http.Client{Timeout: panicReportTimeout}
+
+// reportPanic sends a panic report to the configured webhook in the
+// background. Failures are logged and otherwise ignored. The returned channel
+// is closed once the report is sent.
+func reportPanic(rec any, stack []byte, r *http.Request) <-chan struct{} {
+	done := make(chan struct{})
+	if panicWebhookURL == "" {
+		close(done)
+		return done
+	}
+
+	report := panicReport{
+		Message:   fmt.Sprint(rec),
+		Stack:     string(stack),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		RequestID: r.Header.Get("X-Request-ID"),
+		Time:      time.Now().UTC(),
+	}
+
+	go func() {
+		defer close(done)
+		payload, err := json.Marshal(report)
+		if err != nil {
+			slog.Error("Failed to encode panic report", "error", err)
+			return
+		}
+		resp, err := panicReportClient.Post(panicWebhookURL, "application/json", bytes.NewReader(payload))
+		if err != nil {
+			slog.Error("Failed to send panic report", "error", err)
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			slog.Error("Panic webhook responded with an error", "status", resp.StatusCode)
+		}
+	}()
+	return done
+}
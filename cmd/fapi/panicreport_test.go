@@ -0,0 +1,110 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPanicReport(t *testing.T) {
+	reports := make(chan panicReport, 1)
+	release := make(chan struct{})
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report panicReport
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+			t.Errorf("decoding the report: %v", err)
+		}
+		reports <- report
+		// A slow sink must not hold up the response
+		<-release
+	}))
+	defer webhook.Close()
+	defer close(release)
+
+	saved := panicWebhookURL
+	panicWebhookURL = webhook.URL
+	defer func() { panicWebhookURL = saved }()
+
+	handler := withRecover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+	r := httptest.NewRequest(http.MethodPost, "/v1/collection/orders", nil)
+	r.Header.Set("X-Request-ID", "req-42")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status %d, want 500", rec.Code)
+	}
+
+	select {
+	case report := <-reports:
+		if report.Message != "boom" || report.Method != http.MethodPost || report.Path != "/v1/collection/orders" || report.RequestID != "req-42" {
+			t.Errorf("report %+v", report)
+		}
+		if !strings.Contains(report.Stack, "TestPanicReport") || report.Time.IsZero() {
+			t.Errorf("report without a stack or time: %+v", report)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no panic report received")
+	}
+}
+
+func TestPanicPolicyExit(t *testing.T) {
+	if os.Getenv("FAPI_TEST_PANIC") != "" {
+		// In the subprocess, the panic must end the process with status 2
+		panicPolicy = "log-and-exit"
+		panicWebhookURL = os.Getenv("FAPI_TEST_PANIC")
+		handler := withRecover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("boom")
+		}))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/collection/orders", nil))
+		t.Fatal("still running after the panic")
+	}
+
+	reported := make(chan struct{}, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reported <- struct{}{}
+	}))
+	defer webhook.Close()
+
+	var out bytes.Buffer
+	cmd := exec.Command(os.Args[0], "-test.run=^TestPanicPolicyExit$")
+	cmd.Env = append(os.Environ(), "FAPI_TEST_PANIC="+webhook.URL)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 2 {
+		t.Fatalf("subprocess exited with %v, want status 2\n%s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "Panic, exiting") || !strings.Contains(out.String(), "TestPanicPolicyExit") {
+		t.Errorf("panic and stack not logged:\n%s", out.String())
+	}
+	// The report is sent before exiting
+	select {
+	case <-reported:
+	default:
+		t.Error("no panic report received")
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// quotaSaveInterval is how often the usage is saved with -quota-file
+	quotaSaveInterval = time.Minute
+	// maxQuotaClients caps the clients whose usage is tracked each day, the
+	// ones seen after that share quotaOtherClients
+	maxQuotaClients   = 100000
+	quotaOtherClients = "_other"
+)
+
+// dailyQuota limits the number and total size of the uploads each client IP
+// can make per day. Usage resets at midnight UTC.
+type dailyQuota struct {
+	maxBytes   int64
+	maxCount   int64
+	maxClients int
+
+	mu    sync.Mutex
+	day   time.Time
+	usage map[string]*quotaUsage
+}
+
+type quotaUsage struct {
+	Bytes int64 `json:"bytes"`
+	Count int64 `json:"count"`
+}
+
+// quotaState is the content of -quota-file
+type quotaState struct {
+	Day   time.Time              `json:"day"`
+	Usage map[string]*quotaUsage `json:"usage"`
+}
+
+// uploadQuota is only set when -daily-quota-bytes or -daily-quota-count is
+// greater than zero
+var uploadQuota *dailyQuota
+
+// quotaClient returns the address the uploads of r are charged to. The client
+// IP headers only count once -trusted-proxies says who may set them,
+// otherwise a made up X-Forwarded-For would get a fresh quota.
+func quotaClient(r *http.Request) string {
+	if len(trustedProxies) > 0 {
+		return getClientIP(r)
+	}
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return peer
+}
+
+// chargeQuota charges an upload of size bytes from r to the quota of its
+// client, if quotas are set, and returns the client for refundQuota. On
+// failure the error response has already been sent.
+func chargeQuota(w http.ResponseWriter, r *http.Request, size int) (string, bool) {
+	client := quotaClient(r)
+	if uploadQuota == nil {
+		return client, true
+	}
+	if ok, reset := uploadQuota.allow(client, size); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(reset.Sub(clk.Now()).Seconds())+1))
+		respondWithError(w, http.StatusTooManyRequests, codeQuotaExceeded,
+			"Daily upload quota exceeded, it resets at "+reset.Format(time.RFC3339), nil)
+		return "", false
+	}
+	return client, true
+}
+
+// refundQuota refunds an upload of size bytes from client, if quotas are set
+func refundQuota(client string, size int) {
+	if uploadQuota != nil {
+		uploadQuota.refund(client, size)
+	}
+}
+
+func newDailyQuota(maxBytes, maxCount int64) *dailyQuota {
+	return &dailyQuota{
+		maxBytes:   maxBytes,
+		maxCount:   maxCount,
+		maxClients: maxQuotaClients,
+		usage:      make(map[string]*quotaUsage),
+	}
+}
+
+// today starts a new day of usage if the last one is over, and returns the
+// time it resets at. q.mu must be held.
+func (q *dailyQuota) today() time.Time {
+	day := clk.Now().UTC().Truncate(24 * time.Hour)
+	if !day.Equal(q.day) {
+		q.day = day
+		q.usage = make(map[string]*quotaUsage)
+	}
+	return day.Add(24 * time.Hour)
+}
+
+// allow charges an upload of size bytes to ip if it fits in the quota. It
+// returns false and the time the quota resets at otherwise. An upload that
+// is charged but then not accepted must be refunded. Once maxClients are
+// tracked for the day, new ones are charged to quotaOtherClients together.
+func (q *dailyQuota) allow(ip string, size int) (bool, time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	reset := q.today()
+
+	u, ok := q.usage[ip]
+	if !ok {
+		if len(q.usage) >= q.maxClients {
+			ip = quotaOtherClients
+		}
+		if u, ok = q.usage[ip]; !ok {
+			u = &quotaUsage{}
+			q.usage[ip] = u
+		}
+	}
+	if q.maxCount > 0 && u.Count+1 > q.maxCount {
+		return false, reset
+	}
+	if q.maxBytes > 0 && u.Bytes+int64(size) > q.maxBytes {
+		return false, reset
+	}
+	u.Count++
+	u.Bytes += int64(size)
+	return true, reset
+}
+
+// refund gives back the charge of an upload of size bytes that was allowed
+// but then rejected. Nothing is given back once the quota has reset.
+func (q *dailyQuota) refund(ip string, size int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.today()
+	u, ok := q.usage[ip]
+	if !ok {
+		if u, ok = q.usage[quotaOtherClients]; !ok {
+			return
+		}
+	}
+	u.Count = max(u.Count-1, 0)
+	u.Bytes = max(u.Bytes-int64(size), 0)
+}
+
+// load restores the usage saved in path, if it is from today
+func (q *dailyQuota) load(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state quotaState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("invalid quota file %s: %w", path, err)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.today()
+	if state.Day.Equal(q.day) && state.Usage != nil {
+		q.usage = state.Usage
+	}
+	return nil
+}
+
+// save writes the usage to path, replacing it atomically
+func (q *dailyQuota) save(path string) error {
+	q.mu.Lock()
+	data, err := json.Marshal(quotaState{Day: q.day, Usage: q.usage})
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".quota-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// saveEvery saves the usage to path every interval
+func (q *dailyQuota) saveEvery(path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := q.save(path); err != nil {
+			slog.Error("Failed to save quota usage", "path", path, "error", err)
+		}
+	}
+}
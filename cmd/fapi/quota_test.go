@@ -0,0 +1,256 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDailyQuotaUnderQuota(t *testing.T) {
+	withFakeClock(t, time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC))
+	q := newDailyQuota(100, 3)
+	for i := 0; i < 2; i++ {
+		if ok, _ := q.allow("10.0.0.1", 10); !ok {
+			t.Fatalf("upload %d rejected under quota", i)
+		}
+	}
+	// Quotas are per IP
+	if ok, _ := q.allow("10.0.0.2", 100); !ok {
+		t.Fatal("other IP rejected under quota")
+	}
+}
+
+func TestDailyQuotaAtQuota(t *testing.T) {
+	withFakeClock(t, time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC))
+
+	count := newDailyQuota(0, 2)
+	count.allow("ip", 1)
+	if ok, _ := count.allow("ip", 1); !ok {
+		t.Fatal("upload reaching the count quota rejected")
+	}
+	ok, reset := count.allow("ip", 1)
+	if ok {
+		t.Fatal("upload over the count quota allowed")
+	}
+	if want := time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC); !reset.Equal(want) {
+		t.Errorf("reset = %v, want %v", reset, want)
+	}
+
+	size := newDailyQuota(100, 0)
+	if ok, _ := size.allow("ip", 100); !ok {
+		t.Fatal("upload reaching the byte quota rejected")
+	}
+	if ok, _ := size.allow("ip", 1); ok {
+		t.Fatal("upload over the byte quota allowed")
+	}
+}
+
+func TestDailyQuotaReset(t *testing.T) {
+	c := withFakeClock(t, time.Date(2024, 3, 1, 23, 59, 0, 0, time.UTC))
+	q := newDailyQuota(0, 1)
+	q.allow("ip", 1)
+	if ok, _ := q.allow("ip", 1); ok {
+		t.Fatal("upload over the quota allowed")
+	}
+	c.Advance(time.Minute)
+	if ok, _ := q.allow("ip", 1); !ok {
+		t.Fatal("upload rejected after midnight UTC")
+	}
+}
+
+func TestDailyQuotaRefund(t *testing.T) {
+	withFakeClock(t, time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC))
+	q := newDailyQuota(10, 1)
+	q.allow("ip", 10)
+	q.refund("ip", 10)
+	if ok, _ := q.allow("ip", 10); !ok {
+		t.Fatal("refunded upload still counted")
+	}
+	// Refunding more than was charged doesn't go negative
+	q.refund("ip", 10)
+	q.refund("ip", 10)
+	q.allow("ip", 10)
+	if ok, _ := q.allow("ip", 1); ok {
+		t.Fatal("upload over the quota allowed after extra refunds")
+	}
+}
+
+func TestDailyQuotaPersisted(t *testing.T) {
+	c := withFakeClock(t, time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC))
+	path := filepath.Join(t.TempDir(), "quota.json")
+
+	q := newDailyQuota(0, 1)
+	if err := q.load(path); err != nil {
+		t.Fatalf("load of a missing file: %v", err)
+	}
+	q.allow("ip", 1)
+	if err := q.save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newDailyQuota(0, 1)
+	if err := restarted.load(path); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := restarted.allow("ip", 1); ok {
+		t.Fatal("usage not restored")
+	}
+
+	// Usage from a previous day is discarded
+	c.Advance(24 * time.Hour)
+	nextDay := newDailyQuota(0, 1)
+	if err := nextDay.load(path); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := nextDay.allow("ip", 1); !ok {
+		t.Fatal("usage of the previous day restored")
+	}
+}
+
+func TestRejectedUploadNotCharged(t *testing.T) {
+	withFakeClock(t, time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC))
+	uploadQuota = newDailyQuota(0, 2)
+	recentHashes = newHashLRU(10)
+	defer func() {
+		uploadQuota = nil
+		recentHashes = nil
+	}()
+
+	withWriteQueues(t, newInmemBackend(100), func() {
+		for i, tc := range []struct {
+			body string
+			want int
+		}{
+			{`{"a":1}`, http.StatusAccepted},
+			{`{"a":1}`, http.StatusConflict},
+			{`{"a":2}`, http.StatusAccepted},
+			{`{"a":3}`, http.StatusTooManyRequests},
+		} {
+			rec := doRequest(http.MethodPost, "/v1/collection/quota", "application/json", tc.body)
+			if rec.Code != tc.want {
+				t.Errorf("upload %d: status %d, want %d: %s", i, rec.Code, tc.want, rec.Body)
+			}
+		}
+		drainWrites(context.Background())
+	})
+}
+
+func TestQuotaEveryWritePath(t *testing.T) {
+	withFakeClock(t, time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC))
+	defer func() { uploadQuota = nil }()
+
+	for _, tc := range []struct {
+		name   string
+		upload func(i int) *httptest.ResponseRecorder
+	}{
+		{"POST", func(i int) *httptest.ResponseRecorder {
+			return doRequest(http.MethodPost, "/v1/collection/quota", "application/json", fmt.Sprintf(`{"a":%d}`, i))
+		}},
+		{"PUT", func(i int) *httptest.ResponseRecorder {
+			return doRequest(http.MethodPut, fmt.Sprintf("/v1/collection/quota/%d.json", i), "application/json", "{}")
+		}},
+		{"PATCH", func(i int) *httptest.ResponseRecorder {
+			return doRequest(http.MethodPatch, "/v1/collection/quota/log.ndjson", "application/json", "{}")
+		}},
+		{"NDJSON", func(i int) *httptest.ResponseRecorder {
+			return doRequest(http.MethodPost, "/v1/collection/quota", "application/x-ndjson", fmt.Sprintf(`{"a":%d}`, i))
+		}},
+		{"chunks", func(i int) *httptest.ResponseRecorder {
+			id := fmt.Sprintf("quota/%d.bin", i)
+			doRequest(http.MethodPost, "/v1/collection/"+id+"/chunks/0", "application/octet-stream", "data")
+			return doRequest(http.MethodPost, "/v1/collection/"+id+"/complete", "", "")
+		}},
+	} {
+		uploadQuota = newDailyQuota(0, 1)
+		withChunkDir(t, newInmemBackend(100), func() {
+			if rec := tc.upload(1); rec.Code >= 300 {
+				t.Fatalf("%s: first upload: status %d: %s", tc.name, rec.Code, rec.Body)
+			}
+			rec := tc.upload(2)
+			if !strings.Contains(rec.Body.String(), string(codeQuotaExceeded)) {
+				t.Errorf("%s: upload over the quota: status %d: %s", tc.name, rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+func TestQuotaClient(t *testing.T) {
+	withFakeClock(t, time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC))
+	savedProxies := trustedProxies
+	uploadQuota = newDailyQuota(0, 1)
+	defer func() {
+		uploadQuota = nil
+		trustedProxies = savedProxies
+	}()
+
+	upload := func(forwardedFor string) int {
+		return doRequestWithHeader(http.MethodPost, "/v1/collection/quota", "application/json", "{}", "X-Forwarded-For", forwardedFor).Code
+	}
+	withWriteQueues(t, newInmemBackend(100), func() {
+		// Without -trusted-proxies a made up header doesn't get a new quota
+		trustedProxies = nil
+		if status := upload("198.51.100.1"); status != http.StatusAccepted {
+			t.Errorf("first upload: status %d", status)
+		}
+		if status := upload("198.51.100.2"); status != http.StatusTooManyRequests {
+			t.Errorf("upload with another X-Forwarded-For: status %d, want 429", status)
+		}
+
+		// From a trusted proxy the header names the client
+		trustedProxies = []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+		if status := upload("198.51.100.3"); status != http.StatusAccepted {
+			t.Errorf("upload of another client through a trusted proxy: status %d", status)
+		}
+		if status := upload("198.51.100.3"); status != http.StatusTooManyRequests {
+			t.Errorf("second upload of that client: status %d, want 429", status)
+		}
+		drainWrites(context.Background())
+	})
+}
+
+func TestDailyQuotaClientsCapped(t *testing.T) {
+	withFakeClock(t, time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC))
+	q := newDailyQuota(0, 2)
+	q.maxClients = 2
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"} {
+		if ok, _ := q.allow(ip, 1); !ok {
+			t.Fatalf("first upload of %s rejected", ip)
+		}
+	}
+	// The clients over the cap share one quota
+	if ok, _ := q.allow("10.0.0.5", 1); ok {
+		t.Error("upload over the shared quota allowed")
+	}
+	if n := len(q.usage); n != 3 {
+		t.Errorf("usage of %d clients tracked, want 3", n)
+	}
+	// Refunds go back to the shared quota
+	q.refund("10.0.0.5", 1)
+	if ok, _ := q.allow("10.0.0.6", 1); !ok {
+		t.Error("refund of the shared quota lost")
+	}
+	// The known clients keep their own
+	if ok, _ := q.allow("10.0.0.1", 1); !ok {
+		t.Error("tracked client charged to the shared quota")
+	}
+}
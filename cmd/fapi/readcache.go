@@ -0,0 +1,167 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	readCacheHits   = newCounter("fapi_read_cache_hits_total", "Retrievals served from the read cache.")
+	readCacheMisses = newCounter("fapi_read_cache_misses_total", "Retrievals that had to read from storage.")
+)
+
+// cachedBackend keeps recently retrieved files in memory in front of another
+// backend, up to maxBytes in total. The least recently retrieved files are
+// evicted first. Writes and deletes go to the backend and drop the cached
+// copy.
+type cachedBackend struct {
+	StorageBackend
+	maxBytes int64
+
+	mu    sync.Mutex
+	size  int64
+	order *list.List // of *cachedFile, least recently used at the front
+	files map[string]*list.Element
+	// gen changes on every invalidation, so a file read from the backend
+	// while it was being replaced isn't cached
+	gen uint64
+}
+
+type cachedFile struct {
+	id   string
+	data []byte
+	info storedInfo
+}
+
+func newCachedBackend(backend StorageBackend, maxBytes int64) *cachedBackend {
+	b := &cachedBackend{
+		StorageBackend: backend,
+		maxBytes:       maxBytes,
+		order:          list.New(),
+		files:          make(map[string]*list.Element),
+	}
+	_ = newGaugeFunc("fapi_read_cache_bytes", "Total size of the files held in the read cache.", func() float64 {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return float64(b.size)
+	})
+	return b
+}
+
+func (b *cachedBackend) Open(id string) (io.ReadSeekCloser, storedInfo, error) {
+	b.mu.Lock()
+	if el, ok := b.files[id]; ok {
+		b.order.MoveToBack(el)
+		f := el.Value.(*cachedFile)
+		b.mu.Unlock()
+		readCacheHits.inc()
+		return nopCloser{bytes.NewReader(f.data)}, f.info, nil
+	}
+	gen := b.gen
+	b.mu.Unlock()
+	readCacheMisses.inc()
+
+	rc, info, err := b.StorageBackend.Open(id)
+	// A file taking more than a quarter of the cache would evict too much
+	if err != nil || info.Size > b.maxBytes/4 {
+		return rc, info, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, storedInfo{}, err
+	}
+	b.add(gen, &cachedFile{id: id, data: data, info: info})
+	return nopCloser{bytes.NewReader(data)}, info, nil
+}
+
+// add caches f unless something was invalidated since gen, evicting the
+// least recently used files to make room
+func (b *cachedBackend) add(gen uint64, f *cachedFile) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if gen != b.gen {
+		return
+	}
+	if el, ok := b.files[f.id]; ok {
+		b.remove(el)
+	}
+	b.files[f.id] = b.order.PushBack(f)
+	b.size += int64(len(f.data))
+	for b.size > b.maxBytes {
+		b.remove(b.order.Front())
+	}
+}
+
+// remove drops a cached file. Must be called with mu held.
+func (b *cachedBackend) remove(el *list.Element) {
+	f := b.order.Remove(el).(*cachedFile)
+	delete(b.files, f.id)
+	b.size -= int64(len(f.data))
+}
+
+// invalidate drops the cached copy of id, or of everything if id is empty
+func (b *cachedBackend) invalidate(id string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.gen++
+	if id == "" {
+		b.order.Init()
+		clear(b.files)
+		b.size = 0
+		return
+	}
+	if el, ok := b.files[id]; ok {
+		b.remove(el)
+	}
+}
+
+func (b *cachedBackend) Store(ctx context.Context, id string, data []byte) error {
+	defer b.invalidate(id)
+	return b.StorageBackend.Store(ctx, id, data)
+}
+
+func (b *cachedBackend) StoreFile(ctx context.Context, id, path string) error {
+	defer b.invalidate(id)
+	return b.StorageBackend.StoreFile(ctx, id, path)
+}
+
+func (b *cachedBackend) SetEventTime(id string, t time.Time) error {
+	defer b.invalidate(id)
+	return b.StorageBackend.SetEventTime(id, t)
+}
+
+func (b *cachedBackend) Append(ctx context.Context, id string, data []byte) error {
+	defer b.invalidate(id)
+	return b.StorageBackend.Append(ctx, id, data)
+}
+
+func (b *cachedBackend) Delete(id string) error {
+	defer b.invalidate(id)
+	return b.StorageBackend.Delete(id)
+}
+
+func (b *cachedBackend) Cleanup(before time.Time, collection string) (cleanupResult, error) {
+	defer b.invalidate("")
+	return b.StorageBackend.Cleanup(before, collection)
+}
@@ -0,0 +1,134 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// countingBackend is an inmemBackend counting the files opened
+type countingBackend struct {
+	*inmemBackend
+	opens atomic.Int32
+}
+
+func (b *countingBackend) Open(id string) (io.ReadSeekCloser, storedInfo, error) {
+	b.opens.Add(1)
+	return b.inmemBackend.Open(id)
+}
+
+func TestReadCache(t *testing.T) {
+	backend := &countingBackend{inmemBackend: newInmemBackend(100)}
+	cache := newCachedBackend(backend, 100)
+	ctx := context.Background()
+	opened := func(id, want string, opens int32) {
+		t.Helper()
+		if got := readStored(t, cache, id); got != want {
+			t.Errorf("%s = %q, want %q", id, got, want)
+		}
+		if n := backend.opens.Load(); n != opens {
+			t.Errorf("after reading %s: %d opens of the storage, want %d", id, n, opens)
+		}
+	}
+
+	if err := cache.Store(ctx, "orders/1.json", []byte(`{"v":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	hits, misses := readCacheHits.value.Load(), readCacheMisses.value.Load()
+	opened("orders/1.json", `{"v":1}`, 1)
+	opened("orders/1.json", `{"v":1}`, 1)
+	if readCacheHits.value.Load()-hits != 1 || readCacheMisses.value.Load()-misses != 1 {
+		t.Errorf("%d hits and %d misses, want 1 and 1", readCacheHits.value.Load()-hits, readCacheMisses.value.Load()-misses)
+	}
+
+	// Overwriting, appending and deleting drop the cached copy
+	if err := cache.Store(ctx, "orders/1.json", []byte(`{"v":2}`)); err != nil {
+		t.Fatal(err)
+	}
+	opened("orders/1.json", `{"v":2}`, 2)
+	if err := cache.Append(ctx, "orders/1.json", []byte("\n")); err != nil {
+		t.Fatal(err)
+	}
+	opened("orders/1.json", "{\"v\":2}\n", 3)
+	if err := cache.Delete("orders/1.json"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cache.Open("orders/1.json"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Open after Delete: %v, want not exist", err)
+	}
+
+	// The least recently read files are evicted past the size limit
+	backend.opens.Store(0)
+	content := strings.Repeat("x", 20)
+	for _, id := range []string{"a", "b", "c", "d", "e", "f"} {
+		if err := cache.Store(ctx, "evict/"+id, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, id := range []string{"a", "b", "c", "d", "e"} {
+		opened("evict/"+id, content, int32(i+1))
+	}
+	opened("evict/a", content, 5)
+	// f makes room by evicting b, a was read again since
+	opened("evict/f", content, 6)
+	opened("evict/a", content, 6)
+	opened("evict/b", content, 7)
+
+	// Files over a quarter of the cache aren't kept
+	if err := cache.Store(ctx, "big/1", []byte(strings.Repeat("x", 26))); err != nil {
+		t.Fatal(err)
+	}
+	opened("big/1", strings.Repeat("x", 26), 8)
+	opened("big/1", strings.Repeat("x", 26), 9)
+}
+
+func TestReadCacheRetrieval(t *testing.T) {
+	backend := &countingBackend{inmemBackend: newInmemBackend(100)}
+	cache := newCachedBackend(backend, 1<<20)
+	if err := cache.Store(context.Background(), "orders/1.json", []byte(`{"v":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	withWriteQueues(t, cache, func() {
+		for i := 0; i < 3; i++ {
+			if rec := doRequest(http.MethodGet, "/v1/collection/orders/1.json", "", ""); rec.Body.String() != `{"v":1}` {
+				t.Fatalf("GET: status %d: %s", rec.Code, rec.Body)
+			}
+		}
+		if n := backend.opens.Load(); n != 1 {
+			t.Errorf("%d opens of the storage for 3 GETs, want 1", n)
+		}
+
+		if rec := doRequest(http.MethodPut, "/v1/collection/orders/1.json", "application/json", `{"v":2}`); rec.Code >= 300 {
+			t.Fatalf("PUT: status %d: %s", rec.Code, rec.Body)
+		}
+		drainWrites(context.Background())
+		if rec := doRequest(http.MethodGet, "/v1/collection/orders/1.json", "", ""); rec.Body.String() != `{"v":2}` {
+			t.Errorf("GET after overwriting: status %d: %s", rec.Code, rec.Body)
+		}
+		if rec := doRequest(http.MethodDelete, "/v1/collection/orders/1.json", "", ""); rec.Code >= 300 {
+			t.Fatalf("DELETE: status %d: %s", rec.Code, rec.Body)
+		}
+		if rec := doRequest(http.MethodGet, "/v1/collection/orders/1.json", "", ""); rec.Code != http.StatusNotFound {
+			t.Errorf("GET after deleting: status %d, want 404", rec.Code)
+		}
+	})
+}
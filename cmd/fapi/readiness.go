@@ -0,0 +1,113 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// warmedUp is set once the storage passed its first self-check
+var warmedUp atomic.Bool
+
+// readiness is the state of the subsystems /v1/ready depends on
+type readiness struct {
+	Status string `json:"status"`
+	// DiskWritable is false from a failed write until a write or the
+	// storage self-check succeeds again
+	DiskWritable bool `json:"disk_writable"`
+	// QueueOK is false while any write queue is full
+	QueueOK bool `json:"queue_ok"`
+	// BackendOK is false after -max-write-failures writes failed in a row,
+	// until the storage recovers
+	BackendOK  bool `json:"backend_ok"`
+	WarmupDone bool `json:"warmup_done"`
+	ReadOnly   bool `json:"read_only"`
+	// Breaker is the state of the storage circuit breaker, with
+	// -breaker-failures. The service isn't ready while it's open.
+	Breaker string `json:"breaker,omitempty"`
+}
+
+// checkReadiness reports the known state of each subsystem, without touching
+// the storage, so frequent probes cost nothing. With write set a read-only
+// service isn't ready.
+func checkReadiness(write bool) readiness {
+	ready := readiness{
+		DiskWritable: !diskFailing.Load(),
+		QueueOK:      !queueFull(),
+		BackendOK:    !storageFailing.Load(),
+		WarmupDone:   warmedUp.Load(),
+		ReadOnly:     readOnly.Load(),
+	}
+	breakerOK := true
+	if storageBreaker != nil {
+		state := storageBreaker.State()
+		ready.Breaker, breakerOK = state.String(), state != breakerOpen
+	}
+	switch {
+	case write && ready.ReadOnly:
+		ready.Status = "read_only"
+	case ready.DiskWritable && ready.QueueOK && ready.BackendOK && ready.WarmupDone && breakerOK:
+		ready.Status = "ready"
+	default:
+		ready.Status = "not_ready"
+	}
+	return ready
+}
+
+// handleReady reports whether the service is ready, as READY or NOT READY or,
+// to clients accepting JSON, with the state of each subsystem. With ?write=1
+// a read-only service isn't, for load balancers that only route writes.
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	ready := checkReadiness(r.URL.Query().Has("write"))
+	status := http.StatusOK
+	if ready.Status != "ready" {
+		status = http.StatusServiceUnavailable
+	}
+
+	if acceptsJSON(r.Header.Get("Accept")) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(ready)
+		return
+	}
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte(strings.ToUpper(strings.ReplaceAll(ready.Status, "_", " ")) + "\n"))
+}
+
+// queueFull reports whether any write queue is full. With -ordered-writes a
+// collection's uploads all go to one queue, which may be full while the
+// others are empty.
+func queueFull() bool {
+	for _, q := range writeQueues {
+		if len(q) >= cap(q) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsJSON reports whether an Accept header lists application/json
+func acceptsJSON(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		if mediaType, _, err := mime.ParseMediaType(part); err == nil && mediaType == "application/json" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,142 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// failingCheckBackend is a storage whose self-check fails the first failures
+// times
+type failingCheckBackend struct {
+	*inmemBackend
+	failures int32
+	checks   atomic.Int32
+}
+
+func (b *failingCheckBackend) Check() error {
+	if b.checks.Add(1) <= b.failures {
+		return errors.New("storage not reachable")
+	}
+	return nil
+}
+
+func TestWarmUp(t *testing.T) {
+	defer func() {
+		warmedUp.Store(true)
+		setReady(true)
+	}()
+
+	for _, tc := range []struct {
+		name     string
+		failures int32
+		timeout  time.Duration
+		ready    bool
+	}{
+		{"ready at once", 0, time.Second, true},
+		{"ready after retries", 2, 5 * time.Second, true},
+		{"never ready", 100, 100 * time.Millisecond, false},
+	} {
+		warmedUp.Store(false)
+		setReady(false)
+		backend := &failingCheckBackend{inmemBackend: newInmemBackend(100), failures: tc.failures}
+
+		err := warmUp(backend, tc.timeout)
+		if (err == nil) != tc.ready {
+			t.Errorf("%s: warmUp returned %v", tc.name, err)
+		}
+		if warmedUp.Load() != tc.ready || checkReady() != tc.ready {
+			t.Errorf("%s: warmed up %v, ready %v, want %v", tc.name, warmedUp.Load(), checkReady(), tc.ready)
+		}
+		if tc.ready && backend.checks.Load() != tc.failures+1 {
+			t.Errorf("%s: %d checks, want %d", tc.name, backend.checks.Load(), tc.failures+1)
+		}
+	}
+}
+
+func TestReadyDetails(t *testing.T) {
+	awaitSelfChecks(t)
+	savedQueues, savedBreaker := writeQueues, storageBreaker
+	defer func() {
+		writeQueues, storageBreaker = savedQueues, savedBreaker
+		diskFailing.Store(false)
+		storageFailing.Store(false)
+		warmedUp.Store(true)
+		readOnly.Store(false)
+	}()
+
+	for _, tc := range []struct {
+		name                                 string
+		disk, queue, backend, warm, readOnly bool
+		breaker                              breakerState
+		target, status                       string
+	}{
+		{"all healthy", true, true, true, true, false, breakerClosed, "/v1/ready", "ready"},
+		{"disk not writable", false, true, true, true, false, breakerClosed, "/v1/ready", "not_ready"},
+		{"queues full", true, false, true, true, false, breakerClosed, "/v1/ready", "not_ready"},
+		{"backend failing", true, true, false, true, false, breakerClosed, "/v1/ready", "not_ready"},
+		{"warming up", true, true, true, false, false, breakerClosed, "/v1/ready", "not_ready"},
+		{"several failing", false, false, true, true, false, breakerClosed, "/v1/ready", "not_ready"},
+		{"breaker open", true, true, true, true, false, breakerOpen, "/v1/ready", "not_ready"},
+		{"breaker half-open", true, true, true, true, false, breakerHalfOpen, "/v1/ready", "ready"},
+		// Read-only only matters to writers
+		{"read-only", true, true, true, true, true, breakerClosed, "/v1/ready", "ready"},
+		{"read-only, write", true, true, true, true, true, breakerClosed, "/v1/ready?write=1", "read_only"},
+	} {
+		diskFailing.Store(!tc.disk)
+		// With -ordered-writes one full queue is enough
+		queue := make(chan writeRequest, 1)
+		if !tc.queue {
+			queue <- writeRequest{}
+		}
+		writeQueues = []chan writeRequest{make(chan writeRequest, 1), queue}
+		storageFailing.Store(!tc.backend)
+		warmedUp.Store(tc.warm)
+		readOnly.Store(tc.readOnly)
+		storageBreaker = &breakerBackend{StorageBackend: newInmemBackend(100), state: tc.breaker, openedAt: time.Now(), cooldown: time.Hour}
+
+		wantCode := http.StatusOK
+		if tc.status != "ready" {
+			wantCode = http.StatusServiceUnavailable
+		}
+
+		r := httptest.NewRequest(http.MethodGet, tc.target, nil)
+		r.Header.Set("Accept", "text/html, application/json;q=0.9")
+		rec := httptest.NewRecorder()
+		handleReady(rec, r)
+		var got readiness
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatalf("%s: %v: %s", tc.name, err, rec.Body)
+		}
+		want := readiness{tc.status, tc.disk, tc.queue, tc.backend, tc.warm, tc.readOnly, tc.breaker.String()}
+		if rec.Code != wantCode || got != want {
+			t.Errorf("%s: status %d, %+v, want %d, %+v", tc.name, rec.Code, got, wantCode, want)
+		}
+
+		// Other clients get plain text
+		rec = httptest.NewRecorder()
+		handleReady(rec, httptest.NewRequest(http.MethodGet, tc.target, nil))
+		wantBody := map[string]string{"ready": "READY\n", "not_ready": "NOT READY\n", "read_only": "READ ONLY\n"}[tc.status]
+		if rec.Code != wantCode || rec.Body.String() != wantBody {
+			t.Errorf("%s: plain status %d, %q, want %d, %q", tc.name, rec.Code, rec.Body, wantCode, wantBody)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// readOnly rejects writes while keeping retrieval working, set with
+// -read-only or through /v1/admin/read-only
+var readOnly atomic.Bool
+
+// withWritable rejects requests with 503 while the service is read-only
+func withWritable(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if readOnly.Load() {
+			respondWithError(w, http.StatusServiceUnavailable, codeReadOnly, "Service is read-only", nil)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleAdminReadOnly reports the read-only state, POST ?enabled=true|false
+// switches it
+func handleAdminReadOnly(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, codeInvalidParameter, "Invalid or missing enabled", err)
+			return
+		}
+		if readOnly.Swap(enabled) != enabled {
+			slog.Info("Read-only mode switched", "enabled", enabled)
+		}
+	default:
+		respondWithError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET and POST allowed", nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]bool{"read_only": readOnly.Load()})
+}
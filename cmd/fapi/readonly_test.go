@@ -0,0 +1,108 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// withReadOnly runs fn with the service read-only
+func withReadOnly(t *testing.T, fn func()) {
+	t.Helper()
+	saved := readOnly.Load()
+	readOnly.Store(true)
+	defer readOnly.Store(saved)
+	fn()
+}
+
+func TestReadOnlyRejectsWrites(t *testing.T) {
+	withStored(t, "orders/1.json", `{"id":1}`, func() {
+		withReadOnly(t, func() {
+			for _, tc := range []struct {
+				method, target string
+				status         int
+			}{
+				{http.MethodPost, "/v1/collection/orders", http.StatusServiceUnavailable},
+				{http.MethodPut, "/v1/collection/orders/1.json", http.StatusServiceUnavailable},
+				{http.MethodPatch, "/v1/collection/orders/1.json", http.StatusServiceUnavailable},
+				{http.MethodDelete, "/v1/collection/orders/1.json", http.StatusServiceUnavailable},
+				{http.MethodGet, "/v1/collection/orders/1.json", http.StatusOK},
+				{http.MethodHead, "/v1/collection/orders/1.json", http.StatusOK},
+				{http.MethodGet, "/v1/collection/orders/1.json/meta", http.StatusOK},
+				{http.MethodGet, "/v1/collection/", http.StatusOK},
+			} {
+				rec := doRequest(tc.method, tc.target, "application/json", `{"id":2}`)
+				if rec.Code != tc.status {
+					t.Errorf("%s %s: status %d, want %d", tc.method, tc.target, rec.Code, tc.status)
+				}
+				if tc.status == http.StatusServiceUnavailable && !strings.Contains(rec.Body.String(), string(codeReadOnly)) {
+					t.Errorf("%s %s: %s, want the read_only code", tc.method, tc.target, rec.Body)
+				}
+			}
+			if got := readStored(t, storage, "orders/1.json"); got != `{"id":1}` {
+				t.Errorf("orders/1.json changed to %s", got)
+			}
+		})
+	})
+}
+
+func TestReadOnlyReadiness(t *testing.T) {
+	withWriteQueues(t, newInmemBackend(100), func() {
+		defer drainWrites(context.Background())
+		withReadOnly(t, func() {
+			for target, status := range map[string]int{
+				"/v1/ready":         http.StatusOK,
+				"/v1/ready?write=1": http.StatusServiceUnavailable,
+			} {
+				rec := httptest.NewRecorder()
+				handleReady(rec, httptest.NewRequest(http.MethodGet, target, nil))
+				if rec.Code != status {
+					t.Errorf("%s: status %d, want %d: %s", target, rec.Code, status, rec.Body)
+				}
+			}
+		})
+	})
+}
+
+func TestAdminReadOnlySwitch(t *testing.T) {
+	saved := readOnly.Load()
+	defer readOnly.Store(saved)
+
+	withWriteQueues(t, newInmemBackend(100), func() {
+		for _, enabled := range []bool{true, false} {
+			query := "?enabled=false"
+			want, status := `{"read_only":false}`, http.StatusAccepted
+			if enabled {
+				query, want, status = "?enabled=true", `{"read_only":true}`, http.StatusServiceUnavailable
+			}
+			rec := adminRequest(t, handleAdminReadOnly, http.MethodPost, "/v1/admin/read-only"+query)
+			if got := strings.TrimSpace(rec.Body.String()); rec.Code != http.StatusOK || got != want {
+				t.Fatalf("%s: status %d: %s", query, rec.Code, got)
+			}
+			if rec := doRequest(http.MethodPost, "/v1/collection/orders", "application/json", "{}"); rec.Code != status {
+				t.Errorf("%s: write status %d, want %d", query, rec.Code, status)
+			}
+		}
+		drainWrites(context.Background())
+	})
+
+	if rec := adminRequest(t, handleAdminReadOnly, http.MethodPost, "/v1/admin/read-only?enabled=maybe"); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid enabled: status %d, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReplayConcurrency = 4
+	maxReplayConcurrency     = 32
+	maxReplayRate            = 10000
+	// maxReplayErrors caps the per-file errors reported for a replay
+	maxReplayErrors        = 100
+	replayProgressInterval = 5 * time.Second
+)
+
+// replayResult is the response to a replay
+type replayResult struct {
+	Matched int           `json:"matched"`
+	Sent    int           `json:"sent"`
+	Failed  int           `json:"failed"`
+	Errors  []replayError `json:"errors,omitempty"`
+	// Error is set when the replay stopped before going through every file
+	Error string `json:"error,omitempty"`
+}
+
+type replayError struct {
+	ID    string `json:"id"`
+	Error string `json:"error"`
+}
+
+// handleAdminReplay sends the stored files matching ?collection=, ?since= and
+// ?until= (RFC 3339, compared with the time they were stored) to -mirror-url
+// again, ?concurrency= at a time and at most ?rate= per second. It answers
+// once they have all been sent, logging its progress meanwhile.
+func handleAdminReplay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only POST allowed", nil)
+		return
+	}
+	if mirrorURL == "" {
+		respondWithError(w, http.StatusNotFound, codeDisabled, "Replay needs -mirror-url", nil)
+		return
+	}
+
+	q := r.URL.Query()
+	collection := q.Get("collection")
+	if collection != "" && !isValidName(collection) {
+		respondWithError(w, http.StatusBadRequest, codeInvalidCollection, "Invalid collection name", nil)
+		return
+	}
+	var since, until time.Time
+	for name, t := range map[string]*time.Time{"since": &since, "until": &until} {
+		if value := q.Get(name); value != "" {
+			var err error
+			if *t, err = time.Parse(time.RFC3339Nano, value); err != nil {
+				respondWithError(w, http.StatusBadRequest, codeInvalidParameter, "Invalid "+name, err)
+				return
+			}
+		}
+	}
+	concurrency, ok := intParam(q.Get("concurrency"), defaultReplayConcurrency, 1, maxReplayConcurrency)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, codeInvalidParameter,
+			fmt.Sprintf("concurrency must be between 1 and %d", maxReplayConcurrency), nil)
+		return
+	}
+	rate, ok := intParam(q.Get("rate"), 0, 0, maxReplayRate)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, codeInvalidParameter,
+			fmt.Sprintf("rate must be between 0 and %d", maxReplayRate), nil)
+		return
+	}
+
+	// A replay can take much longer than the server timeouts allow
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	slog.Info("Replay started", "collection", collection, "since", q.Get("since"), "until", q.Get("until"),
+		"concurrency", concurrency, "rate", rate)
+	res := replay(r.Context(), collection, since, until, concurrency, rate)
+	slog.Info("Replay done", "matched", res.Matched, "sent", res.Sent, "failed", res.Failed)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// intParam parses an optional integer query parameter, which must be within
+// [lo, hi]
+func intParam(value string, def, lo, hi int) (int, bool) {
+	if value == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(value)
+	return n, err == nil && n >= lo && n <= hi
+}
+
+// replay sends the stored files of collection stored in [since, until) to the
+// mirror, with concurrency workers. A zero time leaves that end open, a zero
+// rate doesn't limit the files sent per second. It stops early once ctx is
+// done.
+func replay(ctx context.Context, collection string, since, until time.Time, concurrency, rate int) replayResult {
+	var (
+		mu  sync.Mutex
+		res replayResult
+		wg  sync.WaitGroup
+	)
+	ids := make(chan string)
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range ids {
+				err := replayFile(id)
+				mu.Lock()
+				if err != nil {
+					res.Failed++
+					if len(res.Errors) < maxReplayErrors {
+						res.Errors = append(res.Errors, replayError{ID: id, Error: err.Error()})
+					}
+				} else {
+					res.Sent++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	var limit <-chan time.Time
+	if rate > 0 {
+		t := time.NewTicker(time.Second / time.Duration(rate))
+		defer t.Stop()
+		limit = t.C
+	}
+	progress := time.NewTicker(replayProgressInterval)
+	defer progress.Stop()
+
+	err := storage.List(collection, func(id string, info storedInfo) error {
+		if !since.IsZero() && info.ModTime.Before(since) || !until.IsZero() && !info.ModTime.Before(until) {
+			return nil
+		}
+		if limit != nil {
+			select {
+			case <-limit:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		select {
+		case ids <- id:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		res.Matched++
+		select {
+		case <-progress.C:
+			slog.Info("Replay progress", "matched", res.Matched, "sent", res.Sent, "failed", res.Failed)
+		default:
+		}
+		return nil
+	})
+	close(ids)
+	wg.Wait()
+
+	if err != nil {
+		res.Error = err.Error()
+		logError("Replay stopped", err)
+	}
+	return res
+}
+
+// replayFile sends the file stored as id to the collection it was stored in
+// on the mirror
+func replayFile(id string) error {
+	f, _, err := storage.Open(id)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header := http.Header{}
+	header.Set("Content-Type", contentTypeForID(strings.TrimSuffix(id, ".gz")))
+	if isGzipped(id) {
+		// The mirror decompresses it like any compressed upload
+		header.Set("Content-Encoding", "gzip")
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	collection, _, _ := strings.Cut(id, "/")
+	if collection == id {
+		collection = ""
+	}
+	return sendToMirror(mirrorRequest{collection: collection, header: header, data: data})
+}
@@ -0,0 +1,120 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+)
+
+// replayBackend returns a storage with files stored an hour apart from start
+func replayBackend(t *testing.T, start time.Time) StorageBackend {
+	t.Helper()
+	clock := withFakeClock(t, start)
+	backend := newInmemBackend(100)
+	for _, f := range []struct{ id, content string }{
+		{"orders/1.json", `{"id":1}`},
+		{"orders/2.json.gz", gzipped(`{"id":2}`)},
+		{"logs/1.txt", "line"},
+		{"orders/3.json", `{"id":3}`},
+	} {
+		if err := backend.Store(context.Background(), f.id, []byte(f.content)); err != nil {
+			t.Fatal(err)
+		}
+		clock.Advance(time.Hour)
+	}
+	return backend
+}
+
+// replayed runs a replay with query against backend and returns its result
+// and what the mirror received, sorted by body
+func replayed(t *testing.T, backend StorageBackend, query string) (replayResult, []mirrored) {
+	t.Helper()
+	var res replayResult
+	requests := withMirror(t, func() {
+		withWriteQueues(t, backend, func() {
+			rec := adminRequest(t, handleAdminReplay, http.MethodPost, "/v1/admin/replay"+query)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("replay%s: status %d: %s", query, rec.Code, rec.Body)
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			drainWrites(context.Background())
+		})
+	})
+	sort.Slice(requests, func(i, j int) bool { return requests[i].body < requests[j].body })
+	return res, requests
+}
+
+func TestReplay(t *testing.T) {
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	backend := replayBackend(t, start)
+
+	res, requests := replayed(t, backend, "")
+	if res.Matched != 4 || res.Sent != 4 || res.Failed != 0 || len(requests) != 4 {
+		t.Errorf("replay of everything: %+v, %d requests mirrored", res, len(requests))
+	}
+
+	// Files of orders stored from an hour after the start, until the last one
+	res, requests = replayed(t, backend, "?collection=orders&since=2024-05-01T01:00:00Z&until=2024-05-01T03:00:00Z&concurrency=2&rate=100")
+	if res.Matched != 1 || res.Sent != 1 || res.Failed != 0 {
+		t.Errorf("filtered replay: %+v", res)
+	}
+	// The compressed file is sent as it's stored, for the mirror to
+	// decompress
+	want := mirrored{http.MethodPost, "/v1/collection/orders", "application/json", "gzip", "", gzipped(`{"id":2}`)}
+	if len(requests) != 1 || requests[0] != want {
+		t.Errorf("mirrored %+v, want %+v", requests, want)
+	}
+
+	res, requests = replayed(t, backend, "?collection=orders&since=2024-05-01T01:00:00Z")
+	if res.Matched != 2 || len(requests) != 2 || requests[1].body != `{"id":3}` {
+		t.Errorf("replay since: %+v, mirrored %+v", res, requests)
+	}
+}
+
+func TestReplayRejected(t *testing.T) {
+	withStorage(t, newInmemBackend(100), func() {
+		if rec := adminRequest(t, handleAdminReplay, http.MethodPost, "/v1/admin/replay"); rec.Code != http.StatusNotFound {
+			t.Errorf("without -mirror-url: status %d, want 404", rec.Code)
+		}
+	})
+
+	withMirror(t, func() {
+		withWriteQueues(t, newInmemBackend(100), func() {
+			for _, tc := range []struct {
+				method, query string
+				status        int
+			}{
+				{http.MethodGet, "", http.StatusMethodNotAllowed},
+				{http.MethodPost, "?collection=../etc", http.StatusBadRequest},
+				{http.MethodPost, "?since=yesterday", http.StatusBadRequest},
+				{http.MethodPost, "?concurrency=0", http.StatusBadRequest},
+				{http.MethodPost, "?concurrency=33", http.StatusBadRequest},
+				{http.MethodPost, "?rate=-1", http.StatusBadRequest},
+			} {
+				if rec := adminRequest(t, handleAdminReplay, tc.method, "/v1/admin/replay"+tc.query); rec.Code != tc.status {
+					t.Errorf("%s replay%s: status %d, want %d", tc.method, tc.query, rec.Code, tc.status)
+				}
+			}
+			drainWrites(context.Background())
+		})
+	})
+}
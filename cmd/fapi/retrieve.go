@@ -0,0 +1,288 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	copyBufferSize = 32 << 10 // 32 KB
+	// responseFlushInterval is how much of a download is written between
+	// flushes
+	responseFlushInterval = 256 << 10 // 256 KB
+)
+
+var errResponseTooLarge = errors.New("response larger than -max-response-bytes")
+
+// handleRetrieve serves a previously stored file back to the client.
+// http.ServeContent takes care of HEAD, conditional and range requests.
+func handleRetrieve(w http.ResponseWriter, r *http.Request, id string) {
+	if !isValidID(id) {
+		respondWithError(w, http.StatusBadRequest, codeInvalidID, "Invalid id", nil)
+		return
+	}
+
+	f, info, err := storage.Open(id)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			respondWithError(w, http.StatusNotFound, codeNotFound, "Not found", nil)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, codeInternal, "Failed to open file", err)
+		return
+	}
+	defer f.Close()
+
+	if retrievalTimeout > 0 {
+		// Large downloads may legitimately outlast the server wide WriteTimeout
+		rc := http.NewResponseController(w)
+		if err := rc.SetWriteDeadline(time.Now().Add(retrievalTimeout)); err != nil {
+			logError("Failed to set retrieval write deadline", err)
+		}
+	}
+
+	content := &contextReadSeeker{ctx: r.Context(), rs: f}
+	out := &cappedWriter{ResponseWriter: w, rc: http.NewResponseController(w)}
+	if decompressDownloads && isGzipped(id) {
+		serveGzipped(out, r, id, info, content)
+	} else {
+		w.Header().Set("Content-Type", contentTypeForID(id))
+		w.Header().Set("ETag", fileETag(info))
+		http.ServeContent(out, r, id, info.ModTime, content)
+	}
+	if out.exceeded {
+		// Abort rather than end the response, so the client can't take the
+		// truncated content for the whole file
+		slog.Error("Download cut off", "id", id, "error", errResponseTooLarge, "limit", maxResponseBytes)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// cappedWriter flushes a download every responseFlushInterval bytes, so
+// nothing on the way to the client holds on to more than that, and refuses
+// to write more than -max-response-bytes in total
+type cappedWriter struct {
+	http.ResponseWriter
+	rc        *http.ResponseController
+	written   int64
+	unflushed int64
+	exceeded  bool
+}
+
+func (c *cappedWriter) Write(p []byte) (int, error) {
+	if maxResponseBytes > 0 && c.written+int64(len(p)) > maxResponseBytes {
+		c.exceeded = true
+		return 0, errResponseTooLarge
+	}
+	n, err := c.ResponseWriter.Write(p)
+	c.written += int64(n)
+	c.unflushed += int64(n)
+	if err == nil && c.unflushed >= responseFlushInterval {
+		c.unflushed = 0
+		if err := c.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (c *cappedWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// isGzipped reports whether a stored file is gzip compressed. Only the .gz
+// suffix tells, which every id has with -compress-storage: content stored
+// under another id is served as it was uploaded, whatever its first bytes.
+func isGzipped(id string) bool {
+	return strings.HasSuffix(id, ".gz")
+}
+
+// serveGzipped serves a compressed file as is, with Content-Encoding: gzip,
+// to clients that accept gzip and decompressed to the others. Decompressed
+// responses don't support ranges, their length isn't known up front.
+func serveGzipped(w http.ResponseWriter, r *http.Request, id string, info storedInfo, content io.ReadSeeker) {
+	w.Header().Set("Content-Type", contentTypeForID(strings.TrimSuffix(id, ".gz")))
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	if acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("ETag", fileETag(info))
+		http.ServeContent(w, r, id, info.ModTime, content)
+		return
+	}
+
+	// The decompressed content is another representation, with its own ETag
+	etag := fmt.Sprintf(`"%x-%x-identity"`, info.Size, info.ModTime.UnixNano())
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	gzr, err := gzip.NewReader(content)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, codeInternal, "Failed to decompress file", err)
+		return
+	}
+	defer gzr.Close()
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, gzr); err != nil && !errors.Is(err, errResponseTooLarge) {
+		logError("Failed to send decompressed file", err)
+	}
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// storedMeta describes a stored file, as returned by /v1/collection/{id}/meta
+type storedMeta struct {
+	ID          string    `json:"id"`
+	Size        int64     `json:"size"`
+	Received    time.Time `json:"received"`
+	ContentType string    `json:"content_type"`
+	HashAlgo    string    `json:"hash_algo"`
+	Hash        string    `json:"hash"`
+	ETag        string    `json:"etag"`
+	// EventTime is only set if one was recorded, see -max-clock-skew
+	EventTime *time.Time `json:"event_time,omitempty"`
+}
+
+// handleMeta describes a stored file without sending it. The checksum is
+// computed with -hash-algo from the stored content, compressed if
+// -compress-storage is set.
+func handleMeta(w http.ResponseWriter, r *http.Request, id string) {
+	f, info, err := storage.Open(id)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			respondWithError(w, http.StatusNotFound, codeNotFound, "Not found", nil)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, codeInternal, "Failed to open file", err)
+		return
+	}
+	defer f.Close()
+
+	h := contentHasher.New()
+	if _, err := io.Copy(h, &contextReadSeeker{ctx: r.Context(), rs: f}); err != nil {
+		respondWithError(w, http.StatusInternalServerError, codeInternal, "Failed to read file", err)
+		return
+	}
+
+	meta := storedMeta{
+		ID:          id,
+		Size:        info.Size,
+		Received:    info.ModTime.UTC(),
+		ContentType: contentTypeForID(id),
+		HashAlgo:    contentHasher.Name(),
+		Hash:        hex.EncodeToString(h.Sum(nil)),
+		ETag:        fileETag(info),
+	}
+	if !info.EventTime.IsZero() {
+		eventTime := info.EventTime.UTC()
+		meta.EventTime = &eventTime
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(meta)
+}
+
+// fileETag builds a strong validator from size and modification time, stored
+// files are written once so the pair identifies the content
+func fileETag(info storedInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.Size, info.ModTime.UnixNano())
+}
+
+// isValidID reports whether id is a file name, optionally prefixed by its
+// collection name and, with -shard-by ip, the client IP directory
+func isValidID(id string) bool {
+	parts := strings.Split(id, "/")
+	maxParts := 2
+	if shardByIP {
+		maxParts = 3
+	}
+	if len(parts) > maxParts {
+		return false
+	}
+	for _, part := range parts {
+		if !isValidName(part) {
+			return false
+		}
+	}
+	return true
+}
+
+// contentTypeForID returns the Content-Type of a stored file. It must be set
+// before calling http.ServeContent, otherwise ranged responses would be typed
+// by sniffing only the requested slice.
+func contentTypeForID(id string) string {
+	if ctype := mime.TypeByExtension(filepath.Ext(id)); ctype != "" {
+		return ctype
+	}
+	return "application/octet-stream"
+}
+
+// contextReadSeeker fails reads once ctx is done, so a client that went away
+// doesn't keep the handler (and its file) busy
+type contextReadSeeker struct {
+	ctx context.Context
+	rs  io.ReadSeeker
+}
+
+func (c *contextReadSeeker) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if len(p) > copyBufferSize {
+		p = p[:copyBufferSize]
+	}
+	return c.rs.Read(p)
+}
+
+func (c *contextReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	return c.rs.Seek(offset, whence)
+}
@@ -0,0 +1,401 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestContextReadSeekerCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	content := &contextReadSeeker{ctx: ctx, rs: strings.NewReader("stored content")}
+	buf := make([]byte, 6)
+	if n, err := content.Read(buf); err != nil || string(buf[:n]) != "stored" {
+		t.Fatalf("Read = %q, %v", buf[:n], err)
+	}
+	cancel()
+	if _, err := content.Read(buf); !errors.Is(err, context.Canceled) {
+		t.Errorf("Read after cancel: %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestRetrieveClientDisconnects(t *testing.T) {
+	backend := newInmemBackend(100)
+	// Much more than the socket buffers hold, so the handler is still sending
+	// when the client goes away
+	if err := backend.Store(context.Background(), "exports/big.bin", bytes.Repeat([]byte("x"), 64<<20)); err != nil {
+		t.Fatal(err)
+	}
+	withStorage(t, backend, func() {
+		returned := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer close(returned)
+			defer func() { _ = recover() }() // an aborted download panics with http.ErrAbortHandler
+			handleRetrieve(w, r, "exports/big.bin")
+		}))
+		defer server.Close()
+
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(resp.Body, make([]byte, 1024)); err != nil {
+			t.Fatal(err)
+		}
+		// Stop reading and hang up mid download
+		_ = resp.Body.Close()
+
+		select {
+		case <-returned:
+		case <-time.After(5 * time.Second):
+			t.Fatal("handler still running after the client disconnected")
+		}
+	})
+}
+
+// withStored runs fn with an in-memory storage holding content under id
+func withStored(t *testing.T, id, content string, fn func()) {
+	t.Helper()
+	backend := newInmemBackend(100)
+	if err := backend.Store(context.Background(), id, []byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	withStorage(t, backend, fn)
+}
+
+func TestHeadItem(t *testing.T) {
+	withStored(t, "orders/1.json", `{"id":1}`, func() {
+		rec := doRequest(http.MethodHead, "/v1/collection/orders/1.json", "", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d, want 200", rec.Code)
+		}
+		if got := rec.Header().Get("Content-Length"); got != "8" {
+			t.Errorf("Content-Length %q, want 8", got)
+		}
+		if rec.Header().Get("Last-Modified") == "" {
+			t.Error("no Last-Modified header")
+		}
+		if rec.Body.Len() != 0 {
+			t.Errorf("HEAD sent a body: %q", rec.Body)
+		}
+
+		if rec := doRequest(http.MethodHead, "/v1/collection/orders/2.json", "", ""); rec.Code != http.StatusNotFound {
+			t.Errorf("missing item: status %d, want 404", rec.Code)
+		}
+	})
+}
+
+func TestConditionalGet(t *testing.T) {
+	withStored(t, "orders/1.json", `{"id":1}`, func() {
+		rec := doRequest(http.MethodGet, "/v1/collection/orders/1.json", "", "")
+		etag, modified := rec.Header().Get("ETag"), rec.Header().Get("Last-Modified")
+		if rec.Code != http.StatusOK || rec.Body.String() != `{"id":1}` || etag == "" || modified == "" {
+			t.Fatalf("status %d, ETag %q, Last-Modified %q: %s", rec.Code, etag, modified, rec.Body)
+		}
+		if got := rec.Header().Get("Content-Type"); got != "application/json" {
+			t.Errorf("Content-Type %q, want application/json", got)
+		}
+
+		for _, tc := range []struct {
+			header, value string
+			status        int
+		}{
+			{"If-None-Match", etag, http.StatusNotModified},
+			{"If-None-Match", `"stale"`, http.StatusOK},
+			{"If-Modified-Since", modified, http.StatusNotModified},
+		} {
+			rec := doRequestWithHeader(http.MethodGet, "/v1/collection/orders/1.json", "", "", tc.header, tc.value)
+			if rec.Code != tc.status {
+				t.Errorf("%s: %s: status %d, want %d", tc.header, tc.value, rec.Code, tc.status)
+			}
+			if tc.status == http.StatusNotModified && rec.Body.Len() != 0 {
+				t.Errorf("304 with a body: %q", rec.Body)
+			}
+		}
+
+		rec = doRequestWithHeader(http.MethodGet, "/v1/collection/orders/1.json", "", "", "Range", "bytes=0-3")
+		if rec.Code != http.StatusPartialContent || rec.Body.String() != `{"id` {
+			t.Errorf("range: status %d: %q", rec.Code, rec.Body)
+		}
+	})
+}
+
+func TestRangeGet(t *testing.T) {
+	backend, err := newFSBackend([]string{t.TempDir()}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := "0123456789abcdefghij"
+	if err := backend.Store(context.Background(), "exports/data.txt", []byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	withStorage(t, backend, func() {
+		for _, tc := range []struct{ rng, want, contentRange string }{
+			{"bytes=5-9", "56789", "bytes 5-9/20"},
+			{"bytes=15-", "fghij", "bytes 15-19/20"},
+			{"bytes=-3", "hij", "bytes 17-19/20"},
+		} {
+			rec := doRequestWithHeader(http.MethodGet, "/v1/collection/exports/data.txt", "", "", "Range", tc.rng)
+			if rec.Code != http.StatusPartialContent || rec.Body.String() != tc.want {
+				t.Errorf("%s: status %d: %q, want 206: %q", tc.rng, rec.Code, rec.Body, tc.want)
+			}
+			if got := rec.Header().Get("Content-Range"); got != tc.contentRange {
+				t.Errorf("%s: Content-Range %q, want %q", tc.rng, got, tc.contentRange)
+			}
+			// Typed from the id, not by sniffing the slice
+			if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain") {
+				t.Errorf("%s: Content-Type %q, want text/plain", tc.rng, got)
+			}
+		}
+		if rec := doRequestWithHeader(http.MethodGet, "/v1/collection/exports/data.txt", "", "", "Range", "bytes=30-"); rec.Code != http.StatusRequestedRangeNotSatisfiable {
+			t.Errorf("range past the end: status %d, want 416", rec.Code)
+		}
+	})
+}
+
+// slowOpenBackend serves stored files through readers that pause on every read
+type slowOpenBackend struct {
+	*inmemBackend
+	delay time.Duration
+}
+
+type slowReadSeekCloser struct {
+	io.ReadSeekCloser
+	delay time.Duration
+}
+
+func (s slowReadSeekCloser) Read(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	return s.ReadSeekCloser.Read(p)
+}
+
+func (b slowOpenBackend) Open(id string) (io.ReadSeekCloser, storedInfo, error) {
+	f, info, err := b.inmemBackend.Open(id)
+	if err != nil {
+		return nil, info, err
+	}
+	return slowReadSeekCloser{f, b.delay}, info, nil
+}
+
+func TestRetrievalWriteTimeout(t *testing.T) {
+	// 10 reads of copyBufferSize at 50ms each outlast the 200ms server write timeout
+	content := bytes.Repeat([]byte("x"), 10*copyBufferSize)
+	backend := slowOpenBackend{newInmemBackend(100), 50 * time.Millisecond}
+	if err := backend.Store(context.Background(), "exports/slow.bin", content); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := retrievalTimeout
+	defer func() { retrievalTimeout = saved }()
+	withStorage(t, backend, func() {
+		server := httptest.NewUnstartedServer(http.HandlerFunc(handleCollection))
+		server.Config.WriteTimeout = 200 * time.Millisecond
+		server.Start()
+		defer server.Close()
+
+		download := func() (int, error) {
+			resp, err := http.Get(server.URL + "/v1/collection/exports/slow.bin")
+			if err != nil {
+				return 0, err
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			return len(body), err
+		}
+
+		// The server wide timeout cuts the download short
+		retrievalTimeout = 0
+		if n, err := download(); err == nil && n == len(content) {
+			t.Error("download outlived the server write timeout")
+		}
+
+		retrievalTimeout = 5 * time.Second
+		if n, err := download(); err != nil || n != len(content) {
+			t.Errorf("download with -retrieval-write-timeout: %d of %d bytes, %v", n, len(content), err)
+		}
+	})
+}
+
+func TestItemMeta(t *testing.T) {
+	const content = `{"id":1}`
+	withStored(t, "orders/1.json", content, func() {
+		rec := doRequest(http.MethodGet, "/v1/collection/orders/1.json/meta", "", "")
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("status %d, Content-Type %q: %s", rec.Code, rec.Header().Get("Content-Type"), rec.Body)
+		}
+		var meta storedMeta
+		if err := json.Unmarshal(rec.Body.Bytes(), &meta); err != nil {
+			t.Fatal(err)
+		}
+		h := contentHasher.New()
+		h.Write([]byte(content))
+		want := hex.EncodeToString(h.Sum(nil))
+		if meta.ID != "orders/1.json" || meta.Size != int64(len(content)) || meta.ContentType != "application/json" ||
+			meta.HashAlgo != contentHasher.Name() || meta.Hash != want || meta.Received.IsZero() || meta.ETag == "" {
+			t.Errorf("meta = %+v", meta)
+		}
+		// The ETag is the one of the item itself
+		if got := doRequest(http.MethodHead, "/v1/collection/orders/1.json", "", "").Header().Get("ETag"); got != meta.ETag {
+			t.Errorf("ETag %q, item ETag %q", meta.ETag, got)
+		}
+
+		for _, id := range []string{"orders/2.json", "other/1.json"} {
+			if rec := doRequest(http.MethodGet, "/v1/collection/"+id+"/meta", "", ""); rec.Code != http.StatusNotFound {
+				t.Errorf("%s/meta: status %d, want 404", id, rec.Code)
+			}
+		}
+	})
+}
+
+func TestGzipDownload(t *testing.T) {
+	const content = `{"id":1}`
+	backend := newInmemBackend(100)
+	for _, id := range []string{"orders/1.json.gz", "orders/2.bin"} {
+		if err := backend.Store(context.Background(), id, []byte(gzipped(content))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	withStorage(t, backend, func() {
+		const id = "orders/1.json.gz"
+		for _, tc := range []struct {
+			acceptEncoding string
+			compressed     bool
+		}{
+			{"gzip", true},
+			{"br, gzip;q=0.5", true},
+			{"*", true},
+			{"", false},
+			{"identity", false},
+			{"gzip;q=0", false},
+		} {
+			rec := doRequestWithHeader(http.MethodGet, "/v1/collection/"+id, "", "", "Accept-Encoding", tc.acceptEncoding)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("%s, Accept-Encoding %q: status %d", id, tc.acceptEncoding, rec.Code)
+			}
+			if got := rec.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("%s, Accept-Encoding %q: Content-Type %q", id, tc.acceptEncoding, got)
+			}
+			if rec.Header().Get("Vary") != "Accept-Encoding" {
+				t.Errorf("%s, Accept-Encoding %q: Vary %q", id, tc.acceptEncoding, rec.Header().Get("Vary"))
+			}
+			want, encoding := content, ""
+			if tc.compressed {
+				want, encoding = gzipped(content), "gzip"
+			}
+			if rec.Body.String() != want || rec.Header().Get("Content-Encoding") != encoding {
+				t.Errorf("%s, Accept-Encoding %q: Content-Encoding %q, body %q", id, tc.acceptEncoding, rec.Header().Get("Content-Encoding"), rec.Body)
+			}
+		}
+
+		// Without the .gz suffix, content starting like gzip is what was
+		// uploaded and is sent as is
+		rec := doRequestWithHeader(http.MethodGet, "/v1/collection/orders/2.bin", "", "", "Accept-Encoding", "")
+		if rec.Body.String() != gzipped(content) || rec.Header().Get("Content-Encoding") != "" || rec.Header().Get("Vary") != "" {
+			t.Errorf("orders/2.bin: Content-Encoding %q, body %q", rec.Header().Get("Content-Encoding"), rec.Body)
+		}
+
+		// Disabled, the stored file is sent as is
+		saved := decompressDownloads
+		decompressDownloads = false
+		defer func() { decompressDownloads = saved }()
+		rec = doRequest(http.MethodGet, "/v1/collection/orders/1.json.gz", "", "")
+		if rec.Body.String() != gzipped(content) || rec.Header().Get("Content-Encoding") != "" {
+			t.Errorf("-decompress-downloads=false: Content-Encoding %q, body %q", rec.Header().Get("Content-Encoding"), rec.Body)
+		}
+	})
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	saved := maxResponseBytes
+	defer func() { maxResponseBytes = saved }()
+	content := strings.Repeat("x", 2<<20)
+	backend := newInmemBackend(100)
+	for id, data := range map[string]string{"exports/big.txt": content, "exports/big.txt.gz": gzipped(content)} {
+		if err := backend.Store(context.Background(), id, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	withStorage(t, backend, func() {
+		for _, tc := range []struct {
+			id    string
+			limit int64
+			rang  string
+			cut   bool
+		}{
+			{"exports/big.txt", 0, "", false},
+			{"exports/big.txt", 4 << 20, "", false},
+			{"exports/big.txt", 1 << 20, "", true},
+			// Decompressed on the way, the cap applies to what is sent
+			{"exports/big.txt.gz", 1 << 20, "", true},
+			{"exports/big.txt", 1 << 20, "bytes=0-1023", false},
+		} {
+			maxResponseBytes = tc.limit
+			var logged bytes.Buffer
+			savedLogger := slog.Default()
+			slog.SetDefault(slog.New(slog.NewTextHandler(&logged, nil)))
+
+			returned := make(chan struct{})
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer close(returned)
+				handleRetrieve(w, r, tc.id)
+			}))
+			r, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+			if tc.rang != "" {
+				r.Header.Set("Range", tc.rang)
+			}
+			// The transport would otherwise ask for gzip itself
+			r.Header.Set("Accept-Encoding", "identity")
+			resp, err := http.DefaultClient.Do(r)
+			var body []byte
+			if err == nil {
+				body, err = io.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+			<-returned
+			server.Close()
+			slog.SetDefault(savedLogger)
+
+			cutOff := strings.Contains(logged.String(), "Download cut off")
+			if tc.cut {
+				if err == nil || !cutOff {
+					t.Errorf("%s, limit %d: read %d bytes, %v, cut off logged %v, want an error", tc.id, tc.limit, len(body), err, cutOff)
+				}
+				if int64(len(body)) > tc.limit {
+					t.Errorf("%s, limit %d: %d bytes sent", tc.id, tc.limit, len(body))
+				}
+				continue
+			}
+			want := content
+			if tc.rang != "" {
+				want = content[:1024]
+			}
+			if err != nil || string(body) != want || cutOff {
+				t.Errorf("%s, limit %d, range %q: read %d bytes, %v, cut off logged %v", tc.id, tc.limit, tc.rang, len(body), err, cutOff)
+			}
+		}
+	})
+}
@@ -0,0 +1,45 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package main
+
+import "testing"
+
+func TestReusePort(t *testing.T) {
+	saved := reusePort
+	defer func() { reusePort = saved }()
+
+	reusePort = true
+	first, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	addr := first.Addr().String()
+
+	second, err := listen(addr)
+	if err != nil {
+		t.Fatalf("second listener on %s: %v", addr, err)
+	}
+	_ = second.Close()
+
+	// Without the option the port is taken
+	reusePort = false
+	if l, err := listen(addr); err == nil {
+		_ = l.Close()
+		t.Errorf("second listener on %s without -reuseport", addr)
+	}
+}
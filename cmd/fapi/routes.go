@@ -0,0 +1,333 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// methodHandlers dispatches a request by method. Other methods are answered
+// with 405 and an Allow header listing the supported ones.
+type methodHandlers map[string]http.HandlerFunc
+
+func (m methodHandlers) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h, ok := m[r.Method]; ok {
+		h(w, r)
+		return
+	}
+	w.Header().Set("Allow", m.allow())
+	respondWithError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only "+m.allow()+" allowed", nil)
+}
+
+func (m methodHandlers) allow() string {
+	methods := make([]string, 0, len(m))
+	for method := range m {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
+
+var (
+	// collectionRoot serves /v1/collection and the catch-all endpoint
+	collectionRoot = methodHandlers{
+		http.MethodGet:  handleEcho,
+		http.MethodHead: handleEcho,
+		http.MethodPost: withWritable(handlePost),
+	}
+
+	// collectionItem serves /v1/collection/{name} and /v1/collection/{id}
+	collectionItem = methodHandlers{
+		http.MethodGet:    handleItemGet,
+		http.MethodHead:   handleItemGet,
+		http.MethodPost:   withWritable(handleItemPost),
+		http.MethodPut:    withWritable(handlePut),
+		http.MethodPatch:  withWritable(handlePatch),
+		http.MethodDelete: withWritable(handleDelete),
+	}
+)
+
+// handleCollection routes /v1/collection/ requests to the root or the items
+func handleCollection(w http.ResponseWriter, r *http.Request) {
+	if itemID(r) == "" {
+		collectionRoot.ServeHTTP(w, r)
+		return
+	}
+	collectionItem.ServeHTTP(w, r)
+}
+
+func itemID(r *http.Request) string {
+	return strings.TrimPrefix(r.URL.Path, collectionPathPrefix)
+}
+
+// handleEcho returns the request headers and query params, to help debugging
+// the apps that talk to us
+func handleEcho(w http.ResponseWriter, r *http.Request) {
+	data := map[string]any{
+		"method":  r.Method,
+		"path":    r.URL.Path,
+		"query":   r.URL.Query(),
+		"headers": r.Header,
+	}
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, codeInternal, "Failed to encode response", err)
+		return
+	}
+}
+
+// metaSuffix ends the path of the metadata of a stored file. Content can't be
+// stored under an id ending with it, so GET of such a path is never ambiguous.
+const metaSuffix = "/meta"
+
+func handleItemGet(w http.ResponseWriter, r *http.Request) {
+	id := itemID(r)
+	if stored, ok := strings.CutSuffix(id, metaSuffix); ok && isValidID(stored) {
+		handleMeta(w, r, stored)
+		return
+	}
+	handleRetrieve(w, r, id)
+}
+
+// handlePut stores the body under the id given in the path, replacing any
+// previous content
+func handlePut(w http.ResponseWriter, r *http.Request) {
+	id := itemID(r)
+	id, collection, ok := checkTargetID(w, id)
+	if !ok {
+		return
+	}
+	if !admitCollection(w, collection) {
+		return
+	}
+	eventTime, ok := eventTimeOf(w, r)
+	if !ok {
+		return
+	}
+	callback, ok := callbackURL(w, r)
+	if !ok {
+		return
+	}
+
+	raw, body, ok := readBodyAndRaw(w, r)
+	if !ok {
+		return
+	}
+
+	if isJSONID(id) && !validateJSONID(w, body, collection) {
+		return
+	}
+	if !isJSONID(id) && !validateContent(w, body, collection, path.Ext(strings.TrimSuffix(id, ".gz"))) {
+		return
+	}
+
+	req := writeRequest{
+		data:       body,
+		id:         id,
+		collection: collection,
+		enqueued:   time.Now(),
+		callback:   callback,
+		eventTime:  eventTime,
+	}
+	client, ok := chargeQuota(w, r, len(body))
+	if !ok {
+		return
+	}
+	if !enqueueWrite(w, req) {
+		refundQuota(client, len(body))
+		return
+	}
+	mirrorItem(r, collection, id, raw)
+
+	w.Header().Set("Location", collectionURL(id))
+	setContentHash(w, contentHash(body))
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = w.Write([]byte("Stored\n"))
+}
+
+// patchLocks serialises the appends to the same id, so each PATCH sees the
+// size its own append resulted in
+var patchLocks = newKeyLock()
+
+// handlePatch appends the JSON documents of the body, one per line, to the
+// content stored under the id given in the path, creating it if needed. Every
+// line must be valid JSON passing validateJSON, otherwise nothing is
+// appended. It answers with the new size once the lines are written.
+func handlePatch(w http.ResponseWriter, r *http.Request) {
+	id, collection, ok := checkTargetID(w, itemID(r))
+	if !ok {
+		return
+	}
+	if !admitCollection(w, collection) {
+		return
+	}
+	eventTime, ok := eventTimeOf(w, r)
+	if !ok {
+		return
+	}
+
+	raw, body, ok := readBodyAndRaw(w, r)
+	if !ok {
+		return
+	}
+
+	var data []byte
+	for i, line := range bytes.Split(body, []byte{'\n'}) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if !json.Valid(line) {
+			respondWithError(w, http.StatusBadRequest, codeInvalidJSON, fmt.Sprintf("Invalid JSON on line %d", i+1), nil)
+			return
+		}
+		if !validateJSON(w, line, collection) {
+			return
+		}
+		prepared, err := prepareJSON(line, true)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, codeInvalidJSON, fmt.Sprintf("Invalid JSON on line %d", i+1), err)
+			return
+		}
+		data = append(data, prepared...)
+	}
+	if len(data) == 0 {
+		respondWithError(w, http.StatusBadRequest, codeEmptyBody, "Nothing to append", nil)
+		return
+	}
+
+	client, ok := chargeQuota(w, r, len(data))
+	if !ok {
+		return
+	}
+
+	defer patchLocks.lock(id)()
+
+	req := writeRequest{
+		data:       data,
+		id:         id,
+		collection: collection,
+		enqueued:   time.Now(),
+		appendLine: true,
+		done:       make(chan error, 1),
+		ctx:        r.Context(),
+		eventTime:  eventTime,
+	}
+	if !enqueueWrite(w, req) {
+		refundQuota(client, len(data))
+		return
+	}
+	select {
+	case err := <-req.done:
+		if errors.Is(err, errDeadLettered) {
+			respondDeadLettered(w)
+			return
+		}
+		if err != nil {
+			refundQuota(client, len(data))
+			respondWithError(w, http.StatusInternalServerError, codeWriteFailed, "Failed to append to the file", err)
+			return
+		}
+	case <-r.Context().Done():
+		recordCancelled(r, phaseWrite, r.Context().Err())
+		return
+	}
+	mirrorItem(r, collection, id, raw)
+
+	f, info, err := storage.Open(id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, codeInternal, "Failed to open file", err)
+		return
+	}
+	f.Close()
+
+	w.Header().Set("Location", collectionURL(id))
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"id": id, "size": info.Size})
+}
+
+func handleDelete(w http.ResponseWriter, r *http.Request) {
+	id := itemID(r)
+	if !isValidID(id) {
+		respondWithError(w, http.StatusBadRequest, codeInvalidID, "Invalid id", nil)
+		return
+	}
+
+	if err := storage.Delete(id); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			respondWithError(w, http.StatusNotFound, codeNotFound, "Not found", nil)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, codeInternal, "Failed to delete file", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkTargetID checks that content can be stored under the id chosen by the
+// client and returns the id to store it as, after -long-names, and its
+// collection. On failure the error response has already been sent.
+func checkTargetID(w http.ResponseWriter, id string) (string, string, bool) {
+	if !isValidID(id) {
+		respondWithError(w, http.StatusBadRequest, codeInvalidID, "Invalid id", nil)
+		return "", "", false
+	}
+	if strings.HasSuffix(id, metaSuffix) {
+		respondWithError(w, http.StatusBadRequest, codeInvalidID, "Ids must not end with "+metaSuffix+", it's reserved for the metadata", nil)
+		return "", "", false
+	}
+	id, ok := fitID(id)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, codeInvalidID, fmt.Sprintf("Id segments must not be longer than %d bytes", maxNameLength), nil)
+		return "", "", false
+	}
+	if compressStorage && !strings.HasSuffix(id, ".gz") {
+		respondWithError(w, http.StatusBadRequest, codeInvalidID, "Ids must end with .gz when storage compression is enabled", nil)
+		return "", "", false
+	}
+
+	collection, _, _ := strings.Cut(id, "/")
+	if collection == id {
+		collection = ""
+	}
+	if !isCollectionAllowed(collection) {
+		respondWithError(w, http.StatusForbidden, codeCollectionNotAllowed, "Collection not allowed", nil)
+		return "", "", false
+	}
+	return id, collection, true
+}
+
+// validateJSONID checks the body stored under a .json id is valid JSON that
+// passes validateJSON
+func validateJSONID(w http.ResponseWriter, body []byte, collection string) bool {
+	if !json.Valid(body) {
+		respondWithError(w, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON", nil)
+		return false
+	}
+	return validateJSON(w, body, collection)
+}
+
+func isJSONID(id string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(id, ".gz"), ".json")
+}
@@ -0,0 +1,236 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// patchSize sends a PATCH of body to id and returns the size it reports
+func patchSize(t *testing.T, id, body string) int64 {
+	t.Helper()
+	rec := doRequest(http.MethodPatch, "/v1/collection/"+id, "application/json", body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PATCH %s: status %d: %s", id, rec.Code, rec.Body)
+	}
+	var resp struct {
+		Size int64 `json:"size"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Size
+}
+
+func TestPatchAppendCreatingNew(t *testing.T) {
+	backend, err := newFSBackend([]string{t.TempDir()}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withWriteQueues(t, backend, func() {
+		if size := patchSize(t, "logs/new.json", `{"n":1}`); size != 8 {
+			t.Errorf("size = %d, want 8", size)
+		}
+		drainWrites(context.Background())
+	})
+	if got := readStored(t, backend, "logs/new.json"); got != "{\"n\":1}\n" {
+		t.Errorf("stored %q", got)
+	}
+}
+
+func TestPatchAppendToExisting(t *testing.T) {
+	backend, err := newFSBackend([]string{t.TempDir()}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Store(context.Background(), "logs/old.json", []byte("{\"n\":0}\n")); err != nil {
+		t.Fatal(err)
+	}
+	withWriteQueues(t, backend, func() {
+		if size := patchSize(t, "logs/old.json", "{\"n\":1}\n{\"n\":2}"); size != 24 {
+			t.Errorf("size = %d, want 24", size)
+		}
+		// Nothing is appended when a line is invalid
+		if rec := doRequest(http.MethodPatch, "/v1/collection/logs/old.json", "application/json", "{\"n\":3}\n{"); rec.Code != http.StatusBadRequest {
+			t.Errorf("invalid line: status %d, want 400", rec.Code)
+		}
+		drainWrites(context.Background())
+	})
+	if got := readStored(t, backend, "logs/old.json"); got != "{\"n\":0}\n{\"n\":1}\n{\"n\":2}\n" {
+		t.Errorf("stored %q", got)
+	}
+}
+
+func TestMetaIDReserved(t *testing.T) {
+	withWriteQueues(t, newInmemBackend(100), func() {
+		for _, method := range []string{http.MethodPut, http.MethodPatch} {
+			if rec := doRequest(method, "/v1/collection/orders/meta", "application/json", `{"id":1}`); rec.Code != http.StatusBadRequest {
+				t.Errorf("%s orders/meta: status %d, want 400", method, rec.Code)
+			}
+		}
+		// An id merely containing meta is fine
+		if rec := doRequest(http.MethodPut, "/v1/collection/orders/meta.json", "application/json", `{"id":1}`); rec.Code >= 300 {
+			t.Errorf("PUT orders/meta.json: status %d: %s", rec.Code, rec.Body)
+		}
+		drainWrites(context.Background())
+
+		rec := doRequest(http.MethodGet, "/v1/collection/orders/meta.json/meta", "", "")
+		var meta storedMeta
+		if err := json.Unmarshal(rec.Body.Bytes(), &meta); rec.Code != http.StatusOK || err != nil || meta.ID != "orders/meta.json" {
+			t.Errorf("GET orders/meta.json/meta: status %d: %s", rec.Code, rec.Body)
+		}
+	})
+}
+
+func TestMethodsPerRoute(t *testing.T) {
+	for _, tc := range []struct {
+		method, target string
+		status         int
+		allow          string
+	}{
+		{http.MethodDelete, "/v1/collection/", http.StatusMethodNotAllowed, "GET, HEAD, POST"},
+		{http.MethodPut, "/v1/collection/", http.StatusMethodNotAllowed, "GET, HEAD, POST"},
+		{http.MethodGet, "/v1/collection/", http.StatusOK, ""},
+		{"TRACE", "/v1/collection/orders/1.json", http.StatusMethodNotAllowed, "DELETE, GET, HEAD, PATCH, POST, PUT"},
+		{http.MethodGet, "/v1/collection/orders/1.json", http.StatusNotFound, ""},
+		{http.MethodDelete, "/v1/collection/orders/1.json", http.StatusNotFound, ""},
+	} {
+		withStorage(t, newInmemBackend(100), func() {
+			rec := doRequest(tc.method, tc.target, "", "")
+			if rec.Code != tc.status || rec.Header().Get("Allow") != tc.allow {
+				t.Errorf("%s %s: status %d, Allow %q, want %d, %q", tc.method, tc.target, rec.Code, rec.Header().Get("Allow"), tc.status, tc.allow)
+			}
+		})
+	}
+}
+
+func TestRoutePrefix(t *testing.T) {
+	saved := routePrefix
+	routePrefix = "/ingest"
+	defer func() { routePrefix = saved }()
+	handler, _ := newHandlers()
+
+	withWriteQueues(t, newInmemBackend(100), func() {
+		for _, tc := range []struct {
+			method, target string
+			status         int
+		}{
+			{http.MethodGet, "/ingest/v1/health", http.StatusOK},
+			{http.MethodGet, "/ingest/v1/ready", http.StatusOK},
+			{http.MethodPost, "/ingest/v1/collection/orders", http.StatusAccepted},
+			{http.MethodPost, "/ingest", http.StatusAccepted},
+			{http.MethodGet, "/v1/health", http.StatusNotFound},
+			{http.MethodPost, "/v1/collection/orders", http.StatusNotFound},
+		} {
+			r := httptest.NewRequest(tc.method, tc.target, strings.NewReader(`{"a":1}`))
+			r.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, r)
+			if rec.Code != tc.status {
+				t.Errorf("%s %s: status %d, want %d", tc.method, tc.target, rec.Code, tc.status)
+			}
+		}
+		drainWrites(context.Background())
+	})
+}
+
+func TestCleanPaths(t *testing.T) {
+	handler, _ := newHandlers()
+	backend := newInmemBackend(100)
+	withWriteQueues(t, backend, func() {
+		for _, target := range []string{
+			"/v1/collection/logs",
+			"/v1/collection/logs/",
+			"/v1/collection//logs",
+			"//v1//collection///logs//",
+			"/v1/collection/./logs",
+			"/v1/collection/other/../logs/",
+		} {
+			r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(`{"a":1}`))
+			r.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, r)
+			if loc := rec.Header().Get("Location"); rec.Code != http.StatusAccepted || !strings.HasPrefix(loc, "/v1/collection/logs/") {
+				t.Errorf("POST %s: status %d, Location %q, want 202 into logs", target, rec.Code, loc)
+			}
+		}
+		drainWrites(context.Background())
+	})
+	if firstStored(backend, "other") != "" {
+		t.Error("content stored in other")
+	}
+
+	// Disabled, unclean paths are redirected instead
+	saved := cleanPaths
+	cleanPaths = false
+	defer func() { cleanPaths = saved }()
+	r := httptest.NewRequest(http.MethodPost, "/v1/collection//logs", strings.NewReader(`{"a":1}`))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+	if rec.Code != http.StatusTemporaryRedirect || rec.Header().Get("Location") != "/v1/collection/logs" {
+		t.Errorf("unclean path with -clean-paths=false: status %d, Location %q", rec.Code, rec.Header().Get("Location"))
+	}
+}
+
+func TestAdminAddr(t *testing.T) {
+	savedAddr, savedToken := adminAddr, adminToken
+	adminToken = testAdminToken
+	defer func() { adminAddr, adminToken = savedAddr, savedToken }()
+
+	serve := func(handler http.Handler, target string) int {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set("Authorization", "Bearer "+testAdminToken)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	adminAddr = "127.0.0.1:0"
+	handler, admin := newHandlers()
+	for _, target := range []string{"/metrics", "/v1/admin/read-only"} {
+		if status := serve(handler, target); status != http.StatusNotFound {
+			t.Errorf("%s on the main port: status %d, want 404", target, status)
+		}
+		if status := serve(admin, target); status != http.StatusOK {
+			t.Errorf("%s on the admin port: status %d, want 200", target, status)
+		}
+	}
+	for _, target := range []string{"/v1/admin/logs", "/v1/debug/recent", "/v1/selftest"} {
+		if status := serve(handler, target); status != http.StatusNotFound {
+			t.Errorf("%s on the main port: status %d, want 404", target, status)
+		}
+	}
+	// Health stays on the main port
+	if status := serve(handler, "/v1/health"); status != http.StatusOK {
+		t.Errorf("/v1/health on the main port: status %d, want 200", status)
+	}
+	if status := serve(admin, "/v1/health"); status != http.StatusNotFound {
+		t.Errorf("/v1/health on the admin port: status %d, want 404", status)
+	}
+
+	// Without it everything is served on the main port
+	adminAddr = ""
+	handler, _ = newHandlers()
+	for _, target := range []string{"/metrics", "/v1/admin/read-only", "/v1/health"} {
+		if status := serve(handler, target); status != http.StatusOK {
+			t.Errorf("%s without -admin-addr: status %d, want 200", target, status)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// jsonSchema is a loaded JSON Schema. The following keywords are supported:
+// type, enum, const, properties, required, additionalProperties, items,
+// minItems, maxItems, minLength, maxLength, pattern, minimum, maximum,
+// exclusiveMinimum and exclusiveMaximum. Schemas using one of
+// unsupportedKeywords are rejected when loaded rather than half enforced.
+type jsonSchema struct {
+	raw      []byte
+	root     any
+	patterns map[string]*regexp.Regexp
+}
+
+// schemaViolation describes where and why a document doesn't match a schema.
+// Path is a JSON Pointer to the offending value.
+type schemaViolation struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// unsupportedKeywords are the keywords that constrain a document but aren't
+// implemented. Annotations such as title or description are ignored.
+var unsupportedKeywords = []string{
+	"$ref", "$dynamicRef", "allOf", "anyOf", "oneOf", "not", "if", "then", "else",
+	"format", "multipleOf", "uniqueItems", "contains", "prefixItems",
+	"patternProperties", "propertyNames", "minProperties", "maxProperties",
+	"dependencies", "dependentRequired", "dependentSchemas",
+	"unevaluatedItems", "unevaluatedProperties",
+}
+
+func loadSchema(path string) (*jsonSchema, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseSchema(raw)
+}
+
+func parseSchema(raw []byte) (*jsonSchema, error) {
+	root, err := decodeJSON(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	s := &jsonSchema{raw: raw, root: root, patterns: make(map[string]*regexp.Regexp)}
+	if err := s.compile(root); err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	return s, nil
+}
+
+// decodeJSON decodes a single JSON document keeping numbers as json.Number
+func decodeJSON(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after JSON document")
+	}
+	return v, nil
+}
+
+// compile checks the shape of a (sub)schema and pre-compiles its patterns
+func (s *jsonSchema) compile(node any) error {
+	switch n := node.(type) {
+	case bool:
+		return nil
+	case map[string]any:
+		for _, key := range unsupportedKeywords {
+			if _, ok := n[key]; ok {
+				return fmt.Errorf("unsupported keyword %q", key)
+			}
+		}
+		if p, ok := n["pattern"]; ok {
+			str, ok := p.(string)
+			if !ok {
+				return errors.New("pattern must be a string")
+			}
+			re, err := regexp.Compile(str)
+			if err != nil {
+				return err
+			}
+			s.patterns[str] = re
+		}
+		if props, ok := n["properties"].(map[string]any); ok {
+			for _, sub := range props {
+				if err := s.compile(sub); err != nil {
+					return err
+				}
+			}
+		}
+		for _, key := range []string{"items", "additionalProperties"} {
+			if sub, ok := n[key]; ok {
+				if err := s.compile(sub); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	default:
+		return errors.New("a schema must be an object or a boolean")
+	}
+}
+
+// validate returns the violations of doc, which must have been decoded with
+// decodeJSON. A nil result means the document is valid.
+func (s *jsonSchema) validate(doc any) []schemaViolation {
+	var out []schemaViolation
+	s.validateNode(s.root, doc, "", &out)
+	return out
+}
+
+func (s *jsonSchema) validateNode(node, v any, path string, out *[]schemaViolation) {
+	fail := func(format string, args ...any) {
+		*out = append(*out, schemaViolation{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	schema, ok := node.(map[string]any)
+	if !ok {
+		if node == false {
+			fail("value is not allowed")
+		}
+		return
+	}
+
+	if t, ok := schema["type"]; ok && !matchesType(t, v) {
+		fail("expected type %v, got %s", t, jsonType(v))
+		return
+	}
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			if jsonEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("value is not one of the allowed values")
+		}
+	}
+	if c, ok := schema["const"]; ok && !jsonEqual(c, v) {
+		fail("value does not match the expected constant")
+	}
+
+	switch val := v.(type) {
+	case json.Number:
+		f, _ := val.Float64()
+		if min, ok := schemaNumber(schema, "minimum"); ok && f < min {
+			fail("must be >= %s", formatFloat(min))
+		}
+		if max, ok := schemaNumber(schema, "maximum"); ok && f > max {
+			fail("must be <= %s", formatFloat(max))
+		}
+		if min, ok := schemaNumber(schema, "exclusiveMinimum"); ok && f <= min {
+			fail("must be > %s", formatFloat(min))
+		}
+		if max, ok := schemaNumber(schema, "exclusiveMaximum"); ok && f >= max {
+			fail("must be < %s", formatFloat(max))
+		}
+	case string:
+		n := float64(utf8.RuneCountInString(val))
+		if min, ok := schemaNumber(schema, "minLength"); ok && n < min {
+			fail("must be at least %s characters long", formatFloat(min))
+		}
+		if max, ok := schemaNumber(schema, "maxLength"); ok && n > max {
+			fail("must be at most %s characters long", formatFloat(max))
+		}
+		if p, ok := schema["pattern"].(string); ok && !s.patterns[p].MatchString(val) {
+			fail("must match pattern %q", p)
+		}
+	case []any:
+		n := float64(len(val))
+		if min, ok := schemaNumber(schema, "minItems"); ok && n < min {
+			fail("must have at least %s items", formatFloat(min))
+		}
+		if max, ok := schemaNumber(schema, "maxItems"); ok && n > max {
+			fail("must have at most %s items", formatFloat(max))
+		}
+		if items, ok := schema["items"]; ok {
+			for i, item := range val {
+				s.validateNode(items, item, path+"/"+strconv.Itoa(i), out)
+			}
+		}
+	case map[string]any:
+		if required, ok := schema["required"].([]any); ok {
+			for _, r := range required {
+				if name, ok := r.(string); ok {
+					if _, present := val[name]; !present {
+						fail("missing required property %q", name)
+					}
+				}
+			}
+		}
+		props, _ := schema["properties"].(map[string]any)
+		additional, hasAdditional := schema["additionalProperties"]
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			childPath := path + "/" + escapePointer(k)
+			if sub, ok := props[k]; ok {
+				s.validateNode(sub, val[k], childPath, out)
+			} else if hasAdditional {
+				if additional == false {
+					*out = append(*out, schemaViolation{Path: childPath, Message: "additional property is not allowed"})
+				} else {
+					s.validateNode(additional, val[k], childPath, out)
+				}
+			}
+		}
+	}
+}
+
+func jsonType(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	default:
+		return "unknown"
+	}
+}
+
+func matchesType(t, v any) bool {
+	switch tt := t.(type) {
+	case string:
+		if tt == "integer" {
+			n, ok := v.(json.Number)
+			if !ok {
+				return false
+			}
+			f, err := n.Float64()
+			return err == nil && f == math.Trunc(f)
+		}
+		return tt == jsonType(v)
+	case []any:
+		for _, sub := range tt {
+			if matchesType(sub, v) {
+				return true
+			}
+		}
+		return false
+	default:
+		return true
+	}
+}
+
+func schemaNumber(schema map[string]any, key string) (float64, bool) {
+	n, ok := schema[key].(json.Number)
+	if !ok {
+		return 0, false
+	}
+	f, err := n.Float64()
+	return f, err == nil
+}
+
+// jsonEqual compares two values produced by decodeJSON, numbers by value
+func jsonEqual(a, b any) bool {
+	switch av := a.(type) {
+	case json.Number:
+		bv, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		af, aerr := av.Float64()
+		bf, berr := bv.Float64()
+		return aerr == nil && berr == nil && af == bf
+	case []any:
+		bv, ok := b.([]any)
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !jsonEqual(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]any:
+		bv, ok := b.(map[string]any)
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for k, x := range av {
+			y, ok := bv[k]
+			if !ok || !jsonEqual(x, y) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a == b
+	}
+}
+
+func escapePointer(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~", "~0"), "/", "~1")
+}
+
+func handleSchema(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		respondWithError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET allowed", nil)
+		return
+	}
+	schema := schemaFor(r.URL.Query().Get("collection"))
+	if schema == nil {
+		respondWithError(w, http.StatusNotFound, codeNoSchema, "No schema configured", nil)
+		return
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	_, _ = w.Write(schema.raw)
+}
+
+// handleSchemaValidate validates the posted document against the schema of the
+// ?collection parameter, or the default one, without storing it
+func handleSchemaValidate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only POST allowed", nil)
+		return
+	}
+	schema := schemaFor(r.URL.Query().Get("collection"))
+	if schema == nil {
+		respondWithError(w, http.StatusNotFound, codeNoSchema, "No schema configured", nil)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		if isMaxBytesError(err) {
+			respondWithError(w, http.StatusRequestEntityTooLarge, codeBodyTooLarge, "Request body too large", err)
+			return
+		}
+		respondWithError(w, http.StatusBadRequest, codeReadFailed, "Failed to read request body", err)
+		return
+	}
+	doc, err := decodeJSON(body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON", err)
+		return
+	}
+
+	violations := schema.validate(doc)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"valid":      len(violations) == 0,
+		"violations": nonNilViolations(violations),
+	})
+}
+
+// respondWithViolations rejects a document that doesn't match the schema
+func respondWithViolations(w http.ResponseWriter, violations []schemaViolation) {
+	logError(fmt.Sprintf("Schema validation failed with %d violation(s)", len(violations)), nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"error":      "Schema validation failed",
+		"code":       codeSchemaViolation,
+		"violations": violations,
+	})
+}
+
+func nonNilViolations(v []schemaViolation) []schemaViolation {
+	if v == nil {
+		return []schemaViolation{}
+	}
+	return v
+}
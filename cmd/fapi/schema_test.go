@@ -0,0 +1,120 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSchemaUnsupportedKeywords(t *testing.T) {
+	for _, raw := range []string{
+		`{"allOf":[{"type":"object"}]}`,
+		`{"anyOf":[{"type":"string"},{"type":"number"}]}`,
+		`{"oneOf":[{"type":"string"}]}`,
+		`{"$ref":"#/$defs/order"}`,
+		`{"properties":{"email":{"type":"string","format":"email"}}}`,
+		`{"patternProperties":{"^x-":{"type":"string"}}}`,
+		`{"items":{"properties":{"tags":{"uniqueItems":true}}}}`,
+	} {
+		if _, err := parseSchema([]byte(raw)); err == nil || !strings.Contains(err.Error(), "unsupported keyword") {
+			t.Errorf("parseSchema(%s) error %v, want an unsupported keyword", raw, err)
+		}
+	}
+}
+
+func TestParseSchemaAnnotations(t *testing.T) {
+	// A property may be named like a keyword, and annotations are ignored
+	raw := `{"$schema":"https://json-schema.org/draft/2020-12/schema","title":"Order","description":"An order",
+		"type":"object","properties":{"format":{"type":"string"}},"required":["format"]}`
+	schema, err := parseSchema([]byte(raw))
+	if err != nil {
+		t.Fatalf("parseSchema: %v", err)
+	}
+	doc, _ := decodeJSON([]byte(`{"format":1}`))
+	if violations := schema.validate(doc); len(violations) != 1 || violations[0].Path != "/format" {
+		t.Errorf("violations %+v, want one at /format", violations)
+	}
+}
+
+// withSchema runs fn with the schema parsed from raw active, or none when raw
+// is empty
+func withSchema(t *testing.T, raw string, fn func()) {
+	t.Helper()
+	var schema *jsonSchema
+	if raw != "" {
+		var err error
+		if schema, err = parseSchema([]byte(raw)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	saved := schemas.Load()
+	schemas.Store(&schemaSet{fallback: schema})
+	defer schemas.Store(saved)
+	fn()
+}
+
+const orderSchema = `{"type":"object","required":["id"],"properties":{"id":{"type":"integer","minimum":1},"tags":{"type":"array","items":{"type":"string"}}},"additionalProperties":false}`
+
+func TestSchemaValidateEndpoint(t *testing.T) {
+	withSchema(t, orderSchema, func() {
+		for _, tc := range []struct {
+			doc        string
+			valid      bool
+			violations []schemaViolation
+		}{
+			{`{"id":1,"tags":["a"]}`, true, []schemaViolation{}},
+			{`{"id":0,"tags":["a",2],"extra":true}`, false, []schemaViolation{
+				{Path: "/extra", Message: "additional property is not allowed"},
+				{Path: "/id", Message: "must be >= 1"},
+				{Path: "/tags/1", Message: "expected type string, got number"},
+			}},
+			{`{"tags":[]}`, false, []schemaViolation{{Path: "", Message: `missing required property "id"`}}},
+		} {
+			r := httptest.NewRequest(http.MethodPost, "/v1/schema/validate", strings.NewReader(tc.doc))
+			rec := httptest.NewRecorder()
+			handleSchemaValidate(rec, r)
+			var resp struct {
+				Valid      bool              `json:"valid"`
+				Violations []schemaViolation `json:"violations"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); rec.Code != http.StatusOK || err != nil {
+				t.Fatalf("%s: status %d, %v: %s", tc.doc, rec.Code, err, rec.Body)
+			}
+			if resp.Valid != tc.valid || !reflect.DeepEqual(resp.Violations, tc.violations) {
+				t.Errorf("%s: valid %v, violations %+v, want %v, %+v", tc.doc, resp.Valid, resp.Violations, tc.valid, tc.violations)
+			}
+		}
+
+		// Nothing is stored, and malformed samples are told apart
+		rec := httptest.NewRecorder()
+		handleSchemaValidate(rec, httptest.NewRequest(http.MethodPost, "/v1/schema/validate", strings.NewReader(`{"id":`)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("invalid JSON: status %d, want 400", rec.Code)
+		}
+	})
+
+	withSchema(t, "", func() {
+		rec := httptest.NewRecorder()
+		handleSchemaValidate(rec, httptest.NewRequest(http.MethodPost, "/v1/schema/validate", strings.NewReader(`{}`)))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("no schema: status %d, want 404", rec.Code)
+		}
+	})
+}
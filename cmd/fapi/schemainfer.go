@@ -0,0 +1,159 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+)
+
+// typeOrder is the order types are listed in when a value has several
+var typeOrder = []string{"object", "array", "string", "integer", "number", "boolean", "null"}
+
+// shape accumulates what the samples seen at one place in the documents
+// have in common
+type shape struct {
+	types map[string]bool
+
+	// objects counts the object samples, keys how many of them hold each
+	// property
+	objects    int
+	keys       map[string]int
+	properties map[string]*shape
+
+	items *shape
+}
+
+func newShape() *shape {
+	return &shape{types: make(map[string]bool)}
+}
+
+// add merges a value decoded with decodeJSON into the shape
+func (s *shape) add(v any) {
+	t := jsonType(v)
+	if n, ok := v.(json.Number); ok {
+		if f, err := n.Float64(); err == nil && f == math.Trunc(f) {
+			t = "integer"
+		}
+	}
+	s.types[t] = true
+
+	switch val := v.(type) {
+	case map[string]any:
+		if s.properties == nil {
+			s.keys = make(map[string]int)
+			s.properties = make(map[string]*shape)
+		}
+		s.objects++
+		for k, sub := range val {
+			s.keys[k]++
+			if s.properties[k] == nil {
+				s.properties[k] = newShape()
+			}
+			s.properties[k].add(sub)
+		}
+	case []any:
+		if s.items == nil {
+			s.items = newShape()
+		}
+		for _, sub := range val {
+			s.items.add(sub)
+		}
+	}
+}
+
+// schema returns the JSON Schema matching every sample added to the shape.
+// Properties are required when all the object samples have them.
+func (s *shape) schema() map[string]any {
+	out := make(map[string]any)
+
+	var types []string
+	for _, t := range typeOrder {
+		// An integer is a number too, listing both would be redundant
+		if s.types[t] && !(t == "integer" && s.types["number"]) {
+			types = append(types, t)
+		}
+	}
+	switch len(types) {
+	case 0:
+	case 1:
+		out["type"] = types[0]
+	default:
+		out["type"] = types
+	}
+
+	if s.properties != nil {
+		props := make(map[string]any, len(s.properties))
+		required := []string{}
+		for k, sub := range s.properties {
+			props[k] = sub.schema()
+			if s.keys[k] == s.objects {
+				required = append(required, k)
+			}
+		}
+		sort.Strings(required)
+		out["properties"] = props
+		out["required"] = required
+	}
+	// Empty arrays say nothing about their items
+	if s.items != nil && len(s.items.types) > 0 {
+		out["items"] = s.items.schema()
+	}
+	return out
+}
+
+// handleSchemaInfer returns a JSON Schema inferred from one or more sample
+// documents sent one after the other (e.g. as NDJSON). Nothing is stored.
+func handleSchemaInfer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only POST allowed", nil)
+		return
+	}
+
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize))
+	dec.UseNumber()
+	root := newShape()
+	samples := 0
+	for {
+		var doc any
+		err := dec.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			if isMaxBytesError(err) {
+				respondWithError(w, http.StatusRequestEntityTooLarge, codeBodyTooLarge, "Request body too large", err)
+				return
+			}
+			respondWithError(w, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON", err)
+			return
+		}
+		root.add(doc)
+		samples++
+	}
+	if samples == 0 {
+		respondWithError(w, http.StatusBadRequest, codeEmptyBody, "No sample documents", nil)
+		return
+	}
+
+	schema := root.schema()
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	w.Header().Set("Content-Type", "application/schema+json")
+	_ = json.NewEncoder(w).Encode(schema)
+}
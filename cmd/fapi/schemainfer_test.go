@@ -0,0 +1,103 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func inferRequest(method, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handleSchemaInfer(rec, httptest.NewRequest(method, "/v1/schema/infer", strings.NewReader(body)))
+	return rec
+}
+
+func TestSchemaInfer(t *testing.T) {
+	samples := `{"id":1,"price":9.5,"tags":["a"],"customer":{"name":"ada","vip":true},"note":null}
+{"id":2,"price":10,"tags":[],"customer":{"name":"bob"}}`
+	rec := inferRequest(http.MethodPost, samples)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/schema+json" {
+		t.Fatalf("status %d, Content-Type %q: %s", rec.Code, rec.Header().Get("Content-Type"), rec.Body)
+	}
+
+	want := `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"required": ["customer", "id", "price", "tags"],
+		"properties": {
+			"id": {"type": "integer"},
+			"price": {"type": "number"},
+			"tags": {"type": "array", "items": {"type": "string"}},
+			"customer": {
+				"type": "object",
+				"required": ["name"],
+				"properties": {"name": {"type": "string"}, "vip": {"type": "boolean"}}
+			},
+			"note": {"type": "null"}
+		}
+	}`
+	var got, expected any
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	_ = json.Unmarshal([]byte(want), &expected)
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("inferred %s", rec.Body)
+	}
+
+	// The inferred schema accepts the samples it was inferred from
+	schema, err := parseSchema(rec.Body.Bytes())
+	if err != nil {
+		t.Fatalf("inferred schema doesn't parse: %v", err)
+	}
+	for _, sample := range strings.Split(samples, "\n") {
+		doc, _ := decodeJSON([]byte(sample))
+		if violations := schema.validate(doc); len(violations) > 0 {
+			t.Errorf("%s violates the inferred schema: %+v", sample, violations)
+		}
+	}
+}
+
+func TestSchemaInferMixedTypes(t *testing.T) {
+	rec := inferRequest(http.MethodPost, `[1, "a", 2.5, {"k":1}] [[]]`)
+	var got map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	items, _ := got["items"].(map[string]any)
+	if !reflect.DeepEqual(items["type"], []any{"object", "array", "string", "number"}) {
+		t.Errorf("items %v, want the types listed once each", items)
+	}
+}
+
+func TestSchemaInferErrors(t *testing.T) {
+	for _, tc := range []struct {
+		method, body string
+		status       int
+	}{
+		{http.MethodPost, "", http.StatusBadRequest},
+		{http.MethodPost, `{"a":`, http.StatusBadRequest},
+		{http.MethodGet, "", http.StatusMethodNotAllowed},
+	} {
+		if rec := inferRequest(tc.method, tc.body); rec.Code != tc.status {
+			t.Errorf("%s %q: status %d, want %d", tc.method, tc.body, rec.Code, tc.status)
+		}
+	}
+}
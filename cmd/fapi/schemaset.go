@@ -0,0 +1,106 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+const schemaFileSuffix = ".schema.json"
+
+// schemaSet holds the schemas uploads are validated against: one per
+// collection found in -schema-dir, and -schema for every other collection
+type schemaSet struct {
+	fallback    *jsonSchema
+	collections map[string]*jsonSchema
+}
+
+// schemas is swapped as a whole when the schemas are reloaded on SIGHUP
+var schemas atomic.Pointer[schemaSet]
+
+// schemaFor returns the schema of collection, nil if it isn't validated
+func schemaFor(collection string) *jsonSchema {
+	set := schemas.Load()
+	if set == nil {
+		return nil
+	}
+	if s, ok := set.collections[collection]; ok {
+		return s
+	}
+	return set.fallback
+}
+
+// loadSchemas loads the -schema file and every <collection>.schema.json file
+// in -schema-dir. Either may be empty.
+func loadSchemas(path, dir string) (*schemaSet, error) {
+	set := &schemaSet{collections: make(map[string]*jsonSchema)}
+	if path != "" {
+		s, err := loadSchema(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		set.fallback = s
+	}
+	if dir == "" {
+		return set, nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		collection, ok := strings.CutSuffix(e.Name(), schemaFileSuffix)
+		if !ok || e.IsDir() || !isValidName(collection) {
+			continue
+		}
+		file := filepath.Join(dir, e.Name())
+		s, err := loadSchema(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		set.collections[collection] = s
+	}
+	return set, nil
+}
+
+// reloadSchemasOnHangup reloads the schemas whenever the process receives
+// SIGHUP. If any schema fails to load the previous ones are kept.
+func reloadSchemasOnHangup() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		reloadSchemas()
+	}
+}
+
+// reloadSchemas replaces the schemas with those of -schema and -schema-dir,
+// unless any of them fails to load
+func reloadSchemas() {
+	set, err := loadSchemas(schemaPath, schemaDir)
+	if err != nil {
+		slog.Error("Failed to reload schemas, keeping the previous ones", "error", err)
+		return
+	}
+	schemas.Store(set)
+	slog.Info("Schemas reloaded", "collections", len(set.collections), "default", set.fallback != nil)
+}
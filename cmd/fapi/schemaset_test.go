@@ -0,0 +1,140 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const userSchema = `{"type":"object","required":["name"],"properties":{"name":{"type":"string"}}}`
+
+// writeSchemaDir writes files, named after their keys, to dir
+func writeSchemaDir(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// withSchemaFlags runs fn with -schema and -schema-dir set to path and dir,
+// and the schemas reset
+func withSchemaFlags(t *testing.T, path, dir string, fn func()) {
+	t.Helper()
+	savedPath, savedDir, savedSet := schemaPath, schemaDir, schemas.Load()
+	schemaPath, schemaDir = path, dir
+	defer func() {
+		schemaPath, schemaDir = savedPath, savedDir
+		schemas.Store(savedSet)
+	}()
+	fn()
+}
+
+func TestSchemaDir(t *testing.T) {
+	dir := t.TempDir()
+	writeSchemaDir(t, dir, map[string]string{
+		"orders.schema.json": orderSchema,
+		"users.schema.json":  userSchema,
+		// Not schemas of a collection
+		"README.md":     "not a schema",
+		"..schema.json": `{"type":"string"}`,
+	})
+	set, err := loadSchemas("", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set.collections) != 2 || set.fallback != nil {
+		t.Fatalf("loaded %d collection schemas, default %v", len(set.collections), set.fallback != nil)
+	}
+
+	withSchemaFlags(t, "", dir, func() {
+		schemas.Store(set)
+		withWriteQueues(t, newInmemBackend(100), func() {
+			for _, tc := range []struct {
+				collection, body string
+				status           int
+			}{
+				{"orders", `{"id":1}`, http.StatusAccepted},
+				{"orders", `{"name":"ada"}`, http.StatusUnprocessableEntity},
+				{"users", `{"name":"ada"}`, http.StatusAccepted},
+				{"users", `{"id":1}`, http.StatusUnprocessableEntity},
+				// No schema, anything goes
+				{"events", `{"anything":true}`, http.StatusAccepted},
+			} {
+				rec := doRequest(http.MethodPost, "/v1/collection/"+tc.collection, "application/json", tc.body)
+				if rec.Code != tc.status {
+					t.Errorf("%s %s: status %d, want %d: %s", tc.collection, tc.body, rec.Code, tc.status, rec.Body)
+				}
+			}
+			drainWrites(context.Background())
+		})
+	})
+}
+
+func TestSchemaDirFallback(t *testing.T) {
+	dir := t.TempDir()
+	writeSchemaDir(t, dir, map[string]string{"orders.schema.json": orderSchema})
+	fallback := filepath.Join(t.TempDir(), "default.json")
+	if err := os.WriteFile(fallback, []byte(userSchema), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	set, err := loadSchemas(fallback, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withSchemaFlags(t, fallback, dir, func() {
+		schemas.Store(set)
+		if schemaFor("orders") != set.collections["orders"] || schemaFor("events") != set.fallback || set.fallback == nil {
+			t.Error("orders doesn't get its own schema, or events the default one")
+		}
+	})
+
+	writeSchemaDir(t, dir, map[string]string{"broken.schema.json": "{"})
+	if _, err := loadSchemas(fallback, dir); err == nil {
+		t.Error("invalid schema in -schema-dir loaded")
+	}
+}
+
+func TestReloadSchemas(t *testing.T) {
+	dir := t.TempDir()
+	withSchemaFlags(t, "", dir, func() {
+		schemas.Store(nil)
+		writeSchemaDir(t, dir, map[string]string{"orders.schema.json": orderSchema})
+		reloadSchemas()
+		if schemaFor("orders") == nil {
+			t.Fatal("orders schema not loaded")
+		}
+
+		// A schema that fails to load keeps the previous ones
+		loaded := schemas.Load()
+		writeSchemaDir(t, dir, map[string]string{"users.schema.json": "{"})
+		reloadSchemas()
+		if schemas.Load() != loaded {
+			t.Error("schemas replaced by a set that failed to load")
+		}
+
+		writeSchemaDir(t, dir, map[string]string{"users.schema.json": userSchema})
+		reloadSchemas()
+		if schemaFor("users") == nil || schemaFor("orders") == nil {
+			t.Error("users schema not added on reload")
+		}
+	})
+}
@@ -0,0 +1,99 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Sequence numbers persisted to -sequence-file are reserved in blocks, so the
+// file is only rewritten once per block. After a restart numbering resumes at
+// the end of the last reserved block: numbers may be skipped, never reused.
+const sequenceBlock = 1000
+
+// fileSequence numbers stored files when -sequence is set
+var fileSequence sequence
+
+type sequence struct {
+	n atomic.Uint64
+
+	mu       sync.Mutex
+	path     string
+	reserved uint64
+}
+
+// load resumes the sequence from the state file at path, if it exists
+func (s *sequence) load(path string) error {
+	s.path = path
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	v, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid sequence file %s: %w", path, err)
+	}
+	s.n.Store(v)
+	s.reserved = v
+	return nil
+}
+
+func (s *sequence) next() uint64 {
+	v := s.n.Add(1)
+	if s.path != "" {
+		s.reserve(v)
+	}
+	return v
+}
+
+// reserve makes sure v is covered by the block saved in the state file
+func (s *sequence) reserve(v uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v <= s.reserved {
+		return
+	}
+	s.reserved = v + sequenceBlock - 1
+	if err := s.save(s.reserved); err != nil {
+		slog.Error("Failed to save sequence", "path", s.path, "error", err)
+	}
+}
+
+// save replaces the state file atomically, a crash never leaves it truncated
+func (s *sequence) save(v uint64) error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".sequence-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := fmt.Fprintf(tmp, "%d\n", v); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,128 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSequenceNames(t *testing.T) {
+	saved := useSequence
+	useSequence = true
+	defer func() { useSequence = saved }()
+
+	const uploads = 20
+	backend := newInmemBackend(100)
+	withWriteQueues(t, backend, func() {
+		for i := 0; i < uploads; i++ {
+			doRequest(http.MethodPost, "/v1/collection/seq", "application/json", fmt.Sprintf(`{"i":%d}`, i))
+		}
+		drainWrites(context.Background())
+
+		var ids []string
+		_ = backend.List("seq", func(id string, _ storedInfo) error { ids = append(ids, id); return nil })
+		if len(ids) != uploads {
+			t.Fatalf("%d files stored, want %d", len(ids), uploads)
+		}
+		// Sorting the names gives the order the uploads were sent in
+		sort.Strings(ids)
+		var last uint64
+		for i, id := range ids {
+			n, err := strconv.ParseUint(strings.SplitN(path.Base(id), "-", 2)[0], 10, 64)
+			if err != nil {
+				t.Fatalf("%s doesn't start with a sequence number", id)
+			}
+			if i > 0 && n != last+1 {
+				t.Errorf("%s follows %d", id, last)
+			}
+			last = n
+			if got := readStored(t, backend, id); got != fmt.Sprintf(`{"i":%d}`, i) {
+				t.Errorf("%s holds %s, upload %d", id, got, i)
+			}
+		}
+	})
+}
+
+func TestSequenceConcurrent(t *testing.T) {
+	var s sequence
+	const goroutines, each = 8, 1000
+	seen := make([][]uint64, goroutines)
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < each; i++ {
+				seen[g] = append(seen[g], s.next())
+			}
+		}()
+	}
+	wg.Wait()
+
+	unique := make(map[uint64]bool)
+	for _, numbers := range seen {
+		for i, n := range numbers {
+			if unique[n] {
+				t.Fatalf("%d handed out twice", n)
+			}
+			unique[n] = true
+			if i > 0 && n <= numbers[i-1] {
+				t.Errorf("%d after %d", n, numbers[i-1])
+			}
+		}
+	}
+}
+
+func TestSequenceFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "sequence")
+
+	var first sequence
+	if err := first.load(file); err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(1); i <= 3; i++ {
+		if n := first.next(); n != i {
+			t.Fatalf("next() = %d, want %d", n, i)
+		}
+	}
+	if data, _ := os.ReadFile(file); string(data) != fmt.Sprintf("%d\n", sequenceBlock) {
+		t.Errorf("sequence file holds %q, want the end of the first block", data)
+	}
+
+	// After a restart numbering resumes past the reserved block
+	var second sequence
+	if err := second.load(file); err != nil {
+		t.Fatal(err)
+	}
+	if n := second.next(); n != sequenceBlock+1 {
+		t.Errorf("next() after a restart = %d, want %d", n, sequenceBlock+1)
+	}
+
+	_ = os.WriteFile(file, []byte("garbage"), 0644)
+	var third sequence
+	if err := third.load(file); err == nil {
+		t.Error("invalid sequence file loaded")
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// drainLogInterval is how often the remaining requests are logged while
+// shutting down
+const drainLogInterval = time.Second
+
+// shuttingDown is closed once shutdown starts, for the requests that would
+// otherwise go on for as long as their client wants
+var shuttingDown = make(chan struct{})
+
+// activeRequests is the number of requests currently being handled
+var activeRequests atomic.Int64
+
+var _ = newGaugeFunc("fapi_active_requests", "Requests currently being handled.", func() float64 {
+	return float64(activeRequests.Load())
+})
+
+// handledRequests counts the requests received since startup, for
+// -max-requests
+var handledRequests atomic.Int64
+
+// requestLimitReached is closed once -max-requests requests were received
+var requestLimitReached = make(chan struct{})
+
+// withRequestLimit counts the requests and starts a graceful shutdown once
+// -max-requests of them were received, for the orchestrator to restart the
+// process. The request that reaches the limit is still handled.
+func withRequestLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if handledRequests.Add(1) == maxRequests {
+			close(requestLimitReached)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withActiveRequests keeps activeRequests up to date
+func withActiveRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		activeRequests.Add(1)
+		defer activeRequests.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// endpoint is a server and the listener it serves on
+type endpoint struct {
+	server *http.Server
+	ln     net.Listener
+}
+
+// serve serves the endpoints until SIGINT or SIGTERM, then stops accepting
+// requests on all of them and waits up to -shutdown-timeout for the active
+// ones, logging how many are left as they drain. The accepted uploads are
+// then written, see drainWrites.
+func serve(endpoints ...endpoint) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	served := make(chan error, len(endpoints))
+	for _, e := range endpoints {
+		go func() {
+			served <- e.server.Serve(e.ln)
+		}()
+	}
+	select {
+	case err := <-served:
+		fatal("Server error", "error", err)
+	case sig := <-stop:
+		slog.Info("Shutting down", "signal", sig.String(), "active", activeRequests.Load())
+	case <-requestLimitReached:
+		slog.Info("Shutting down, request limit reached", "requests", maxRequests, "active", activeRequests.Load())
+	}
+
+	close(shuttingDown)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		errs := make([]error, len(endpoints))
+		var wg sync.WaitGroup
+		for i, e := range endpoints {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[i] = e.server.Shutdown(ctx)
+			}()
+		}
+		wg.Wait()
+		done <- errors.Join(errs...)
+	}()
+
+	ticker := time.NewTicker(drainLogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				// Handlers may still be queueing, so the queues can't be
+				// closed
+				slog.Warn("Shutdown timed out", "active", activeRequests.Load(), "error", err)
+				slog.Error("Queued writes dropped", "dropped", queueDepth())
+				return
+			}
+			drainWrites(ctx)
+			slog.Info("Shutdown complete")
+			return
+		case <-ticker.C:
+			slog.Info("Draining", "active", activeRequests.Load())
+		}
+	}
+}
+
+// drainWrites writes the queued uploads, then sends their mirror requests
+// and callbacks, until ctx is done. Whatever is left by then is logged as
+// dropped. It must only run once no handler can queue anything.
+func drainWrites(ctx context.Context) {
+	slog.Info("Writing queued uploads", "queued", queueDepth())
+	if !waitFor(ctx, &pendingManifests) {
+		slog.Error("Shutdown timed out, queued writes dropped", "dropped", queueDepth())
+		return
+	}
+	for _, queue := range writeQueues {
+		close(queue)
+	}
+	if !waitFor(ctx, writerWorkers) {
+		slog.Error("Shutdown timed out, queued writes dropped", "dropped", queueDepth())
+		return
+	}
+
+	if mirrorQueue != nil {
+		close(mirrorQueue)
+		if !waitFor(ctx, &mirrorRunning) {
+			slog.Error("Shutdown timed out, mirror requests dropped", "dropped", len(mirrorQueue))
+		}
+	}
+	if callbackQueue != nil {
+		close(callbackQueue)
+		if !waitFor(ctx, &callbacksRunning) {
+			slog.Error("Shutdown timed out, callbacks dropped", "dropped", len(callbackQueue))
+		}
+	}
+}
+
+// waitFor waits for wg until ctx is done, and reports whether wg finished
+func waitFor(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// metricValue returns the value of the unlabelled metric name from /metrics
+func metricValue(t *testing.T, name string) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if value, ok := strings.CutPrefix(line, name+" "); ok {
+			return value
+		}
+	}
+	t.Fatalf("metric %s not found", name)
+	return ""
+}
+
+func TestActiveRequestsGauge(t *testing.T) {
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	handler := withActiveRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+	}))
+
+	if got := metricValue(t, "fapi_active_requests"); got != "0" {
+		t.Fatalf("before: got %s, want 0", got)
+	}
+	done := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		go func() {
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+			done <- struct{}{}
+		}()
+		<-entered
+	}
+	if got := metricValue(t, "fapi_active_requests"); got != "2" {
+		t.Fatalf("during: got %s, want 2", got)
+	}
+
+	release <- struct{}{}
+	<-done
+	if got := metricValue(t, "fapi_active_requests"); got != "1" {
+		t.Fatalf("after one: got %s, want 1", got)
+	}
+	release <- struct{}{}
+	<-done
+	if got := metricValue(t, "fapi_active_requests"); got != "0" {
+		t.Fatalf("after both: got %s, want 0", got)
+	}
+}
+
+// slowBackend delays every write, so they pile up in the queue
+type slowBackend struct {
+	*inmemBackend
+	delay time.Duration
+}
+
+func (b slowBackend) Store(ctx context.Context, id string, data []byte) error {
+	time.Sleep(b.delay)
+	return b.inmemBackend.Store(ctx, id, data)
+}
+
+// withWriteQueues runs fn with fresh writer workers storing into backend,
+// one queue per worker if -ordered-writes is set
+func withWriteQueues(t *testing.T, backend StorageBackend, fn func()) {
+	t.Helper()
+	saved := storage
+	storage = backend
+	defer func() {
+		storage = saved
+		writeQueues = nil
+	}()
+	startWorkers(orderedWrites)
+	fn()
+}
+
+func TestDrainWritesQueued(t *testing.T) {
+	backend := slowBackend{newInmemBackend(100), 5 * time.Millisecond}
+	withWriteQueues(t, backend, func() {
+		for i := 0; i < 20; i++ {
+			id := fmt.Sprintf("drain/%d.json", i)
+			queueFor("drain") <- writeRequest{data: []byte("{}"), id: id, collection: "drain", enqueued: time.Now()}
+		}
+		drainWrites(context.Background())
+	})
+	for i := 0; i < 20; i++ {
+		id := fmt.Sprintf("drain/%d.json", i)
+		if _, _, err := backend.Open(id); err != nil {
+			t.Errorf("%s not written: %v", id, err)
+		}
+	}
+}
+
+func TestDrainWritesTimeout(t *testing.T) {
+	backend := slowBackend{newInmemBackend(100), 50 * time.Millisecond}
+	withWriteQueues(t, backend, func() {
+		for i := 0; i < 20; i++ {
+			queueFor("drain") <- writeRequest{data: []byte("{}"), id: fmt.Sprintf("drain/%d.json", i), collection: "drain"}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		drainWrites(ctx)
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("drainWrites took %v past its deadline", elapsed)
+		}
+		// Let the dropped writes finish before the backend is restored
+		writerWorkers.Wait()
+	})
+}
+
+// TestMaxRequestsExit runs fapi in a subprocess with -max-requests and checks
+// it exits on its own once they are served, with every upload written
+func TestMaxRequestsExit(t *testing.T) {
+	if ln, err := net.Listen("tcp", ":8989"); err != nil {
+		t.Skipf("port 8989 is not available: %v", err)
+	} else {
+		ln.Close()
+	}
+
+	dir := t.TempDir()
+	var out bytes.Buffer
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "FAPI_TEST_ARGS=-max-requests=3 -upload-dirs="+dir)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	// Wait for the listener without sending a request, it would count
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", "127.0.0.1:8989")
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			cmd.Process.Kill()
+			t.Fatalf("fapi did not start: %v\n%s", err, out.String())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	for i := 0; i < 3; i++ {
+		resp, err := client.Post("http://127.0.0.1:8989/v1/collection/limit", "application/json", strings.NewReader(fmt.Sprintf(`{"n":%d}`, i)))
+		if err != nil {
+			cmd.Process.Kill()
+			t.Fatalf("upload %d: %v", i, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			t.Errorf("upload %d: status %d", i, resp.StatusCode)
+		}
+	}
+
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Fatalf("fapi exited with %v\n%s", err, out.String())
+		}
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		t.Fatalf("fapi did not exit after 3 requests\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "request limit reached") {
+		t.Errorf("shutdown reason not logged:\n%s", out.String())
+	}
+
+	written := 0
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			written++
+		}
+		return nil
+	})
+	if written != 3 {
+		t.Errorf("got %d files written, want 3\n%s", written, out.String())
+	}
+}
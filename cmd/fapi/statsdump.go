@@ -0,0 +1,31 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "log/slog"
+
+// logStats logs a snapshot of the write pipeline. It only reads atomics and
+// channel lengths, so it works even when request handling is stuck.
+func logStats() {
+	slog.Info("Stats",
+		"queue_depth", queueDepth(),
+		"queue_capacity", queueCapacity(),
+		"workers", workerCount+int(extraWorkers.Load()),
+		"writes", writesTotal.total(),
+		"written_bytes", writtenBytes.total(),
+		"write_errors", writeErrors.total(),
+		"ready", checkReady(),
+		"read_only", readOnly.Load())
+}
@@ -0,0 +1,88 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is a bytes.Buffer safe to log to from several goroutines
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestStatsOnSignal(t *testing.T) {
+	var out lockedBuffer
+	saved := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&out, nil)))
+	defer slog.SetDefault(saved)
+
+	// Keep SIGUSR1 from killing the test before logStatsOnSignal listens
+	ignored := make(chan os.Signal, 1)
+	signal.Notify(ignored, syscall.SIGUSR1)
+	defer signal.Stop(ignored)
+
+	withWriteQueues(t, newInmemBackend(100), func() {
+		go logStatsOnSignal()
+		deadline := time.Now().Add(5 * time.Second)
+		for !strings.Contains(out.String(), `"msg":"Stats"`) {
+			if time.Now().After(deadline) {
+				t.Fatalf("no stats logged: %s", out.String())
+			}
+			_ = syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+			time.Sleep(20 * time.Millisecond)
+		}
+		drainWrites(context.Background())
+	})
+
+	line, _, _ := strings.Cut(out.String(), "\n")
+	var stats map[string]any
+	if err := json.Unmarshal([]byte(line), &stats); err != nil {
+		t.Fatalf("%v: %s", err, line)
+	}
+	for _, key := range []string{"queue_depth", "queue_capacity", "workers", "writes", "written_bytes", "write_errors"} {
+		if _, ok := stats[key]; !ok {
+			t.Errorf("stats are missing %s: %s", key, line)
+		}
+	}
+	if stats["queue_capacity"] != float64(writeQueueCap) || stats["workers"] != float64(workerCount) {
+		t.Errorf("stats %s, want a queue capacity of %d and %d workers", line, writeQueueCap, workerCount)
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// StorageBackend stores uploaded files and serves them back by id
+type StorageBackend interface {
+	// Store saves data under id. It gives up, leaving nothing behind, once
+	// ctx is done.
+	Store(ctx context.Context, id string, data []byte) error
+	// Append adds data at the end of the content stored under id, creating
+	// it if needed. It gives up, leaving the content as it was, once ctx is
+	// done.
+	Append(ctx context.Context, id string, data []byte) error
+	// StoreFile saves the content of the local file path under id, like
+	// Store, without holding it all in memory where the backend can
+	StoreFile(ctx context.Context, id, path string) error
+	// SetEventTime records the event time of the content stored under id,
+	// or forgets it if t is zero, see -max-clock-skew
+	SetEventTime(id string, t time.Time) error
+	// Open returns the content stored under id, or an error wrapping
+	// os.ErrNotExist if there is none
+	Open(id string) (io.ReadSeekCloser, storedInfo, error)
+	// Delete removes the content stored under id, or returns an error
+	// wrapping os.ErrNotExist if there is none
+	Delete(id string) error
+	// Cleanup removes the content stored before the given time, only in
+	// collection unless it's empty
+	Cleanup(before time.Time, collection string) (cleanupResult, error)
+	// List calls fn with the id and info of everything stored, only in
+	// collection unless it's empty. It stops at the first error fn returns.
+	List(collection string, fn func(id string, info storedInfo) error) error
+	// Collections lists the named collections holding content
+	Collections() ([]string, error)
+	// Check verifies the backend is able to store and read back data
+	Check() error
+}
+
+// cleanupResult counts the files removed by a cleanup
+type cleanupResult struct {
+	Removed int   `json:"removed"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// storedInfo describes a stored file
+type storedInfo struct {
+	Size    int64
+	ModTime time.Time
+	// EventTime is the zero time unless one was recorded with SetEventTime
+	EventTime time.Time
+}
+
+// storage is the backend selected with -storage
+var storage StorageBackend
+
+func newStorageBackend(kind string) (StorageBackend, error) {
+	switch kind {
+	case "fs":
+		return newFSBackend(uploadDirs, compressStorage)
+	case "inmem":
+		return newInmemBackend(inmemMaxEntries), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", kind)
+	}
+}
+
+// uploadDirs are the directories files are spread across, see -upload-dirs
+var uploadDirs = []string{"./uploads"}
+
+// fsBackend stores files in one or more local directories
+type fsBackend struct {
+	dirs     []string
+	compress bool
+
+	// appendLocks serialises appends to the same file, keyed by path
+	appendLocks *keyLock
+}
+
+func newFSBackend(dirs []string, compress bool) (*fsBackend, error) {
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create upload directory %s: %w", dir, err)
+		}
+	}
+	return &fsBackend{dirs: dirs, compress: compress, appendLocks: newKeyLock()}, nil
+}
+
+// dirFor returns the directory a file with the given id is written to.
+// Hashing the id keeps the choice stable, so retrieval knows where to look.
+func (b *fsBackend) dirFor(id string) string {
+	if len(b.dirs) == 1 {
+		return b.dirs[0]
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(id))
+	return b.dirs[h.Sum32()%uint32(len(b.dirs))]
+}
+
+func (b *fsBackend) Store(ctx context.Context, id string, data []byte) error {
+	return writeToFile(ctx, data, filepath.Join(b.dirFor(id), id), b.compress)
+}
+
+func (b *fsBackend) StoreFile(ctx context.Context, id, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return writeFileFrom(ctx, f, info.Size(), filepath.Join(b.dirFor(id), id), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, b.compress)
+}
+
+// SetEventTime keeps t in an extended attribute of the file, which the file
+// system must support
+func (b *fsBackend) SetEventTime(id string, t time.Time) error {
+	return setEventTimeXattr(filepath.Join(b.dirFor(id), id), t)
+}
+
+func (b *fsBackend) Append(ctx context.Context, id string, data []byte) error {
+	path := filepath.Join(b.dirFor(id), id)
+	defer b.appendLocks.lock(path)()
+	return appendToFile(ctx, data, path, b.compress)
+}
+
+// Open opens the file stored under id. The directory the id hashes to is
+// tried first, then the others in case the directory list has changed.
+func (b *fsBackend) Open(id string) (io.ReadSeekCloser, storedInfo, error) {
+	preferred := b.dirFor(id)
+	f, err := openRegular(filepath.Join(preferred, id))
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return statStored(f, err)
+	}
+	for _, dir := range b.dirs {
+		if dir == preferred {
+			continue
+		}
+		if f, err := openRegular(filepath.Join(dir, id)); err == nil || !errors.Is(err, os.ErrNotExist) {
+			return statStored(f, err)
+		}
+	}
+	return nil, storedInfo{}, err
+}
+
+// Delete removes the file stored under id from whichever directory holds it
+func (b *fsBackend) Delete(id string) error {
+	err := os.Remove(filepath.Join(b.dirFor(id), id))
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for _, dir := range b.dirs {
+		if dir == b.dirFor(id) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, id)); err == nil || !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return err
+}
+
+func (b *fsBackend) Cleanup(before time.Time, collection string) (cleanupResult, error) {
+	var res cleanupResult
+	for _, dir := range b.dirs {
+		root := filepath.Join(dir, collection)
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			// Leave alone probes and temporary files
+			if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), ".") {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil || !info.ModTime().Before(before) {
+				return nil
+			}
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			res.Removed++
+			res.Bytes += info.Size()
+			return nil
+		})
+		if err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+func (b *fsBackend) List(collection string, fn func(id string, info storedInfo) error) error {
+	for _, dir := range b.dirs {
+		err := filepath.WalkDir(filepath.Join(dir, collection), func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			// Leave out probes and temporary files
+			if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), ".") {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			return fn(filepath.ToSlash(rel), storedInfo{Size: info.Size(), ModTime: info.ModTime()})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Collections lists the collection directories of every upload directory
+func (b *fsBackend) Collections() ([]string, error) {
+	seen := make(map[string]bool)
+	var names []string
+	for _, dir := range b.dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.IsDir() && isValidName(e.Name()) && !seen[e.Name()] {
+				seen[e.Name()] = true
+				names = append(names, e.Name())
+			}
+		}
+	}
+	return names, nil
+}
+
+func (b *fsBackend) Check() error {
+	for _, dir := range b.dirs {
+		if err := storageSelfTest(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openRegular opens path, treating anything but a regular file as missing
+func openRegular(path string) (*os.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := f.Stat(); err != nil || !info.Mode().IsRegular() {
+		f.Close()
+		return nil, fmt.Errorf("%s is not a regular file: %w", path, os.ErrNotExist)
+	}
+	return f, nil
+}
+
+func statStored(f *os.File, err error) (io.ReadSeekCloser, storedInfo, error) {
+	if err != nil {
+		return nil, storedInfo{}, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, storedInfo{}, err
+	}
+	return f, storedInfo{Size: info.Size(), ModTime: info.ModTime(), EventTime: eventTimeXattrOf(f.Name())}, nil
+}
@@ -0,0 +1,279 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// countFiles returns the number of regular files under dir
+func countFiles(t *testing.T, dir string) int {
+	t.Helper()
+	n := 0
+	err := filepath.WalkDir(dir, func(_ string, d os.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			n++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestUploadDirsFanOut(t *testing.T) {
+	dirs := []string{t.TempDir(), t.TempDir()}
+	backend, err := newFSBackend(dirs, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const files = 20
+	var ids []string
+	for i := 0; i < files; i++ {
+		id := fmt.Sprintf("orders/%d.json", i)
+		ids = append(ids, id)
+		if err := backend.Store(context.Background(), id, []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first, second := countFiles(t, dirs[0]), countFiles(t, dirs[1])
+	if first == 0 || second == 0 || first+second != files {
+		t.Errorf("files spread %d/%d across the directories", first, second)
+	}
+	for i, id := range ids {
+		if got := readStored(t, backend, id); got != fmt.Sprint(i) {
+			t.Errorf("%s = %q", id, got)
+		}
+	}
+
+	var listed []string
+	if err := backend.List("orders", func(id string, _ storedInfo) error {
+		listed = append(listed, id)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(listed)
+	sort.Strings(ids)
+	if fmt.Sprint(listed) != fmt.Sprint(ids) {
+		t.Errorf("listed %v, want %v", listed, ids)
+	}
+}
+
+func TestUploadDirsFindsMovedFiles(t *testing.T) {
+	dirs := []string{t.TempDir(), t.TempDir()}
+	backend, err := newFSBackend(dirs, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A file in the directory it doesn't hash to, as left by a change of
+	// -upload-dirs, is still found
+	id := "orders/moved.json"
+	other := dirs[0]
+	if backend.dirFor(id) == other {
+		other = dirs[1]
+	}
+	if err := os.MkdirAll(filepath.Join(other, "orders"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(other, id), []byte("{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got := readStored(t, backend, id); got != "{}" {
+		t.Errorf("%s = %q", id, got)
+	}
+	if err := backend.Delete(id); err != nil {
+		t.Errorf("Delete: %v", err)
+	}
+	if _, _, err := backend.Open(id); !os.IsNotExist(err) {
+		t.Errorf("Open after Delete: %v, want not exist", err)
+	}
+}
+
+func TestShardByIP(t *testing.T) {
+	saved := shardByIP
+	shardByIP = true
+	defer func() { shardByIP = saved }()
+
+	dir := t.TempDir()
+	backend, err := newFSBackend([]string{dir}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withWriteQueues(t, backend, func() {
+		var ids []string
+		for _, remote := range []string{"192.0.2.7:1234", "[2001:db8::1]:1234", "192.0.2.7:5678"} {
+			r := httptest.NewRequest(http.MethodPost, "/v1/collection/orders", strings.NewReader(`{"from":"`+remote+`"}`))
+			r.RemoteAddr = remote
+			r.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			handleCollection(rec, r)
+			if rec.Code != http.StatusAccepted {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+			ids = append(ids, strings.TrimPrefix(rec.Header().Get("Location"), "/v1/collection/"))
+		}
+		drainWrites(context.Background())
+
+		for i, shard := range []string{"192.0.2.7", "2001_db8__1", "192.0.2.7"} {
+			if filepath.Dir(ids[i]) != "orders/"+shard {
+				t.Errorf("%s not in orders/%s", ids[i], shard)
+			}
+			if _, err := os.Stat(filepath.Join(dir, ids[i])); err != nil {
+				t.Error(err)
+			}
+			// Retrieval finds the files in their shard
+			if rec := doRequest(http.MethodGet, "/v1/collection/"+ids[i], "", ""); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"from"`) {
+				t.Errorf("GET %s: status %d: %s", ids[i], rec.Code, rec.Body)
+			}
+		}
+	})
+}
+
+// cancelAfterContext is a context cancelled after its error was checked
+// checks times, in the middle of a write
+type cancelAfterContext struct {
+	context.Context
+	checks atomic.Int32
+}
+
+func (c *cancelAfterContext) Err() error {
+	if c.checks.Add(-1) < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestStoreCancelledMidWrite(t *testing.T) {
+	saved := writeBufferSize
+	writeBufferSize = 16
+	defer func() { writeBufferSize = saved }()
+
+	dir := t.TempDir()
+	backend, err := newFSBackend([]string{dir}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte(strings.Repeat("x", 1000))
+
+	ctx := &cancelAfterContext{Context: context.Background()}
+	ctx.checks.Store(3)
+	if err := backend.Store(ctx, "orders/1.json", data); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Store = %v, want cancelled", err)
+	}
+	// The partial file is removed
+	if n := countFiles(t, dir); n != 0 {
+		t.Errorf("%d files left after the abandoned write", n)
+	}
+
+	// An abandoned append leaves the content as it was
+	if err := backend.Store(context.Background(), "orders/2.json", []byte("before\n")); err != nil {
+		t.Fatal(err)
+	}
+	ctx.checks.Store(3)
+	if err := backend.Append(ctx, "orders/2.json", data); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Append = %v, want cancelled", err)
+	}
+	if got := readStored(t, backend, "orders/2.json"); got != "before\n" {
+		t.Errorf("after the abandoned append: %q", got)
+	}
+}
+
+func TestPooledWritersDetached(t *testing.T) {
+	var first, second bytes.Buffer
+	buf := getBufferedWriter(&first)
+	buf.WriteString("never flushed")
+	putBufferedWriter(buf)
+
+	// Whichever writer the pool hands out next, nothing carries over
+	buf = getBufferedWriter(&second)
+	buf.WriteString("next")
+	if err := buf.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	putBufferedWriter(buf)
+	if first.Len() != 0 || second.String() != "next" {
+		t.Errorf("first file got %q, second %q", first.String(), second.String())
+	}
+}
+
+func TestPooledWritersNoBleed(t *testing.T) {
+	saved := writeBufferSize
+	// Small buffers flush many times per file
+	writeBufferSize = 64
+	defer func() { writeBufferSize = saved }()
+
+	for _, compress := range []bool{false, true} {
+		backend, err := newFSBackend([]string{t.TempDir()}, compress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		const writers, files = 20, 15
+		var wg sync.WaitGroup
+		for w := 0; w < writers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < files; i++ {
+					// Sizes vary around the buffer size, each file its own letter
+					data := strings.Repeat(string(rune('a'+(w+i)%26)), (w*files+i)*7%300+1)
+					if err := backend.Store(context.Background(), fmt.Sprintf("bleed/%d-%d.json", w, i), []byte(data)); err != nil {
+						t.Error(err)
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		for w := 0; w < writers; w++ {
+			for i := 0; i < files; i++ {
+				want := strings.Repeat(string(rune('a'+(w+i)%26)), (w*files+i)*7%300+1)
+				got := readStored(t, backend, fmt.Sprintf("bleed/%d-%d.json", w, i))
+				if compress {
+					// Stored files are served as they are, still compressed
+					zr, err := gzip.NewReader(strings.NewReader(got))
+					if err != nil {
+						t.Fatal(err)
+					}
+					data, err := io.ReadAll(zr)
+					if err != nil {
+						t.Fatal(err)
+					}
+					got = string(data)
+				}
+				if got != want {
+					t.Fatalf("compress %v: %d-%d.json holds %q, want %q", compress, w, i, got, want)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+const storageProbeInterval = time.Second
+
+var (
+	// writeFailures counts the writes that failed in a row
+	writeFailures atomic.Int64
+	// storageFailing is set while the service is not ready because of
+	// failing writes
+	storageFailing atomic.Bool
+	// diskFailing is set from a failed write until a write or the storage
+	// self-check succeeds again, it's the disk_writable of /v1/ready
+	diskFailing atomic.Bool
+	// recovering is set while awaitStorageRecovery runs
+	recovering atomic.Bool
+)
+
+// recordWriteResult tracks failing writes. After -max-write-failures in a
+// row the service stops being ready, so uploads are rejected instead of
+// accepted and lost, until the storage passes its self-check again.
+func recordWriteResult(err error) {
+	if err == nil {
+		writeFailures.Store(0)
+		diskFailing.Store(false)
+		return
+	}
+	diskFailing.Store(true)
+	if recovering.CompareAndSwap(false, true) {
+		go awaitStorageRecovery(storage)
+	}
+	if maxWriteFailures <= 0 {
+		return
+	}
+	if n := writeFailures.Add(1); n >= int64(maxWriteFailures) && storageFailing.CompareAndSwap(false, true) {
+		setReady(false)
+		slog.Error("Storage failing, not ready until it recovers", "failures", n, "error", err)
+	}
+}
+
+// awaitStorageRecovery checks backend until it works again, then makes the
+// service ready
+func awaitStorageRecovery(backend StorageBackend) {
+	for {
+		time.Sleep(storageProbeInterval)
+		if err := backend.Check(); err != nil {
+			slog.Debug("Storage still failing", "error", err)
+			continue
+		}
+		writeFailures.Store(0)
+		diskFailing.Store(false)
+		if storageFailing.CompareAndSwap(true, false) {
+			setReady(true)
+			slog.Info("Storage recovered")
+		}
+		// A write failing meanwhile found recovering set, carry on for it
+		recovering.Store(false)
+		if !diskFailing.Load() || !recovering.CompareAndSwap(false, true) {
+			return
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// brokenBackend is a storage whose writes and self-check fail while broken
+// is set, like a directory remounted read-only
+type brokenBackend struct {
+	*inmemBackend
+	broken atomic.Bool
+}
+
+var errReadOnlyFS = errors.New("read-only file system")
+
+func (b *brokenBackend) Store(ctx context.Context, id string, data []byte) error {
+	if b.broken.Load() {
+		return errReadOnlyFS
+	}
+	return b.inmemBackend.Store(ctx, id, data)
+}
+
+func (b *brokenBackend) Check() error {
+	if b.broken.Load() {
+		return errReadOnlyFS
+	}
+	return nil
+}
+
+// awaitSelfChecks waits for the storage self-checks started by failed writes
+// to stop, so they don't change the state of the next test
+func awaitSelfChecks(t *testing.T) {
+	t.Helper()
+	waitUntil(t, 5*time.Second, "the storage self-checks to stop", func() bool { return !recovering.Load() })
+}
+
+// withMaxWriteFailures runs fn with -max-write-failures set to n
+func withMaxWriteFailures(t *testing.T, n int, fn func()) {
+	t.Helper()
+	awaitSelfChecks(t)
+	saved := maxWriteFailures
+	maxWriteFailures = n
+	defer func() {
+		awaitSelfChecks(t)
+		maxWriteFailures = saved
+		writeFailures.Store(0)
+		storageFailing.Store(false)
+		diskFailing.Store(false)
+		setReady(true)
+	}()
+	fn()
+}
+
+func TestStorageFailingFlipsReadiness(t *testing.T) {
+	backend := &brokenBackend{inmemBackend: newInmemBackend(100)}
+	backend.broken.Store(true)
+
+	withMaxWriteFailures(t, 3, func() {
+		withWriteQueues(t, backend, func() {
+			for i := 0; i < 3; i++ {
+				if rec := doRequest(http.MethodPost, "/v1/collection/orders", "application/json", "{}"); rec.Code != http.StatusAccepted {
+					t.Fatalf("upload %d: status %d: %s", i, rec.Code, rec.Body)
+				}
+			}
+			waitUntil(t, 5*time.Second, "not ready after the failed writes", func() bool { return !checkReady() })
+
+			rec := doRequest(http.MethodPost, "/v1/collection/orders", "application/json", "{}")
+			if rec.Code != http.StatusServiceUnavailable {
+				t.Errorf("upload while failing: status %d, want 503", rec.Code)
+			}
+
+			// Ready again once the storage passes its self-check
+			backend.broken.Store(false)
+			waitUntil(t, 5*time.Second, "ready after the storage recovered", checkReady)
+			if rec := doRequest(http.MethodPost, "/v1/collection/orders", "application/json", `{"ok":true}`); rec.Code != http.StatusAccepted {
+				t.Errorf("upload after recovery: status %d: %s", rec.Code, rec.Body)
+			}
+			drainWrites(context.Background())
+			if firstStored(backend, "orders") == "" {
+				t.Error("upload after recovery not stored")
+			}
+		})
+	})
+}
+
+func TestWriteFailuresReset(t *testing.T) {
+	withStorage(t, newInmemBackend(100), func() {
+		withMaxWriteFailures(t, 3, func() {
+			// Only failures in a row count
+			for _, err := range []error{errReadOnlyFS, errReadOnlyFS, nil, errReadOnlyFS, errReadOnlyFS} {
+				recordWriteResult(err)
+			}
+			if !checkReady() || storageFailing.Load() {
+				t.Error("not ready without 3 failures in a row")
+			}
+		})
+
+		withMaxWriteFailures(t, 0, func() {
+			for i := 0; i < 100; i++ {
+				recordWriteResult(errReadOnlyFS)
+			}
+			if !checkReady() {
+				t.Error("not ready with -max-write-failures=0")
+			}
+		})
+	})
+}
+
+func TestDiskWritable(t *testing.T) {
+	backend := &brokenBackend{inmemBackend: newInmemBackend(100)}
+	backend.broken.Store(true)
+	diskWritable := func() bool { return checkReadiness(false).DiskWritable }
+
+	// Known from the writes, even without -max-write-failures
+	withMaxWriteFailures(t, 0, func() {
+		withStorage(t, backend, func() {
+			recordWriteResult(errReadOnlyFS)
+			if diskWritable() {
+				t.Error("disk writable after a failed write")
+			}
+			recordWriteResult(nil)
+			if !diskWritable() {
+				t.Error("disk not writable after a write succeeded")
+			}
+
+			// Without writes, the storage self-check tells when it recovered
+			recordWriteResult(errReadOnlyFS)
+			backend.broken.Store(false)
+			waitUntil(t, 5*time.Second, "the disk to be writable", diskWritable)
+		})
+	})
+}
@@ -0,0 +1,166 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// streamSummary is the response to a stream once the client has closed it
+type streamSummary struct {
+	Accepted int         `json:"accepted"`
+	Rejected int         `json:"rejected"`
+	Errors   []lineError `json:"errors,omitempty"`
+	// Error is set when reading the stream failed or was stopped part way
+	// through
+	Error string `json:"error,omitempty"`
+}
+
+// handleStream stores each line of a long-lived NDJSON body as its own upload
+// as soon as it arrives. When the write queue is full reading pauses until
+// there is room, which slows the client down through TCP flow control. The
+// body has no overall size limit or deadline, but each line must fit
+// -max-body-size and arrive within -read-timeout. On shutdown it stops
+// reading and answers with the summary of the lines received so far.
+func handleStream(w http.ResponseWriter, r *http.Request, collection string) {
+	collection, ok := fitName(collection)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, codeInvalidCollection, "Invalid collection name", nil)
+		return
+	}
+	if !isCollectionAllowed(collection) {
+		respondWithError(w, http.StatusForbidden, codeCollectionNotAllowed, "Collection not allowed", nil)
+		return
+	}
+	if !admitCollection(w, collection) {
+		return
+	}
+	eventTime, ok := eventTimeOf(w, r)
+	if !ok {
+		return
+	}
+	body, ok := openStreamBody(w, r)
+	if !ok {
+		return
+	}
+	defer r.Body.Close()
+
+	ip, client := sanitizeIP(getClientIP(r)), quotaClient(r)
+	if ip == "" {
+		ip = "unknown"
+	}
+
+	// The server timeouts are meant for whole requests, a stream only has
+	// to keep lines coming
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	// On shutdown the line being waited for is given up, so the client gets
+	// its summary before the server stops
+	stop := shuttingDown
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+			_ = rc.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	var summary streamSummary
+	stopped := false
+	sc := newLineScanner(body)
+	for line := 1; ; line++ {
+		if readTimeout > 0 {
+			_ = rc.SetReadDeadline(time.Now().Add(readTimeout))
+		}
+		// Checked after setting the deadline, which could otherwise replace
+		// the one set on shutdown
+		select {
+		case <-stop:
+			stopped = true
+		default:
+		}
+		if stopped || !sc.Scan() {
+			break
+		}
+		doc := bytes.TrimSpace(sc.Bytes())
+		if len(doc) == 0 && !sc.tooLong {
+			continue
+		}
+		var code errorCode
+		var msg string
+		if sc.tooLong {
+			oversizedRecords.inc()
+			code, msg = codeBodyTooLarge, recordTooLarge()
+		} else {
+			_, code, msg = storeBatchLine(r.Context(), collection, ip, client, doc, eventTime, nil)
+		}
+		if code != "" {
+			summary.Rejected++
+			if len(summary.Errors) < maxBatchErrors {
+				summary.Errors = append(summary.Errors, lineError{Line: line, Offset: sc.lineStart, Code: string(code), Error: msg})
+			}
+			continue
+		}
+		summary.Accepted++
+		mirrorLine(r, collection, doc)
+	}
+
+	status := http.StatusAccepted
+	err := sc.Err()
+	if err != nil {
+		// The read may have been given up on shutdown
+		select {
+		case <-stop:
+			stopped = true
+		default:
+		}
+	}
+	if err == nil && !stopped {
+		err = body.close()
+	}
+	switch {
+	case stopped:
+		// What was read so far is stored, the client can resume with the
+		// next line once the service is back
+		w.Header().Set("Retry-After", retryAfterHeader())
+		status, summary.Error = http.StatusServiceUnavailable, "Server shutting down"
+	case err != nil:
+		switch {
+		case errors.Is(err, errDecompressRatio):
+			status, summary.Error = http.StatusRequestEntityTooLarge, "Decompression ratio too high"
+		case body.isGzip && isGzipError(err, body.received):
+			status, summary.Error = http.StatusBadRequest, "Invalid gzip data"
+		case recordCancelled(r, phaseReadBody, err) == reasonDeadlineExceeded:
+			status, summary.Error = http.StatusRequestTimeout, "No line received in time"
+		default:
+			status, summary.Error = http.StatusBadRequest, "Failed to read request body"
+		}
+		logError(summary.Error, err)
+	}
+
+	if writeTimeout > 0 {
+		_ = rc.SetWriteDeadline(time.Now().Add(writeTimeout))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(summary)
+}
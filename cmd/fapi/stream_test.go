@@ -0,0 +1,157 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func decodeSummary(t *testing.T, body []byte) streamSummary {
+	t.Helper()
+	var summary streamSummary
+	if err := json.Unmarshal(body, &summary); err != nil {
+		t.Fatalf("%v: %s", err, body)
+	}
+	return summary
+}
+
+func TestStreamLines(t *testing.T) {
+	backend := newInmemBackend(100)
+	withWriteQueues(t, backend, func() {
+		rec := doRequest(http.MethodPost, "/v1/collection/events/stream", "application/x-ndjson", "{\"n\":1}\n\nnot json\n{\"n\":2}\n")
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+		summary := decodeSummary(t, rec.Body.Bytes())
+		if summary.Accepted != 2 || summary.Rejected != 1 || summary.Errors[0].Line != 3 {
+			t.Errorf("got %+v", summary)
+		}
+		drainWrites(context.Background())
+	})
+	n := 0
+	_ = backend.List("events", func(string, storedInfo) error { n++; return nil })
+	if n != 2 {
+		t.Errorf("%d lines stored, want 2", n)
+	}
+}
+
+func TestStreamSniffedGzip(t *testing.T) {
+	saved := sniffGzip
+	sniffGzip = true
+	defer func() { sniffGzip = saved }()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, _ = gz.Write([]byte("{\"n\":1}\n{\"n\":2}\n"))
+	_ = gz.Close()
+	withWriteQueues(t, newInmemBackend(100), func() {
+		// No Content-Encoding, the body is recognised as gzip
+		rec := doRequest(http.MethodPost, "/v1/collection/events/stream", "application/x-ndjson", buf.String())
+		if summary := decodeSummary(t, rec.Body.Bytes()); rec.Code != http.StatusAccepted || summary.Accepted != 2 {
+			t.Errorf("status %d, got %+v", rec.Code, summary)
+		}
+		drainWrites(context.Background())
+	})
+}
+
+func TestStreamRequiresContentType(t *testing.T) {
+	saved := requireContentType
+	requireContentType = true
+	defer func() { requireContentType = saved }()
+
+	rec := doRequest(http.MethodPost, "/v1/collection/events/stream", "", "{}\n")
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want 400", rec.Code)
+	}
+}
+
+func TestStreamStopsOnShutdown(t *testing.T) {
+	saved := shuttingDown
+	shuttingDown = make(chan struct{})
+	defer func() { shuttingDown = saved }()
+
+	backend := newInmemBackend(100)
+	withWriteQueues(t, backend, func() {
+		server := httptest.NewServer(http.HandlerFunc(handleCollection))
+		defer server.Close()
+
+		body, lines := io.Pipe()
+		defer lines.Close()
+		type result struct {
+			status  int
+			summary []byte
+			err     error
+		}
+		done := make(chan result, 1)
+		go func() {
+			resp, err := http.Post(server.URL+"/v1/collection/events/stream", "application/x-ndjson", body)
+			if err != nil {
+				done <- result{err: err}
+				return
+			}
+			defer resp.Body.Close()
+			data, err := io.ReadAll(resp.Body)
+			done <- result{resp.StatusCode, data, err}
+		}()
+
+		_, _ = lines.Write([]byte("{\"n\":1}\n"))
+		// Wait for the line to be stored, the stream then waits for the next
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if _, _, err := backend.Open(firstStored(backend, "events")); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("line not stored")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		close(shuttingDown)
+		select {
+		case res := <-done:
+			if res.err != nil {
+				t.Fatal(res.err)
+			}
+			summary := decodeSummary(t, res.summary)
+			if res.status != http.StatusServiceUnavailable || summary.Accepted != 1 || summary.Error == "" {
+				t.Errorf("status %d, got %+v", res.status, summary)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("stream not stopped on shutdown")
+		}
+		drainWrites(context.Background())
+	})
+}
+
+// firstStored returns the id of the first item of collection, if any
+func firstStored(backend StorageBackend, collection string) string {
+	var first string
+	_ = backend.List(collection, func(id string, _ storedInfo) error {
+		if first == "" {
+			first = id
+		}
+		return nil
+	})
+	return first
+}
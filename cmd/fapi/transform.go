@@ -0,0 +1,113 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	// transformStderrLimit caps how much of the command's stderr is kept
+	// for the log
+	transformStderrLimit = 1024
+	// transformWaitDelay is how long to wait for the output of a command
+	// after it was killed
+	transformWaitDelay = time.Second
+)
+
+var (
+	errTransformTimeout        = errors.New("transform command timed out")
+	errTransformOutputTooLarge = errors.New("transform output too large")
+)
+
+// transformArgs is -transform-cmd split into the program and its arguments
+var transformArgs []string
+
+// errTransformRejected is returned when the transform command exits with a
+// non-zero status
+type errTransformRejected struct {
+	exitCode int
+	stderr   string
+}
+
+func (e *errTransformRejected) Error() string {
+	msg := fmt.Sprintf("transform command exited with status %d", e.exitCode)
+	if e.stderr != "" {
+		msg += ": " + e.stderr
+	}
+	return msg
+}
+
+// transformBody pipes body through -transform-cmd and returns its output. The
+// command is run directly, not through a shell, and killed after
+// -transform-timeout. If ctx ends first its error is returned as is.
+func transformBody(parent context.Context, body []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(parent, transformTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, transformArgs[0], transformArgs[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	// Children of a killed command may still hold its output open
+	cmd.WaitDelay = transformWaitDelay
+	stdout := &limitedBuffer{max: int(maxDecompressedSize)}
+	stderr := &limitedBuffer{max: transformStderrLimit}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err := cmd.Run()
+	// The request was cancelled or timed out, it's not the command's fault
+	if parent.Err() != nil {
+		return nil, parent.Err()
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, errTransformTimeout
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return nil, &errTransformRejected{exitCode: exitErr.ExitCode(), stderr: strings.TrimSpace(stderr.String())}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if stdout.truncated {
+		return nil, errTransformOutputTooLarge
+	}
+	return stdout.Bytes(), nil
+}
+
+// limitedBuffer keeps the first max bytes written to it and drops the rest.
+// It never fails, so the command isn't blocked on a full pipe.
+type limitedBuffer struct {
+	bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	room := b.max - b.Len()
+	if len(p) > room {
+		b.truncated = true
+	}
+	if room > 0 {
+		b.Buffer.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
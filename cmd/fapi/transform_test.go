@@ -0,0 +1,74 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withTransform runs fn with -transform-cmd set to args
+func withTransform(t *testing.T, args []string, fn func()) {
+	t.Helper()
+	saved, savedTimeout := transformArgs, transformTimeout
+	transformArgs, transformTimeout = args, 5*time.Second
+	defer func() { transformArgs, transformTimeout = saved, savedTimeout }()
+	fn()
+}
+
+func TestTransformBody(t *testing.T) {
+	withTransform(t, []string{"tr", "a-z", "A-Z"}, func() {
+		out, err := transformBody(context.Background(), []byte("abc"))
+		if err != nil || string(out) != "ABC" {
+			t.Errorf("transformBody = %q, %v", out, err)
+		}
+	})
+	withTransform(t, []string{"false"}, func() {
+		var rejected *errTransformRejected
+		if _, err := transformBody(context.Background(), nil); !errors.As(err, &rejected) || rejected.exitCode != 1 {
+			t.Errorf("transformBody error %v, want a rejection with status 1", err)
+		}
+	})
+}
+
+func TestTransformCancelled(t *testing.T) {
+	withTransform(t, []string{"sleep", "5"}, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		if _, err := transformBody(ctx, nil); !errors.Is(err, context.Canceled) {
+			t.Fatalf("transformBody error %v, want %v", err, context.Canceled)
+		}
+
+		metric := `fapi_cancelled_requests_total{phase="transform",reason="canceled"}`
+		ctx, cancel = context.WithCancel(context.Background())
+		cancel()
+		r := httptest.NewRequest(http.MethodPost, "/v1/collection/orders", strings.NewReader(`{"id":1}`)).WithContext(ctx)
+		r.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		handleCollection(rec, r)
+		// Nobody is left to read a response, so none is written
+		if rec.Code == http.StatusUnprocessableEntity || rec.Body.Len() > 0 {
+			t.Errorf("cancelled request answered with %d: %s", rec.Code, rec.Body)
+		}
+		if got := metricValue(t, metric); got != "1" {
+			t.Errorf("%s = %s, want 1", metric, got)
+		}
+	})
+}
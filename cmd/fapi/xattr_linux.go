@@ -0,0 +1,52 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+	"time"
+)
+
+// eventTimeXattr is the extended attribute the event time of a stored file
+// is kept in
+const eventTimeXattr = "user.fapi.event_time"
+
+// setEventTimeXattr records t as the event time of the file at path, or
+// removes it if t is zero
+func setEventTimeXattr(path string, t time.Time) error {
+	if t.IsZero() {
+		err := syscall.Removexattr(path, eventTimeXattr)
+		if errors.Is(err, syscall.ENODATA) {
+			return nil
+		}
+		return err
+	}
+	return syscall.Setxattr(path, eventTimeXattr, []byte(t.UTC().Format(time.RFC3339Nano)), 0)
+}
+
+// eventTimeXattrOf returns the event time recorded for the file at path, or
+// the zero time if there is none
+func eventTimeXattrOf(path string) time.Time {
+	buf := make([]byte, 64)
+	n, err := syscall.Getxattr(path, eventTimeXattr, buf)
+	if err != nil {
+		return time.Time{}
+	}
+	t, _ := time.Parse(time.RFC3339Nano, string(buf[:n]))
+	return t
+}
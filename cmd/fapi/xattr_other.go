@@ -0,0 +1,37 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// setEventTimeXattr records t as the event time of the file at path, or
+// removes it if t is zero. Only supported on Linux.
+func setEventTimeXattr(path string, t time.Time) error {
+	if t.IsZero() {
+		return nil
+	}
+	return errors.ErrUnsupported
+}
+
+// eventTimeXattrOf returns the zero time, event times are only recorded on
+// Linux
+func eventTimeXattrOf(path string) time.Time {
+	return time.Time{}
+}
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -29,6 +30,7 @@ var (
 	useSSL    bool
 	checkType string
 	timeout   time.Duration
+	prefix    string
 )
 
 // genURL builds the URL for a health or readiness check
@@ -39,11 +41,28 @@ func genURL(checkType string) string {
 	}
 
 	path := "/v1/health"
-	if checkType == "ready" {
+	if isReadinessCheck(checkType) {
 		path = "/v1/ready"
 	}
 
-	return fmt.Sprintf("%s://%s:%d%s", scheme, host, port, path)
+	return fmt.Sprintf("%s://%s:%d%s%s", scheme, host, port, strings.TrimRight(prefix, "/"), path)
+}
+
+func isReadinessCheck(checkType string) bool {
+	return checkType == "ready" || checkType == "readiness"
+}
+
+// genURLs builds the URLs to probe for the given check type, "both" checks
+// health and readiness
+func genURLs(checkType string) ([]string, error) {
+	switch {
+	case checkType == "health" || isReadinessCheck(checkType):
+		return []string{genURL(checkType)}, nil
+	case checkType == "both":
+		return []string{genURL("health"), genURL("ready")}, nil
+	default:
+		return nil, fmt.Errorf("unknown check type %q", checkType)
+	}
 }
 
 // check performs a GET request against the given URL and returns true if 200 OK
@@ -64,21 +83,36 @@ func check(url string) bool {
 	return true
 }
 
+// checkAll checks each URL in turn and returns false at the first failure
+func checkAll(urls []string) bool {
+	for _, url := range urls {
+		if !check(url) {
+			return false
+		}
+		fmt.Printf("check succeeded for %s\n", url)
+	}
+	return true
+}
+
 func main() {
 	// Flags
 	flag.StringVar(&host, "host", "localhost", "Host of the service")
 	flag.IntVar(&port, "port", 8989, "Port of the service")
 	flag.BoolVar(&useSSL, "ssl", false, "Use HTTPS instead of HTTP")
-	flag.StringVar(&checkType, "check", "health", "Type of check: health or readiness")
+	flag.StringVar(&checkType, "check", "health", "Type of check: health, readiness or both")
 	flag.DurationVar(&timeout, "timeout", 5*time.Second, "HTTP timeout")
+	flag.StringVar(&prefix, "prefix", "", "Route prefix the service is started with (its -route-prefix)")
 	flag.Parse()
 
-	// Build URL and perform check
-	url := genURL(checkType)
-	if !check(url) {
+	// Build URLs and perform checks, all of them must pass
+	urls, err := genURLs(checkType)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if !checkAll(urls) {
 		os.Exit(1)
 	}
 
-	fmt.Printf("%s check succeeded for %s\n", checkType, url)
 	os.Exit(0)
 }
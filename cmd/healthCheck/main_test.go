@@ -0,0 +1,79 @@
+// Copyright 2023 Paolo Fabio Zaino
+//
+// Licensed under the GNU AFFERO GENERAL PUBLIC LICENSE (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html#license-text
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestGenURLsBoth(t *testing.T) {
+	host, port, useSSL, prefix = "fapi", 8989, false, "/api/"
+	urls, err := genURLs("both")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"http://fapi:8989/api/v1/health", "http://fapi:8989/api/v1/ready"}
+	if len(urls) != 2 || urls[0] != want[0] || urls[1] != want[1] {
+		t.Errorf("genURLs(both) = %v, want %v", urls, want)
+	}
+	if _, err := genURLs("liveness"); err == nil {
+		t.Error("unknown check type accepted")
+	}
+}
+
+func TestCheckBothPartialFailures(t *testing.T) {
+	var healthStatus, readyStatus int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/health":
+			w.WriteHeader(healthStatus)
+		case "/v1/ready":
+			w.WriteHeader(readyStatus)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	h, p, _ := net.SplitHostPort(u.Host)
+	host, useSSL, prefix, timeout = h, false, "", time.Second
+	port, _ = strconv.Atoi(p)
+
+	urls, err := genURLs("both")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		health, ready int
+		want          bool
+	}{
+		{http.StatusOK, http.StatusOK, true},
+		{http.StatusOK, http.StatusServiceUnavailable, false}, // warming up
+		{http.StatusServiceUnavailable, http.StatusOK, false},
+		{http.StatusServiceUnavailable, http.StatusServiceUnavailable, false},
+	} {
+		healthStatus, readyStatus = tc.health, tc.ready
+		if got := checkAll(urls); got != tc.want {
+			t.Errorf("health %d, ready %d: checkAll = %v, want %v", tc.health, tc.ready, got, tc.want)
+		}
+	}
+}